@@ -51,6 +51,7 @@ type BanRequest struct {
 	Reason    string        `json:"reason,omitempty"`
 	CreatedBy string        `json:"created_by,omitempty"`
 	Permanent bool          `json:"permanent,omitempty"` // If true, adds to blacklist
+	Scope     string        `json:"scope,omitempty"`     // Optional: limits a temporary ban to one service
 }
 
 // UnbanRequest represents a manual unban request
@@ -66,6 +67,13 @@ type WhitelistRequest struct {
 	CreatedBy string `json:"created_by,omitempty"`
 }
 
+// HoneypotRequest represents a request to add or remove a honeypot username
+type HoneypotRequest struct {
+	Username  string `json:"username"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
 // BanResponse represents the response to ban operations
 type BanResponse struct {
 	Success   bool   `json:"success"`
@@ -83,10 +91,11 @@ type ListResponse struct {
 }
 
 type BlacklistItem struct {
-	IPAddress string    `json:"ip_address"`
-	Reason    string    `json:"reason,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
-	CreatedBy string    `json:"created_by"`
+	IPAddress string     `json:"ip_address"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	CreatedBy string     `json:"created_by"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Nil if the entry never expires
 }
 
 type WhitelistItem struct {
@@ -104,6 +113,43 @@ func validateIP(ipAddress string) error {
 	return nil
 }
 
+// validateIPOrCIDR validates if the value is an IP address or a CIDR prefix
+func validateIPOrCIDR(value string) error {
+	if strings.Contains(value, "/") {
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			return fmt.Errorf("invalid CIDR prefix: %s", value)
+		}
+		return nil
+	}
+	return validateIP(value)
+}
+
+// refreshAccessLists reloads the whitelist and blacklist from the database
+// so that changes are enforced immediately
+func (bm *BanManager) refreshAccessLists() {
+	if bm.ipBanManager == nil {
+		return
+	}
+	if err := bm.configManager.ReloadAccessLists(); err != nil {
+		log.Printf("Warning: failed to refresh access lists: %v", err)
+		return
+	}
+	bm.ipBanManager.SetAccessListEntries(bm.configManager.GetWhitelist(), bm.configManager.GetBlacklistEntries())
+}
+
+// refreshHoneypots reloads the honeypot usernames from the database so that
+// changes are enforced immediately
+func (bm *BanManager) refreshHoneypots() {
+	if bm.ipBanManager == nil {
+		return
+	}
+	if err := bm.configManager.ReloadHoneypotUsernames(); err != nil {
+		log.Printf("Warning: failed to refresh honeypot usernames: %v", err)
+		return
+	}
+	bm.ipBanManager.SetHoneypotUsernames(bm.configManager.GetHoneypotUsernames())
+}
+
 // HandleManualBan handles manual ban requests
 func (bm *BanManager) HandleManualBan(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -117,8 +163,8 @@ func (bm *BanManager) HandleManualBan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate IP address
-	if err := validateIP(req.IPAddress); err != nil {
+	// Validate IP address or CIDR prefix
+	if err := validateIPOrCIDR(req.IPAddress); err != nil {
 		response := BanResponse{
 			Success:   false,
 			Message:   err.Error(),
@@ -130,9 +176,25 @@ func (bm *BanManager) HandleManualBan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set defaults
+	// The blacklist applies to every service
+	if req.Permanent && req.Scope != "" {
+		response := BanResponse{
+			Success:   false,
+			Message:   "permanent bans cannot be limited to a scope",
+			IPAddress: req.IPAddress,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Set defaults, attributing the ban to the authenticated API user
 	if req.CreatedBy == "" {
 		req.CreatedBy = "api"
+		if username, _, ok := r.BasicAuth(); ok && username != "" {
+			req.CreatedBy = username
+		}
 	}
 	if req.Reason == "" {
 		req.Reason = "Manual ban via API"
@@ -144,18 +206,14 @@ func (bm *BanManager) HandleManualBan(w http.ResponseWriter, r *http.Request) {
 	if req.Permanent {
 		// Add to permanent blacklist
 		if bm.db != nil {
-			err := bm.db.AddToBlacklist(req.IPAddress, req.Reason, req.CreatedBy)
+			err := bm.db.AddToBlacklist(req.IPAddress, req.Reason, req.CreatedBy, time.Time{})
 			if err != nil {
-				if strings.Contains(err.Error(), "UNIQUE") {
-					message = fmt.Sprintf("IP %s is already blacklisted", req.IPAddress)
-					success = true
-				} else {
-					message = fmt.Sprintf("Failed to add to blacklist: %v", err)
-					success = false
-				}
+				message = fmt.Sprintf("Failed to add to blacklist: %v", err)
+				success = false
 			} else {
 				message = fmt.Sprintf("IP %s permanently banned (blacklisted)", req.IPAddress)
 				success = true
+				bm.refreshAccessLists()
 			}
 		} else {
 			message = "Database not available for permanent bans"
@@ -171,7 +229,12 @@ func (bm *BanManager) HandleManualBan(w http.ResponseWriter, r *http.Request) {
 				duration = banConfig.InitialBanTime
 			}
 
-			err := bm.ipBanManager.ManualBan(req.IPAddress, duration)
+			err := bm.ipBanManager.ManualBanWithOptions(req.IPAddress, ipban.BanOptions{
+				Duration:  duration,
+				Reason:    req.Reason,
+				CreatedBy: req.CreatedBy,
+				Scope:     req.Scope,
+			})
 			if err != nil {
 				message = fmt.Sprintf("Failed to add temporary ban: %v", err)
 				success = false
@@ -199,8 +262,8 @@ func (bm *BanManager) HandleManualBan(w http.ResponseWriter, r *http.Request) {
 	}
 	json.NewEncoder(w).Encode(response)
 
-	log.Printf("Manual ban request: IP=%s, Permanent=%v, Reason=%s, Success=%v",
-		req.IPAddress, req.Permanent, req.Reason, success)
+	log.Printf("Manual ban request: IP=%s, Permanent=%v, Reason=%s, CreatedBy=%s, Success=%v",
+		req.IPAddress, req.Permanent, req.Reason, req.CreatedBy, success)
 }
 
 // HandleManualUnban handles manual unban requests
@@ -216,8 +279,8 @@ func (bm *BanManager) HandleManualUnban(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Validate IP address
-	if err := validateIP(req.IPAddress); err != nil {
+	// Validate IP address or CIDR prefix
+	if err := validateIPOrCIDR(req.IPAddress); err != nil {
 		response := BanResponse{
 			Success:   false,
 			Message:   err.Error(),
@@ -247,6 +310,7 @@ func (bm *BanManager) HandleManualUnban(w http.ResponseWriter, r *http.Request)
 			} else {
 				message = fmt.Sprintf("IP %s removed from blacklist", req.IPAddress)
 				success = true
+				bm.refreshAccessLists()
 			}
 		} else {
 			// Remove from temporary ban radix tree
@@ -308,8 +372,8 @@ func (bm *BanManager) handleAddToWhitelist(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Validate IP address
-	if err := validateIP(req.IPAddress); err != nil {
+	// Validate IP address or CIDR prefix
+	if err := validateIPOrCIDR(req.IPAddress); err != nil {
 		response := BanResponse{
 			Success:   false,
 			Message:   err.Error(),
@@ -345,6 +409,7 @@ func (bm *BanManager) handleAddToWhitelist(w http.ResponseWriter, r *http.Reques
 		} else {
 			message = fmt.Sprintf("IP %s added to whitelist", req.IPAddress)
 			success = true
+			bm.refreshAccessLists()
 		}
 	} else {
 		message = "Database not available for whitelist operations"
@@ -376,8 +441,8 @@ func (bm *BanManager) handleRemoveFromWhitelist(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	// Validate IP address
-	if err := validateIP(req.IPAddress); err != nil {
+	// Validate IP address or CIDR prefix
+	if err := validateIPOrCIDR(req.IPAddress); err != nil {
 		response := BanResponse{
 			Success:   false,
 			Message:   err.Error(),
@@ -400,6 +465,7 @@ func (bm *BanManager) handleRemoveFromWhitelist(w http.ResponseWriter, r *http.R
 		} else {
 			message = fmt.Sprintf("IP %s removed from whitelist", req.IPAddress)
 			success = true
+			bm.refreshAccessLists()
 		}
 	} else {
 		message = "Database not available for whitelist operations"
@@ -465,6 +531,187 @@ func (bm *BanManager) handleGetWhitelist(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(response)
 }
 
+// HandleHoneypots handles honeypot username management
+func (bm *BanManager) HandleHoneypots(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		bm.handleAddHoneypot(w, r)
+	case http.MethodDelete:
+		bm.handleRemoveHoneypot(w, r)
+	case http.MethodGet:
+		bm.handleGetHoneypots(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (bm *BanManager) handleAddHoneypot(w http.ResponseWriter, r *http.Request) {
+	var req HoneypotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	if req.Username == "" {
+		response := HoneypotResponse{
+			Success: false,
+			Message: "username is required",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Set defaults, attributing the entry to the authenticated API user
+	if req.CreatedBy == "" {
+		req.CreatedBy = "api"
+		if username, _, ok := r.BasicAuth(); ok && username != "" {
+			req.CreatedBy = username
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "Honeypot username via API"
+	}
+
+	var message string
+	var success bool
+
+	if bm.db != nil {
+		err := bm.db.AddHoneypotUsername(req.Username, req.Reason, req.CreatedBy)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				message = fmt.Sprintf("Username %s is already a honeypot", req.Username)
+				success = true
+			} else {
+				message = fmt.Sprintf("Failed to add honeypot username: %v", err)
+				success = false
+			}
+		} else {
+			message = fmt.Sprintf("Username %s added to honeypots", req.Username)
+			success = true
+			bm.refreshHoneypots()
+		}
+	} else {
+		message = "Database not available for honeypot operations"
+		success = false
+	}
+
+	response := HoneypotResponse{
+		Success:  success,
+		Message:  message,
+		Username: req.Username,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if success {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(response)
+
+	log.Printf("Add honeypot username request: Username=%s, Reason=%s, Success=%v",
+		req.Username, req.Reason, success)
+}
+
+func (bm *BanManager) handleRemoveHoneypot(w http.ResponseWriter, r *http.Request) {
+	var req HoneypotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	if req.Username == "" {
+		response := HoneypotResponse{
+			Success: false,
+			Message: "username is required",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	var message string
+	var success bool
+
+	if bm.db != nil {
+		err := bm.db.RemoveHoneypotUsername(req.Username)
+		if err != nil {
+			message = fmt.Sprintf("Failed to remove honeypot username: %v", err)
+			success = false
+		} else {
+			message = fmt.Sprintf("Username %s removed from honeypots", req.Username)
+			success = true
+			bm.refreshHoneypots()
+		}
+	} else {
+		message = "Database not available for honeypot operations"
+		success = false
+	}
+
+	response := HoneypotResponse{
+		Success:  success,
+		Message:  message,
+		Username: req.Username,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if success {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(response)
+
+	log.Printf("Remove honeypot username request: Username=%s, Success=%v", req.Username, success)
+}
+
+func (bm *BanManager) handleGetHoneypots(w http.ResponseWriter, r *http.Request) {
+	var honeypots []HoneypotItem
+	var success bool
+	var message string
+
+	if bm.db != nil {
+		entries, err := bm.db.GetHoneypotUsernames()
+		if err != nil {
+			message = fmt.Sprintf("Failed to get honeypot usernames: %v", err)
+			success = false
+		} else {
+			for _, entry := range entries {
+				honeypots = append(honeypots, HoneypotItem{
+					Username:  entry.Username,
+					Reason:    entry.Reason,
+					CreatedAt: entry.CreatedAt,
+					CreatedBy: entry.CreatedBy,
+				})
+			}
+			success = true
+		}
+	} else {
+		message = "Database not available"
+		success = false
+	}
+
+	response := HoneypotListResponse{
+		Success:   success,
+		Message:   message,
+		Count:     len(honeypots),
+		Honeypots: honeypots,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if success {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
 // HandleBlacklist handles blacklist listing
 func (bm *BanManager) HandleBlacklist(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -488,6 +735,7 @@ func (bm *BanManager) HandleBlacklist(w http.ResponseWriter, r *http.Request) {
 					Reason:    entry.Reason,
 					CreatedAt: entry.CreatedAt,
 					CreatedBy: entry.CreatedBy,
+					ExpiresAt: entry.ExpiresAt,
 				})
 			}
 			success = true
@@ -525,12 +773,14 @@ func (bm *BanManager) HandleTemporaryBans(w http.ResponseWriter, r *http.Request
 	var message string
 
 	if bm.ipBanManager != nil {
-		bannedIPs := bm.ipBanManager.GetAllBannedIPs()
-		for ip, expiry := range bannedIPs {
+		for _, ban := range bm.ipBanManager.GetActiveBans() {
 			tempBans = append(tempBans, TempBanItem{
-				IPAddress: ip,
-				ExpiresAt: expiry,
-				Duration:  time.Until(expiry),
+				IPAddress:  ban.IP,
+				ExpiresAt:  ban.ExpiresAt,
+				Duration:   time.Until(ban.ExpiresAt),
+				Jail:       ban.Jail,
+				Scope:      ban.Scope,
+				Provenance: ban.Provenance,
 			})
 		}
 		success = true
@@ -626,11 +876,96 @@ func (bm *BanManager) HandleRadixStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// HandleShadowDiff reports how the shadow policy's ban decisions differ
+// from the live policy's
+func (bm *BanManager) HandleShadowDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var diff *ipban.ShadowDiff
+	var success bool
+	var message string
+
+	if bm.ipBanManager == nil {
+		message = "IP ban manager not available"
+		success = false
+	} else if !bm.configManager.GetConfig().Shadow.Enabled {
+		message = "Shadow policy not enabled"
+		success = false
+	} else {
+		shadowDiff := bm.ipBanManager.GetShadowDiff()
+		diff = &shadowDiff
+		success = true
+	}
+
+	response := ShadowDiffResponse{
+		Success: success,
+		Message: message,
+		Diff:    diff,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if success {
+		w.WriteHeader(http.StatusOK)
+	} else if bm.ipBanManager != nil {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleAccountsUnderAttack lists the accounts marked as under a
+// distributed attack
+func (bm *BanManager) HandleAccountsUnderAttack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var accounts []ipban.AccountAttack
+	var success bool
+	var message string
+
+	if bm.ipBanManager == nil {
+		message = "IP ban manager not available"
+		success = false
+	} else if !bm.configManager.GetConfig().Accounts.Enabled {
+		message = "Account tracking not enabled"
+		success = false
+	} else {
+		accounts = bm.ipBanManager.GetAccountsUnderAttack()
+		success = true
+	}
+
+	response := AccountAttackListResponse{
+		Success:  success,
+		Count:    len(accounts),
+		Accounts: accounts,
+		Message:  message,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if success {
+		w.WriteHeader(http.StatusOK)
+	} else if bm.ipBanManager != nil {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
 // Additional response types
 type TempBanItem struct {
-	IPAddress string        `json:"ip_address"`
-	ExpiresAt time.Time     `json:"expires_at"`
-	Duration  time.Duration `json:"duration_remaining"`
+	IPAddress  string            `json:"ip_address"`
+	ExpiresAt  time.Time         `json:"expires_at"`
+	Duration   time.Duration     `json:"duration_remaining"`
+	Jail       string            `json:"jail,omitempty"`
+	Scope      string            `json:"scope,omitempty"`      // Service the ban is limited to; empty for global bans
+	Provenance *ipban.Provenance `json:"provenance,omitempty"` // What triggered the ban
 }
 
 type TempBanListResponse struct {
@@ -652,6 +987,39 @@ type RadixStatsResponse struct {
 	Stats   map[string]interface{} `json:"stats,omitempty"`
 }
 
+type ShadowDiffResponse struct {
+	Success bool              `json:"success"`
+	Message string            `json:"message,omitempty"`
+	Diff    *ipban.ShadowDiff `json:"diff,omitempty"`
+}
+
+type HoneypotResponse struct {
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+	Username string `json:"username,omitempty"`
+}
+
+type HoneypotItem struct {
+	Username  string    `json:"username"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+}
+
+type HoneypotListResponse struct {
+	Success   bool           `json:"success"`
+	Message   string         `json:"message,omitempty"`
+	Count     int            `json:"count"`
+	Honeypots []HoneypotItem `json:"honeypots,omitempty"`
+}
+
+type AccountAttackListResponse struct {
+	Success  bool                  `json:"success"`
+	Count    int                   `json:"count"`
+	Accounts []ipban.AccountAttack `json:"accounts,omitempty"`
+	Message  string                `json:"message,omitempty"`
+}
+
 // HandleSecurityStatus handles API security status requests
 func (bm *BanManager) HandleSecurityStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -691,14 +1059,17 @@ func (bm *BanManager) HandleSecurityStatus(w http.ResponseWriter, r *http.Reques
 func (bm *BanManager) SetupRoutes(mux *http.ServeMux) {
 	// Create handlers
 	handlers := map[string]http.HandlerFunc{
-		"/api/ban":             bm.HandleManualBan,
-		"/api/unban":           bm.HandleManualUnban,
-		"/api/whitelist":       bm.HandleWhitelist,
-		"/api/blacklist":       bm.HandleBlacklist,
-		"/api/temp-bans":       bm.HandleTemporaryBans,
-		"/api/purge-bans":      bm.HandlePurgeBans,
-		"/api/radix-stats":     bm.HandleRadixStats,
-		"/api/security-status": bm.HandleSecurityStatus,
+		"/api/ban":                   bm.HandleManualBan,
+		"/api/unban":                 bm.HandleManualUnban,
+		"/api/whitelist":             bm.HandleWhitelist,
+		"/api/honeypots":             bm.HandleHoneypots,
+		"/api/blacklist":             bm.HandleBlacklist,
+		"/api/temp-bans":             bm.HandleTemporaryBans,
+		"/api/purge-bans":            bm.HandlePurgeBans,
+		"/api/radix-stats":           bm.HandleRadixStats,
+		"/api/shadow-diff":           bm.HandleShadowDiff,
+		"/api/accounts-under-attack": bm.HandleAccountsUnderAttack,
+		"/api/security-status":       bm.HandleSecurityStatus,
 	}
 
 	// Apply security middleware if enabled
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"fail2ban-haproxy/internal/clock"
 	"fail2ban-haproxy/internal/config"
 )
 
@@ -26,6 +27,7 @@ type RateLimiter struct {
 	limit   int
 	window  time.Duration
 	enabled bool
+	clock   clock.Clock
 }
 
 // ClientLimiter tracks requests for a specific client
@@ -47,17 +49,24 @@ func NewSecurityMiddleware(apiConfig config.APIConfig) (*SecurityMiddleware, err
 
 	// Initialize rate limiter
 	if apiConfig.RateLimiting.Enabled {
-		sm.rateLimiter = &RateLimiter{
-			clients: make(map[string]*ClientLimiter),
-			limit:   apiConfig.RateLimiting.RequestsPer,
-			window:  time.Minute,
-			enabled: true,
-		}
+		sm.rateLimiter = NewRateLimiter(apiConfig.RateLimiting.RequestsPer, time.Minute, clock.Real())
 	}
 
 	return sm, nil
 }
 
+// NewRateLimiter creates a rate limiter allowing limit requests per client
+// within window, as measured by clk
+func NewRateLimiter(limit int, window time.Duration, clk clock.Clock) *RateLimiter {
+	return &RateLimiter{
+		clients: make(map[string]*ClientLimiter),
+		limit:   limit,
+		window:  window,
+		enabled: true,
+		clock:   clk,
+	}
+}
+
 // parseAllowedIPs parses the allowed IP addresses and CIDR ranges
 func (sm *SecurityMiddleware) parseAllowedIPs() error {
 	sm.allowedNets = make([]*net.IPNet, 0, len(sm.config.AllowedIPs))
@@ -183,7 +192,7 @@ func (rl *RateLimiter) Allow(clientIP string) bool {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
+	now := rl.clock.Now()
 
 	// Get or create client limiter
 	client, exists := rl.clients[clientIP]
@@ -226,7 +235,7 @@ func (rl *RateLimiter) Cleanup() {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	now := time.Now()
+	now := rl.clock.Now()
 	cutoff := now.Add(-rl.window * 2) // Keep data for 2 windows
 
 	for clientIP, client := range rl.clients {
@@ -285,12 +294,12 @@ func (sm *SecurityMiddleware) StartCleanupRoutine() {
 	}
 
 	go func() {
-		ticker := time.NewTicker(5 * time.Minute)
+		ticker := sm.rateLimiter.clock.NewTicker(5 * time.Minute)
 		defer ticker.Stop()
 
 		for {
 			select {
-			case <-ticker.C:
+			case <-ticker.C():
 				sm.rateLimiter.Cleanup()
 			}
 		}
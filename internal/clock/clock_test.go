@@ -0,0 +1,140 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// received returns the value waiting on c, or false if there is none
+func received(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeAdvance(t *testing.T) {
+	clock := NewFake(start)
+	if !clock.Now().Equal(start) {
+		t.Fatalf("Expected %v, got %v", start, clock.Now())
+	}
+
+	clock.Advance(36 * time.Hour)
+	if want := start.Add(36 * time.Hour); !clock.Now().Equal(want) {
+		t.Errorf("Expected %v, got %v", want, clock.Now())
+	}
+
+	clock.Set(start)
+	if !clock.Now().Equal(start) {
+		t.Errorf("Expected the clock to move back to %v, got %v", start, clock.Now())
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	clock := NewFake(start)
+	timer := clock.NewTimer(time.Minute)
+
+	clock.Advance(59 * time.Second)
+	if _, ok := received(timer.C()); ok {
+		t.Fatal("Expected the timer not to fire early")
+	}
+
+	clock.Advance(time.Hour)
+	fired, ok := received(timer.C())
+	if !ok {
+		t.Fatal("Expected the timer to fire")
+	}
+	if want := start.Add(time.Minute); !fired.Equal(want) {
+		t.Errorf("Expected the timer to fire at %v, got %v", want, fired)
+	}
+
+	if timer.Reset(time.Minute) {
+		t.Error("Expected Reset of a fired timer to report it was not pending")
+	}
+	if !timer.Stop() {
+		t.Error("Expected Stop of a reset timer to report it was pending")
+	}
+	clock.Advance(time.Hour)
+	if _, ok := received(timer.C()); ok {
+		t.Error("Expected a stopped timer not to fire")
+	}
+}
+
+func TestFakeTimerFiresImmediately(t *testing.T) {
+	clock := NewFake(start)
+	if _, ok := received(clock.NewTimer(0).C()); !ok {
+		t.Error("Expected a zero timer to fire at once")
+	}
+}
+
+func TestFakeTickerDropsMissedTicks(t *testing.T) {
+	clock := NewFake(start)
+	ticker := clock.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	clock.Advance(5 * time.Minute)
+	fired, ok := received(ticker.C())
+	if !ok {
+		t.Fatal("Expected the ticker to fire")
+	}
+	if want := start.Add(time.Minute); !fired.Equal(want) {
+		t.Errorf("Expected the first tick at %v, got %v", want, fired)
+	}
+	if _, ok := received(ticker.C()); ok {
+		t.Error("Expected ticks missed by a slow receiver to be dropped")
+	}
+
+	clock.Advance(time.Minute)
+	if fired, _ := received(ticker.C()); !fired.Equal(start.Add(6 * time.Minute)) {
+		t.Errorf("Expected the ticker to keep its period, got %v", fired)
+	}
+}
+
+func TestFakeFiresInDeadlineOrder(t *testing.T) {
+	clock := NewFake(start)
+	late := clock.NewTimer(2 * time.Hour)
+	early := clock.NewTimer(time.Hour)
+
+	clock.Advance(3 * time.Hour)
+	earlyAt, _ := received(early.C())
+	lateAt, _ := received(late.C())
+	if !earlyAt.Before(lateAt) {
+		t.Errorf("Expected timers to fire at their own deadlines, got %v and %v", earlyAt, lateAt)
+	}
+}
+
+func TestFakeSleepAndBlockUntil(t *testing.T) {
+	clock := NewFake(start)
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Hour)
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Sleep to return once the clock advanced")
+	}
+}
+
+func TestRealClock(t *testing.T) {
+	clock := Real()
+	before := time.Now()
+	if now := clock.Now(); now.Before(before) {
+		t.Errorf("Expected the real time, got %v", now)
+	}
+
+	timer := clock.NewTimer(time.Millisecond)
+	select {
+	case <-timer.C():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the real timer to fire")
+	}
+}
@@ -0,0 +1,184 @@
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock whose time only moves when Advance or Set is called.
+// Timers, tickers and sleepers fire as the time passes their deadline, in
+// deadline order, so code under test sees the same sequence of events it
+// would in real time. It is safe for concurrent use.
+type Fake struct {
+	mutex   sync.Mutex
+	added   *sync.Cond // Broadcast whenever a timer or ticker is started
+	now     time.Time
+	pending []*fakeTimer // Started timers and tickers
+}
+
+// NewFake returns a fake clock set to now
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.added = sync.NewCond(&f.mutex)
+	return f
+}
+
+// Now returns the fake time
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// Advance moves the fake time forward by d, firing every timer and ticker
+// that comes due on the way
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.moveTo(f.now.Add(d))
+}
+
+// Set moves the fake time to t, firing every timer and ticker due by then.
+// Setting an earlier time moves the clock back without firing anything, as
+// when the system clock is stepped backwards.
+func (f *Fake) Set(t time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.moveTo(t)
+}
+
+// BlockUntil waits until at least n timers and tickers are started and not
+// stopped, so a test can advance the clock only once the goroutine under
+// test is waiting on it
+func (f *Fake) BlockUntil(n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for len(f.pending) < n {
+		f.added.Wait()
+	}
+}
+
+// NewTimer returns a timer that fires once the fake time reaches d from now
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.start(t, d)
+	return t
+}
+
+// NewTicker returns a ticker that fires every d of fake time
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1), period: d}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.start(t, d)
+	return fakeTicker{t}
+}
+
+// Sleep blocks until the fake time has moved d forward
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.NewTimer(d).C()
+}
+
+// start schedules t to fire d from now. Caller must hold the lock.
+func (f *Fake) start(t *fakeTimer, d time.Duration) {
+	t.when = f.now.Add(d)
+	f.pending = append(f.pending, t)
+	f.added.Broadcast()
+	f.moveTo(f.now)
+}
+
+// stop unschedules t and reports whether it was pending. Caller must hold
+// the lock.
+func (f *Fake) stop(t *fakeTimer) bool {
+	i := slices.Index(f.pending, t)
+	if i < 0 {
+		return false
+	}
+	f.pending = slices.Delete(f.pending, i, i+1)
+	return true
+}
+
+// moveTo fires the pending timers due by now, earliest first, then sets
+// the time to now. Caller must hold the lock.
+func (f *Fake) moveTo(now time.Time) {
+	for {
+		var next *fakeTimer
+		for _, t := range f.pending {
+			if !t.when.After(now) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		if next.when.After(f.now) {
+			f.now = next.when
+		}
+		// Like time.Ticker, drop ticks the receiver is too slow for
+		select {
+		case next.c <- next.when:
+		default:
+		}
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			f.stop(next)
+		}
+	}
+	f.now = now
+}
+
+// fakeTimer is a timer or, with a period, a ticker of a Fake clock
+type fakeTimer struct {
+	clock  *Fake
+	c      chan time.Time
+	when   time.Time     // When it fires next
+	period time.Duration // Zero for timers
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop unschedules the timer and, like time.Timer since Go 1.23, discards
+// a value it fired but was not received yet
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.stopAndDrain()
+}
+
+// Reset reschedules the timer to fire d from now and reports whether it
+// was pending
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	pending := t.stopAndDrain()
+	t.clock.start(t, d)
+	return pending
+}
+
+// stopAndDrain stops the timer and empties its channel. Caller must hold
+// the clock's lock.
+func (t *fakeTimer) stopAndDrain() bool {
+	pending := t.clock.stop(t)
+	select {
+	case <-t.c:
+	default:
+	}
+	return pending
+}
+
+// fakeTicker adapts a periodic fakeTimer to the Ticker interface
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
@@ -11,20 +11,34 @@ import (
 )
 
 type Config struct {
-	Syslog     SyslogConfig     `mapstructure:"syslog"`
-	SPOA       SPOAConfig       `mapstructure:"spoa"`
-	Envoy      EnvoyConfig      `mapstructure:"envoy"`
-	Nginx      NginxConfig      `mapstructure:"nginx"`
-	Ban        BanConfig        `mapstructure:"ban"`
-	Database   DatabaseConfig   `mapstructure:"database"`
-	Prometheus PrometheusConfig `mapstructure:"prometheus"`
-	API        APIConfig        `mapstructure:"api"`
+	Syslog      SyslogConfig      `mapstructure:"syslog"`
+	SPOA        SPOAConfig        `mapstructure:"spoa"`
+	Envoy       EnvoyConfig       `mapstructure:"envoy"`
+	Nginx       NginxConfig       `mapstructure:"nginx"`
+	Ban         BanConfig         `mapstructure:"ban"`
+	Jails       []JailConfig      `mapstructure:"jails"`
+	Shadow      ShadowConfig      `mapstructure:"shadow"`
+	Accounts    AccountConfig     `mapstructure:"accounts"`
+	Recidive    RecidiveConfig    `mapstructure:"recidive"`
+	Database    DatabaseConfig    `mapstructure:"database"`
+	Prometheus  PrometheusConfig  `mapstructure:"prometheus"`
+	API         APIConfig         `mapstructure:"api"`
+	Persistence PersistenceConfig `mapstructure:"persistence"`
 }
 
 type SyslogConfig struct {
 	Address  string          `mapstructure:"address"`
 	Protocol string          `mapstructure:"protocol"`
 	Patterns []PatternConfig `mapstructure:"patterns"`
+
+	// SuccessPatterns match successful logins, which relax the counters of
+	// the address (see SuccessConfig)
+	SuccessPatterns []PatternConfig `mapstructure:"success_patterns"`
+
+	// Violations are dated by the RFC 3164 or RFC 5424 timestamp of their
+	// message. Timestamps further than ClockSkewTolerance ahead of the local
+	// clock are rejected in favour of the receive time.
+	ClockSkewTolerance time.Duration `mapstructure:"clock_skew_tolerance"`
 }
 
 type PatternConfig struct {
@@ -33,6 +47,11 @@ type PatternConfig struct {
 	IPGroup     int    `mapstructure:"ip_group"`
 	Severity    int    `mapstructure:"severity"`
 	Description string `mapstructure:"description"`
+	Jail        string `mapstructure:"jail"` // Optional: jail whose ban policy applies
+
+	// UsernameGroup is the regex group capturing the account name, or 0 if
+	// the pattern does not capture one
+	UsernameGroup int `mapstructure:"username_group"`
 }
 
 type SPOAConfig struct {
@@ -66,8 +85,242 @@ type BanConfig struct {
 	TimeWindow       time.Duration `mapstructure:"time_window"`
 	CleanupInterval  time.Duration `mapstructure:"cleanup_interval"`
 	MaxMemoryTTL     time.Duration `mapstructure:"max_memory_ttl"`
+
+	// DurationStrategy selects how ban durations grow with the ban count;
+	// BanSteps lists the durations of the steps strategy
+	DurationStrategy string          `mapstructure:"duration_strategy"`
+	BanSteps         []time.Duration `mapstructure:"ban_steps"`
+
+	// Memory bounds: the number of tracked IPs, beyond which the least
+	// recently seen non-banned entries are evicted, and the number of
+	// violations kept per IP and jail. Zero disables the limit.
+	MaxTrackedIPs      int `mapstructure:"max_tracked_ips"`
+	MaxViolationsPerIP int `mapstructure:"max_violations_per_ip"`
+
+	// Mode selects the ban trigger: "count" bans after MaxAttempts violations
+	// within TimeWindow, "score" bans once the decayed severity score reaches
+	// ScoreThreshold
+	Mode           string        `mapstructure:"mode"`
+	ScoreThreshold float64       `mapstructure:"score_threshold"`
+	ScoreHalfLife  time.Duration `mapstructure:"score_half_life"`
+
+	// Violations are counted per prefix of this length (32/128 = per address)
+	IPv4AggregationPrefix int `mapstructure:"ipv4_aggregation_prefix"`
+	IPv6AggregationPrefix int `mapstructure:"ipv6_aggregation_prefix"`
+
+	SubnetEscalation SubnetEscalationConfig `mapstructure:"subnet_escalation"`
+
+	Success SuccessConfig `mapstructure:"success"`
+
+	Forgiveness ForgivenessConfig `mapstructure:"forgiveness"`
+
+	// Addresses and CIDR prefixes that are never banned, and that are always
+	// banned, in addition to the database whitelist and blacklist tables
+	Whitelist []string `mapstructure:"whitelist"`
+	Blacklist []string `mapstructure:"blacklist"`
+
+	// Decoy usernames that do not exist; a failed login to any of them bans
+	// at once, in addition to the database honeypot_usernames table
+	HoneypotUsernames []string `mapstructure:"honeypot_usernames"`
+}
+
+// BlacklistEntry is a blacklisted address or CIDR prefix with its expiry
+type BlacklistEntry struct {
+	Address   string
+	ExpiresAt time.Time // Zero for entries without expiry
+}
+
+// JailConfig is a named ban policy, like a fail2ban jail. Patterns refer to
+// it by name; violations are counted separately per jail. Zero values
+// inherit from the global ban configuration.
+type JailConfig struct {
+	Name             string        `mapstructure:"name"`
+	InitialBanTime   time.Duration `mapstructure:"initial_ban_time"`
+	MaxBanTime       time.Duration `mapstructure:"max_ban_time"`
+	EscalationFactor float64       `mapstructure:"escalation_factor"`
+	MaxAttempts      int           `mapstructure:"max_attempts"`
+	TimeWindow       time.Duration `mapstructure:"time_window"`
+
+	DurationStrategy string          `mapstructure:"duration_strategy"`
+	BanSteps         []time.Duration `mapstructure:"ban_steps"`
+
+	// Bans from a jail only block the address for that jail's scope, which
+	// proxies name when checking a request. Global makes every ban of the
+	// jail block all services; GlobalAfter does so from the given ban count on.
+	Global      bool `mapstructure:"global"`
+	GlobalAfter int  `mapstructure:"global_after"`
+}
+
+// WithJail returns the ban configuration with the jail's settings applied
+func (b BanConfig) WithJail(jail JailConfig) BanConfig {
+	if jail.InitialBanTime > 0 {
+		b.InitialBanTime = jail.InitialBanTime
+	}
+	if jail.MaxBanTime > 0 {
+		b.MaxBanTime = jail.MaxBanTime
+	}
+	if jail.EscalationFactor > 0 {
+		b.EscalationFactor = jail.EscalationFactor
+	}
+	if jail.MaxAttempts > 0 {
+		b.MaxAttempts = jail.MaxAttempts
+	}
+	if jail.TimeWindow > 0 {
+		b.TimeWindow = jail.TimeWindow
+	}
+	if jail.DurationStrategy != "" {
+		b.DurationStrategy = jail.DurationStrategy
+	}
+	if len(jail.BanSteps) > 0 {
+		b.BanSteps = jail.BanSteps
+	}
+	return b
+}
+
+// FindJail returns the jail with the given name
+func (c *Config) FindJail(name string) (JailConfig, bool) {
+	for _, jail := range c.Jails {
+		if jail.Name == name {
+			return jail, true
+		}
+	}
+	return JailConfig{}, false
+}
+
+// Actions taken when an account reaches its failure threshold
+const (
+	AccountActionMark = "mark" // Mark the account as under attack
+	AccountActionBan  = "ban"  // Ban every address that failed to log in to it
+)
+
+// AccountConfig describes the detection of distributed attacks on one
+// account: failures of patterns capturing a username are counted per
+// account across all addresses, so attackers spreading their attempts over
+// many addresses still reach the threshold. Failures from fewer than
+// MinDistinctIPs addresses are left to the per-address policy, so a single
+// client retrying a stale password does not count as an attack.
+type AccountConfig struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	MaxAttempts    int           `mapstructure:"max_attempts"`     // Failures per account within TimeWindow
+	MinDistinctIPs int           `mapstructure:"min_distinct_ips"` // Addresses the failures must come from
+	TimeWindow     time.Duration `mapstructure:"time_window"`
+	Action         string        `mapstructure:"action"`
+	MarkDuration   time.Duration `mapstructure:"mark_duration"` // How long an account stays marked as under attack
+}
+
+// RecidiveConfig describes the promotion of repeat offenders to the
+// blacklist, like fail2ban's recidive jail: an address banned MaxBans times
+// within LookbackWindow is blacklisted for BlacklistDuration, or for good if
+// it is zero. Ban times are kept in the ban history for the lookback window,
+// so they count even after the address was dropped from memory.
+type RecidiveConfig struct {
+	Enabled           bool          `mapstructure:"enabled"`
+	MaxBans           int           `mapstructure:"max_bans"`
+	LookbackWindow    time.Duration `mapstructure:"lookback_window"`
+	BlacklistDuration time.Duration `mapstructure:"blacklist_duration"`
+}
+
+// ShadowConfig describes a candidate ban policy that is evaluated against
+// live traffic without enforcing anything. Zero ban settings inherit from
+// the live ban configuration; without patterns the live patterns are used.
+type ShadowConfig struct {
+	Enabled   bool            `mapstructure:"enabled"`
+	Ban       BanConfig       `mapstructure:"ban"`
+	Patterns  []PatternConfig `mapstructure:"patterns"`
+	Retention time.Duration   `mapstructure:"retention"` // How long ban decisions are kept for comparison
+}
+
+// WithShadow returns the ban configuration with the shadow policy's ban
+// trigger and duration settings applied
+func (b BanConfig) WithShadow(shadow BanConfig) BanConfig {
+	if shadow.InitialBanTime > 0 {
+		b.InitialBanTime = shadow.InitialBanTime
+	}
+	if shadow.MaxBanTime > 0 {
+		b.MaxBanTime = shadow.MaxBanTime
+	}
+	if shadow.EscalationFactor > 0 {
+		b.EscalationFactor = shadow.EscalationFactor
+	}
+	if shadow.MaxAttempts > 0 {
+		b.MaxAttempts = shadow.MaxAttempts
+	}
+	if shadow.TimeWindow > 0 {
+		b.TimeWindow = shadow.TimeWindow
+	}
+	if shadow.DurationStrategy != "" {
+		b.DurationStrategy = shadow.DurationStrategy
+	}
+	if len(shadow.BanSteps) > 0 {
+		b.BanSteps = shadow.BanSteps
+	}
+	if shadow.Mode != "" {
+		b.Mode = shadow.Mode
+	}
+	if shadow.ScoreThreshold > 0 {
+		b.ScoreThreshold = shadow.ScoreThreshold
+	}
+	if shadow.ScoreHalfLife > 0 {
+		b.ScoreHalfLife = shadow.ScoreHalfLife
+	}
+	return b
+}
+
+// SubnetEscalationConfig controls automatic bans of a whole prefix once
+// enough distinct addresses inside it have been banned
+type SubnetEscalationConfig struct {
+	Enabled          bool          `mapstructure:"enabled"`
+	Threshold        int           `mapstructure:"threshold"`   // Distinct banned IPs needed to ban the prefix
+	TimeWindow       time.Duration `mapstructure:"time_window"` // Window in which the bans must occur
+	IPv4PrefixLength int           `mapstructure:"ipv4_prefix_length"`
+	IPv6PrefixLength int           `mapstructure:"ipv6_prefix_length"`
+	InitialBanTime   time.Duration `mapstructure:"initial_ban_time"`
+	MaxBanTime       time.Duration `mapstructure:"max_ban_time"`
+	EscalationFactor float64       `mapstructure:"escalation_factor"`
+}
+
+// SuccessConfig controls how successful logins relax the counters of an
+// address, so a user who mistyped a password is not one failure away from a
+// ban after logging in
+type SuccessConfig struct {
+	// ForgiveViolations is the number of most recent violations a
+	// successful login removes; 0 removes them all
+	ForgiveViolations int `mapstructure:"forgive_violations"`
+
+	// Addresses with a successful login within TrustDuration tolerate
+	// ToleranceFactor times the usual attempts or score before a ban
+	TrustDuration   time.Duration `mapstructure:"trust_duration"`
+	ToleranceFactor float64       `mapstructure:"tolerance_factor"`
 }
 
+// ForgivenessConfig controls how long repeat offenders are remembered. Ban
+// counts only drive escalation, so forgiving them shortens later bans.
+type ForgivenessConfig struct {
+	// CleanInterval is the time without violations or bans after which a
+	// ban count drops by one. Zero, the default, never forgives.
+	CleanInterval time.Duration `mapstructure:"clean_interval"`
+
+	// HistoryRetention is how long the ban counts of addresses dropped from
+	// memory are kept, so that they escalate from where they left off when
+	// the address returns. Zero forgets them with the address.
+	HistoryRetention time.Duration `mapstructure:"history_retention"`
+}
+
+// Ban trigger modes
+const (
+	BanModeCount = "count"
+	BanModeScore = "score"
+)
+
+// Ban duration strategies. n is the ban count, starting at 1; durations
+// are capped at the maximum ban time.
+const (
+	DurationStrategyLinear      = "linear"      // InitialBanTime * EscalationFactor * n
+	DurationStrategyExponential = "exponential" // InitialBanTime * EscalationFactor^(n-1)
+	DurationStrategyFibonacci   = "fibonacci"   // InitialBanTime * 1, 2, 3, 5, 8, ...
+	DurationStrategySteps       = "steps"       // BanSteps[n-1], then the last step
+)
+
 type DatabaseConfig struct {
 	Enabled         bool          `mapstructure:"enabled"`
 	Driver          string        `mapstructure:"driver"`           // sqlite3, mysql, postgres
@@ -77,6 +330,15 @@ type DatabaseConfig struct {
 	RetryDelay      time.Duration `mapstructure:"retry_delay"`
 }
 
+// PersistenceConfig controls snapshots of the in-memory ban state so that
+// bans and escalation counters survive restarts
+type PersistenceConfig struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	Backend  string        `mapstructure:"backend"`  // file or database
+	Path     string        `mapstructure:"path"`     // Snapshot file for the file backend
+	Interval time.Duration `mapstructure:"interval"` // How often to take a snapshot
+}
+
 type PrometheusConfig struct {
 	Enabled bool   `mapstructure:"enabled"`
 	Address string `mapstructure:"address"`
@@ -131,6 +393,7 @@ func Load() (*Config, error) {
 func setDefaults() {
 	viper.SetDefault("syslog.address", "127.0.0.1:514")
 	viper.SetDefault("syslog.protocol", "udp")
+	viper.SetDefault("syslog.clock_skew_tolerance", "1m")
 
 	viper.SetDefault("spoa.address", "0.0.0.0")
 	viper.SetDefault("spoa.port", 12345)
@@ -156,6 +419,42 @@ func setDefaults() {
 	viper.SetDefault("ban.time_window", "10m")
 	viper.SetDefault("ban.cleanup_interval", "1m")
 	viper.SetDefault("ban.max_memory_ttl", "72h")
+	viper.SetDefault("ban.duration_strategy", "linear")
+	viper.SetDefault("ban.max_tracked_ips", 100000)
+	viper.SetDefault("ban.max_violations_per_ip", 50)
+	viper.SetDefault("ban.mode", "count")
+	viper.SetDefault("ban.score_threshold", 15.0)
+	viper.SetDefault("ban.score_half_life", "10m")
+	viper.SetDefault("ban.ipv4_aggregation_prefix", 32)
+	viper.SetDefault("ban.ipv6_aggregation_prefix", 64)
+	viper.SetDefault("ban.subnet_escalation.enabled", false)
+	viper.SetDefault("ban.subnet_escalation.threshold", 5)
+	viper.SetDefault("ban.subnet_escalation.time_window", "1h")
+	viper.SetDefault("ban.subnet_escalation.ipv4_prefix_length", 24)
+	viper.SetDefault("ban.subnet_escalation.ipv6_prefix_length", 64)
+	viper.SetDefault("ban.subnet_escalation.initial_ban_time", "1h")
+	viper.SetDefault("ban.subnet_escalation.max_ban_time", "168h")
+	viper.SetDefault("ban.subnet_escalation.escalation_factor", 2.0)
+	viper.SetDefault("ban.success.forgive_violations", 0)
+	viper.SetDefault("ban.success.trust_duration", "24h")
+	viper.SetDefault("ban.success.tolerance_factor", 2.0)
+	viper.SetDefault("ban.forgiveness.clean_interval", "0s")
+	viper.SetDefault("ban.forgiveness.history_retention", "720h")
+
+	viper.SetDefault("shadow.enabled", false)
+	viper.SetDefault("shadow.retention", "24h")
+
+	viper.SetDefault("accounts.enabled", false)
+	viper.SetDefault("accounts.max_attempts", 20)
+	viper.SetDefault("accounts.min_distinct_ips", 2)
+	viper.SetDefault("accounts.time_window", "1h")
+	viper.SetDefault("accounts.action", AccountActionMark)
+	viper.SetDefault("accounts.mark_duration", "1h")
+
+	viper.SetDefault("recidive.enabled", false)
+	viper.SetDefault("recidive.max_bans", 5)
+	viper.SetDefault("recidive.lookback_window", "168h")
+	viper.SetDefault("recidive.blacklist_duration", "0s")
 
 	viper.SetDefault("database.enabled", false)
 	viper.SetDefault("database.driver", "sqlite3")
@@ -164,6 +463,11 @@ func setDefaults() {
 	viper.SetDefault("database.max_retries", 3)
 	viper.SetDefault("database.retry_delay", "5s")
 
+	viper.SetDefault("persistence.enabled", false)
+	viper.SetDefault("persistence.backend", "file")
+	viper.SetDefault("persistence.path", "./fail2ban-state.json")
+	viper.SetDefault("persistence.interval", "1m")
+
 	viper.SetDefault("prometheus.enabled", false)
 	viper.SetDefault("prometheus.address", "0.0.0.0")
 	viper.SetDefault("prometheus.port", 2112)
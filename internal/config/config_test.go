@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"testing"
 	"time"
 
@@ -195,6 +196,9 @@ func TestLoadDefaults(t *testing.T) {
 	if cfg.Syslog.Protocol != "udp" {
 		t.Errorf("Expected default syslog protocol 'udp', got '%s'", cfg.Syslog.Protocol)
 	}
+	if cfg.Syslog.ClockSkewTolerance != time.Minute {
+		t.Errorf("Expected default clock skew tolerance 1m, got %v", cfg.Syslog.ClockSkewTolerance)
+	}
 
 	if cfg.SPOA.Address != "0.0.0.0" {
 		t.Errorf("Expected default SPOA address '0.0.0.0', got '%s'", cfg.SPOA.Address)
@@ -262,6 +266,302 @@ func TestLoadDefaults(t *testing.T) {
 	if cfg.Ban.MaxMemoryTTL != 72*time.Hour {
 		t.Errorf("Expected default max_memory_ttl 72h, got %v", cfg.Ban.MaxMemoryTTL)
 	}
+	if cfg.Ban.MaxTrackedIPs != 100000 {
+		t.Errorf("Expected default max_tracked_ips 100000, got %d", cfg.Ban.MaxTrackedIPs)
+	}
+	if cfg.Ban.MaxViolationsPerIP != 50 {
+		t.Errorf("Expected default max_violations_per_ip 50, got %d", cfg.Ban.MaxViolationsPerIP)
+	}
+	if cfg.Ban.Mode != BanModeCount {
+		t.Errorf("Expected default mode 'count', got '%s'", cfg.Ban.Mode)
+	}
+	if cfg.Ban.ScoreHalfLife != 10*time.Minute {
+		t.Errorf("Expected default score_half_life 10m, got %v", cfg.Ban.ScoreHalfLife)
+	}
+	if cfg.Ban.IPv4AggregationPrefix != 32 {
+		t.Errorf("Expected default ipv4_aggregation_prefix 32, got %d", cfg.Ban.IPv4AggregationPrefix)
+	}
+	if cfg.Ban.IPv6AggregationPrefix != 64 {
+		t.Errorf("Expected default ipv6_aggregation_prefix 64, got %d", cfg.Ban.IPv6AggregationPrefix)
+	}
+	if cfg.Ban.Forgiveness.CleanInterval != 0 {
+		t.Errorf("Expected default forgiveness.clean_interval 0, got %v", cfg.Ban.Forgiveness.CleanInterval)
+	}
+
+	subnet := cfg.Ban.SubnetEscalation
+	if subnet.Enabled != false {
+		t.Errorf("Expected default subnet_escalation.enabled false, got %t", subnet.Enabled)
+	}
+	if subnet.Threshold != 5 {
+		t.Errorf("Expected default subnet_escalation.threshold 5, got %d", subnet.Threshold)
+	}
+	if subnet.IPv4PrefixLength != 24 {
+		t.Errorf("Expected default subnet_escalation.ipv4_prefix_length 24, got %d", subnet.IPv4PrefixLength)
+	}
+	if subnet.IPv6PrefixLength != 64 {
+		t.Errorf("Expected default subnet_escalation.ipv6_prefix_length 64, got %d", subnet.IPv6PrefixLength)
+	}
+	if subnet.MaxBanTime != 168*time.Hour {
+		t.Errorf("Expected default subnet_escalation.max_ban_time 168h, got %v", subnet.MaxBanTime)
+	}
+
+	if cfg.Persistence.Enabled != false {
+		t.Errorf("Expected default persistence.enabled false, got %t", cfg.Persistence.Enabled)
+	}
+	if cfg.Persistence.Backend != "file" {
+		t.Errorf("Expected default persistence.backend 'file', got '%s'", cfg.Persistence.Backend)
+	}
+	if cfg.Persistence.Interval != time.Minute {
+		t.Errorf("Expected default persistence.interval 1m, got %v", cfg.Persistence.Interval)
+	}
+}
+
+func TestLoadJails(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+
+	configContent := `
+syslog:
+  patterns:
+    - name: "postfix-sasl-failure"
+      regex: "SASL LOGIN authentication failed.*\\[([0-9.]+)\\]"
+      jail: "postfix-sasl"
+
+ban:
+  initial_ban_time: "10m"
+  max_ban_time: "48h"
+  max_attempts: 3
+
+jails:
+  - name: "postfix-sasl"
+    max_attempts: 5
+    time_window: "1h"
+    max_ban_time: "168h"
+`
+
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	viper.Reset()
+	viper.AddConfigPath(tmpDir)
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.Syslog.Patterns[0].Jail != "postfix-sasl" {
+		t.Errorf("Expected pattern jail 'postfix-sasl', got '%s'", cfg.Syslog.Patterns[0].Jail)
+	}
+
+	jail, ok := cfg.FindJail("postfix-sasl")
+	if !ok {
+		t.Fatal("Expected jail 'postfix-sasl' to be configured")
+	}
+	if _, ok := cfg.FindJail("sogo"); ok {
+		t.Error("Expected unknown jail to not be found")
+	}
+
+	policy := cfg.Ban.WithJail(jail)
+	if policy.MaxAttempts != 5 {
+		t.Errorf("Expected jail max attempts 5, got %d", policy.MaxAttempts)
+	}
+	if policy.TimeWindow != time.Hour {
+		t.Errorf("Expected jail time window 1h, got %v", policy.TimeWindow)
+	}
+	if policy.MaxBanTime != 168*time.Hour {
+		t.Errorf("Expected jail max ban time 168h, got %v", policy.MaxBanTime)
+	}
+	// Unset jail settings are inherited
+	if policy.InitialBanTime != 10*time.Minute {
+		t.Errorf("Expected inherited initial ban time 10m, got %v", policy.InitialBanTime)
+	}
+	if policy.EscalationFactor != cfg.Ban.EscalationFactor {
+		t.Errorf("Expected inherited escalation factor %v, got %v", cfg.Ban.EscalationFactor, policy.EscalationFactor)
+	}
+}
+
+func TestLoadShadow(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+
+	configContent := `
+ban:
+  initial_ban_time: "10m"
+  max_attempts: 3
+  time_window: "10m"
+
+shadow:
+  enabled: true
+  ban:
+    max_attempts: 5
+    time_window: "30m"
+  patterns:
+    - name: "sogo-login-failure"
+      regex: "SOGo.*Login failed for user .* from ([0-9.]+)"
+      ip_group: 1
+`
+
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	viper.Reset()
+	viper.AddConfigPath(tmpDir)
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if !cfg.Shadow.Enabled || len(cfg.Shadow.Patterns) != 1 {
+		t.Fatalf("Expected enabled shadow policy with one pattern, got %+v", cfg.Shadow)
+	}
+	if cfg.Shadow.Retention != 24*time.Hour {
+		t.Errorf("Expected default shadow retention 24h, got %v", cfg.Shadow.Retention)
+	}
+
+	policy := cfg.Ban.WithShadow(cfg.Shadow.Ban)
+	if policy.MaxAttempts != 5 || policy.TimeWindow != 30*time.Minute {
+		t.Errorf("Expected shadow max attempts 5 within 30m, got %d within %v", policy.MaxAttempts, policy.TimeWindow)
+	}
+	// Unset shadow settings are inherited from the live policy
+	if policy.InitialBanTime != 10*time.Minute || policy.Mode != BanModeCount {
+		t.Errorf("Expected inherited initial ban time and mode, got %v %q", policy.InitialBanTime, policy.Mode)
+	}
+}
+
+func TestLoadAccounts(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+
+	configContent := `
+accounts:
+  enabled: true
+  max_attempts: 50
+
+syslog:
+  patterns:
+    - name: "dovecot-auth-failure"
+      regex: "dovecot: auth failed.*user=<([^>]+)>.*rip=([0-9.]+)"
+      ip_group: 2
+      username_group: 1
+`
+
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	viper.Reset()
+	viper.AddConfigPath(tmpDir)
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if !cfg.Accounts.Enabled || cfg.Accounts.MaxAttempts != 50 {
+		t.Errorf("Expected account tracking with 50 attempts, got %+v", cfg.Accounts)
+	}
+	if cfg.Accounts.Action != AccountActionMark || cfg.Accounts.TimeWindow != time.Hour {
+		t.Errorf("Expected default mark action within 1h, got %q within %v", cfg.Accounts.Action, cfg.Accounts.TimeWindow)
+	}
+	if cfg.Accounts.MinDistinctIPs != 2 {
+		t.Errorf("Expected default min_distinct_ips 2, got %d", cfg.Accounts.MinDistinctIPs)
+	}
+	if len(cfg.Syslog.Patterns) != 1 || cfg.Syslog.Patterns[0].UsernameGroup != 1 {
+		t.Errorf("Expected pattern with username group 1, got %+v", cfg.Syslog.Patterns)
+	}
+}
+
+func TestLoadDurationStrategy(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+
+	configContent := `
+ban:
+  duration_strategy: "exponential"
+
+jails:
+  - name: "dovecot"
+    duration_strategy: "steps"
+    ban_steps: ["10m", "1h", "24h", "168h"]
+  - name: "postfix"
+`
+
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	viper.Reset()
+	viper.AddConfigPath(tmpDir)
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.Ban.DurationStrategy != DurationStrategyExponential {
+		t.Errorf("Expected exponential duration strategy, got %q", cfg.Ban.DurationStrategy)
+	}
+
+	dovecot, _ := cfg.FindJail("dovecot")
+	policy := cfg.Ban.WithJail(dovecot)
+	expected := []time.Duration{10 * time.Minute, time.Hour, 24 * time.Hour, 168 * time.Hour}
+	if policy.DurationStrategy != DurationStrategySteps || !slices.Equal(policy.BanSteps, expected) {
+		t.Errorf("Expected steps %v, got %q with %v", expected, policy.DurationStrategy, policy.BanSteps)
+	}
+
+	// Jails without a strategy inherit the global one
+	postfix, _ := cfg.FindJail("postfix")
+	if policy := cfg.Ban.WithJail(postfix); policy.DurationStrategy != DurationStrategyExponential {
+		t.Errorf("Expected inherited exponential strategy, got %q", policy.DurationStrategy)
+	}
+}
+
+func TestLoadRecidive(t *testing.T) {
+	tmpDir := t.TempDir()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+
+	configContent := `
+recidive:
+  enabled: true
+  max_bans: 3
+  blacklist_duration: "720h"
+`
+
+	if err := os.WriteFile(configFile, []byte(configContent), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	viper.Reset()
+	viper.AddConfigPath(tmpDir)
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if !cfg.Recidive.Enabled || cfg.Recidive.MaxBans != 3 {
+		t.Errorf("Expected recidive enabled with max_bans 3, got %+v", cfg.Recidive)
+	}
+	if cfg.Recidive.LookbackWindow != 168*time.Hour {
+		t.Errorf("Expected default lookback window of 168h, got %v", cfg.Recidive.LookbackWindow)
+	}
+	if cfg.Recidive.BlacklistDuration != 720*time.Hour {
+		t.Errorf("Expected blacklist duration of 720h, got %v", cfg.Recidive.BlacklistDuration)
+	}
 }
 
 func TestLoadMissingFile(t *testing.T) {
@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"fail2ban-haproxy/internal/clock"
 	"fail2ban-haproxy/internal/database"
 )
 
@@ -19,18 +23,31 @@ type ConfigManager struct {
 	cancel       context.CancelFunc
 	patterns     []PatternConfig
 	banConfig    *BanConfig
+	jails        []JailConfig
+	whitelist    []string         // Database whitelist entries
+	honeypots    []string         // Database honeypot usernames
+	blacklist    []BlacklistEntry // Database blacklist entries
 	updateChan   chan struct{}
-	reloadTicker *time.Ticker
+	subscribers  []chan struct{} // Channels of Subscribe, signalled with updateChan
+	reloadTicker clock.Ticker
+	clock        clock.Clock
 	// Keep track of database status and last successful load
 	dbConnected     bool
 	lastDbLoad      time.Time
 	failureCount    int
 	lastDbPatterns  []PatternConfig
 	lastDbBanConfig *BanConfig
+	lastDbJails     []JailConfig
 }
 
 // NewConfigManager creates a new configuration manager
 func NewConfigManager(cfg *Config) (*ConfigManager, error) {
+	return NewConfigManagerWithClock(cfg, clock.Real())
+}
+
+// NewConfigManagerWithClock creates a configuration manager that times its
+// reloads and retries with clk, so tests can drive them with a fake clock
+func NewConfigManagerWithClock(cfg *Config, clk clock.Clock) (*ConfigManager, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	cm := &ConfigManager{
@@ -38,11 +55,13 @@ func NewConfigManager(cfg *Config) (*ConfigManager, error) {
 		ctx:        ctx,
 		cancel:     cancel,
 		updateChan: make(chan struct{}, 1),
+		clock:      clk,
 	}
 
 	// Initialize with file configuration
 	cm.patterns = cfg.Syslog.Patterns
 	cm.banConfig = &cfg.Ban
+	cm.jails = cfg.Jails
 
 	// Initialize database if enabled
 	if cfg.Database.Enabled {
@@ -98,6 +117,65 @@ func (cm *ConfigManager) GetBanConfig() BanConfig {
 	return *cm.banConfig
 }
 
+// GetJails returns the current jail configuration
+func (cm *ConfigManager) GetJails() []JailConfig {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	jails := make([]JailConfig, len(cm.jails))
+	copy(jails, cm.jails)
+	return jails
+}
+
+// GetWhitelist returns the whitelisted addresses and prefixes from the file
+// configuration and the database
+func (cm *ConfigManager) GetWhitelist() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	whitelist := make([]string, 0, len(cm.config.Ban.Whitelist)+len(cm.whitelist))
+	whitelist = append(whitelist, cm.config.Ban.Whitelist...)
+	return append(whitelist, cm.whitelist...)
+}
+
+// GetHoneypotUsernames returns the honeypot usernames from the file
+// configuration and the database
+func (cm *ConfigManager) GetHoneypotUsernames() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	honeypots := make([]string, 0, len(cm.config.Ban.HoneypotUsernames)+len(cm.honeypots))
+	honeypots = append(honeypots, cm.config.Ban.HoneypotUsernames...)
+	return append(honeypots, cm.honeypots...)
+}
+
+// GetBlacklist returns the blacklisted addresses and prefixes from the file
+// configuration and the database
+func (cm *ConfigManager) GetBlacklist() []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	blacklist := make([]string, 0, len(cm.config.Ban.Blacklist)+len(cm.blacklist))
+	blacklist = append(blacklist, cm.config.Ban.Blacklist...)
+	for _, entry := range cm.blacklist {
+		blacklist = append(blacklist, entry.Address)
+	}
+	return blacklist
+}
+
+// GetBlacklistEntries returns the blacklist like GetBlacklist, with the
+// expiry of the database entries
+func (cm *ConfigManager) GetBlacklistEntries() []BlacklistEntry {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	blacklist := make([]BlacklistEntry, 0, len(cm.config.Ban.Blacklist)+len(cm.blacklist))
+	for _, address := range cm.config.Ban.Blacklist {
+		blacklist = append(blacklist, BlacklistEntry{Address: address})
+	}
+	return append(blacklist, cm.blacklist...)
+}
+
 // GetConfig returns the base configuration
 func (cm *ConfigManager) GetConfig() *Config {
 	return cm.config
@@ -108,6 +186,17 @@ func (cm *ConfigManager) UpdateChan() <-chan struct{} {
 	return cm.updateChan
 }
 
+// Subscribe returns a new channel that signals when configuration is
+// updated, for consumers other than the one reading UpdateChan
+func (cm *ConfigManager) Subscribe() <-chan struct{} {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	updates := make(chan struct{}, 1)
+	cm.subscribers = append(cm.subscribers, updates)
+	return updates
+}
+
 // loadFromDatabase loads configuration from database with fallback to previous config on failure
 func (cm *ConfigManager) loadFromDatabase() error {
 	if cm.db == nil {
@@ -169,17 +258,55 @@ func (cm *ConfigManager) loadFromDatabase() error {
 		return fmt.Errorf("failed to load ban config and no previous config available: %w", err)
 	}
 
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	// Load jail profiles
+	dbProfiles, err := cm.db.GetBanProfiles()
+	if err != nil {
+		cm.mu.Lock()
+		cm.dbConnected = false
+		cm.failureCount++
+		cm.mu.Unlock()
+		log.Printf("Failed to load ban profiles from database (failure #%d), keeping previous configuration: %v", cm.failureCount, err)
 
-	// Mark database as connected and reset failure count
-	wasDisconnected := !cm.dbConnected
-	cm.dbConnected = true
-	cm.failureCount = 0
-	cm.lastDbLoad = time.Now()
+		// Keep using previous database config if available
+		if cm.lastDbPatterns != nil || cm.lastDbBanConfig != nil {
+			return nil
+		}
 
-	if wasDisconnected {
-		log.Printf("Database connection restored after %d failures", cm.failureCount)
+		return fmt.Errorf("failed to load ban profiles and no previous config available: %w", err)
+	}
+
+	// Load whitelist and blacklist
+	whitelist, blacklist, err := cm.loadAccessLists()
+	if err != nil {
+		cm.mu.Lock()
+		cm.dbConnected = false
+		cm.failureCount++
+		cm.mu.Unlock()
+		log.Printf("Failed to load access lists from database (failure #%d), keeping previous lists: %v", cm.failureCount, err)
+
+		// Keep using previous database config if available
+		if cm.lastDbPatterns != nil || cm.lastDbBanConfig != nil {
+			return nil
+		}
+
+		return fmt.Errorf("failed to load access lists and no previous config available: %w", err)
+	}
+
+	// Load honeypot usernames
+	honeypots, err := cm.loadHoneypotUsernames()
+	if err != nil {
+		cm.mu.Lock()
+		cm.dbConnected = false
+		cm.failureCount++
+		cm.mu.Unlock()
+		log.Printf("Failed to load honeypot usernames from database (failure #%d), keeping previous usernames: %v", cm.failureCount, err)
+
+		// Keep using previous database config if available
+		if cm.lastDbPatterns != nil || cm.lastDbBanConfig != nil {
+			return nil
+		}
+
+		return fmt.Errorf("failed to load honeypot usernames and no previous config available: %w", err)
 	}
 
 	// Convert patterns
@@ -193,9 +320,72 @@ func (cm *ConfigManager) loadFromDatabase() error {
 				IPGroup:     dbPattern.IPGroup,
 				Severity:    dbPattern.Severity,
 				Description: dbPattern.Description,
+				Jail:        dbPattern.Jail,
+
+				UsernameGroup: dbPattern.UsernameGroup,
 			}
 		}
+	}
+
+	// Convert ban config
+	var banConfig *BanConfig
+	if dbBanConfig != nil {
+		// Start from the file configuration so that settings without a
+		// database column are kept
+		fileBanConfig := cm.config.Ban
+		banConfig = &fileBanConfig
+		banConfig.InitialBanTime = dbBanConfig.InitialBanTime
+		banConfig.MaxBanTime = dbBanConfig.MaxBanTime
+		banConfig.EscalationFactor = dbBanConfig.EscalationFactor
+		banConfig.MaxAttempts = dbBanConfig.MaxAttempts
+		banConfig.TimeWindow = dbBanConfig.TimeWindow
+		banConfig.CleanupInterval = dbBanConfig.CleanupInterval
+		banConfig.MaxMemoryTTL = dbBanConfig.MaxMemoryTTL
+		banConfig.DurationStrategy = dbBanConfig.DurationStrategy
+		banConfig.BanSteps = dbBanConfig.BanSteps
+	}
+
+	// Convert jail profiles. A profile replaces the ban settings of the
+	// file jail of the same name, keeping its other settings, and adds to
+	// the other file jails. Once the last profile is disabled or deleted,
+	// the file jails apply again.
+	jails := slices.Clone(cm.config.Jails)
+	for _, profile := range dbProfiles {
+		i := slices.IndexFunc(jails, func(jail JailConfig) bool { return jail.Name == profile.Name })
+		if i < 0 {
+			jails = append(jails, JailConfig{Name: profile.Name})
+			i = len(jails) - 1
+		}
+		jails[i].InitialBanTime = profile.InitialBanTime
+		jails[i].MaxBanTime = profile.MaxBanTime
+		jails[i].EscalationFactor = profile.EscalationFactor
+		jails[i].MaxAttempts = profile.MaxAttempts
+		jails[i].TimeWindow = profile.TimeWindow
+		jails[i].DurationStrategy = profile.DurationStrategy
+		jails[i].BanSteps = profile.BanSteps
+	}
+
+	// Reject a database configuration that does not validate, keeping the
+	// previous one
+	if err := cm.validateReload(patterns, banConfig, jails); err != nil {
+		log.Printf("Invalid configuration in database, keeping previous configuration: %v", err)
+		return fmt.Errorf("invalid database configuration: %w", err)
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
 
+	// Mark database as connected and reset failure count
+	wasDisconnected := !cm.dbConnected
+	cm.dbConnected = true
+	cm.failureCount = 0
+	cm.lastDbLoad = cm.clock.Now()
+
+	if wasDisconnected {
+		log.Printf("Database connection restored after %d failures", cm.failureCount)
+	}
+
+	if patterns != nil {
 		// Update current patterns and save as last known good
 		cm.patterns = patterns
 		cm.lastDbPatterns = make([]PatternConfig, len(patterns))
@@ -203,47 +393,151 @@ func (cm *ConfigManager) loadFromDatabase() error {
 		log.Printf("Loaded and cached %d patterns from database", len(patterns))
 	}
 
-	// Convert ban config
-	if dbBanConfig != nil {
-		banConfig := &BanConfig{
-			InitialBanTime:   dbBanConfig.InitialBanTime,
-			MaxBanTime:       dbBanConfig.MaxBanTime,
-			EscalationFactor: dbBanConfig.EscalationFactor,
-			MaxAttempts:      dbBanConfig.MaxAttempts,
-			TimeWindow:       dbBanConfig.TimeWindow,
-			CleanupInterval:  dbBanConfig.CleanupInterval,
-			MaxMemoryTTL:     dbBanConfig.MaxMemoryTTL,
-		}
-
+	if banConfig != nil {
 		// Update current ban config and save as last known good
 		cm.banConfig = banConfig
-		cm.lastDbBanConfig = &BanConfig{
-			InitialBanTime:   banConfig.InitialBanTime,
-			MaxBanTime:       banConfig.MaxBanTime,
-			EscalationFactor: banConfig.EscalationFactor,
-			MaxAttempts:      banConfig.MaxAttempts,
-			TimeWindow:       banConfig.TimeWindow,
-			CleanupInterval:  banConfig.CleanupInterval,
-			MaxMemoryTTL:     banConfig.MaxMemoryTTL,
-		}
+		lastDbBanConfig := *banConfig
+		cm.lastDbBanConfig = &lastDbBanConfig
 		log.Printf("Loaded and cached ban configuration from database")
 	}
 
+	jailsReset := false
+	if len(dbProfiles) > 0 {
+		// Update current jails and save as last known good
+		cm.jails = jails
+		cm.lastDbJails = make([]JailConfig, len(jails))
+		copy(cm.lastDbJails, jails)
+		log.Printf("Loaded and cached %d ban profiles from database", len(dbProfiles))
+	} else if cm.lastDbJails != nil {
+		cm.jails = jails
+		cm.lastDbJails = nil
+		jailsReset = true
+		log.Printf("No ban profiles in database, using the file jails")
+	}
+
+	listsChanged := cm.setAccessLists(whitelist, blacklist)
+	if !slices.Equal(cm.honeypots, honeypots) {
+		cm.honeypots = honeypots
+		listsChanged = true
+	}
+
 	// Signal configuration update only if we actually loaded new data
-	if len(patterns) > 0 || dbBanConfig != nil {
-		select {
-		case cm.updateChan <- struct{}{}:
-		default:
-			// Channel is full, skip
+	if len(patterns) > 0 || dbBanConfig != nil || len(dbProfiles) > 0 || jailsReset || listsChanged {
+		for _, updates := range append([]chan struct{}{cm.updateChan}, cm.subscribers...) {
+			select {
+			case updates <- struct{}{}:
+			default:
+				// Channel is full, skip
+			}
 		}
 	}
 
 	return nil
 }
 
+// loadAccessLists reads the enabled whitelist and blacklist entries
+func (cm *ConfigManager) loadAccessLists() ([]string, []BlacklistEntry, error) {
+	whitelistEntries, err := cm.db.GetWhitelist()
+	if err != nil {
+		return nil, nil, err
+	}
+	blacklistEntries, err := cm.db.GetBlacklist()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	whitelist := make([]string, len(whitelistEntries))
+	for i, entry := range whitelistEntries {
+		whitelist[i] = entry.IPAddress
+	}
+	blacklist := make([]BlacklistEntry, len(blacklistEntries))
+	for i, entry := range blacklistEntries {
+		blacklist[i].Address = entry.IPAddress
+		if entry.ExpiresAt != nil {
+			blacklist[i].ExpiresAt = *entry.ExpiresAt
+		}
+	}
+	return whitelist, blacklist, nil
+}
+
+// loadHoneypotUsernames reads the enabled honeypot usernames
+func (cm *ConfigManager) loadHoneypotUsernames() ([]string, error) {
+	entries, err := cm.db.GetHoneypotUsernames()
+	if err != nil {
+		return nil, err
+	}
+
+	honeypots := make([]string, len(entries))
+	for i, entry := range entries {
+		honeypots[i] = entry.Username
+	}
+	return honeypots, nil
+}
+
+// ReloadHoneypotUsernames reloads only the honeypot usernames from the
+// database, for changes that must be enforced without waiting for the next
+// reload
+func (cm *ConfigManager) ReloadHoneypotUsernames() error {
+	if cm.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	honeypots, err := cm.loadHoneypotUsernames()
+	if err != nil {
+		return fmt.Errorf("failed to load honeypot usernames: %w", err)
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.honeypots = honeypots
+	return nil
+}
+
+// setAccessLists stores the database access lists and reports whether they
+// changed. Caller must hold the lock.
+func (cm *ConfigManager) setAccessLists(whitelist []string, blacklist []BlacklistEntry) bool {
+	changed := !slices.Equal(cm.whitelist, whitelist) || !slices.Equal(cm.blacklist, blacklist)
+	cm.whitelist = whitelist
+	cm.blacklist = blacklist
+	return changed
+}
+
+// ReloadAccessLists reloads only the whitelist and blacklist from the
+// database, for changes that must be enforced without waiting for the
+// next reload
+func (cm *ConfigManager) ReloadAccessLists() error {
+	if cm.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	whitelist, blacklist, err := cm.loadAccessLists()
+	if err != nil {
+		return fmt.Errorf("failed to load access lists: %w", err)
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.setAccessLists(whitelist, blacklist)
+	return nil
+}
+
+// AddToBlacklist adds an entry to the database blacklist until expiresAt,
+// or for good if it is zero, and reloads the access lists so the entry is
+// kept by the next synchronization
+func (cm *ConfigManager) AddToBlacklist(ipAddress, reason, createdBy string, expiresAt time.Time) error {
+	if cm.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	if err := cm.db.AddToBlacklist(ipAddress, reason, createdBy, expiresAt); err != nil {
+		return err
+	}
+	return cm.ReloadAccessLists()
+}
+
 // startReloadRoutine starts the configuration reload routine
 func (cm *ConfigManager) startReloadRoutine() {
-	cm.reloadTicker = time.NewTicker(cm.config.Database.RefreshInterval)
+	cm.reloadTicker = cm.clock.NewTicker(cm.config.Database.RefreshInterval)
 
 	go func() {
 		defer cm.reloadTicker.Stop()
@@ -252,7 +546,7 @@ func (cm *ConfigManager) startReloadRoutine() {
 			select {
 			case <-cm.ctx.Done():
 				return
-			case <-cm.reloadTicker.C:
+			case <-cm.reloadTicker.C():
 				if err := cm.reloadConfiguration(); err != nil {
 					log.Printf("Warning: failed to reload configuration: %v", err)
 				}
@@ -276,7 +570,7 @@ func (cm *ConfigManager) reloadConfiguration() error {
 	for attempt := 0; attempt <= maxRetries; attempt++ {
 		if attempt > 0 {
 			log.Printf("Retrying configuration reload (attempt %d/%d)", attempt, maxRetries)
-			time.Sleep(retryDelay)
+			cm.clock.Sleep(retryDelay)
 		}
 
 		if err := cm.loadFromDatabase(); err != nil {
@@ -385,6 +679,28 @@ type ConfigurationSource struct {
 	DatabaseConnected bool   `json:"database_connected"`
 }
 
+// validateReload validates the configuration a database reload would
+// apply: the given patterns and ban config, or the current ones where nil,
+// and the given jails
+func (cm *ConfigManager) validateReload(patterns []PatternConfig, banConfig *BanConfig, jails []JailConfig) error {
+	cm.mu.RLock()
+	candidate := &ConfigManager{
+		config:    cm.config,
+		patterns:  cm.patterns,
+		banConfig: cm.banConfig,
+		jails:     jails,
+	}
+	cm.mu.RUnlock()
+
+	if patterns != nil {
+		candidate.patterns = patterns
+	}
+	if banConfig != nil {
+		candidate.banConfig = banConfig
+	}
+	return candidate.ValidateConfiguration()
+}
+
 // ValidateConfiguration validates the current configuration
 func (cm *ConfigManager) ValidateConfiguration() error {
 	patterns := cm.GetPatterns()
@@ -392,6 +708,29 @@ func (cm *ConfigManager) ValidateConfiguration() error {
 		return fmt.Errorf("no patterns configured")
 	}
 
+	jails := cm.GetJails()
+	jailNames := make(map[string]bool, len(jails))
+	for i, jail := range jails {
+		if jail.Name == "" {
+			return fmt.Errorf("jail %d has empty name", i)
+		}
+		if jailNames[jail.Name] {
+			return fmt.Errorf("duplicate jail: %s", jail.Name)
+		}
+		if jail.InitialBanTime < 0 || jail.MaxBanTime < 0 || jail.MaxAttempts < 0 || jail.TimeWindow < 0 || jail.GlobalAfter < 0 {
+			return fmt.Errorf("jail %s has negative settings", jail.Name)
+		}
+		if jail.EscalationFactor != 0 && jail.EscalationFactor <= 1.0 {
+			return fmt.Errorf("jail %s escalation factor must be greater than 1.0", jail.Name)
+		}
+		if jail.DurationStrategy != "" || len(jail.BanSteps) > 0 {
+			if err := validateDurationStrategy(cm.GetBanConfig().WithJail(jail)); err != nil {
+				return fmt.Errorf("jail %s: %w", jail.Name, err)
+			}
+		}
+		jailNames[jail.Name] = true
+	}
+
 	// Validate each pattern
 	for i, pattern := range patterns {
 		if pattern.Name == "" {
@@ -403,6 +742,12 @@ func (cm *ConfigManager) ValidateConfiguration() error {
 		if pattern.IPGroup < 1 {
 			return fmt.Errorf("pattern %s has invalid IP group: %d", pattern.Name, pattern.IPGroup)
 		}
+		if pattern.Jail != "" && !jailNames[pattern.Jail] {
+			return fmt.Errorf("pattern %s refers to unknown jail: %s", pattern.Name, pattern.Jail)
+		}
+		if pattern.UsernameGroup < 0 {
+			return fmt.Errorf("pattern %s has invalid username group: %d", pattern.Name, pattern.UsernameGroup)
+		}
 	}
 
 	banConfig := cm.GetBanConfig()
@@ -421,6 +766,191 @@ func (cm *ConfigManager) ValidateConfiguration() error {
 	if banConfig.TimeWindow <= 0 {
 		return fmt.Errorf("time window must be positive")
 	}
+	if err := validateDurationStrategy(banConfig); err != nil {
+		return err
+	}
+
+	if banConfig.MaxTrackedIPs < 0 {
+		return fmt.Errorf("max tracked IPs must not be negative")
+	}
+	if banConfig.MaxViolationsPerIP < 0 {
+		return fmt.Errorf("max violations per IP must not be negative")
+	}
+
+	switch banConfig.Mode {
+	case "", BanModeCount:
+	case BanModeScore:
+		if banConfig.ScoreThreshold <= 0 {
+			return fmt.Errorf("score threshold must be positive")
+		}
+		if banConfig.ScoreHalfLife <= 0 {
+			return fmt.Errorf("score half-life must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown ban mode: %s", banConfig.Mode)
+	}
+
+	if banConfig.IPv4AggregationPrefix < 1 || banConfig.IPv4AggregationPrefix > 32 {
+		return fmt.Errorf("IPv4 aggregation prefix must be between 1 and 32")
+	}
+	if banConfig.IPv6AggregationPrefix < 1 || banConfig.IPv6AggregationPrefix > 128 {
+		return fmt.Errorf("IPv6 aggregation prefix must be between 1 and 128")
+	}
+
+	if subnet := banConfig.SubnetEscalation; subnet.Enabled {
+		if subnet.Threshold < 2 {
+			return fmt.Errorf("subnet escalation threshold must be at least 2")
+		}
+		if subnet.TimeWindow <= 0 {
+			return fmt.Errorf("subnet escalation time window must be positive")
+		}
+		if subnet.IPv4PrefixLength < 1 || subnet.IPv4PrefixLength > 31 {
+			return fmt.Errorf("subnet escalation IPv4 prefix length must be between 1 and 31")
+		}
+		if subnet.IPv6PrefixLength < 1 || subnet.IPv6PrefixLength > 127 {
+			return fmt.Errorf("subnet escalation IPv6 prefix length must be between 1 and 127")
+		}
+		if subnet.InitialBanTime <= 0 || subnet.MaxBanTime <= 0 {
+			return fmt.Errorf("subnet escalation ban times must be positive")
+		}
+	}
+
+	for _, entry := range banConfig.Whitelist {
+		if !isAddressOrPrefix(entry) {
+			return fmt.Errorf("invalid whitelist entry: %s", entry)
+		}
+	}
+	for _, entry := range banConfig.Blacklist {
+		if !isAddressOrPrefix(entry) {
+			return fmt.Errorf("invalid blacklist entry: %s", entry)
+		}
+	}
+	if banConfig.Forgiveness.CleanInterval < 0 || banConfig.Forgiveness.HistoryRetention < 0 {
+		return fmt.Errorf("forgiveness settings must not be negative")
+	}
+	if banConfig.Success.ForgiveViolations < 0 || banConfig.Success.TrustDuration < 0 {
+		return fmt.Errorf("success settings must not be negative")
+	}
+	if banConfig.Success.ToleranceFactor != 0 && banConfig.Success.ToleranceFactor < 1.0 {
+		return fmt.Errorf("success tolerance factor must be at least 1.0")
+	}
+	for i, pattern := range cm.GetConfig().Syslog.SuccessPatterns {
+		if pattern.Name == "" {
+			return fmt.Errorf("success pattern %d has empty name", i)
+		}
+		if pattern.Regex == "" {
+			return fmt.Errorf("success pattern %s has empty regex", pattern.Name)
+		}
+		if pattern.IPGroup < 1 {
+			return fmt.Errorf("success pattern %s has invalid IP group: %d", pattern.Name, pattern.IPGroup)
+		}
+		if pattern.Jail != "" && !jailNames[pattern.Jail] {
+			return fmt.Errorf("success pattern %s refers to unknown jail: %s", pattern.Name, pattern.Jail)
+		}
+	}
+	for i, username := range banConfig.HoneypotUsernames {
+		if strings.TrimSpace(username) == "" {
+			return fmt.Errorf("honeypot username %d is empty", i)
+		}
+	}
+
+	if accounts := cm.GetConfig().Accounts; accounts.Enabled {
+		if accounts.MaxAttempts <= 0 || accounts.TimeWindow <= 0 {
+			return fmt.Errorf("account max attempts and time window must be positive")
+		}
+		if accounts.MinDistinctIPs < 0 || accounts.MinDistinctIPs > accounts.MaxAttempts {
+			return fmt.Errorf("account min distinct IPs must be between 0 and max attempts")
+		}
+		if accounts.MarkDuration < 0 {
+			return fmt.Errorf("account mark duration must not be negative")
+		}
+		if accounts.Action == AccountActionMark && accounts.MarkDuration == 0 {
+			return fmt.Errorf("account mark duration must be positive with the mark action")
+		}
+		switch accounts.Action {
+		case AccountActionMark, AccountActionBan:
+		default:
+			return fmt.Errorf("unknown account action: %s", accounts.Action)
+		}
+	}
+
+	if recidive := cm.GetConfig().Recidive; recidive.Enabled {
+		if recidive.MaxBans < 2 {
+			return fmt.Errorf("recidive max bans must be at least 2")
+		}
+		if recidive.LookbackWindow <= 0 {
+			return fmt.Errorf("recidive lookback window must be positive")
+		}
+		if recidive.BlacklistDuration < 0 {
+			return fmt.Errorf("recidive blacklist duration must not be negative")
+		}
+	}
+
+	if shadow := cm.GetConfig().Shadow; shadow.Enabled {
+		shadowBan := shadow.Ban
+		if shadowBan.InitialBanTime < 0 || shadowBan.MaxBanTime < 0 || shadowBan.MaxAttempts < 0 ||
+			shadowBan.TimeWindow < 0 || shadowBan.ScoreThreshold < 0 || shadowBan.ScoreHalfLife < 0 ||
+			shadow.Retention < 0 {
+			return fmt.Errorf("shadow policy has negative settings")
+		}
+		if shadowBan.EscalationFactor != 0 && shadowBan.EscalationFactor <= 1.0 {
+			return fmt.Errorf("shadow escalation factor must be greater than 1.0")
+		}
+
+		effective := banConfig.WithShadow(shadowBan)
+		switch effective.Mode {
+		case "", BanModeCount:
+		case BanModeScore:
+			if effective.ScoreThreshold <= 0 || effective.ScoreHalfLife <= 0 {
+				return fmt.Errorf("shadow score threshold and half-life must be positive")
+			}
+		default:
+			return fmt.Errorf("unknown shadow ban mode: %s", effective.Mode)
+		}
+		if err := validateDurationStrategy(effective); err != nil {
+			return fmt.Errorf("shadow policy: %w", err)
+		}
+
+		for i, pattern := range shadow.Patterns {
+			if pattern.Name == "" {
+				return fmt.Errorf("shadow pattern %d has empty name", i)
+			}
+			if pattern.Regex == "" {
+				return fmt.Errorf("shadow pattern %s has empty regex", pattern.Name)
+			}
+			if pattern.IPGroup < 1 {
+				return fmt.Errorf("shadow pattern %s has invalid IP group: %d", pattern.Name, pattern.IPGroup)
+			}
+		}
+	}
 
 	return nil
 }
+
+// validateDurationStrategy checks the ban duration strategy of a policy
+func validateDurationStrategy(policy BanConfig) error {
+	switch policy.DurationStrategy {
+	case "", DurationStrategyLinear, DurationStrategyExponential, DurationStrategyFibonacci:
+	case DurationStrategySteps:
+		if len(policy.BanSteps) == 0 {
+			return fmt.Errorf("steps duration strategy requires ban steps")
+		}
+	default:
+		return fmt.Errorf("unknown duration strategy: %s", policy.DurationStrategy)
+	}
+	for _, step := range policy.BanSteps {
+		if step <= 0 {
+			return fmt.Errorf("ban steps must be positive")
+		}
+	}
+	return nil
+}
+
+// isAddressOrPrefix reports whether value is an IP address or CIDR prefix
+func isAddressOrPrefix(value string) bool {
+	if strings.Contains(value, "/") {
+		_, _, err := net.ParseCIDR(value)
+		return err == nil
+	}
+	return net.ParseIP(value) != nil
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/clock"
+)
+
+// getDatabaseTestConfig returns a valid configuration with a new SQLite
+// database, which provides the default patterns
+func getDatabaseTestConfig(t *testing.T) *Config {
+	return &Config{
+		Database: DatabaseConfig{Enabled: true, Driver: "sqlite3", DSN: filepath.Join(t.TempDir(), "config.db")},
+		Ban: BanConfig{
+			InitialBanTime:        time.Hour,
+			MaxBanTime:            24 * time.Hour,
+			EscalationFactor:      2.0,
+			MaxAttempts:           3,
+			TimeWindow:            10 * time.Minute,
+			IPv4AggregationPrefix: 32,
+			IPv6AggregationPrefix: 128,
+		},
+	}
+}
+
+func TestConfigManagerReloadsOnItsClock(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+
+	cfg := getDatabaseTestConfig(t)
+	cfg.Database.RefreshInterval = time.Hour
+	cm, err := NewConfigManagerWithClock(cfg, fake)
+	if err != nil {
+		t.Fatalf("Failed to create config manager: %v", err)
+	}
+	defer cm.Stop()
+
+	if status := cm.GetDatabaseStatus(); !status.LastSuccessfulLoad.Equal(start) {
+		t.Fatalf("Expected the initial load at %v, got %v", start, status.LastSuccessfulLoad)
+	}
+
+	// Nothing is reloaded before the refresh interval has passed
+	fake.BlockUntil(1)
+	fake.Advance(59 * time.Minute)
+	if status := cm.GetDatabaseStatus(); !status.LastSuccessfulLoad.Equal(start) {
+		t.Errorf("Expected no reload yet, got a load at %v", status.LastSuccessfulLoad)
+	}
+
+	fake.Advance(time.Minute)
+	want := start.Add(time.Hour)
+	for i := 0; !cm.GetDatabaseStatus().LastSuccessfulLoad.Equal(want); i++ {
+		if i == 100 {
+			t.Fatalf("Expected a reload at %v, got %v", want, cm.GetDatabaseStatus().LastSuccessfulLoad)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConfigManagerDropsDisabledProfiles(t *testing.T) {
+	cfg := getDatabaseTestConfig(t)
+	cfg.Jails = []JailConfig{{Name: "ssh", MaxAttempts: 3}}
+	cm, err := NewConfigManager(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create config manager: %v", err)
+	}
+	defer cm.Stop()
+
+	conn, err := sql.Open("sqlite3", cfg.Database.DSN)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer conn.Close()
+	exec := func(statement string) {
+		t.Helper()
+		if _, err := conn.Exec(statement); err != nil {
+			t.Fatalf("Failed to run %q: %v", statement, err)
+		}
+	}
+	reload := func() {
+		t.Helper()
+		select {
+		case <-cm.UpdateChan():
+		default:
+		}
+		if err := cm.loadFromDatabase(); err != nil {
+			t.Fatalf("Failed to reload: %v", err)
+		}
+	}
+
+	exec(`INSERT INTO ban_config (name, initial_ban_time_seconds, max_ban_time_seconds, escalation_factor,
+		max_attempts, time_window_seconds, cleanup_interval_seconds, max_memory_ttl_seconds)
+		VALUES ('dovecot', 3600, 86400, 2.0, 2, 600, 60, 259200)`)
+	reload()
+	if jails := cm.GetJails(); len(jails) != 2 || jails[1].Name != "dovecot" {
+		t.Fatalf("Expected the file jail and the database profile, got %+v", jails)
+	}
+
+	exec(`UPDATE ban_config SET enabled = FALSE WHERE name = 'dovecot'`)
+	reload()
+	if jails := cm.GetJails(); len(jails) != 1 || jails[0].Name != "ssh" {
+		t.Errorf("Expected only the file jail once the last profile is disabled, got %+v", jails)
+	}
+	select {
+	case <-cm.UpdateChan():
+	default:
+		t.Error("Expected dropping the profiles to signal an update")
+	}
+}
+
+func TestConfigManagerBlacklistEntriesKeepExpiry(t *testing.T) {
+	cfg := getDatabaseTestConfig(t)
+	cfg.Ban.Blacklist = []string{"10.0.0.0/8"}
+	cm, err := NewConfigManager(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create config manager: %v", err)
+	}
+	defer cm.Stop()
+
+	expiresAt := time.Now().Add(time.Hour)
+	if err := cm.AddToBlacklist("192.0.2.1", "auto-recidive", "system", expiresAt); err != nil {
+		t.Fatalf("Failed to blacklist: %v", err)
+	}
+
+	entries := cm.GetBlacklistEntries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected the file and the database entry, got %+v", entries)
+	}
+	if entries[0].Address != "10.0.0.0/8" || !entries[0].ExpiresAt.IsZero() {
+		t.Errorf("Expected the file entry without expiry, got %+v", entries[0])
+	}
+	if entries[1].Address != "192.0.2.1" || entries[1].ExpiresAt.Unix() != expiresAt.Unix() {
+		t.Errorf("Expected the database entry to expire at %v, got %+v", expiresAt, entries[1])
+	}
+	if blacklist := cm.GetBlacklist(); len(blacklist) != 2 || blacklist[1] != "192.0.2.1" {
+		t.Errorf("Expected GetBlacklist to list both addresses, got %v", blacklist)
+	}
+}
+
+func TestConfigManagerRejectsInvalidReload(t *testing.T) {
+	cfg := getDatabaseTestConfig(t)
+	cm, err := NewConfigManager(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create config manager: %v", err)
+	}
+	defer cm.Stop()
+
+	previous := cm.GetBanConfig()
+	conn, err := sql.Open("sqlite3", cfg.Database.DSN)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec(`UPDATE ban_config SET escalation_factor = 1.0, initial_ban_time_seconds = 60`); err != nil {
+		t.Fatalf("Failed to update the ban config: %v", err)
+	}
+
+	if err := cm.loadFromDatabase(); err == nil {
+		t.Fatal("Expected the invalid database configuration to be rejected")
+	}
+	if banConfig := cm.GetBanConfig(); banConfig.InitialBanTime != previous.InitialBanTime || banConfig.EscalationFactor != previous.EscalationFactor {
+		t.Errorf("Expected the previous ban config to be kept, got %+v", banConfig)
+	}
+	if err := cm.ValidateConfiguration(); err != nil {
+		t.Errorf("Expected the kept configuration to validate, got %v", err)
+	}
+}
+
+func TestValidateConfigurationRequiresMarkDuration(t *testing.T) {
+	cfg := getDatabaseTestConfig(t)
+	cfg.Database.Enabled = false
+	cfg.Syslog.Patterns = []PatternConfig{{Name: "auth", Regex: `from ([0-9.]+)`, IPGroup: 1}}
+	cfg.Accounts = AccountConfig{Enabled: true, MaxAttempts: 10, TimeWindow: time.Hour, Action: AccountActionMark}
+	cm, err := NewConfigManager(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create config manager: %v", err)
+	}
+	defer cm.Stop()
+
+	if err := cm.ValidateConfiguration(); err == nil {
+		t.Error("Expected the mark action without a mark duration to be rejected")
+	}
+
+	cfg.Accounts.MarkDuration = time.Hour
+	if err := cm.ValidateConfiguration(); err != nil {
+		t.Errorf("Expected a positive mark duration to validate, got %v", err)
+	}
+
+	cfg.Accounts.Action = AccountActionBan
+	cfg.Accounts.MarkDuration = 0
+	if err := cm.ValidateConfiguration(); err != nil {
+		t.Errorf("Expected the ban action to not need a mark duration, got %v", err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,8 +16,10 @@ const (
 			name VARCHAR(255) NOT NULL UNIQUE,
 			regex TEXT NOT NULL,
 			ip_group INTEGER NOT NULL DEFAULT 1,
+			username_group INTEGER NOT NULL DEFAULT 0,
 			severity INTEGER NOT NULL DEFAULT 1,
 			description TEXT,
+			ban_config_id INTEGER REFERENCES ban_config(id) ON DELETE SET NULL,
 			enabled BOOLEAN NOT NULL DEFAULT TRUE,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
@@ -32,6 +36,8 @@ const (
 			time_window_seconds INTEGER NOT NULL,
 			cleanup_interval_seconds INTEGER NOT NULL,
 			max_memory_ttl_seconds INTEGER NOT NULL,
+			duration_strategy VARCHAR(32) NOT NULL DEFAULT 'linear',
+			ban_steps_seconds TEXT,
 			enabled BOOLEAN NOT NULL DEFAULT TRUE,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
@@ -44,7 +50,8 @@ const (
 			reason TEXT,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			created_by VARCHAR(255) DEFAULT 'system',
-			enabled BOOLEAN NOT NULL DEFAULT TRUE
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			expires_at_unix INTEGER NOT NULL DEFAULT 0
 		);`
 
 	createWhitelistTable = `
@@ -57,17 +64,108 @@ const (
 			enabled BOOLEAN NOT NULL DEFAULT TRUE
 		);`
 
+	createHoneypotTable = `
+		CREATE TABLE IF NOT EXISTS honeypot_usernames (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username VARCHAR(255) NOT NULL UNIQUE,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			created_by VARCHAR(255) DEFAULT 'system',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE
+		);`
+
+	createBanStateTable = `
+		CREATE TABLE IF NOT EXISTS ban_state (
+			ip_address VARCHAR(64) NOT NULL PRIMARY KEY,
+			ban_expiry_unix INTEGER NOT NULL DEFAULT 0,
+			ban_count INTEGER NOT NULL DEFAULT 0,
+			first_seen_unix INTEGER NOT NULL,
+			last_seen_unix INTEGER NOT NULL,
+			violations TEXT,
+			jails TEXT,
+			provenance TEXT,
+			recent_bans TEXT,
+			clean_since_unix INTEGER NOT NULL DEFAULT 0,
+			last_success_unix INTEGER NOT NULL DEFAULT 0,
+			score DOUBLE PRECISION NOT NULL DEFAULT 0,
+			score_updated_unix INTEGER NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`
+
+	createBanHistoryTable = `
+		CREATE TABLE IF NOT EXISTS ban_history (
+			ip_address VARCHAR(64) NOT NULL PRIMARY KEY,
+			ban_count INTEGER NOT NULL DEFAULT 0,
+			jails TEXT,
+			last_seen_unix INTEGER NOT NULL,
+			clean_since_unix INTEGER NOT NULL,
+			recent_bans TEXT,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`
+
 	createIndexes = `
 		CREATE INDEX IF NOT EXISTS idx_patterns_enabled ON patterns(enabled);
 		CREATE INDEX IF NOT EXISTS idx_ban_config_enabled ON ban_config(enabled);
 		CREATE INDEX IF NOT EXISTS idx_patterns_name ON patterns(name);
+		CREATE INDEX IF NOT EXISTS idx_patterns_ban_config ON patterns(ban_config_id);
 		CREATE INDEX IF NOT EXISTS idx_ban_config_name ON ban_config(name);
 		CREATE INDEX IF NOT EXISTS idx_blacklist_ip ON blacklist(ip_address);
 		CREATE INDEX IF NOT EXISTS idx_blacklist_enabled ON blacklist(enabled);
 		CREATE INDEX IF NOT EXISTS idx_whitelist_ip ON whitelist(ip_address);
-		CREATE INDEX IF NOT EXISTS idx_whitelist_enabled ON whitelist(enabled);`
+		CREATE INDEX IF NOT EXISTS idx_whitelist_enabled ON whitelist(enabled);
+		CREATE INDEX IF NOT EXISTS idx_honeypot_usernames_enabled ON honeypot_usernames(enabled);`
+)
+
+// Columns added after the initial schema, applied to existing databases
+const (
+	addPatternsBanConfigColumn = `
+		ALTER TABLE patterns ADD COLUMN ban_config_id INTEGER REFERENCES ban_config(id) ON DELETE SET NULL`
+
+	addPatternsBanConfigColumnMySQL = `
+		ALTER TABLE patterns ADD COLUMN ban_config_id INT NULL,
+			ADD FOREIGN KEY (ban_config_id) REFERENCES ban_config(id) ON DELETE SET NULL`
+
+	addBanStateJailsColumn = `
+		ALTER TABLE ban_state ADD COLUMN jails TEXT`
+
+	addBanStateProvenanceColumn = `
+		ALTER TABLE ban_state ADD COLUMN provenance TEXT`
+
+	addPatternsUsernameGroupColumn = `
+		ALTER TABLE patterns ADD COLUMN username_group INTEGER NOT NULL DEFAULT 0`
+
+	addBanConfigDurationStrategyColumn = `
+		ALTER TABLE ban_config ADD COLUMN duration_strategy VARCHAR(32) NOT NULL DEFAULT 'linear'`
+
+	addBanConfigBanStepsColumn = `
+		ALTER TABLE ban_config ADD COLUMN ban_steps_seconds TEXT`
+
+	addBanStateRecentBansColumn = `
+		ALTER TABLE ban_state ADD COLUMN recent_bans TEXT`
+
+	addBanHistoryRecentBansColumn = `
+		ALTER TABLE ban_history ADD COLUMN recent_bans TEXT`
+
+	addBlacklistExpiresAtColumn = `
+		ALTER TABLE blacklist ADD COLUMN expires_at_unix BIGINT NOT NULL DEFAULT 0`
+
+	addBanStateCleanSinceColumn = `
+		ALTER TABLE ban_state ADD COLUMN clean_since_unix BIGINT NOT NULL DEFAULT 0`
+
+	addBanStateLastSuccessColumn = `
+		ALTER TABLE ban_state ADD COLUMN last_success_unix BIGINT NOT NULL DEFAULT 0`
+
+	addBanStateScoreColumn = `
+		ALTER TABLE ban_state ADD COLUMN score DOUBLE PRECISION NOT NULL DEFAULT 0`
+
+	addBanStateScoreUpdatedColumn = `
+		ALTER TABLE ban_state ADD COLUMN score_updated_unix BIGINT NOT NULL DEFAULT 0`
 )
 
+// DefaultBanProfile is the name of the ban_config row holding the global
+// ban policy. Every other enabled row is a jail profile.
+const DefaultBanProfile = "default"
+
 // MySQL specific schema adjustments
 const (
 	createPatternsTableMySQL = `
@@ -76,11 +174,14 @@ const (
 			name VARCHAR(255) NOT NULL UNIQUE,
 			regex TEXT NOT NULL,
 			ip_group INT NOT NULL DEFAULT 1,
+			username_group INT NOT NULL DEFAULT 0,
 			severity INT NOT NULL DEFAULT 1,
 			description TEXT,
+			ban_config_id INT NULL,
 			enabled BOOLEAN NOT NULL DEFAULT TRUE,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			FOREIGN KEY (ban_config_id) REFERENCES ban_config(id) ON DELETE SET NULL
 		);`
 
 	createBanConfigTableMySQL = `
@@ -94,6 +195,8 @@ const (
 			time_window_seconds INT NOT NULL,
 			cleanup_interval_seconds INT NOT NULL,
 			max_memory_ttl_seconds INT NOT NULL,
+			duration_strategy VARCHAR(32) NOT NULL DEFAULT 'linear',
+			ban_steps_seconds TEXT,
 			enabled BOOLEAN NOT NULL DEFAULT TRUE,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
@@ -106,7 +209,8 @@ const (
 			reason TEXT,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			created_by VARCHAR(255) DEFAULT 'system',
-			enabled BOOLEAN NOT NULL DEFAULT TRUE
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			expires_at_unix BIGINT NOT NULL DEFAULT 0
 		);`
 
 	createWhitelistTableMySQL = `
@@ -118,6 +222,45 @@ const (
 			created_by VARCHAR(255) DEFAULT 'system',
 			enabled BOOLEAN NOT NULL DEFAULT TRUE
 		);`
+
+	createHoneypotTableMySQL = `
+		CREATE TABLE IF NOT EXISTS honeypot_usernames (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			username VARCHAR(255) NOT NULL UNIQUE,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			created_by VARCHAR(255) DEFAULT 'system',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE
+		);`
+
+	createBanStateTableMySQL = `
+		CREATE TABLE IF NOT EXISTS ban_state (
+			ip_address VARCHAR(64) NOT NULL PRIMARY KEY,
+			ban_expiry_unix BIGINT NOT NULL DEFAULT 0,
+			ban_count INT NOT NULL DEFAULT 0,
+			first_seen_unix BIGINT NOT NULL,
+			last_seen_unix BIGINT NOT NULL,
+			violations TEXT,
+			jails TEXT,
+			provenance TEXT,
+			recent_bans TEXT,
+			clean_since_unix BIGINT NOT NULL DEFAULT 0,
+			last_success_unix BIGINT NOT NULL DEFAULT 0,
+			score DOUBLE PRECISION NOT NULL DEFAULT 0,
+			score_updated_unix BIGINT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		);`
+
+	createBanHistoryTableMySQL = `
+		CREATE TABLE IF NOT EXISTS ban_history (
+			ip_address VARCHAR(64) NOT NULL PRIMARY KEY,
+			ban_count INT NOT NULL DEFAULT 0,
+			jails TEXT,
+			last_seen_unix BIGINT NOT NULL,
+			clean_since_unix BIGINT NOT NULL,
+			recent_bans TEXT,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		);`
 )
 
 // PostgreSQL specific schema adjustments
@@ -128,8 +271,10 @@ const (
 			name VARCHAR(255) NOT NULL UNIQUE,
 			regex TEXT NOT NULL,
 			ip_group INTEGER NOT NULL DEFAULT 1,
+			username_group INTEGER NOT NULL DEFAULT 0,
 			severity INTEGER NOT NULL DEFAULT 1,
 			description TEXT,
+			ban_config_id INTEGER REFERENCES ban_config(id) ON DELETE SET NULL,
 			enabled BOOLEAN NOT NULL DEFAULT TRUE,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
@@ -146,6 +291,8 @@ const (
 			time_window_seconds INTEGER NOT NULL,
 			cleanup_interval_seconds INTEGER NOT NULL,
 			max_memory_ttl_seconds INTEGER NOT NULL,
+			duration_strategy VARCHAR(32) NOT NULL DEFAULT 'linear',
+			ban_steps_seconds TEXT,
 			enabled BOOLEAN NOT NULL DEFAULT TRUE,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
@@ -158,7 +305,8 @@ const (
 			reason TEXT,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			created_by VARCHAR(255) DEFAULT 'system',
-			enabled BOOLEAN NOT NULL DEFAULT TRUE
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			expires_at_unix BIGINT NOT NULL DEFAULT 0
 		);`
 
 	createWhitelistTablePostgres = `
@@ -170,6 +318,45 @@ const (
 			created_by VARCHAR(255) DEFAULT 'system',
 			enabled BOOLEAN NOT NULL DEFAULT TRUE
 		);`
+
+	createHoneypotTablePostgres = `
+		CREATE TABLE IF NOT EXISTS honeypot_usernames (
+			id SERIAL PRIMARY KEY,
+			username VARCHAR(255) NOT NULL UNIQUE,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			created_by VARCHAR(255) DEFAULT 'system',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE
+		);`
+
+	createBanStateTablePostgres = `
+		CREATE TABLE IF NOT EXISTS ban_state (
+			ip_address VARCHAR(64) NOT NULL PRIMARY KEY,
+			ban_expiry_unix BIGINT NOT NULL DEFAULT 0,
+			ban_count INTEGER NOT NULL DEFAULT 0,
+			first_seen_unix BIGINT NOT NULL,
+			last_seen_unix BIGINT NOT NULL,
+			violations TEXT,
+			jails TEXT,
+			provenance TEXT,
+			recent_bans TEXT,
+			clean_since_unix BIGINT NOT NULL DEFAULT 0,
+			last_success_unix BIGINT NOT NULL DEFAULT 0,
+			score DOUBLE PRECISION NOT NULL DEFAULT 0,
+			score_updated_unix BIGINT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`
+
+	createBanHistoryTablePostgres = `
+		CREATE TABLE IF NOT EXISTS ban_history (
+			ip_address VARCHAR(64) NOT NULL PRIMARY KEY,
+			ban_count INTEGER NOT NULL DEFAULT 0,
+			jails TEXT,
+			last_seen_unix BIGINT NOT NULL,
+			clean_since_unix BIGINT NOT NULL,
+			recent_bans TEXT,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`
 )
 
 // Pattern represents a pattern configuration from database
@@ -179,10 +366,14 @@ type Pattern struct {
 	IPGroup     int
 	Severity    int
 	Description string
+	Jail        string // Name of the referenced ban profile, empty for the default
+
+	UsernameGroup int // Regex group capturing the account name, 0 if none
 }
 
 // BanConfig represents ban configuration from database
 type BanConfig struct {
+	Name             string
 	InitialBanTime   time.Duration
 	MaxBanTime       time.Duration
 	EscalationFactor float64
@@ -190,6 +381,39 @@ type BanConfig struct {
 	TimeWindow       time.Duration
 	CleanupInterval  time.Duration
 	MaxMemoryTTL     time.Duration
+	DurationStrategy string
+	BanSteps         []time.Duration // Durations of the steps strategy
+}
+
+// BanStateEntry represents the persisted ban state of one IP or prefix
+type BanStateEntry struct {
+	IPAddress  string
+	BanExpiry  time.Time // Zero if not currently banned
+	BanCount   int
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	Violations string // JSON-encoded violation history
+	Jails      string // JSON-encoded per-jail counters, empty if none
+	Provenance string // JSON-encoded provenance of the last ban, empty if none
+	RecentBans string // JSON-encoded recent ban times, empty if none
+
+	// Forgiveness, trust and scoring state of the counter of patterns
+	// without a jail; zero times are stored as 0
+	CleanSince   time.Time
+	LastSuccess  time.Time
+	Score        float64
+	ScoreUpdated time.Time
+}
+
+// BanHistoryEntry represents the remembered ban counts of an IP or prefix
+// no longer tracked in memory
+type BanHistoryEntry struct {
+	IPAddress  string
+	BanCount   int
+	Jails      string // JSON-encoded per-jail ban counts, empty if none
+	LastSeen   time.Time
+	CleanSince time.Time
+	RecentBans string // JSON-encoded recent ban times, empty if none
 }
 
 // DatabaseConfig represents database configuration
@@ -202,8 +426,19 @@ type DatabaseConfig struct {
 	RetryDelay      time.Duration
 }
 
-// BlacklistEntry represents a permanently banned IP
+// BlacklistEntry represents a blacklisted IP or prefix
 type BlacklistEntry struct {
+	ID        int        `json:"id"`
+	IPAddress string     `json:"ip_address"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	CreatedBy string     `json:"created_by"`
+	Enabled   bool       `json:"enabled"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Nil if the entry never expires
+}
+
+// WhitelistEntry represents a permanently allowed IP
+type WhitelistEntry struct {
 	ID        int       `json:"id"`
 	IPAddress string    `json:"ip_address"`
 	Reason    string    `json:"reason,omitempty"`
@@ -212,10 +447,10 @@ type BlacklistEntry struct {
 	Enabled   bool      `json:"enabled"`
 }
 
-// WhitelistEntry represents a permanently allowed IP
-type WhitelistEntry struct {
+// HoneypotEntry represents a decoy username
+type HoneypotEntry struct {
 	ID        int       `json:"id"`
-	IPAddress string    `json:"ip_address"`
+	Username  string    `json:"username"`
 	Reason    string    `json:"reason,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 	CreatedBy string    `json:"created_by"`
@@ -250,7 +485,7 @@ func NewDB(dbConfig DatabaseConfig) (*DB, error) {
 }
 
 func (db *DB) InitSchema() error {
-	var patternsSQL, banConfigSQL, blacklistSQL, whitelistSQL string
+	var patternsSQL, banConfigSQL, blacklistSQL, whitelistSQL, honeypotSQL, banStateSQL, banHistorySQL, patternsBanConfigSQL string
 
 	switch db.driver {
 	case "mysql":
@@ -258,27 +493,39 @@ func (db *DB) InitSchema() error {
 		banConfigSQL = createBanConfigTableMySQL
 		blacklistSQL = createBlacklistTableMySQL
 		whitelistSQL = createWhitelistTableMySQL
+		honeypotSQL = createHoneypotTableMySQL
+		banStateSQL = createBanStateTableMySQL
+		banHistorySQL = createBanHistoryTableMySQL
+		patternsBanConfigSQL = addPatternsBanConfigColumnMySQL
 	case "postgres":
 		patternsSQL = createPatternsTablePostgres
 		banConfigSQL = createBanConfigTablePostgres
 		blacklistSQL = createBlacklistTablePostgres
 		whitelistSQL = createWhitelistTablePostgres
+		honeypotSQL = createHoneypotTablePostgres
+		banStateSQL = createBanStateTablePostgres
+		banHistorySQL = createBanHistoryTablePostgres
+		patternsBanConfigSQL = addPatternsBanConfigColumn
 	default: // sqlite3
 		patternsSQL = createPatternsTable
 		banConfigSQL = createBanConfigTable
 		blacklistSQL = createBlacklistTable
 		whitelistSQL = createWhitelistTable
+		honeypotSQL = createHoneypotTable
+		banStateSQL = createBanStateTable
+		banHistorySQL = createBanHistoryTable
+		patternsBanConfigSQL = addPatternsBanConfigColumn
 	}
 
-	// Create tables
-	if _, err := db.conn.Exec(patternsSQL); err != nil {
-		return fmt.Errorf("failed to create patterns table: %w", err)
-	}
-
+	// Create tables; ban_config comes first as patterns references it
 	if _, err := db.conn.Exec(banConfigSQL); err != nil {
 		return fmt.Errorf("failed to create ban_config table: %w", err)
 	}
 
+	if _, err := db.conn.Exec(patternsSQL); err != nil {
+		return fmt.Errorf("failed to create patterns table: %w", err)
+	}
+
 	if _, err := db.conn.Exec(blacklistSQL); err != nil {
 		return fmt.Errorf("failed to create blacklist table: %w", err)
 	}
@@ -287,6 +534,71 @@ func (db *DB) InitSchema() error {
 		return fmt.Errorf("failed to create whitelist table: %w", err)
 	}
 
+	if _, err := db.conn.Exec(honeypotSQL); err != nil {
+		return fmt.Errorf("failed to create honeypot_usernames table: %w", err)
+	}
+
+	if _, err := db.conn.Exec(banStateSQL); err != nil {
+		return fmt.Errorf("failed to create ban_state table: %w", err)
+	}
+
+	if _, err := db.conn.Exec(banHistorySQL); err != nil {
+		return fmt.Errorf("failed to create ban_history table: %w", err)
+	}
+
+	// Upgrade tables created by earlier versions
+	if err := db.ensureColumn("patterns", "ban_config_id", patternsBanConfigSQL); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("patterns", "username_group", addPatternsUsernameGroupColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_config", "duration_strategy", addBanConfigDurationStrategyColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_config", "ban_steps_seconds", addBanConfigBanStepsColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("blacklist", "expires_at_unix", addBlacklistExpiresAtColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_state", "jails", addBanStateJailsColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_state", "provenance", addBanStateProvenanceColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_state", "recent_bans", addBanStateRecentBansColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_state", "clean_since_unix", addBanStateCleanSinceColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_state", "last_success_unix", addBanStateLastSuccessColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_state", "score", addBanStateScoreColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_state", "score_updated_unix", addBanStateScoreUpdatedColumn); err != nil {
+		return err
+	}
+
+	if err := db.ensureColumn("ban_history", "recent_bans", addBanHistoryRecentBansColumn); err != nil {
+		return err
+	}
+
 	// Create indexes
 	if _, err := db.conn.Exec(createIndexes); err != nil {
 		log.Printf("Warning: failed to create indexes: %v", err)
@@ -295,12 +607,28 @@ func (db *DB) InitSchema() error {
 	return nil
 }
 
+// ensureColumn runs the given ALTER TABLE statement if the column is missing
+func (db *DB) ensureColumn(table, column, alterSQL string) error {
+	rows, err := db.conn.Query(fmt.Sprintf("SELECT %s FROM %s WHERE 1 = 0", column, table))
+	if err == nil {
+		rows.Close()
+		return nil
+	}
+
+	if _, err := db.conn.Exec(alterSQL); err != nil {
+		return fmt.Errorf("failed to add %s column to %s table: %w", column, table, err)
+	}
+
+	return nil
+}
+
 func (db *DB) GetPatterns() ([]Pattern, error) {
 	rows, err := db.conn.Query(`
-		SELECT name, regex, ip_group, severity, description
-		FROM patterns
-		WHERE enabled = TRUE
-		ORDER BY name`)
+		SELECT p.name, p.regex, p.ip_group, p.username_group, p.severity, p.description, b.name
+		FROM patterns p
+		LEFT JOIN ban_config b ON b.id = p.ban_config_id AND b.enabled = TRUE
+		WHERE p.enabled = TRUE
+		ORDER BY p.name`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query patterns: %w", err)
 	}
@@ -309,9 +637,9 @@ func (db *DB) GetPatterns() ([]Pattern, error) {
 	var patterns []Pattern
 	for rows.Next() {
 		var p Pattern
-		var description sql.NullString
+		var description, jail sql.NullString
 
-		err := rows.Scan(&p.Name, &p.Regex, &p.IPGroup, &p.Severity, &description)
+		err := rows.Scan(&p.Name, &p.Regex, &p.IPGroup, &p.UsernameGroup, &p.Severity, &description, &jail)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan pattern: %w", err)
 		}
@@ -319,6 +647,9 @@ func (db *DB) GetPatterns() ([]Pattern, error) {
 		if description.Valid {
 			p.Description = description.String
 		}
+		if jail.Valid && jail.String != DefaultBanProfile {
+			p.Jail = jail.String
+		}
 
 		patterns = append(patterns, p)
 	}
@@ -326,19 +657,64 @@ func (db *DB) GetPatterns() ([]Pattern, error) {
 	return patterns, nil
 }
 
+// GetBanConfig returns the global ban policy: the default profile, or the
+// most recently created enabled profile if there is no default
 func (db *DB) GetBanConfig() (*BanConfig, error) {
 	row := db.conn.QueryRow(`
-		SELECT initial_ban_time_seconds, max_ban_time_seconds, escalation_factor,
-		       max_attempts, time_window_seconds, cleanup_interval_seconds, max_memory_ttl_seconds
+		SELECT name, initial_ban_time_seconds, max_ban_time_seconds, escalation_factor,
+		       max_attempts, time_window_seconds, cleanup_interval_seconds, max_memory_ttl_seconds,
+		       duration_strategy, ban_steps_seconds
 		FROM ban_config
 		WHERE enabled = TRUE
-		ORDER BY created_at DESC
-		LIMIT 1`)
+		ORDER BY CASE WHEN name = ? THEN 0 ELSE 1 END, created_at DESC
+		LIMIT 1`, DefaultBanProfile)
+
+	banConfig, err := scanBanConfig(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // No config found, will use file fallback
+		}
+		return nil, fmt.Errorf("failed to scan ban config: %w", err)
+	}
+
+	return banConfig, nil
+}
+
+// GetBanProfiles returns the enabled ban profiles other than the default.
+// Each profile is a jail that patterns can reference.
+func (db *DB) GetBanProfiles() ([]BanConfig, error) {
+	rows, err := db.conn.Query(`
+		SELECT name, initial_ban_time_seconds, max_ban_time_seconds, escalation_factor,
+		       max_attempts, time_window_seconds, cleanup_interval_seconds, max_memory_ttl_seconds,
+		       duration_strategy, ban_steps_seconds
+		FROM ban_config
+		WHERE enabled = TRUE AND name <> ?
+		ORDER BY name`, DefaultBanProfile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ban profiles: %w", err)
+	}
+	defer rows.Close()
+
+	var profiles []BanConfig
+	for rows.Next() {
+		profile, err := scanBanConfig(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan ban profile: %w", err)
+		}
+		profiles = append(profiles, *profile)
+	}
+
+	return profiles, nil
+}
 
+// scanBanConfig reads a ban_config row selected by GetBanConfig or GetBanProfiles
+func scanBanConfig(row interface{ Scan(...any) error }) (*BanConfig, error) {
 	var banConfig BanConfig
 	var initialBanSeconds, maxBanSeconds, timeWindowSeconds, cleanupIntervalSeconds, maxMemoryTTLSeconds int
+	var banSteps sql.NullString
 
 	err := row.Scan(
+		&banConfig.Name,
 		&initialBanSeconds,
 		&maxBanSeconds,
 		&banConfig.EscalationFactor,
@@ -346,13 +722,11 @@ func (db *DB) GetBanConfig() (*BanConfig, error) {
 		&timeWindowSeconds,
 		&cleanupIntervalSeconds,
 		&maxMemoryTTLSeconds,
+		&banConfig.DurationStrategy,
+		&banSteps,
 	)
-
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil // No config found, will use file fallback
-		}
-		return nil, fmt.Errorf("failed to scan ban config: %w", err)
+		return nil, err
 	}
 
 	// Convert seconds to time.Duration
@@ -362,9 +736,34 @@ func (db *DB) GetBanConfig() (*BanConfig, error) {
 	banConfig.CleanupInterval = time.Duration(cleanupIntervalSeconds) * time.Second
 	banConfig.MaxMemoryTTL = time.Duration(maxMemoryTTLSeconds) * time.Second
 
+	if banSteps.Valid {
+		banConfig.BanSteps, err = parseBanSteps(banSteps.String)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ban steps of %s: %w", banConfig.Name, err)
+		}
+	}
+
 	return &banConfig, nil
 }
 
+// parseBanSteps parses a comma-separated list of ban step durations in
+// seconds, such as "600,3600,86400"
+func parseBanSteps(value string) ([]time.Duration, error) {
+	var steps []time.Duration
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		seconds, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, time.Duration(seconds)*time.Second)
+	}
+	return steps, nil
+}
+
 func (db *DB) Close() error {
 	return db.conn.Close()
 }
@@ -374,11 +773,37 @@ func (db *DB) Ping() error {
 }
 
 // Blacklist management
-func (db *DB) AddToBlacklist(ipAddress, reason, createdBy string) error {
-	_, err := db.conn.Exec(`
-		INSERT INTO blacklist (ip_address, reason, created_by)
-		VALUES (?, ?, ?)`,
-		ipAddress, reason, createdBy)
+
+// AddToBlacklist blacklists an address or prefix until expiresAt, or for
+// good if expiresAt is zero. An existing entry for the address, including
+// one removed earlier, is re-enabled with the new reason and expiry.
+func (db *DB) AddToBlacklist(ipAddress, reason, createdBy string, expiresAt time.Time) error {
+	var expiresAtUnix int64
+	if !expiresAt.IsZero() {
+		expiresAtUnix = expiresAt.Unix()
+	}
+
+	var upsertSQL string
+	switch db.driver {
+	case "mysql":
+		upsertSQL = `
+		INSERT INTO blacklist (ip_address, reason, created_by, expires_at_unix)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			reason = VALUES(reason), created_by = VALUES(created_by),
+			created_at = CURRENT_TIMESTAMP, enabled = TRUE,
+			expires_at_unix = VALUES(expires_at_unix)`
+	default: // sqlite3 and postgres
+		upsertSQL = `
+		INSERT INTO blacklist (ip_address, reason, created_by, expires_at_unix)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (ip_address) DO UPDATE SET
+			reason = excluded.reason, created_by = excluded.created_by,
+			created_at = CURRENT_TIMESTAMP, enabled = TRUE,
+			expires_at_unix = excluded.expires_at_unix`
+	}
+
+	_, err := db.conn.Exec(upsertSQL, ipAddress, reason, createdBy, expiresAtUnix)
 	return err
 }
 
@@ -394,17 +819,18 @@ func (db *DB) IsBlacklisted(ipAddress string) (bool, error) {
 	var count int
 	err := db.conn.QueryRow(`
 		SELECT COUNT(*) FROM blacklist
-		WHERE ip_address = ? AND enabled = TRUE`,
-		ipAddress).Scan(&count)
+		WHERE ip_address = ? AND enabled = TRUE
+		  AND (expires_at_unix = 0 OR expires_at_unix > ?)`,
+		ipAddress, time.Now().Unix()).Scan(&count)
 	return count > 0, err
 }
 
 func (db *DB) GetBlacklist() ([]BlacklistEntry, error) {
 	rows, err := db.conn.Query(`
-		SELECT id, ip_address, reason, created_at, created_by, enabled
+		SELECT id, ip_address, reason, created_at, created_by, enabled, expires_at_unix
 		FROM blacklist
-		WHERE enabled = TRUE
-		ORDER BY created_at DESC`)
+		WHERE enabled = TRUE AND (expires_at_unix = 0 OR expires_at_unix > ?)
+		ORDER BY created_at DESC`, time.Now().Unix())
 	if err != nil {
 		return nil, fmt.Errorf("failed to query blacklist: %w", err)
 	}
@@ -414,8 +840,9 @@ func (db *DB) GetBlacklist() ([]BlacklistEntry, error) {
 	for rows.Next() {
 		var entry BlacklistEntry
 		var reason sql.NullString
+		var expiresAt int64
 
-		err := rows.Scan(&entry.ID, &entry.IPAddress, &reason, &entry.CreatedAt, &entry.CreatedBy, &entry.Enabled)
+		err := rows.Scan(&entry.ID, &entry.IPAddress, &reason, &entry.CreatedAt, &entry.CreatedBy, &entry.Enabled, &expiresAt)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan blacklist entry: %w", err)
 		}
@@ -423,6 +850,10 @@ func (db *DB) GetBlacklist() ([]BlacklistEntry, error) {
 		if reason.Valid {
 			entry.Reason = reason.String
 		}
+		if expiresAt > 0 {
+			expiry := time.Unix(expiresAt, 0)
+			entry.ExpiresAt = &expiry
+		}
 
 		entries = append(entries, entry)
 	}
@@ -487,6 +918,227 @@ func (db *DB) GetWhitelist() ([]WhitelistEntry, error) {
 	return entries, nil
 }
 
+// Honeypot username management
+func (db *DB) AddHoneypotUsername(username, reason, createdBy string) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO honeypot_usernames (username, reason, created_by)
+		VALUES (?, ?, ?)`,
+		username, reason, createdBy)
+	return err
+}
+
+func (db *DB) RemoveHoneypotUsername(username string) error {
+	_, err := db.conn.Exec(`
+		UPDATE honeypot_usernames SET enabled = FALSE
+		WHERE username = ?`,
+		username)
+	return err
+}
+
+func (db *DB) GetHoneypotUsernames() ([]HoneypotEntry, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, username, reason, created_at, created_by, enabled
+		FROM honeypot_usernames
+		WHERE enabled = TRUE
+		ORDER BY username`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query honeypot usernames: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []HoneypotEntry
+	for rows.Next() {
+		var entry HoneypotEntry
+		var reason sql.NullString
+
+		err := rows.Scan(&entry.ID, &entry.Username, &reason, &entry.CreatedAt, &entry.CreatedBy, &entry.Enabled)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan honeypot username: %w", err)
+		}
+
+		if reason.Valid {
+			entry.Reason = reason.String
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Ban state persistence
+
+// unixOrZero returns t in Unix seconds, or 0 for the zero time
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// timeOrZero returns the time of Unix seconds stored by unixOrZero
+func timeOrZero(seconds int64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// SaveBanState replaces the persisted ban state with the given entries
+func (db *DB) SaveBanState(entries []BanStateEntry) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM ban_state"); err != nil {
+		return fmt.Errorf("failed to clear ban state: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO ban_state (ip_address, ban_expiry_unix, ban_count, first_seen_unix, last_seen_unix, violations, jails, provenance, recent_bans,
+		                       clean_since_unix, last_success_unix, score, score_updated_unix)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare ban state insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, entry := range entries {
+		var banExpiry int64
+		if !entry.BanExpiry.IsZero() {
+			banExpiry = entry.BanExpiry.Unix()
+		}
+
+		_, err := stmt.Exec(entry.IPAddress, banExpiry, entry.BanCount,
+			entry.FirstSeen.Unix(), entry.LastSeen.Unix(), entry.Violations, entry.Jails, entry.Provenance, entry.RecentBans,
+			unixOrZero(entry.CleanSince), unixOrZero(entry.LastSuccess), entry.Score, unixOrZero(entry.ScoreUpdated))
+		if err != nil {
+			return fmt.Errorf("failed to insert ban state for %s: %w", entry.IPAddress, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetBanState returns all persisted ban state entries
+func (db *DB) GetBanState() ([]BanStateEntry, error) {
+	rows, err := db.conn.Query(`
+		SELECT ip_address, ban_expiry_unix, ban_count, first_seen_unix, last_seen_unix, violations, jails, provenance, recent_bans,
+		       clean_since_unix, last_success_unix, score, score_updated_unix
+		FROM ban_state`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ban state: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []BanStateEntry
+	for rows.Next() {
+		var entry BanStateEntry
+		var banExpiry, firstSeen, lastSeen, cleanSince, lastSuccess, scoreUpdated int64
+		var violations, jails, provenance, recentBans sql.NullString
+
+		err := rows.Scan(&entry.IPAddress, &banExpiry, &entry.BanCount, &firstSeen, &lastSeen,
+			&violations, &jails, &provenance, &recentBans,
+			&cleanSince, &lastSuccess, &entry.Score, &scoreUpdated)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan ban state entry: %w", err)
+		}
+
+		if banExpiry > 0 {
+			entry.BanExpiry = time.Unix(banExpiry, 0)
+		}
+		entry.FirstSeen = time.Unix(firstSeen, 0)
+		entry.LastSeen = time.Unix(lastSeen, 0)
+		entry.CleanSince = timeOrZero(cleanSince)
+		entry.LastSuccess = timeOrZero(lastSuccess)
+		entry.ScoreUpdated = timeOrZero(scoreUpdated)
+		if violations.Valid {
+			entry.Violations = violations.String
+		}
+		if jails.Valid {
+			entry.Jails = jails.String
+		}
+		if provenance.Valid {
+			entry.Provenance = provenance.String
+		}
+		if recentBans.Valid {
+			entry.RecentBans = recentBans.String
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// SaveBanHistory replaces the persisted ban history with the given entries
+func (db *DB) SaveBanHistory(entries []BanHistoryEntry) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM ban_history"); err != nil {
+		return fmt.Errorf("failed to clear ban history: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO ban_history (ip_address, ban_count, jails, last_seen_unix, clean_since_unix, recent_bans)
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare ban history insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, entry := range entries {
+		_, err := stmt.Exec(entry.IPAddress, entry.BanCount, entry.Jails,
+			entry.LastSeen.Unix(), entry.CleanSince.Unix(), entry.RecentBans)
+		if err != nil {
+			return fmt.Errorf("failed to insert ban history for %s: %w", entry.IPAddress, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetBanHistory returns all persisted ban history entries
+func (db *DB) GetBanHistory() ([]BanHistoryEntry, error) {
+	rows, err := db.conn.Query(`
+		SELECT ip_address, ban_count, jails, last_seen_unix, clean_since_unix, recent_bans
+		FROM ban_history`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ban history: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []BanHistoryEntry
+	for rows.Next() {
+		var entry BanHistoryEntry
+		var lastSeen, cleanSince int64
+		var jails, recentBans sql.NullString
+
+		if err := rows.Scan(&entry.IPAddress, &entry.BanCount, &jails, &lastSeen, &cleanSince, &recentBans); err != nil {
+			return nil, fmt.Errorf("failed to scan ban history entry: %w", err)
+		}
+
+		entry.LastSeen = time.Unix(lastSeen, 0)
+		entry.CleanSince = time.Unix(cleanSince, 0)
+		if jails.Valid {
+			entry.Jails = jails.String
+		}
+		if recentBans.Valid {
+			entry.RecentBans = recentBans.String
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
 // InsertDefaultData inserts some default patterns and ban config for testing
 func (db *DB) InsertDefaultData() error {
 	// Insert default patterns if none exist
@@ -544,7 +1196,7 @@ func (db *DB) InsertDefaultData() error {
 				name, initial_ban_time_seconds, max_ban_time_seconds, escalation_factor,
 				max_attempts, time_window_seconds, cleanup_interval_seconds, max_memory_ttl_seconds
 			) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-			"default",
+			DefaultBanProfile,
 			300,    // 5 minutes
 			86400,  // 24 hours
 			2.0,    // escalation factor
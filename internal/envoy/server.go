@@ -67,10 +67,13 @@ func (s *Server) Check(ctx context.Context, req *auth.CheckRequest) (*auth.Check
 		return s.allowResponse(), nil
 	}
 
-	// Check if IP is banned
-	if s.banManager.IsBanned(clientIP) {
+	// Check if IP is banned, for the service named by the scope context
+	// extension if any
+	scope := req.GetAttributes().GetContextExtensions()["scope"]
+	if s.banManager.IsBannedIn(clientIP, scope) {
 		s.logger.Debug("Blocking banned IP via Envoy ext_authz",
-			zap.String("ip", clientIP))
+			zap.String("ip", clientIP),
+			zap.String("scope", scope))
 		return s.denyResponse("IP is banned due to suspicious activity"), nil
 	}
 
@@ -293,6 +293,92 @@ func TestCheckBannedIP(t *testing.T) {
 	}
 }
 
+func TestCheckAggregatedIPv6Ban(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.IPv6AggregationPrefix = 64
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	server := NewServer(cfg, logger, banManager)
+
+	// Each violation comes from a fresh address in the same /64
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		banManager.RecordViolation(fmt.Sprintf("2001:db8:1:2::%x", i+1), 1, "test violation")
+	}
+
+	tests := []struct {
+		ip           string
+		expectedCode codes.Code
+	}{
+		{"2001:db8:1:2::beef", codes.PermissionDenied},
+		{"2001:db8:1:3::1", codes.OK},
+	}
+
+	for _, test := range tests {
+		req := &auth.CheckRequest{
+			Attributes: &auth.AttributeContext{
+				Request: &auth.AttributeContext_Request{
+					Http: &auth.AttributeContext_HttpRequest{
+						Headers: map[string]string{
+							"x-forwarded-for": test.ip,
+						},
+					},
+				},
+			},
+		}
+
+		response, err := server.Check(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if response.Status.Code != int32(test.expectedCode) {
+			t.Errorf("Expected status code %d for %s, got %d", int32(test.expectedCode), test.ip, response.Status.Code)
+		}
+	}
+}
+
+func TestCheckScope(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	server := NewServer(cfg, logger, banManager)
+
+	banManager.ManualBanWithOptions("203.0.113.7", ipban.BanOptions{Duration: time.Hour, Scope: "smtp"})
+
+	tests := []struct {
+		scope        string
+		expectedCode codes.Code
+	}{
+		{"smtp", codes.PermissionDenied},
+		{"webmail", codes.OK},
+		{"", codes.OK},
+	}
+
+	for _, test := range tests {
+		req := &auth.CheckRequest{
+			Attributes: &auth.AttributeContext{
+				Request: &auth.AttributeContext_Request{
+					Http: &auth.AttributeContext_HttpRequest{
+						Headers: map[string]string{
+							"x-forwarded-for": "203.0.113.7",
+						},
+					},
+				},
+			},
+		}
+		if test.scope != "" {
+			req.Attributes.ContextExtensions = map[string]string{"scope": test.scope}
+		}
+
+		response, err := server.Check(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if response.Status.Code != int32(test.expectedCode) {
+			t.Errorf("Expected status code %d for scope %q, got %d", int32(test.expectedCode), test.scope, response.Status.Code)
+		}
+	}
+}
+
 func TestCheckNoClientIP(t *testing.T) {
 	cfg := getTestConfig()
 	logger := getTestLogger()
@@ -0,0 +1,147 @@
+package ipban
+
+import (
+	"context"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// AccessListSource provides the whitelist and blacklist, such as the
+// ConfigManager merging the file configuration with the database tables
+type AccessListSource interface {
+	GetWhitelist() []string
+	GetBlacklist() []string
+}
+
+// BlacklistEntrySource is an AccessListSource whose blacklist entries may
+// expire, such as the ConfigManager with the database blacklist table
+type BlacklistEntrySource interface {
+	GetBlacklistEntries() []config.BlacklistEntry
+}
+
+// accessLists holds the whitelist and blacklist as prefix tries. A new
+// value is published on every change, so IsBanned reads it without locking.
+type accessLists struct {
+	whitelist *RadixTree
+	blacklist *RadixTree
+}
+
+// SetAccessLists replaces the whitelist and blacklist. Entries are IP
+// addresses or CIDR prefixes; invalid entries are logged and skipped.
+// Whitelisted addresses are never banned and their violations are not
+// recorded; blacklisted addresses are always banned.
+func (m *Manager) SetAccessLists(whitelist, blacklist []string) {
+	m.SetAccessListEntries(whitelist, blacklistEntries(blacklist))
+}
+
+// SetAccessListEntries is SetAccessLists with blacklist entries that may
+// expire. Repeat offenders the recidive policy blacklisted are kept until
+// they expire or the new blacklist has them, so a synchronization that
+// runs before they are stored does not lift their ban.
+func (m *Manager) SetAccessListEntries(whitelist []string, blacklist []config.BlacklistEntry) {
+	lists := m.buildAccessLists(whitelist, blacklist)
+
+	m.mutex.Lock()
+	m.mergePendingBlacklist(lists.blacklist, m.clock.Now())
+	m.lists.Store(lists)
+	m.mutex.Unlock()
+
+	m.logger.Info("Access lists updated",
+		zap.Int("whitelist", len(whitelist)),
+		zap.Int("blacklist", len(blacklist)))
+}
+
+// blacklistEntries returns addresses as blacklist entries without expiry
+func blacklistEntries(addresses []string) []config.BlacklistEntry {
+	entries := make([]config.BlacklistEntry, len(addresses))
+	for i, address := range addresses {
+		entries[i].Address = address
+	}
+	return entries
+}
+
+func (m *Manager) buildAccessLists(whitelist []string, blacklist []config.BlacklistEntry) *accessLists {
+	return &accessLists{
+		whitelist: m.buildAccessList("whitelist", blacklistEntries(whitelist)),
+		blacklist: m.buildAccessList("blacklist", blacklist),
+	}
+}
+
+func (m *Manager) buildAccessList(name string, entries []config.BlacklistEntry) *RadixTree {
+	tree := NewRadixTree()
+	for _, entry := range entries {
+		key, err := parseKey(entry.Address)
+		if err != nil {
+			m.logger.Warn("Skipping invalid access list entry",
+				zap.String("list", name),
+				zap.String("entry", entry.Address))
+			continue
+		}
+		tree.insert(key, entry.ExpiresAt)
+	}
+	return tree
+}
+
+// mergePendingBlacklist adds the recidive entries not yet in the source
+// blacklist to blacklist, and forgets those it has or that expired.
+// Caller must hold m.mutex.
+func (m *Manager) mergePendingBlacklist(blacklist *RadixTree, now time.Time) {
+	for key, expiresAt := range m.pendingBlacklist {
+		if (!expiresAt.IsZero() && !expiresAt.After(now)) || blacklist.bannedAt(key, now) {
+			delete(m.pendingBlacklist, key)
+			continue
+		}
+		blacklist.insert(key, expiresAt)
+	}
+}
+
+// IsWhitelisted reports whether ip is covered by a whitelist entry
+func (m *Manager) IsWhitelisted(ip string) bool {
+	addr, err := parseAddr(ip)
+	return err == nil && m.lists.Load().whitelist.bannedAt(addrKey(addr), time.Time{})
+}
+
+// IsBlacklisted reports whether ip is covered by an unexpired blacklist
+// entry
+func (m *Manager) IsBlacklisted(ip string) bool {
+	addr, err := parseAddr(ip)
+	return err == nil && m.lists.Load().blacklist.bannedAt(addrKey(addr), m.clock.Now())
+}
+
+// SyncAccessLists loads the access lists from source, and again every time
+// updates signals a change, until ctx is cancelled. Blacklist expiries are
+// loaded if source is a BlacklistEntrySource; honeypot usernames,
+// jails and the ban policy are loaded too if source is also a
+// HoneypotSource, a JailSource or a BanPolicySource.
+func (m *Manager) SyncAccessLists(ctx context.Context, source AccessListSource, updates <-chan struct{}) {
+	m.loadAccessLists(source)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-updates:
+			m.loadAccessLists(source)
+		}
+	}
+}
+
+func (m *Manager) loadAccessLists(source AccessListSource) {
+	if entries, ok := source.(BlacklistEntrySource); ok {
+		m.SetAccessListEntries(source.GetWhitelist(), entries.GetBlacklistEntries())
+	} else {
+		m.SetAccessLists(source.GetWhitelist(), source.GetBlacklist())
+	}
+	if honeypots, ok := source.(HoneypotSource); ok {
+		m.SetHoneypotUsernames(honeypots.GetHoneypotUsernames())
+	}
+	if policy, ok := source.(BanPolicySource); ok {
+		m.SetBanPolicy(policy.GetBanConfig())
+	}
+	if jails, ok := source.(JailSource); ok {
+		m.SetJails(jails.GetJails())
+	}
+}
@@ -0,0 +1,145 @@
+package ipban
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+)
+
+func TestWhitelistPreventsBans(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.Whitelist = []string{"192.168.1.0/24", "2001:db8::1"}
+	manager := NewManager(cfg, getTestLogger())
+
+	for _, ip := range []string{"192.168.1.10", "2001:db8::1"} {
+		for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+			manager.RecordViolation(ip, 1, "test violation")
+		}
+		if manager.IsBanned(ip) {
+			t.Errorf("Expected whitelisted %s to not be banned", ip)
+		}
+		if manager.GetIPStats(ip) != nil {
+			t.Errorf("Expected no violations to be recorded for whitelisted %s", ip)
+		}
+	}
+
+	// A manual ban does not override the whitelist
+	manager.ManualBan("192.168.1.0/16", time.Hour)
+	if manager.IsBanned("192.168.1.10") {
+		t.Error("Expected whitelist to take precedence over temporary bans")
+	}
+	if !manager.IsBanned("192.168.2.10") {
+		t.Error("Expected addresses outside the whitelist to be banned")
+	}
+}
+
+func TestBlacklistBans(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.Blacklist = []string{"203.0.113.0/24", "198.51.100.7"}
+	cfg.Ban.Whitelist = []string{"203.0.113.5"}
+	manager := NewManager(cfg, getTestLogger())
+
+	tests := []struct {
+		ip     string
+		banned bool
+	}{
+		{"203.0.113.77", true},
+		{"198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"203.0.113.5", false}, // Whitelist takes precedence
+	}
+
+	for _, test := range tests {
+		if banned := manager.IsBanned(test.ip); banned != test.banned {
+			t.Errorf("IsBanned(%s): expected %v, got %v", test.ip, test.banned, banned)
+		}
+	}
+}
+
+func TestSetAccessListsSkipsInvalidEntries(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	manager.SetAccessLists([]string{"not-an-ip", " 10.0.0.1 "}, []string{"10.0.0.0/33", "10.0.0.0/8"})
+
+	if !manager.IsWhitelisted("10.0.0.1") {
+		t.Error("Expected valid whitelist entry to be applied")
+	}
+	if !manager.IsBlacklisted("10.1.2.3") {
+		t.Error("Expected valid blacklist entry to be applied")
+	}
+	if manager.IsBanned("10.0.0.1") || !manager.IsBanned("10.0.0.2") {
+		t.Error("Expected whitelist to take precedence over the blacklist")
+	}
+}
+
+func TestBlacklistEntriesExpire(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	manager.SetAccessListEntries(nil, []config.BlacklistEntry{
+		{Address: "10.0.0.1", ExpiresAt: time.Now().Add(time.Hour)},
+		{Address: "10.0.0.2", ExpiresAt: time.Now().Add(-time.Minute)},
+		{Address: "10.0.0.3"},
+	})
+
+	if !manager.IsBlacklisted("10.0.0.1") || !manager.IsBlacklisted("10.0.0.3") {
+		t.Error("Expected unexpired blacklist entries to be applied")
+	}
+	if manager.IsBlacklisted("10.0.0.2") {
+		t.Error("Expected the expired blacklist entry to not be applied")
+	}
+
+	blacklist := manager.lists.Load().blacklist
+	if blacklist.BannedAt("10.0.0.1", time.Now().Add(2*time.Hour)) {
+		t.Error("Expected the blacklist entry to expire")
+	}
+	if !blacklist.BannedAt("10.0.0.3", time.Now().Add(2*time.Hour)) {
+		t.Error("Expected the entry without expiry to stay")
+	}
+}
+
+type staticAccessLists struct {
+	mutex     sync.Mutex
+	blacklist []string
+}
+
+func (s *staticAccessLists) GetWhitelist() []string { return nil }
+
+func (s *staticAccessLists) GetBlacklist() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.blacklist
+}
+
+func (s *staticAccessLists) setBlacklist(blacklist []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.blacklist = blacklist
+}
+
+func TestSyncAccessLists(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	source := &staticAccessLists{blacklist: []string{"10.0.0.1"}}
+	updates := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		manager.SyncAccessLists(ctx, source, updates)
+		close(done)
+	}()
+
+	source.setBlacklist([]string{"10.0.0.2"})
+	updates <- struct{}{}
+	cancel()
+	<-done
+
+	if !manager.IsBanned("10.0.0.2") {
+		t.Error("Expected the updated blacklist to be applied")
+	}
+	if manager.IsBanned("10.0.0.1") {
+		t.Error("Expected entries removed from the source to be lifted")
+	}
+}
@@ -0,0 +1,235 @@
+package ipban
+
+import (
+	"fail2ban-haproxy/internal/config"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// accountFailure is a failed login to an account
+type accountFailure struct {
+	key       netip.Prefix
+	timestamp time.Time
+}
+
+// accountStats tracks the failed logins to one account across all
+// addresses. It is guarded by the manager's lock.
+type accountStats struct {
+	failures    []accountFailure // Oldest first, at most MaxAttempts
+	attack      *AccountAttack   // Set while the account is marked as under attack
+	lastFailure time.Time
+}
+
+// AccountAttack describes an account whose failed logins reached the
+// account threshold
+type AccountAttack struct {
+	Username   string    `json:"username"`
+	Failures   int       `json:"failures"`
+	IPs        []string  `json:"ips"` // Addresses the failures came from
+	DetectedAt time.Time `json:"detected_at"`
+	Until      time.Time `json:"until"`
+}
+
+// normalizeUsername returns the key accounts are tracked under. Mail
+// addresses and login names are compared case-insensitively.
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// recordAccountFailure counts a failed login from key to the account and
+// applies the configured action once the account reaches its threshold. It
+// takes the locks itself, so callers must not hold any.
+func (m *Manager) recordAccountFailure(key netip.Prefix, username string, now time.Time) {
+	attackers, reason := m.countAccountFailure(key, username, now)
+	for _, attacker := range attackers {
+		m.banAccountAttacker(attacker, reason, now)
+	}
+}
+
+// countAccountFailure counts a failed login from key to the account. It
+// marks the account as under attack once it reaches its threshold from
+// enough distinct addresses, or returns the addresses to ban and the reason
+// if the action is to ban them.
+func (m *Manager) countAccountFailure(key netip.Prefix, username string, now time.Time) ([]netip.Prefix, string) {
+	accountCfg := m.cfg.Accounts
+	username = normalizeUsername(username)
+	if username == "" || accountCfg.MaxAttempts <= 0 {
+		return nil, ""
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	account, exists := m.accounts[username]
+	if !exists {
+		account = &accountStats{}
+		m.accounts[username] = account
+	}
+	account.lastFailure = now
+
+	// Drop failures outside the window; MaxAttempts are enough to decide
+	cutoff := now.Add(-accountCfg.TimeWindow)
+	failures := account.failures[:0]
+	for _, failure := range account.failures {
+		if failure.timestamp.After(cutoff) {
+			failures = append(failures, failure)
+		}
+	}
+	if len(failures) >= accountCfg.MaxAttempts {
+		n := copy(failures, failures[len(failures)-accountCfg.MaxAttempts+1:])
+		failures = failures[:n]
+	}
+	account.failures = append(failures, accountFailure{key: key, timestamp: now})
+
+	if len(account.failures) < accountCfg.MaxAttempts {
+		return nil, ""
+	}
+	if account.attack != nil && account.attack.Until.After(now) {
+		return nil, ""
+	}
+
+	attackers := account.failureKeys()
+	if len(attackers) < accountCfg.MinDistinctIPs {
+		return nil, ""
+	}
+	ips := make([]string, len(attackers))
+	for i, attacker := range attackers {
+		ips[i] = formatKey(attacker)
+	}
+	attack := &AccountAttack{
+		Username:   username,
+		Failures:   len(account.failures),
+		IPs:        ips,
+		DetectedAt: now,
+		Until:      now.Add(accountCfg.MarkDuration),
+	}
+	reason := fmt.Sprintf("%d failed logins to %s from %d addresses within %v",
+		attack.Failures, username, len(attack.IPs), accountCfg.TimeWindow)
+
+	m.logger.Warn("Account under distributed attack",
+		zap.String("username", username),
+		zap.Int("failures", attack.Failures),
+		zap.Int("ips", len(attack.IPs)),
+		zap.String("action", accountCfg.Action))
+
+	m.events.Publish(Event{
+		Type:      EventAccountAttack,
+		Username:  username,
+		Reason:    reason,
+		Source:    SourceAccountAttack,
+		Timestamp: now,
+	})
+
+	switch accountCfg.Action {
+	case config.AccountActionBan:
+		// Start counting afresh, so later attempts need a new threshold
+		account.failures = account.failures[:0]
+		return attackers, reason
+	default:
+		account.attack = attack
+		return nil, ""
+	}
+}
+
+// failureKeys returns the distinct keys of the account's failures, in
+// address order
+func (a *accountStats) failureKeys() []netip.Prefix {
+	keys := make([]netip.Prefix, 0, len(a.failures))
+	for _, failure := range a.failures {
+		keys = append(keys, failure.key)
+	}
+	slices.SortFunc(keys, compareKeys)
+	return slices.Compact(keys)
+}
+
+// banAccountAttacker bans key under the global ban policy for taking part
+// in an attack on an account
+func (m *Manager) banAccountAttacker(key netip.Prefix, reason string, now time.Time) {
+	shard := m.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	stats := m.trackStats(key, now)
+	if stats.BanExpiry.After(now) {
+		return
+	}
+
+	policy := m.banPolicy()
+	stats.BanCount++
+	banDuration := banDuration(policy, stats.BanCount)
+	stats.BanExpiry = now.Add(banDuration)
+	stats.Scope = ""
+	stats.Provenance = &Provenance{
+		Source:   SourceAccountAttack,
+		Reason:   reason,
+		BannedAt: now,
+	}
+
+	m.publishBan(key, stats, "")
+
+	ip := formatKey(key)
+	m.logger.Info("IP banned for account attack",
+		zap.String("ip", ip),
+		zap.Duration("duration", banDuration),
+		zap.Int("ban_count", stats.BanCount),
+		zap.Time("expires", stats.BanExpiry))
+
+	m.events.Publish(Event{
+		Type:      EventBanned,
+		IP:        ip,
+		Reason:    reason,
+		Duration:  banDuration,
+		Expires:   stats.BanExpiry,
+		Source:    SourceAccountAttack,
+		Timestamp: now,
+	})
+
+	m.recordRecidive(key, stats, now)
+}
+
+// pruneAccounts forgets accounts without recent failures that are not
+// marked as under attack. Caller must hold the manager's lock.
+func (m *Manager) pruneAccounts(now time.Time) {
+	cutoff := now.Add(-m.cfg.Accounts.TimeWindow)
+	for username, account := range m.accounts {
+		if account.attack != nil && !account.attack.Until.After(now) {
+			account.attack = nil
+		}
+		if account.attack == nil && !account.lastFailure.After(cutoff) {
+			delete(m.accounts, username)
+		}
+	}
+}
+
+// IsAccountUnderAttack reports whether the account is marked as under a
+// distributed attack
+func (m *Manager) IsAccountUnderAttack(username string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	account, exists := m.accounts[normalizeUsername(username)]
+	return exists && account.attack != nil && account.attack.Until.After(m.clock.Now())
+}
+
+// GetAccountsUnderAttack returns the accounts marked as under attack,
+// sorted by username
+func (m *Manager) GetAccountsUnderAttack() []AccountAttack {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	now := m.clock.Now()
+	attacks := []AccountAttack{}
+	for _, account := range m.accounts {
+		if account.attack != nil && account.attack.Until.After(now) {
+			attacks = append(attacks, *account.attack)
+		}
+	}
+	sort.Slice(attacks, func(i, j int) bool { return attacks[i].Username < attacks[j].Username })
+	return attacks
+}
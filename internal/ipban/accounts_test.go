@@ -0,0 +1,130 @@
+package ipban
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+)
+
+func getAccountConfig(action string) *config.Config {
+	cfg := getTestConfig()
+	cfg.Accounts = config.AccountConfig{
+		Enabled:        true,
+		MaxAttempts:    5,
+		MinDistinctIPs: 2,
+		TimeWindow:     time.Hour,
+		Action:         action,
+		MarkDuration:   time.Hour,
+	}
+	return cfg
+}
+
+// spreadAttack records one failed login to username from each of n addresses
+func spreadAttack(manager *Manager, username string, n int) {
+	for i := 1; i <= n; i++ {
+		manager.RecordMatch(fmt.Sprintf("10.0.%d.1", i), Match{Severity: 1, Username: username})
+	}
+}
+
+func TestAccountMarkedUnderAttack(t *testing.T) {
+	manager := NewManager(getAccountConfig(config.AccountActionMark), getTestLogger())
+
+	spreadAttack(manager, "alice@example.com", 4)
+	if manager.IsAccountUnderAttack("alice@example.com") {
+		t.Fatal("Expected account to not be marked below the threshold")
+	}
+
+	spreadAttack(manager, "Alice@Example.com", 1)
+	if !manager.IsAccountUnderAttack("alice@example.com") {
+		t.Fatal("Expected account to be marked under attack, usernames are case-insensitive")
+	}
+
+	attacks := manager.GetAccountsUnderAttack()
+	if len(attacks) != 1 || attacks[0].Failures != 5 || len(attacks[0].IPs) != 4 {
+		t.Errorf("Expected one attack with 5 failures from 4 addresses, got %+v", attacks)
+	}
+	if manager.IsBanned("10.0.1.1") {
+		t.Error("Expected the mark action to not ban anything")
+	}
+}
+
+func TestAccountFailuresFromOneAddress(t *testing.T) {
+	manager := NewManager(getAccountConfig(config.AccountActionMark), getTestLogger())
+
+	for i := 0; i < 10; i++ {
+		manager.RecordMatch("10.0.1.1", Match{Severity: 1, Username: "alice"})
+	}
+	if manager.IsAccountUnderAttack("alice") {
+		t.Fatal("Expected failures from a single address to not mark the account")
+	}
+
+	spreadAttack(manager, "alice", 2)
+	if !manager.IsAccountUnderAttack("alice") {
+		t.Error("Expected a second address to mark the account")
+	}
+}
+
+func TestAccountAttackBansParticipants(t *testing.T) {
+	manager := NewManager(getAccountConfig(config.AccountActionBan), getTestLogger())
+
+	manager.RecordMatch("192.168.1.1", Match{Severity: 1, Username: "bob"})
+	spreadAttack(manager, "alice", 5)
+
+	for i := 1; i <= 5; i++ {
+		ip := fmt.Sprintf("10.0.%d.1", i)
+		if !manager.IsBanned(ip) {
+			t.Errorf("Expected participating IP %s to be banned", ip)
+		}
+	}
+	if manager.IsBanned("192.168.1.1") {
+		t.Error("Expected IP attacking another account to not be banned")
+	}
+	if manager.IsAccountUnderAttack("alice") {
+		t.Error("Expected the ban action to not mark the account")
+	}
+
+	bans := manager.GetActiveBans()
+	if len(bans) != 5 || bans[0].Provenance == nil || bans[0].Provenance.Source != SourceAccountAttack {
+		t.Errorf("Expected 5 bans from the account attack, got %+v", bans)
+	}
+}
+
+func TestAccountFailuresOutsideWindow(t *testing.T) {
+	manager := NewManager(getAccountConfig(config.AccountActionMark), getTestLogger())
+
+	spreadAttack(manager, "alice", 4)
+
+	// Age the recorded failures past the window
+	manager.mutex.Lock()
+	for i := range manager.accounts["alice"].failures {
+		manager.accounts["alice"].failures[i].timestamp = time.Now().Add(-2 * time.Hour)
+	}
+	manager.mutex.Unlock()
+
+	spreadAttack(manager, "alice", 1)
+	if manager.IsAccountUnderAttack("alice") {
+		t.Error("Expected failures outside the window to not count")
+	}
+
+	manager.mutex.Lock()
+	manager.accounts["alice"].lastFailure = time.Now().Add(-2 * time.Hour)
+	manager.mutex.Unlock()
+	manager.cleanup()
+
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	if _, exists := manager.accounts["alice"]; exists {
+		t.Error("Expected cleanup to forget accounts without recent failures")
+	}
+}
+
+func TestAccountTrackingDisabled(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	spreadAttack(manager, "alice", 10)
+	if manager.IsAccountUnderAttack("alice") || len(manager.accounts) != 0 {
+		t.Error("Expected usernames to be ignored with account tracking disabled")
+	}
+}
@@ -0,0 +1,56 @@
+package ipban
+
+import (
+	"fail2ban-haproxy/internal/config"
+	"math"
+	"time"
+)
+
+// banDuration computes the duration of the policy's banCount-th ban with
+// the policy's duration strategy, capped at the maximum ban time
+func banDuration(policy config.BanConfig, banCount int) time.Duration {
+	if banCount < 1 {
+		banCount = 1
+	}
+
+	switch policy.DurationStrategy {
+	case config.DurationStrategyExponential:
+		return cappedBanDuration(float64(policy.InitialBanTime)*
+			math.Pow(policy.EscalationFactor, float64(banCount-1)), policy.MaxBanTime)
+	case config.DurationStrategyFibonacci:
+		return cappedBanDuration(float64(policy.InitialBanTime)*
+			float64(fibonacci(banCount)), policy.MaxBanTime)
+	case config.DurationStrategySteps:
+		if len(policy.BanSteps) == 0 {
+			return cappedBanDuration(float64(policy.InitialBanTime), policy.MaxBanTime)
+		}
+		step := min(banCount, len(policy.BanSteps)) - 1
+		return cappedBanDuration(float64(policy.BanSteps[step]), policy.MaxBanTime)
+	default:
+		return escalatedBanDuration(policy.InitialBanTime, policy.MaxBanTime,
+			policy.EscalationFactor, banCount)
+	}
+}
+
+// cappedBanDuration converts duration to a time.Duration no longer than
+// maxBanTime. The comparison is made first, so durations too long to be
+// represented are capped rather than overflowing.
+func cappedBanDuration(duration float64, maxBanTime time.Duration) time.Duration {
+	if duration >= float64(maxBanTime) {
+		return maxBanTime
+	}
+	return time.Duration(duration)
+}
+
+// fibonacci returns the n-th term of 1, 2, 3, 5, 8, ..., saturating
+// instead of overflowing for large n
+func fibonacci(n int) int64 {
+	a, b := int64(1), int64(2)
+	for i := 1; i < n; i++ {
+		if b > math.MaxInt64-a {
+			return math.MaxInt64
+		}
+		a, b = b, a+b
+	}
+	return a
+}
@@ -0,0 +1,96 @@
+package ipban
+
+import (
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+)
+
+func TestBanDurationStrategies(t *testing.T) {
+	policy := config.BanConfig{
+		InitialBanTime:   10 * time.Minute,
+		MaxBanTime:       7 * 24 * time.Hour,
+		EscalationFactor: 2.0,
+		BanSteps:         []time.Duration{10 * time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour},
+	}
+
+	tests := []struct {
+		strategy string
+		expected []time.Duration // Durations of ban counts 1, 2, ...
+	}{
+		{"", []time.Duration{20 * time.Minute, 40 * time.Minute, time.Hour}},
+		{config.DurationStrategyLinear, []time.Duration{20 * time.Minute, 40 * time.Minute, time.Hour}},
+		{config.DurationStrategyExponential, []time.Duration{
+			10 * time.Minute, 20 * time.Minute, 40 * time.Minute, 80 * time.Minute, 160 * time.Minute,
+		}},
+		{config.DurationStrategyFibonacci, []time.Duration{
+			10 * time.Minute, 20 * time.Minute, 30 * time.Minute, 50 * time.Minute, 80 * time.Minute, 130 * time.Minute,
+		}},
+		{config.DurationStrategySteps, []time.Duration{
+			10 * time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour, 7 * 24 * time.Hour,
+		}},
+	}
+
+	for _, test := range tests {
+		policy.DurationStrategy = test.strategy
+		for i, expected := range test.expected {
+			if result := banDuration(policy, i+1); result != expected {
+				t.Errorf("Strategy %q, ban count %d: expected %v, got %v", test.strategy, i+1, expected, result)
+			}
+		}
+	}
+}
+
+func TestBanDurationCappedAtMaxBanTime(t *testing.T) {
+	policy := config.BanConfig{
+		InitialBanTime:   10 * time.Minute,
+		MaxBanTime:       24 * time.Hour,
+		EscalationFactor: 2.0,
+		BanSteps:         []time.Duration{time.Hour, 30 * 24 * time.Hour},
+	}
+
+	for _, strategy := range []string{
+		config.DurationStrategyLinear,
+		config.DurationStrategyExponential,
+		config.DurationStrategyFibonacci,
+		config.DurationStrategySteps,
+	} {
+		policy.DurationStrategy = strategy
+		// Large ban counts must not overflow
+		for _, banCount := range []int{100, 1000, 100000} {
+			if result := banDuration(policy, banCount); result != 24*time.Hour {
+				t.Errorf("Strategy %s, ban count %d: expected cap of 24h, got %v", strategy, banCount, result)
+			}
+		}
+	}
+}
+
+func TestJailDurationStrategy(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Jails = []config.JailConfig{{
+		Name:             "dovecot",
+		MaxAttempts:      1,
+		DurationStrategy: config.DurationStrategySteps,
+		BanSteps:         []time.Duration{10 * time.Minute, time.Hour},
+	}}
+	manager := NewManager(cfg, getTestLogger())
+	ip := "192.168.1.60"
+
+	expected := []time.Duration{10 * time.Minute, time.Hour, time.Hour}
+	for i, duration := range expected {
+		manager.RecordMatch(ip, Match{Jail: "dovecot", Severity: 1})
+
+		var remaining time.Duration
+		withStats(manager, ip, func(stats *IPStats) {
+			counter := stats.Jails["dovecot"]
+			remaining = time.Until(counter.BanExpiry)
+			// Let the ban expire so the next match bans again
+			counter.BanExpiry = time.Now().Add(-time.Second)
+		})
+
+		if remaining <= duration-time.Minute || remaining > duration {
+			t.Errorf("Ban %d: expected duration %v, got %v", i+1, duration, remaining)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package ipban
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EventType identifies what happened to an address or prefix
+type EventType string
+
+const (
+	EventBanned    EventType = "banned"
+	EventUnbanned  EventType = "unbanned"
+	EventExpired   EventType = "expired"
+	EventViolation EventType = "violation"
+
+	// EventAccountAttack reports an account whose failed logins reached
+	// the account threshold; IP is empty and Username names the account
+	EventAccountAttack EventType = "account_attack"
+
+	// EventBlacklisted reports an address added to the blacklist by the
+	// recidive policy
+	EventBlacklisted EventType = "blacklisted"
+)
+
+// Event sources
+const (
+	SourceDetection        = "detection"         // Violations and the automatic bans they trigger
+	SourceSubnetEscalation = "subnet_escalation" // Prefix bans after repeated bans in one subnet
+	SourceAccountAttack    = "account_attack"    // Distributed failed logins against one account
+	SourceRecidive         = "recidive"          // Repeat offenders promoted to the blacklist
+	SourceManual           = "manual"            // ManualBan and ManualUnban
+	SourceExpiry           = "expiry"            // Bans lifted by the expiry timer when they run out
+	SourceCleanup          = "cleanup"           // Expired bans found by cleanup instead
+	SourcePurge            = "purge"             // PurgeAllBans and PurgeExpiredBans
+)
+
+// DefaultEventBufferSize is the per-subscriber buffer used when Subscribe is
+// given a non-positive size
+const DefaultEventBufferSize = 256
+
+// Event describes a change in ban state or a recorded violation
+type Event struct {
+	Type      EventType     `json:"type"`
+	IP        string        `json:"ip"` // Address or CIDR prefix the event applies to
+	Jail      string        `json:"jail,omitempty"`
+	Scope     string        `json:"scope,omitempty"` // Jail a ban is limited to; empty for global bans
+	Pattern   string        `json:"pattern,omitempty"`
+	Username  string        `json:"username,omitempty"` // Account of account attack events
+	Reason    string        `json:"reason,omitempty"`
+	Severity  int           `json:"severity,omitempty"`
+	Duration  time.Duration `json:"duration,omitempty"` // Ban duration for banned events
+	Expires   time.Time     `json:"expires,omitempty"`
+	Source    string        `json:"source"`
+	Timestamp time.Time     `json:"timestamp"`
+}
+
+// Subscriber receives events from an EventBus. HandleEvent is called from
+// the subscription's own goroutine, one event at a time.
+type Subscriber interface {
+	HandleEvent(event Event)
+}
+
+// SubscriberFunc adapts a function to the Subscriber interface
+type SubscriberFunc func(event Event)
+
+// HandleEvent calls f(event)
+func (f SubscriberFunc) HandleEvent(event Event) {
+	f(event)
+}
+
+// Subscription is a subscriber's registration on an EventBus
+type Subscription struct {
+	events  chan Event
+	dropped atomic.Uint64
+	done    chan struct{}
+}
+
+// Dropped returns the number of events discarded because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// EventBus fans events out to subscribers. Publishing never blocks: each
+// subscriber has a bounded buffer, and events that do not fit are dropped
+// and counted on the subscription.
+type EventBus struct {
+	logger        *zap.Logger
+	mutex         sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+}
+
+// NewEventBus creates an event bus without subscribers
+func NewEventBus(logger *zap.Logger) *EventBus {
+	return &EventBus{
+		logger:        logger,
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe registers subscriber with a buffer of bufferSize events
+func (b *EventBus) Subscribe(subscriber Subscriber, bufferSize int) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = DefaultEventBufferSize
+	}
+
+	sub := &Subscription{
+		events: make(chan Event, bufferSize),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(sub.done)
+		for event := range sub.events {
+			b.deliver(subscriber, event)
+		}
+	}()
+
+	b.mutex.Lock()
+	b.subscriptions[sub] = struct{}{}
+	b.mutex.Unlock()
+
+	return sub
+}
+
+// deliver hands one event to subscriber, recovering from panics so that a
+// faulty subscriber does not stop its subscription
+func (b *EventBus) deliver(subscriber Subscriber, event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			b.logger.Error("Event subscriber panicked",
+				zap.String("event", string(event.Type)),
+				zap.Any("panic", r))
+		}
+	}()
+	subscriber.HandleEvent(event)
+}
+
+// Unsubscribe removes the subscription. Events already buffered are still
+// delivered; Unsubscribe waits until they have been handled.
+func (b *EventBus) Unsubscribe(sub *Subscription) {
+	b.mutex.Lock()
+	if _, exists := b.subscriptions[sub]; !exists {
+		b.mutex.Unlock()
+		return
+	}
+	delete(b.subscriptions, sub)
+	close(sub.events)
+	b.mutex.Unlock()
+
+	<-sub.done
+}
+
+// Close removes all subscriptions
+func (b *EventBus) Close() {
+	b.mutex.RLock()
+	subs := make([]*Subscription, 0, len(b.subscriptions))
+	for sub := range b.subscriptions {
+		subs = append(subs, sub)
+	}
+	b.mutex.RUnlock()
+
+	for _, sub := range subs {
+		b.Unsubscribe(sub)
+	}
+}
+
+// Publish sends event to every subscriber without blocking
+func (b *EventBus) Publish(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for sub := range b.subscriptions {
+		select {
+		case sub.events <- event:
+		default:
+			if sub.dropped.Add(1) == 1 {
+				b.logger.Warn("Event subscriber buffer full, dropping events",
+					zap.String("event", string(event.Type)))
+			}
+		}
+	}
+}
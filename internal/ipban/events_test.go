@@ -0,0 +1,186 @@
+package ipban
+
+import (
+	"testing"
+	"time"
+)
+
+// collectEvents returns a subscriber that forwards events to a channel
+func collectEvents(size int) (SubscriberFunc, chan Event) {
+	ch := make(chan Event, size)
+	return func(event Event) { ch <- event }, ch
+}
+
+func waitForEvent(t *testing.T, ch chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-ch:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for event")
+		return Event{}
+	}
+}
+
+func TestEventBusDeliversEvents(t *testing.T) {
+	bus := NewEventBus(getTestLogger())
+	defer bus.Close()
+
+	subscriber, ch := collectEvents(10)
+	bus.Subscribe(subscriber, 10)
+
+	bus.Publish(Event{Type: EventBanned, IP: "192.168.1.1", Source: SourceManual})
+
+	event := waitForEvent(t, ch)
+	if event.Type != EventBanned || event.IP != "192.168.1.1" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+	if event.Timestamp.IsZero() {
+		t.Error("Expected timestamp to be set on publish")
+	}
+}
+
+func TestEventBusDropsWhenBufferFull(t *testing.T) {
+	bus := NewEventBus(getTestLogger())
+
+	release := make(chan struct{})
+	sub := bus.Subscribe(SubscriberFunc(func(Event) { <-release }), 1)
+
+	// One event is being handled, one is buffered, the rest must be dropped
+	// without blocking the publisher
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			bus.Publish(Event{Type: EventViolation})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a slow subscriber")
+	}
+
+	if dropped := sub.Dropped(); dropped < 8 {
+		t.Errorf("Expected at least 8 dropped events, got %d", dropped)
+	}
+
+	close(release)
+	bus.Close()
+}
+
+func TestEventBusUnsubscribe(t *testing.T) {
+	bus := NewEventBus(getTestLogger())
+
+	subscriber, ch := collectEvents(10)
+	sub := bus.Subscribe(subscriber, 10)
+
+	bus.Publish(Event{Type: EventBanned})
+	bus.Unsubscribe(sub)
+
+	// Buffered events are delivered before Unsubscribe returns
+	if len(ch) != 1 {
+		t.Fatalf("Expected 1 delivered event, got %d", len(ch))
+	}
+
+	bus.Publish(Event{Type: EventUnbanned})
+	if len(ch) != 1 {
+		t.Error("Expected no events after unsubscribing")
+	}
+
+	// Unsubscribing twice is harmless
+	bus.Unsubscribe(sub)
+}
+
+func TestEventBusRecoversFromPanickingSubscriber(t *testing.T) {
+	bus := NewEventBus(getTestLogger())
+	defer bus.Close()
+
+	ch := make(chan Event, 10)
+	bus.Subscribe(SubscriberFunc(func(event Event) {
+		if event.Type == EventViolation {
+			panic("subscriber failure")
+		}
+		ch <- event
+	}), 10)
+
+	bus.Publish(Event{Type: EventViolation})
+	bus.Publish(Event{Type: EventBanned})
+
+	if event := waitForEvent(t, ch); event.Type != EventBanned {
+		t.Errorf("Expected banned event after panic, got %s", event.Type)
+	}
+}
+
+func TestManagerPublishesBanEvents(t *testing.T) {
+	cfg := getTestConfig()
+	manager := NewManager(cfg, getTestLogger())
+
+	subscriber, ch := collectEvents(20)
+	sub := manager.Subscribe(subscriber, 20)
+	defer manager.Unsubscribe(sub)
+
+	ip := "192.168.1.100"
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordMatch(ip, Match{Pattern: "dovecot-auth-failure", Severity: 2, Description: "auth failed"})
+	}
+
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		event := waitForEvent(t, ch)
+		if event.Type != EventViolation || event.Pattern != "dovecot-auth-failure" || event.Severity != 2 {
+			t.Errorf("Unexpected violation event: %+v", event)
+		}
+	}
+
+	banned := waitForEvent(t, ch)
+	if banned.Type != EventBanned || banned.IP != ip {
+		t.Fatalf("Expected banned event for %s, got %+v", ip, banned)
+	}
+	if banned.Source != SourceDetection || banned.Pattern != "dovecot-auth-failure" {
+		t.Errorf("Expected detection ban from the matching pattern, got %+v", banned)
+	}
+	if banned.Duration != 10*time.Minute || banned.Reason == "" {
+		t.Errorf("Expected 10m ban with a reason, got %v %q", banned.Duration, banned.Reason)
+	}
+
+	manager.ManualUnban(ip)
+	if event := waitForEvent(t, ch); event.Type != EventUnbanned || event.Source != SourceManual {
+		t.Errorf("Expected manual unbanned event, got %+v", event)
+	}
+
+	manager.ManualBan("10.0.0.0/24", time.Hour)
+	if event := waitForEvent(t, ch); event.Type != EventBanned || event.IP != "10.0.0.0/24" ||
+		event.Source != SourceManual || event.Duration != time.Hour {
+		t.Errorf("Expected manual banned event, got %+v", event)
+	}
+}
+
+func TestCleanupPublishesExpiredEventOnce(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	subscriber, ch := collectEvents(10)
+	sub := manager.Subscribe(subscriber, 10)
+
+	ip := "192.168.1.100"
+	manager.ManualBan(ip, time.Hour)
+	waitForEvent(t, ch)
+
+	withStats(manager, ip, func(stats *IPStats) {
+		stats.BanExpiry = time.Now().Add(-time.Second)
+	})
+
+	manager.cleanup()
+	manager.cleanup()
+	manager.Unsubscribe(sub)
+
+	if len(ch) != 1 {
+		t.Fatalf("Expected exactly 1 event after two cleanups, got %d", len(ch))
+	}
+	if event := <-ch; event.Type != EventExpired || event.IP != ip || event.Source != SourceCleanup {
+		t.Errorf("Expected expired event from cleanup, got %+v", event)
+	}
+	if manager.IsBanned(ip) {
+		t.Error("Expected IP to no longer be banned")
+	}
+}
@@ -0,0 +1,220 @@
+package ipban
+
+import (
+	"container/heap"
+	"net/netip"
+	"time"
+)
+
+// expiryItem is a key scheduled to have its bans checked at expiry
+type expiryItem struct {
+	key    netip.Prefix
+	expiry time.Time
+	index  int // Position in the heap, maintained by heap.Interface
+}
+
+// expiryHeap is a min-heap of expiry items ordered by expiry
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiry.Before(h[j].expiry) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+// expiryQueue holds the next ban expiry of every banned key, so bans are
+// lifted when they run out instead of on a periodic scan. Each key is
+// queued at most once. It is guarded by the manager's lock.
+type expiryQueue struct {
+	heap  expiryHeap
+	items map[netip.Prefix]*expiryItem
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{items: make(map[netip.Prefix]*expiryItem)}
+}
+
+// schedule queues key at expiry, replacing its previous expiry. It reports
+// whether key is now the first to expire.
+func (q *expiryQueue) schedule(key netip.Prefix, expiry time.Time) bool {
+	if item, exists := q.items[key]; exists {
+		item.expiry = expiry
+		heap.Fix(&q.heap, item.index)
+		return item.index == 0
+	}
+
+	item := &expiryItem{key: key, expiry: expiry}
+	q.items[key] = item
+	heap.Push(&q.heap, item)
+	return item.index == 0
+}
+
+// remove drops key from the queue, if queued
+func (q *expiryQueue) remove(key netip.Prefix) {
+	if item, exists := q.items[key]; exists {
+		heap.Remove(&q.heap, item.index)
+		delete(q.items, key)
+	}
+}
+
+// next returns the earliest queued expiry, or false if the queue is empty
+func (q *expiryQueue) next() (time.Time, bool) {
+	if len(q.heap) == 0 {
+		return time.Time{}, false
+	}
+	return q.heap[0].expiry, true
+}
+
+// popDue removes and returns the first key if it expires at or before now
+func (q *expiryQueue) popDue(now time.Time) (netip.Prefix, bool) {
+	if len(q.heap) == 0 || q.heap[0].expiry.After(now) {
+		return netip.Prefix{}, false
+	}
+	item := heap.Pop(&q.heap).(*expiryItem)
+	delete(q.items, item.key)
+	return item.key, true
+}
+
+// len returns the number of queued keys
+func (q *expiryQueue) len() int {
+	return len(q.heap)
+}
+
+// nextBanExpiry returns the earliest ban expiry across the global counters
+// and all jails, or the zero time if nothing is banned
+func (s *IPStats) nextBanExpiry() time.Time {
+	expiry := s.BanExpiry
+	for _, counter := range s.Jails {
+		if !counter.BanExpiry.IsZero() && (expiry.IsZero() || counter.BanExpiry.Before(expiry)) {
+			expiry = counter.BanExpiry
+		}
+	}
+	return expiry
+}
+
+// scheduleExpiry queues key at the earliest ban expiry of stats, waking the
+// expiry timer if that moves the earliest expiry forward, and keeps the key
+// out of the LRU list while it is queued. Caller must hold the key's shard
+// lock and the manager's lock.
+func (m *Manager) scheduleExpiry(key netip.Prefix, stats *IPStats) {
+	m.syncLRU(key, stats)
+	expiry := stats.nextBanExpiry()
+	if expiry.IsZero() {
+		m.expiries.remove(key)
+		return
+	}
+	if m.expiries.schedule(key, expiry) {
+		select {
+		case m.expiryWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// nextExpiryIn returns how long until the earliest queued ban expiry, or
+// false if no ban is queued
+func (m *Manager) nextExpiryIn() (time.Duration, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	expiry, ok := m.expiries.next()
+	if !ok {
+		return 0, false
+	}
+	return max(0, expiry.Sub(m.clock.Now())), true
+}
+
+// expireDue lifts every ban that expired at or before now and reports the
+// number of addresses and prefixes whose bans ended. It takes the locks
+// itself, so callers must not hold any.
+func (m *Manager) expireDue(now time.Time, source string) int {
+	count := 0
+	for {
+		m.mutex.Lock()
+		key, ok := m.expiries.popDue(now)
+		m.mutex.Unlock()
+		if !ok {
+			return count
+		}
+
+		// The key may have been banned again since it was popped;
+		// expireBans works from its current state
+		shard := m.shardFor(key)
+		shard.mutex.Lock()
+		if m.expireBans(key, now, source) {
+			count++
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// expireBans lifts the expired bans of key, removing it from the trie of
+// every scope left without an active ban and publishing an expired event
+// for each. Bans that are still active are queued again. It reports whether
+// any ban ended. Caller must hold the key's shard lock.
+func (m *Manager) expireBans(key netip.Prefix, now time.Time, source string) bool {
+	stats, exists := m.shardFor(key).stats[key]
+	if !exists {
+		m.deleteBans(key)
+		return false
+	}
+
+	// Latest expiry per scope among the counters whose ban ran out
+	expired := make(map[string]time.Time)
+	expire := func(counter *JailStats) {
+		if counter.BanExpiry.IsZero() || counter.BanExpiry.After(now) {
+			return
+		}
+		if counter.BanExpiry.After(expired[counter.Scope]) {
+			expired[counter.Scope] = counter.BanExpiry
+		}
+		counter.endBan(now)
+	}
+	expire(&stats.JailStats)
+	for _, counter := range stats.Jails {
+		expire(counter)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ended := false
+	for scope, expiry := range expired {
+		// Another counter may still ban the key in the same scope
+		if stats.bannedUntilIn(scope).After(now) {
+			continue
+		}
+		m.scopeTree(scope).delete(key)
+		ended = true
+
+		m.events.Publish(Event{
+			Type:      EventExpired,
+			IP:        formatKey(key),
+			Scope:     scope,
+			Expires:   expiry,
+			Source:    source,
+			Timestamp: now,
+		})
+	}
+
+	m.scheduleExpiry(key, stats)
+	return ended
+}
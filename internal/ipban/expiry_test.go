@@ -0,0 +1,136 @@
+package ipban
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestExpiryQueueOrder(t *testing.T) {
+	queue := newExpiryQueue()
+	base := time.Now()
+
+	queue.schedule(testKey("10.0.0.3"), base.Add(3*time.Minute))
+	queue.schedule(testKey("10.0.0.1"), base.Add(time.Minute))
+	if !queue.schedule(testKey("10.0.0.2"), base.Add(30*time.Second)) {
+		t.Error("Expected the earliest key to be reported first")
+	}
+
+	// Rescheduling moves a key rather than queueing it twice
+	queue.schedule(testKey("10.0.0.2"), base.Add(2*time.Minute))
+	queue.remove(testKey("10.0.0.3"))
+	if queue.len() != 2 {
+		t.Fatalf("Expected 2 queued keys, got %d", queue.len())
+	}
+
+	if _, ok := queue.popDue(base); ok {
+		t.Error("Expected no key to be due yet")
+	}
+	var keys []netip.Prefix
+	for {
+		key, ok := queue.popDue(base.Add(time.Hour))
+		if !ok {
+			break
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) != 2 || keys[0] != testKey("10.0.0.1") || keys[1] != testKey("10.0.0.2") {
+		t.Errorf("Expected keys in expiry order, got %v", keys)
+	}
+	if _, ok := queue.next(); ok {
+		t.Error("Expected the queue to be empty")
+	}
+}
+
+func TestBanExpiresOnTime(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.CleanupInterval = time.Hour // Expiry must not wait for cleanup
+	manager, fake := newFakeClockManager(cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.StartCleanup(ctx)
+
+	subscriber, ch := collectEvents(10)
+	manager.Subscribe(subscriber, 10)
+
+	ip := "192.168.1.110"
+	manager.ManualBan(ip, 5*time.Minute)
+	waitForEvent(t, ch)
+
+	// The cleanup ticker and the expiry timer are both waiting
+	fake.BlockUntil(2)
+	fake.Advance(5 * time.Minute)
+
+	event := waitForEvent(t, ch)
+	if event.Type != EventExpired || event.IP != ip || event.Source != SourceExpiry {
+		t.Fatalf("Expected expired event from the expiry timer, got %+v", event)
+	}
+
+	if len(manager.tree.Lookup(ip)) != 0 {
+		t.Error("Expected expired ban to be removed from the radix tree")
+	}
+	if stats := manager.GetIPStats(ip); !stats.BanExpiry.IsZero() {
+		t.Errorf("Expected ban expiry to be cleared, got %v", stats.BanExpiry)
+	}
+}
+
+func TestScopedBanExpiresSeparately(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+	ip := "192.168.1.111"
+
+	manager.ManualBanWithOptions(ip, BanOptions{Duration: time.Minute, Scope: "smtp"})
+	manager.ManualBan(ip, time.Hour)
+
+	count := manager.expireDue(time.Now().Add(2*time.Minute), SourceExpiry)
+	manager.mutex.RLock()
+	next, queued := manager.expiries.next()
+	manager.mutex.RUnlock()
+
+	if count != 1 {
+		t.Errorf("Expected one ban to end, got %d", count)
+	}
+	if len(manager.scopeTree("smtp").Lookup(ip)) != 0 {
+		t.Error("Expected the scoped ban to be removed from its trie")
+	}
+	if !manager.IsBanned(ip) {
+		t.Error("Expected the global ban to remain")
+	}
+	if !queued || next.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("Expected the global ban to be queued for its own expiry, got %v", next)
+	}
+}
+
+func TestPurgeExpiredBans(t *testing.T) {
+	manager, fake := newFakeClockManager(getTestConfig())
+
+	manager.ManualBan("192.168.1.112", time.Minute)
+	manager.ManualBan("192.168.1.113", time.Hour)
+	fake.Advance(2 * time.Minute)
+
+	if count := manager.PurgeExpiredBans(); count != 1 {
+		t.Errorf("Expected 1 purged ban, got %d", count)
+	}
+	if count := manager.PurgeExpiredBans(); count != 0 {
+		t.Errorf("Expected purged bans to be lifted once, got %d", count)
+	}
+	if !manager.IsBanned("192.168.1.113") {
+		t.Error("Expected active ban to survive the purge")
+	}
+}
+
+func TestUnbanRemovesQueuedExpiry(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	manager.ManualBan("10.0.0.0/24", time.Hour)
+	if err := manager.ManualUnban("10.0.0.0/24"); err != nil {
+		t.Fatalf("ManualUnban failed: %v", err)
+	}
+
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	if manager.expiries.len() != 0 {
+		t.Errorf("Expected unban to remove the queued expiry, got %d queued", manager.expiries.len())
+	}
+}
@@ -0,0 +1,207 @@
+package ipban
+
+import (
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// BanHistory is what is remembered of an address dropped from memory: its
+// ban counts, so that escalation resumes where it left off if the address
+// returns. Entries are forgiven like live counters and dropped once
+// forgiven entirely or older than the history retention.
+type BanHistory struct {
+	BanCount   int            `json:"ban_count"`
+	Jails      map[string]int `json:"jails,omitempty"` // Ban counts of named jails
+	LastSeen   time.Time      `json:"last_seen"`
+	CleanSince time.Time      `json:"clean_since"`
+	RecentBans []time.Time    `json:"recent_bans,omitempty"` // Ban times for the recidive policy
+}
+
+// endBan clears the counter's ban. The counter is clean from the end of the
+// ban on, or from now if the ban is lifted early.
+func (c *JailStats) endBan(now time.Time) {
+	if !c.BanExpiry.IsZero() {
+		end := c.BanExpiry
+		if end.After(now) {
+			end = now
+		}
+		if end.After(c.CleanSince) {
+			c.CleanSince = end
+		}
+	}
+	c.BanExpiry = time.Time{}
+}
+
+// cleanSince returns the time since which the counter has had neither
+// violations nor a ban, or fallback if it is not known
+func (c *JailStats) cleanSince(fallback time.Time) time.Time {
+	since := c.CleanSince
+	if c.BanExpiry.After(since) {
+		since = c.BanExpiry
+	}
+	if since.IsZero() {
+		return fallback
+	}
+	return since
+}
+
+// cleanIntervals returns the number of whole intervals between since and
+// now, and the time the last of them ended
+func cleanIntervals(since time.Time, interval time.Duration, now time.Time) (int, time.Time) {
+	if interval <= 0 || !now.After(since) {
+		return 0, since
+	}
+	n := now.Sub(since) / interval
+	return int(n), since.Add(n * interval)
+}
+
+// forgiveBans drops the counter's ban count by one for every clean interval
+func forgiveBans(counter *JailStats, fallback time.Time, interval time.Duration, now time.Time) {
+	if counter.BanCount == 0 || counter.BanExpiry.After(now) {
+		return
+	}
+	n, end := cleanIntervals(counter.cleanSince(fallback), interval, now)
+	if n == 0 {
+		return
+	}
+	counter.BanCount = max(0, counter.BanCount-n)
+	counter.CleanSince = end
+}
+
+// forgive applies the forgiveness policy to every counter of the address.
+// Caller must hold the address's shard lock.
+func (m *Manager) forgive(stats *IPStats, now time.Time) {
+	interval := m.cfg.Ban.Forgiveness.CleanInterval
+	if interval <= 0 {
+		return
+	}
+	forgiveBans(&stats.JailStats, stats.LastSeen, interval, now)
+	for _, counter := range stats.Jails {
+		forgiveBans(counter, stats.LastSeen, interval, now)
+	}
+}
+
+// historyRetention returns how long history entries are kept: the
+// configured retention, extended to the recidive lookback window
+func (m *Manager) historyRetention() time.Duration {
+	retention := m.cfg.Ban.Forgiveness.HistoryRetention
+	if m.cfg.Recidive.Enabled {
+		retention = max(retention, m.cfg.Recidive.LookbackWindow)
+	}
+	return retention
+}
+
+// rememberHistory keeps the ban counts of an address about to be dropped
+// from memory. Caller must hold the key's shard lock.
+func (m *Manager) rememberHistory(key netip.Prefix, stats *IPStats) {
+	if m.historyRetention() <= 0 {
+		return
+	}
+
+	entry := &BanHistory{
+		BanCount:   stats.BanCount,
+		LastSeen:   stats.LastSeen,
+		CleanSince: stats.JailStats.cleanSince(stats.LastSeen),
+		RecentBans: stats.RecentBans,
+	}
+	for name, counter := range stats.Jails {
+		if counter.BanCount == 0 {
+			continue
+		}
+		if entry.Jails == nil {
+			entry.Jails = make(map[string]int)
+		}
+		entry.Jails[name] = counter.BanCount
+		if since := counter.cleanSince(stats.LastSeen); since.After(entry.CleanSince) {
+			entry.CleanSince = since
+		}
+	}
+
+	if entry.BanCount > 0 || len(entry.Jails) > 0 || len(entry.RecentBans) > 0 {
+		m.shardFor(key).history[key] = entry
+	}
+}
+
+// restoreHistory resumes the remembered ban counts of an address seen
+// again. Caller must hold the key's shard lock.
+func (m *Manager) restoreHistory(key netip.Prefix, stats *IPStats) {
+	shard := m.shardFor(key)
+	entry, exists := shard.history[key]
+	if !exists {
+		return
+	}
+	delete(shard.history, key)
+
+	stats.BanCount = entry.BanCount
+	stats.CleanSince = entry.CleanSince
+	stats.RecentBans = entry.RecentBans
+	for name, banCount := range entry.Jails {
+		if _, ok := m.jailPolicy(name); !ok {
+			continue // The jail was removed from the configuration
+		}
+		counter := stats.jail(name)
+		counter.BanCount = banCount
+		counter.CleanSince = entry.CleanSince
+	}
+}
+
+// pruneHistory forgives the remembered ban counts of the shard and drops
+// entries that were forgiven entirely or are older than the history
+// retention. Caller must hold the shard's lock.
+func (m *Manager) pruneHistory(shard *statsShard, now time.Time) {
+	retention := m.historyRetention()
+	cutoff := now.Add(-retention)
+	recidiveCutoff := now.Add(-m.cfg.Recidive.LookbackWindow)
+
+	for key, entry := range shard.history {
+		if retention <= 0 || entry.LastSeen.Before(cutoff) {
+			delete(shard.history, key)
+			continue
+		}
+
+		entry.RecentBans = pruneBanTimes(entry.RecentBans, recidiveCutoff)
+		if n, end := cleanIntervals(entry.CleanSince, m.cfg.Ban.Forgiveness.CleanInterval, now); n > 0 {
+			entry.CleanSince = end
+			entry.BanCount = max(0, entry.BanCount-n)
+			for name, banCount := range entry.Jails {
+				if banCount <= n {
+					delete(entry.Jails, name)
+				} else {
+					entry.Jails[name] = banCount - n
+				}
+			}
+		}
+		if entry.BanCount == 0 && len(entry.Jails) == 0 && len(entry.RecentBans) == 0 {
+			delete(shard.history, key)
+		}
+	}
+}
+
+// GetBanHistory returns the remembered ban counts of an address no longer
+// tracked in memory, or nil if there are none
+func (m *Manager) GetBanHistory(ip string) *BanHistory {
+	key, err := parseKey(ip)
+	if err != nil {
+		return nil
+	}
+
+	key = m.aggregationKey(key)
+	shard := m.shardFor(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	entry, exists := shard.history[key]
+	if !exists {
+		return nil
+	}
+	result := *entry
+	result.RecentBans = slices.Clone(entry.RecentBans)
+	if entry.Jails != nil {
+		result.Jails = make(map[string]int, len(entry.Jails))
+		for name, banCount := range entry.Jails {
+			result.Jails[name] = banCount
+		}
+	}
+	return &result
+}
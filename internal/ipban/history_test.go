@@ -0,0 +1,200 @@
+package ipban
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+)
+
+func getForgivenessConfig() *config.Config {
+	cfg := getTestConfig()
+	cfg.Ban.Forgiveness = config.ForgivenessConfig{
+		CleanInterval:    time.Hour,
+		HistoryRetention: 30 * 24 * time.Hour,
+	}
+	return cfg
+}
+
+// banAndAge bans ip under the global policy, then moves the end of the ban
+// and the last sighting age into the past, dropping the violations that
+// fell out of the window
+func banAndAge(manager *Manager, ip string, age time.Duration) {
+	for i := 0; i < manager.cfg.Ban.MaxAttempts; i++ {
+		manager.RecordViolation(ip, 1, "failure")
+	}
+
+	withStats(manager, ip, func(stats *IPStats) {
+		stats.BanExpiry = time.Now().Add(-age)
+		stats.CleanSince = stats.BanExpiry
+		stats.LastSeen = stats.BanExpiry
+		stats.Violations = ViolationBuffer{}
+	})
+}
+
+func TestBanCountForgivenAfterCleanIntervals(t *testing.T) {
+	manager := NewManager(getForgivenessConfig(), getTestLogger())
+	ip := "192.168.1.70"
+
+	banAndAge(manager, ip, 150*time.Minute)
+	withStats(manager, ip, func(stats *IPStats) {
+		stats.BanCount = 3
+	})
+
+	manager.cleanup()
+
+	stats := manager.GetIPStats(ip)
+	if stats.BanCount != 1 {
+		t.Errorf("Expected two clean intervals to forgive two bans, got ban count %d", stats.BanCount)
+	}
+
+	// The partial interval is kept for the next forgiveness
+	manager.cleanup()
+	if stats.BanCount != 1 {
+		t.Errorf("Expected a partial interval to not forgive, got ban count %d", stats.BanCount)
+	}
+}
+
+func TestBanCountNotForgivenWhileOffending(t *testing.T) {
+	manager := NewManager(getForgivenessConfig(), getTestLogger())
+	ip := "192.168.1.71"
+
+	banAndAge(manager, ip, 3*time.Hour)
+	manager.RecordViolation(ip, 1, "failure")
+	manager.cleanup()
+
+	if stats := manager.GetIPStats(ip); stats.BanCount != 1 {
+		t.Errorf("Expected a recent violation to prevent forgiveness, got ban count %d", stats.BanCount)
+	}
+}
+
+func TestBanHistoryOutlivesMemory(t *testing.T) {
+	manager := NewManager(getForgivenessConfig(), getTestLogger())
+	ip := "192.168.1.72"
+
+	// Dropped from memory after MaxMemoryTTL, within one clean interval
+	banAndAge(manager, ip, 30*time.Minute)
+	withStats(manager, ip, func(stats *IPStats) {
+		stats.LastSeen = time.Now().Add(-100 * time.Hour)
+	})
+	manager.cleanup()
+
+	if manager.GetIPStats(ip) != nil {
+		t.Fatal("Expected the record to be dropped from memory")
+	}
+	history := manager.GetBanHistory(ip)
+	if history == nil || history.BanCount != 1 {
+		t.Fatalf("Expected the ban count to be remembered, got %+v", history)
+	}
+
+	// Escalation resumes where it left off
+	for i := 0; i < 3; i++ {
+		manager.RecordViolation(ip, 1, "failure")
+	}
+	stats := manager.GetIPStats(ip)
+	if stats.BanCount != 2 {
+		t.Errorf("Expected the second ban to escalate from the history, got ban count %d", stats.BanCount)
+	}
+	if manager.GetBanHistory(ip) != nil {
+		t.Error("Expected the history entry to move back into memory")
+	}
+}
+
+func TestMultiDayEscalationAndForgiveness(t *testing.T) {
+	manager, fake := newFakeClockManager(getForgivenessConfig())
+	ip := "192.168.1.75"
+
+	// offend bans ip and returns how long for
+	offend := func() time.Duration {
+		for i := 0; i < manager.cfg.Ban.MaxAttempts; i++ {
+			manager.RecordViolation(ip, 1, "failure")
+		}
+		return manager.GetIPStats(ip).BannedUntil().Sub(fake.Now())
+	}
+	// passHours moves time forward, cleaning up every hour
+	passHours := func(hours int) {
+		for i := 0; i < hours; i++ {
+			fake.Advance(time.Hour)
+			manager.cleanup()
+		}
+	}
+
+	// Back every hour: each ban is longer than the last
+	for i, want := range []time.Duration{10 * time.Minute, 20 * time.Minute, 30 * time.Minute} {
+		if got := offend(); got != want {
+			t.Errorf("Expected ban %d to last %v, got %v", i+1, want, got)
+		}
+		passHours(1)
+	}
+
+	// A clean day forgives every ban
+	passHours(24)
+	if stats := manager.GetIPStats(ip); stats == nil || stats.BanCount != 0 {
+		t.Fatalf("Expected the ban count to be forgiven, got %+v", stats)
+	}
+	if got := offend(); got != 10*time.Minute {
+		t.Errorf("Expected escalation to start over, got a ban of %v", got)
+	}
+
+	// A month away drops the record and then its history
+	passHours(31 * 24)
+	if manager.GetIPStats(ip) != nil {
+		t.Error("Expected the record to be dropped from memory")
+	}
+	if manager.GetBanHistory(ip) != nil {
+		t.Error("Expected the history to be dropped after the retention")
+	}
+}
+
+func TestBanHistoryForgivenAndPruned(t *testing.T) {
+	manager := NewManager(getForgivenessConfig(), getTestLogger())
+
+	rememberTestHistory(manager, "192.168.1.73", &BanHistory{
+		BanCount:   3,
+		Jails:      map[string]int{"dovecot": 1},
+		LastSeen:   time.Now().Add(-2 * time.Hour),
+		CleanSince: time.Now().Add(-2 * time.Hour),
+	})
+	rememberTestHistory(manager, "192.168.1.74", &BanHistory{
+		BanCount:   10,
+		LastSeen:   time.Now().Add(-31 * 24 * time.Hour),
+		CleanSince: time.Now(),
+	})
+
+	manager.cleanup()
+
+	history := manager.GetBanHistory("192.168.1.73")
+	if history == nil || history.BanCount != 1 || len(history.Jails) != 0 {
+		t.Errorf("Expected two bans forgiven in every jail, got %+v", history)
+	}
+	if manager.GetBanHistory("192.168.1.74") != nil {
+		t.Error("Expected history older than the retention to be dropped")
+	}
+}
+
+func TestBanHistorySurvivesRestart(t *testing.T) {
+	cfg := getForgivenessConfig()
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+
+	manager := NewManager(cfg, getTestLogger())
+	manager.SetStateStore(store)
+	rememberTestHistory(manager, "192.168.1.75", &BanHistory{
+		BanCount:   2,
+		LastSeen:   time.Now().Add(-24 * time.Hour),
+		CleanSince: time.Now(),
+	})
+	if err := manager.SaveState(); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	restarted := NewManager(cfg, getTestLogger())
+	restarted.SetStateStore(store)
+	if _, err := restarted.RestoreState(); err != nil {
+		t.Fatalf("Failed to restore state: %v", err)
+	}
+
+	if history := restarted.GetBanHistory("192.168.1.75"); history == nil || history.BanCount != 2 {
+		t.Errorf("Expected the ban history to survive restart, got %+v", history)
+	}
+}
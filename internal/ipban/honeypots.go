@@ -0,0 +1,39 @@
+package ipban
+
+import "go.uber.org/zap"
+
+// HoneypotSource provides decoy usernames, such as the ConfigManager
+// merging the file configuration with the database table. Access list
+// sources implementing it also keep the honeypot usernames in sync.
+type HoneypotSource interface {
+	GetHoneypotUsernames() []string
+}
+
+// honeypotSet holds the normalized honeypot usernames. A new set is
+// published on every change, so it is read without locking.
+type honeypotSet map[string]struct{}
+
+func newHoneypotSet(usernames []string) *honeypotSet {
+	set := make(honeypotSet, len(usernames))
+	for _, username := range usernames {
+		if username = normalizeUsername(username); username != "" {
+			set[username] = struct{}{}
+		}
+	}
+	return &set
+}
+
+// SetHoneypotUsernames replaces the honeypot usernames. These are decoy
+// accounts that do not exist: a failed login to any of them bans the
+// address at once for the maximum ban time, on every service.
+func (m *Manager) SetHoneypotUsernames(usernames []string) {
+	m.honeypots.Store(newHoneypotSet(usernames))
+
+	m.logger.Info("Honeypot usernames updated", zap.Int("usernames", len(usernames)))
+}
+
+// IsHoneypotUsername reports whether username is a honeypot username
+func (m *Manager) IsHoneypotUsername(username string) bool {
+	_, exists := (*m.honeypots.Load())[normalizeUsername(username)]
+	return exists
+}
@@ -0,0 +1,67 @@
+package ipban
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// honeypotLists is an access list source that also provides honeypot usernames
+type honeypotLists struct {
+	staticAccessLists
+	honeypots []string
+}
+
+func (h *honeypotLists) GetHoneypotUsernames() []string { return h.honeypots }
+
+func TestHoneypotUsernameBansImmediately(t *testing.T) {
+	cfg := getJailConfig()
+	cfg.Ban.HoneypotUsernames = []string{"admin", "Test"}
+	manager := NewManager(cfg, getTestLogger())
+
+	manager.RecordMatch("192.168.1.10", Match{Jail: "sogo", Severity: 1, Username: "ADMIN"})
+
+	if !manager.IsBanned("192.168.1.10") {
+		t.Fatal("Expected a single failed login to a honeypot username to ban")
+	}
+	if !manager.IsBannedIn("192.168.1.10", "postfix-sasl") {
+		t.Error("Expected honeypot ban to apply to every scope")
+	}
+
+	// The ban lasts the jail's maximum ban time
+	bans := manager.GetActiveBans()
+	if len(bans) != 1 || bans[0].Jail != "sogo" {
+		t.Fatalf("Expected one sogo ban, got %+v", bans)
+	}
+	if remaining := time.Until(bans[0].ExpiresAt); remaining < cfg.Ban.MaxBanTime-time.Minute {
+		t.Errorf("Expected a ban of about %v, got %v", cfg.Ban.MaxBanTime, remaining)
+	}
+
+	manager.RecordMatch("192.168.1.11", Match{Severity: 1, Username: "alice"})
+	if manager.IsBanned("192.168.1.11") {
+		t.Error("Expected other usernames to go through the usual threshold")
+	}
+}
+
+func TestSyncHoneypotUsernames(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+	source := &honeypotLists{honeypots: []string{"info"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		manager.SyncAccessLists(ctx, source, nil)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	if !manager.IsHoneypotUsername("Info") {
+		t.Error("Expected honeypot usernames to be loaded from the source")
+	}
+
+	manager.SetHoneypotUsernames(nil)
+	if manager.IsHoneypotUsername("info") {
+		t.Error("Expected honeypot usernames to be replaced")
+	}
+}
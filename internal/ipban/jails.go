@@ -0,0 +1,69 @@
+package ipban
+
+import (
+	"fail2ban-haproxy/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// JailSource provides the jails, such as the ConfigManager merging the
+// file configuration with the ban profiles of the database. Access list
+// sources implementing it also keep the jails in sync.
+type JailSource interface {
+	GetJails() []config.JailConfig
+}
+
+// BanPolicySource provides the global ban policy, such as the ConfigManager
+// reading the default ban profile of the database. Access list sources
+// implementing it also keep the policy in sync.
+type BanPolicySource interface {
+	GetBanConfig() config.BanConfig
+}
+
+// jailSet maps jail names to their configuration. A new set is published
+// on every change, so violations are judged under it without locking.
+type jailSet map[string]config.JailConfig
+
+func newJailSet(jails []config.JailConfig) *jailSet {
+	set := make(jailSet, len(jails))
+	for _, jail := range jails {
+		// The first of several jails with one name wins, as in FindJail
+		if _, exists := set[jail.Name]; !exists {
+			set[jail.Name] = jail
+		}
+	}
+	return &set
+}
+
+// SetJails replaces the jails. Later violations are counted under the new
+// jail settings; those of patterns referring to a jail that no longer
+// exists fall back to the global policy.
+func (m *Manager) SetJails(jails []config.JailConfig) {
+	m.jails.Store(newJailSet(jails))
+
+	m.logger.Info("Jails updated", zap.Int("jails", len(jails)))
+}
+
+// SetBanPolicy replaces the global ban policy that violations, jails and
+// shadow matches are judged under, including its duration strategy. The
+// tracking limits, cleanup interval and aggregation prefixes stay those the
+// manager was created with.
+func (m *Manager) SetBanPolicy(policy config.BanConfig) {
+	m.policy.Store(&policy)
+
+	m.logger.Info("Ban policy updated",
+		zap.Duration("initial_ban_time", policy.InitialBanTime),
+		zap.Int("max_attempts", policy.MaxAttempts),
+		zap.String("duration_strategy", policy.DurationStrategy))
+}
+
+// banPolicy returns the global ban policy
+func (m *Manager) banPolicy() config.BanConfig {
+	return *m.policy.Load()
+}
+
+// findJail returns the configuration of the named jail
+func (m *Manager) findJail(name string) (config.JailConfig, bool) {
+	jail, ok := (*m.jails.Load())[name]
+	return jail, ok
+}
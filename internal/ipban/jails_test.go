@@ -0,0 +1,145 @@
+package ipban
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+	"fail2ban-haproxy/internal/database"
+)
+
+// newProfileDatabase returns the DSN of a configuration database holding
+// the default ban profile and the given statements' rows
+func newProfileDatabase(t *testing.T, statements ...string) string {
+	t.Helper()
+	dsn := filepath.Join(t.TempDir(), "config.db")
+	db, err := database.NewDB(database.DatabaseConfig{Driver: "sqlite3", DSN: dsn})
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+	if err := db.InsertDefaultData(); err != nil {
+		t.Fatalf("Failed to insert default data: %v", err)
+	}
+
+	conn, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer conn.Close()
+	for _, statement := range statements {
+		if _, err := conn.Exec(statement); err != nil {
+			t.Fatalf("Failed to run %q: %v", statement, err)
+		}
+	}
+	return dsn
+}
+
+// syncFromDatabase keeps manager in sync with a config manager reading the
+// database at dsn, and waits until the jail named jail is loaded
+func syncFromDatabase(t *testing.T, manager *Manager, cfg *config.Config, dsn, jail string) {
+	t.Helper()
+	cfg.Database = config.DatabaseConfig{Enabled: true, Driver: "sqlite3", DSN: dsn}
+	// Per-address counting as by default, for the configuration to validate
+	cfg.Ban.IPv4AggregationPrefix = 32
+	cfg.Ban.IPv6AggregationPrefix = 128
+	cm, err := config.NewConfigManager(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create config manager: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.SyncAccessLists(ctx, cm, cm.UpdateChan())
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		cm.Stop()
+	})
+
+	for i := 0; ; i++ {
+		if _, ok := manager.findJail(jail); ok {
+			return
+		}
+		if i == 100 {
+			t.Fatalf("Expected jail %s to be loaded from the database", jail)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSetJailsReplacesJails(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Jails = []config.JailConfig{{Name: "dovecot", InitialBanTime: time.Hour}}
+	manager := NewManager(cfg, getTestLogger())
+
+	manager.SetJails([]config.JailConfig{{Name: "sogo", MaxAttempts: 1}})
+	if _, ok := manager.jailPolicy("dovecot"); ok {
+		t.Error("Expected the removed jail to be unknown")
+	}
+	if policy, ok := manager.jailPolicy("sogo"); !ok || policy.MaxAttempts != 1 {
+		t.Errorf("Expected the new jail's policy, got %+v", policy)
+	}
+}
+
+func TestDatabaseProfileChangesBanDuration(t *testing.T) {
+	dsn := newProfileDatabase(t, `
+		INSERT INTO ban_config (name, initial_ban_time_seconds, max_ban_time_seconds, escalation_factor,
+			max_attempts, time_window_seconds, cleanup_interval_seconds, max_memory_ttl_seconds)
+		VALUES ('dovecot', 3600, 86400, 2.0, 2, 600, 60, 259200)`)
+
+	cfg := getTestConfig()
+	manager, fake := newFakeClockManager(cfg)
+	syncFromDatabase(t, manager, cfg, dsn, "dovecot")
+
+	ip := "192.0.2.1"
+	for i := 0; i < 2; i++ {
+		manager.RecordMatch(ip, Match{Pattern: "dovecot-auth-failure", Jail: "dovecot", Severity: 1})
+	}
+	if !manager.IsBanned(ip) {
+		t.Fatal("Expected the profile's max attempts to ban")
+	}
+	profile := config.BanConfig{InitialBanTime: time.Hour, MaxBanTime: 24 * time.Hour, EscalationFactor: 2.0}
+	if got, want := manager.GetIPStats(ip).BannedUntil().Sub(fake.Now()), banDuration(profile, 1); got != want {
+		t.Errorf("Expected a ban of %v from the profile's 1h initial ban time, got %v", want, got)
+	}
+}
+
+func TestDatabaseBanPolicyChangesDurationStrategy(t *testing.T) {
+	dsn := newProfileDatabase(t, `
+		UPDATE ban_config SET max_attempts = 2, duration_strategy = 'steps', ban_steps_seconds = '900,7200'
+		WHERE name = 'default'`, `
+		INSERT INTO ban_config (name, initial_ban_time_seconds, max_ban_time_seconds, escalation_factor,
+			max_attempts, time_window_seconds, cleanup_interval_seconds, max_memory_ttl_seconds, duration_strategy)
+		VALUES ('sogo', 60, 86400, 3.0, 2, 600, 60, 259200, 'exponential')`)
+
+	cfg := getTestConfig()
+	manager, fake := newFakeClockManager(cfg)
+	syncFromDatabase(t, manager, cfg, dsn, "sogo")
+
+	// The default profile's steps apply to matches outside jails
+	ip := "192.0.2.1"
+	for _, want := range []time.Duration{15 * time.Minute, 2 * time.Hour} {
+		for i := 0; i < 2; i++ {
+			manager.RecordMatch(ip, Match{Pattern: "generic-auth-failure", Severity: 1})
+		}
+		if got := manager.GetIPStats(ip).BannedUntil().Sub(fake.Now()); got != want {
+			t.Errorf("Expected a %v ban from the default profile's steps, got %v", want, got)
+		}
+		fake.Advance(want + time.Minute)
+	}
+
+	// A profile's own strategy overrides the default profile's
+	ip = "192.0.2.2"
+	for i := 0; i < 2; i++ {
+		manager.RecordMatch(ip, Match{Pattern: "sogo-auth-failure", Jail: "sogo", Severity: 1})
+	}
+	if got := manager.GetIPStats(ip).BannedUntil().Sub(fake.Now()); got != time.Minute {
+		t.Errorf("Expected the profile's exponential 1m first ban, got %v", got)
+	}
+}
@@ -0,0 +1,147 @@
+package ipban
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// The manager tracks and bans keys: single addresses and CIDR prefixes,
+// held as canonical netip.Prefix values. An address is the full-length
+// prefix of its canonical form, so every spelling of an address maps to one
+// key. Strings from callers are parsed once, where they enter the package,
+// and keys are only formatted again for events, logs and snapshots.
+
+// parseAddr parses an IP address into its canonical form. It accepts the
+// variants proxies and log formats produce: IPv4-mapped IPv6 addresses
+// are unmapped, zones and enclosing brackets are dropped, and IPv4 octets
+// with leading zeros are read as decimal.
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && s[0] == '[' && s[len(s)-1] == ']' {
+		s = s[1 : len(s)-1]
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		var ok bool
+		if addr, ok = parseZeroPaddedIPv4(s); !ok {
+			return netip.Addr{}, fmt.Errorf("invalid IP address: %s", s)
+		}
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// NormalizeIP returns the canonical form of an IP address written in any of
+// the variants the manager accepts, so callers validate addresses the way
+// they will be tracked
+func NormalizeIP(ip string) (string, error) {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// parseZeroPaddedIPv4 parses dotted-quad IPv4 addresses whose octets have
+// leading zeros, such as 010.001.002.003, which netip rejects
+func parseZeroPaddedIPv4(s string) (netip.Addr, bool) {
+	var octets [4]byte
+	field, digits, value := 0, 0, 0
+	for i := 0; i <= len(s); i++ {
+		if i == len(s) || s[i] == '.' {
+			if digits == 0 || field == len(octets) {
+				return netip.Addr{}, false
+			}
+			octets[field] = byte(value)
+			field, digits, value = field+1, 0, 0
+			continue
+		}
+		if s[i] < '0' || s[i] > '9' || digits == 3 {
+			return netip.Addr{}, false
+		}
+		value = value*10 + int(s[i]-'0')
+		digits++
+		if value > 255 {
+			return netip.Addr{}, false
+		}
+	}
+	if field != len(octets) {
+		return netip.Addr{}, false
+	}
+	return netip.AddrFrom4(octets), true
+}
+
+// parseKey parses an IP address or CIDR prefix into its canonical key.
+// Prefixes are masked to their network address; IPv4-mapped IPv6 prefixes
+// such as ::ffff:10.0.0.0/104 become IPv4 prefixes.
+func parseKey(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	addrPart, bitsPart, isPrefix := strings.Cut(s, "/")
+
+	addr, err := parseAddr(addrPart)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address or CIDR prefix: %s", s)
+	}
+	if !isPrefix {
+		return addrKey(addr), nil
+	}
+
+	bits, err := strconv.ParseUint(bitsPart, 10, 8)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address or CIDR prefix: %s", s)
+	}
+	if addr.Is4() && strings.Contains(addrPart, ":") {
+		if bits >= ipv4KeyBits {
+			bits -= ipv4KeyBits
+		} else {
+			// Broader than the IPv4-mapped range: an IPv6 prefix
+			addr = netip.AddrFrom16(addr.As16())
+		}
+	}
+
+	key, err := addr.Prefix(int(bits))
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address or CIDR prefix: %s", s)
+	}
+	return key, nil
+}
+
+// addrKey returns the key of a single address
+func addrKey(addr netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// formatKey returns the string form of a key: the bare address for single
+// addresses, CIDR notation for prefixes
+func formatKey(key netip.Prefix) string {
+	if key.IsSingleIP() {
+		return key.Addr().String()
+	}
+	return key.String()
+}
+
+// prefixOf returns the key of the prefix containing key, using ipv4Bits or
+// ipv6Bits depending on the address family. If key is already at least
+// that broad it is returned unchanged.
+func prefixOf(key netip.Prefix, ipv4Bits, ipv6Bits int) (netip.Prefix, bool) {
+	bits := ipv6Bits
+	if key.Addr().Is4() {
+		bits = ipv4Bits
+	}
+	if bits >= key.Bits() {
+		return key, true
+	}
+
+	prefix, err := key.Addr().Prefix(bits)
+	return prefix, err == nil
+}
+
+// compareKeys orders keys by address, then by prefix length
+func compareKeys(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
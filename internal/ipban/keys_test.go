@@ -0,0 +1,149 @@
+package ipban
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// testKey parses an IP address or CIDR prefix into its key, panicking on
+// invalid input
+func testKey(s string) netip.Prefix {
+	key, err := parseKey(s)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"192.168.1.1", "192.168.1.1", true},
+		{"::ffff:192.168.1.1", "192.168.1.1", true},
+		{"192.168.001.001", "192.168.1.1", true},
+		{"010.000.000.001", "10.0.0.1", true},
+		{" 192.168.1.1 ", "192.168.1.1", true},
+		{"2001:DB8::1", "2001:db8::1", true},
+		{"2001:db8:0:0:0:0:0:1", "2001:db8::1", true},
+		{"[2001:db8::1]", "2001:db8::1", true},
+		{"fe80::1%eth0", "fe80::1", true},
+		{"256.1.1.1", "", false},
+		{"0192.168.1.1", "", false},
+		{"1.2.3", "", false},
+		{"invalid", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		addr, err := parseAddr(test.input)
+		if test.valid && err != nil {
+			t.Errorf("parseAddr(%q) returned unexpected error: %v", test.input, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("parseAddr(%q) expected error, got %s", test.input, addr)
+		} else if test.valid && addr.String() != test.expected {
+			t.Errorf("parseAddr(%q) = %s, expected %s", test.input, addr, test.expected)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"192.168.1.1", "192.168.1.1", true},
+		{"::ffff:192.168.1.1", "192.168.1.1", true},
+		{"203.0.113.77/24", "203.0.113.0/24", true},
+		{"203.0.113.77/32", "203.0.113.77", true},
+		{"2001:db8::1/48", "2001:db8::/48", true},
+		{"2001:db8::1/128", "2001:db8::1", true},
+		{"::ffff:10.1.2.3/104", "10.0.0.0/8", true},
+		{"::ffff:10.1.2.3/64", "::/64", true},
+		{"010.001.002.003/16", "10.1.0.0/16", true},
+		{"10.0.0.0/33", "", false},
+		{"10.0.0.0/", "", false},
+		{"10.0.0.0/-1", "", false},
+		{"invalid", "", false},
+	}
+
+	for _, test := range tests {
+		key, err := parseKey(test.input)
+		if test.valid && err != nil {
+			t.Errorf("parseKey(%s) returned unexpected error: %v", test.input, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("parseKey(%s) expected error, got %s", test.input, key)
+		} else if test.valid && formatKey(key) != test.expected {
+			t.Errorf("parseKey(%s) = %s, expected %s", test.input, formatKey(key), test.expected)
+		}
+	}
+}
+
+func TestPrefixOf(t *testing.T) {
+	tests := []struct {
+		key      string
+		ipv4Bits int
+		ipv6Bits int
+		expected string
+	}{
+		{"192.0.2.77", 24, 64, "192.0.2.0/24"},
+		{"192.0.2.77", 32, 64, "192.0.2.77"},
+		{"2001:db8:1:2:3:4:5:6", 24, 64, "2001:db8:1:2::/64"},
+		{"2001:db8:1:2::/64", 24, 48, "2001:db8:1::/48"},
+		{"2001:db8::/32", 24, 48, "2001:db8::/32"},
+		{"::ffff:192.0.2.77", 24, 64, "192.0.2.0/24"},
+	}
+
+	for _, test := range tests {
+		result, ok := prefixOf(testKey(test.key), test.ipv4Bits, test.ipv6Bits)
+		if !ok {
+			t.Errorf("prefixOf(%s) failed", test.key)
+		} else if formatKey(result) != test.expected {
+			t.Errorf("prefixOf(%s, %d, %d) = %s, expected %s", test.key, test.ipv4Bits, test.ipv6Bits, formatKey(result), test.expected)
+		}
+	}
+}
+
+func TestAddressVariantsShareOneEntry(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxAttempts = 3
+	manager := NewManager(cfg, getTestLogger())
+
+	manager.RecordViolation("192.168.1.120", 1, "plain")
+	manager.RecordViolation("::ffff:192.168.1.120", 1, "mapped")
+	manager.RecordViolation("192.168.001.120", 1, "zero-padded")
+
+	if count := manager.GetStatsCount(); count != 1 {
+		t.Fatalf("Expected one tracked entry for every spelling, got %d", count)
+	}
+	for _, ip := range []string{"192.168.1.120", "::ffff:192.168.1.120", "192.168.001.120"} {
+		if !manager.IsBanned(ip) {
+			t.Errorf("Expected %s to be banned", ip)
+		}
+	}
+	if _, exists := manager.GetAllBannedIPs()["192.168.1.120"]; !exists {
+		t.Error("Expected the ban to be listed under the canonical address")
+	}
+
+	if err := manager.ManualUnban("::ffff:192.168.1.120"); err != nil {
+		t.Fatalf("ManualUnban failed: %v", err)
+	}
+	if manager.IsBanned("192.168.1.120") {
+		t.Error("Expected unbanning any spelling to lift the ban")
+	}
+}
+
+func TestInvalidAddressesAreIgnored(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	manager.RecordViolation("not-an-ip", 1, "garbage")
+	if count := manager.GetStatsCount(); count != 0 {
+		t.Errorf("Expected invalid addresses not to be tracked, got %d entries", count)
+	}
+	if manager.IsBanned("not-an-ip") {
+		t.Error("Expected invalid addresses to never be banned")
+	}
+}
@@ -1,10 +1,15 @@
 package ipban
 
 import (
+	"container/list"
 	"context"
+	"fail2ban-haproxy/internal/clock"
 	"fail2ban-haproxy/internal/config"
-	"net"
+	"fmt"
+	"math"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -13,230 +18,823 @@ import (
 type Manager struct {
 	cfg    *config.Config
 	logger *zap.Logger
+	clock  clock.Clock
 	tree   *RadixTree
+
+	// shards partition the per-address stats, ban history and LRU order,
+	// each under its own lock. mutex guards the state shared between
+	// addresses: the writers of the ban tries, the expiry queue, subnet
+	// escalation, accounts and the shadow policy. Where both are needed,
+	// the shard's lock is taken first.
+	shards []statsShard
 	mutex  sync.RWMutex
-	stats  map[string]*IPStats
+
+	subnetHits map[netip.Prefix]map[netip.Prefix]time.Time // prefix -> banned key -> ban time
+	store      StateStore
+	events     *EventBus
+	shadow     *shadowState
+	lists      atomic.Pointer[accessLists]
+	scoped     atomic.Pointer[scopeTrees] // Bans limited to one scope
+	accounts   map[string]*accountStats   // Failed logins by username
+	expiries   *expiryQueue               // Next ban expiry of every banned key
+	expiryWake chan struct{}              // Signals an earlier next expiry to StartCleanup
+
+	blacklistStore BlacklistStore // Where the recidive policy blacklists, if anywhere
+
+	// pendingBlacklist holds the expiry of the repeat offenders blacklisted
+	// in memory until the synchronized blacklist has them, guarded by mutex
+	pendingBlacklist map[netip.Prefix]time.Time
+	honeypots        atomic.Pointer[honeypotSet]
+	jails            atomic.Pointer[jailSet]
+	policy           atomic.Pointer[config.BanConfig]
+
+	// lru orders the keys of unbanned stats entries from most (front) to
+	// least recently seen, across all shards. Its lock is taken last, after
+	// any shard lock and the manager's lock.
+	lruMutex sync.Mutex
+	lru      *list.List
+
+	tracked           atomic.Int64 // Stats entries of all shards
+	evictedIPs        atomic.Uint64
+	droppedViolations atomic.Uint64
 }
 
 type IPStats struct {
-	Violations    []Violation
-	BanExpiry     time.Time
-	BanCount      int
-	FirstSeen     time.Time
-	LastSeen      time.Time
-	TotalSeverity int
+	JailStats // Counters for patterns without a jail
+
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// LastSuccess is the time of the last successful login, if any
+	LastSuccess time.Time `json:"last_success"`
+
+	// RecentBans are the times of the automatic bans within the recidive
+	// lookback window, if the recidive policy is enabled
+	RecentBans []time.Time `json:"recent_bans,omitempty"`
+
+	// Jails holds the counters of named jails, keyed by jail name
+	Jails map[string]*JailStats `json:"jails,omitempty"`
+
+	lruElement *list.Element // Position in the LRU list, nil while banned
+}
+
+// JailStats tracks violations, score and ban escalation under one jail's
+// ban policy
+type JailStats struct {
+	Violations    ViolationBuffer `json:"violations"`
+	BanExpiry     time.Time       `json:"ban_expiry"`
+	BanCount      int             `json:"ban_count"`
+	TotalSeverity int             `json:"total_severity"`
+
+	// Scope is the jail the current ban is limited to, or empty if it
+	// blocks the address on every service
+	Scope string `json:"scope,omitempty"`
+
+	// CleanSince is the time of the last violation or the end of the last
+	// ban, whichever is later; ban counts are forgiven from then on
+	CleanSince time.Time `json:"clean_since,omitempty"`
+
+	// Score is the severity score as of ScoreUpdated; it decays
+	// exponentially with the configured half-life
+	Score        float64   `json:"score"`
+	ScoreUpdated time.Time `json:"score_updated"`
+
+	// Provenance describes what triggered the most recent ban. It is
+	// replaced, never modified, so it may be shared with readers.
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	samples []logSample // Most recent matching log lines, oldest first
 }
 
 type Violation struct {
-	Timestamp   time.Time
+	Timestamp   time.Time `json:"timestamp"`
+	Severity    int       `json:"severity"`
+	Description string    `json:"description"`
+	Pattern     string    `json:"pattern,omitempty"`
+	Sender      string    `json:"sender,omitempty"`
+	Username    string    `json:"username,omitempty"` // Normalized account the failed login was for
+}
+
+// Match describes a log line that matched a detection pattern
+type Match struct {
+	Pattern     string
+	Jail        string // Jail whose ban policy applies; empty for the global policy
 	Severity    int
 	Description string
-}
+	LogLine     string // Log line that matched, kept as ban evidence
+	Sender      string // Address of the syslog sender that reported it
+	Username    string // Account the failed login was for, if the pattern captures it
 
-type RadixTree struct {
-	root *RadixNode
+	// Timestamp is when the log line says the failure happened, which dates
+	// the violation in its time window. Zero means it happened on receipt.
+	Timestamp time.Time
 }
 
-type RadixNode struct {
-	children [2]*RadixNode // 0 and 1 for binary tree
-	isEnd    bool
-	ip       string
-	banned   bool
+// loggedAt returns when the match happened: its timestamp, or now if it
+// has none
+func (match Match) loggedAt(now time.Time) time.Time {
+	if match.Timestamp.IsZero() {
+		return now
+	}
+	return match.Timestamp
 }
 
 func NewManager(cfg *config.Config, logger *zap.Logger) *Manager {
-	return &Manager{
-		cfg:    cfg,
-		logger: logger,
-		tree:   NewRadixTree(),
-		stats:  make(map[string]*IPStats),
+	m := &Manager{
+		cfg:              cfg,
+		logger:           logger,
+		clock:            clock.Real(),
+		tree:             NewRadixTree(),
+		shards:           newStatsShards(statsShards),
+		lru:              list.New(),
+		subnetHits:       make(map[netip.Prefix]map[netip.Prefix]time.Time),
+		accounts:         make(map[string]*accountStats),
+		pendingBlacklist: make(map[netip.Prefix]time.Time),
+		expiries:         newExpiryQueue(),
+		expiryWake:       make(chan struct{}, 1),
+		events:           NewEventBus(logger),
 	}
+	m.shadow = newShadowState(m.clock.Now())
+	m.lists.Store(m.buildAccessLists(cfg.Ban.Whitelist, blacklistEntries(cfg.Ban.Blacklist)))
+	m.scoped.Store(&scopeTrees{})
+	m.honeypots.Store(newHoneypotSet(cfg.Ban.HoneypotUsernames))
+	m.jails.Store(newJailSet(cfg.Jails))
+	policy := cfg.Ban
+	m.policy.Store(&policy)
+	return m
 }
 
-func NewRadixTree() *RadixTree {
-	return &RadixTree{
-		root: &RadixNode{},
-	}
+// SetClock replaces the clock the manager reads the time from, the system
+// clock by default. Tests use a fake clock to simulate days of activity
+// without sleeping. It must be called before the manager is used.
+func (m *Manager) SetClock(c clock.Clock) {
+	m.clock = c
+	m.shadow = newShadowState(c.Now())
 }
 
-func (m *Manager) RecordViolation(ip string, severity int, description string) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// Subscribe registers subscriber for ban and violation events. Events are
+// delivered asynchronously; when the subscriber falls more than bufferSize
+// events behind, further events are dropped rather than delaying the manager.
+func (m *Manager) Subscribe(subscriber Subscriber, bufferSize int) *Subscription {
+	return m.events.Subscribe(subscriber, bufferSize)
+}
 
-	now := time.Now()
-	stats, exists := m.stats[ip]
+// Unsubscribe removes a subscription created by Subscribe
+func (m *Manager) Unsubscribe(sub *Subscription) {
+	m.events.Unsubscribe(sub)
+}
 
+func newIPStats(now time.Time) *IPStats {
+	return &IPStats{
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+}
+
+// jail returns the counters for the named jail, creating them if needed.
+// The empty name refers to the global counters.
+func (s *IPStats) jail(name string) *JailStats {
+	if name == "" {
+		return &s.JailStats
+	}
+	if s.Jails == nil {
+		s.Jails = make(map[string]*JailStats)
+	}
+	counter, exists := s.Jails[name]
 	if !exists {
-		stats = &IPStats{
-			Violations: make([]Violation, 0),
-			FirstSeen:  now,
-			LastSeen:   now,
+		counter = &JailStats{}
+		s.Jails[name] = counter
+	}
+	return counter
+}
+
+// BannedUntil returns the latest ban expiry across the global counters and
+// all jails
+func (s *IPStats) BannedUntil() time.Time {
+	expiry := s.BanExpiry
+	for _, counter := range s.Jails {
+		if counter.BanExpiry.After(expiry) {
+			expiry = counter.BanExpiry
 		}
-		m.stats[ip] = stats
+	}
+	return expiry
+}
+
+// clearBans lifts the global ban and the bans of all jails
+func (s *IPStats) clearBans(now time.Time) {
+	s.JailStats.endBan(now)
+	for _, counter := range s.Jails {
+		counter.endBan(now)
+	}
+}
+
+// RecordViolation records a violation for ip under the global ban policy.
+// Violations are counted under the address's aggregation key, so with a
+// shorter IPv6 aggregation prefix every address of the same /64 (by default)
+// shares one counter and one ban.
+func (m *Manager) RecordViolation(ip string, severity int, description string) {
+	m.RecordMatch(ip, Match{Severity: severity, Description: description})
+}
+
+// RecordMatch records a pattern match for ip against the match's jail.
+// Each jail counts violations separately and applies its own thresholds,
+// ban times and escalation; an empty or unknown jail uses the global policy.
+// The violation is dated by the match's timestamp, so lines delivered late
+// or in batches are counted when they happened, while bans always start on
+// receipt. Matches from whitelisted or invalid addresses are ignored.
+func (m *Manager) RecordMatch(ip string, match Match) {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		m.logger.Debug("Ignoring violation from invalid IP",
+			zap.String("ip", ip),
+			zap.String("pattern", match.Pattern))
+		return
+	}
+	key := addrKey(addr)
+	if m.lists.Load().whitelist.bannedAt(key, time.Time{}) {
+		m.logger.Debug("Ignoring violation from whitelisted IP",
+			zap.String("ip", ip),
+			zap.String("pattern", match.Pattern))
+		return
+	}
+	key = m.aggregationKey(key)
+	jail := match.Jail
+	policy, ok := m.jailPolicy(jail)
+	if !ok {
+		jail = ""
 	}
 
+	shard := m.shardFor(key)
+	shard.mutex.Lock()
+
+	now := m.clock.Now()
+	stats := m.trackStats(key, now)
 	stats.LastSeen = now
-	stats.TotalSeverity += severity
-	stats.Violations = append(stats.Violations, Violation{
-		Timestamp:   now,
-		Severity:    severity,
-		Description: description,
+	counter := stats.jail(jail)
+	loggedAt := match.loggedAt(now)
+	policy = m.withTolerance(policy, stats.LastSuccess, loggedAt)
+
+	m.droppedViolations.Add(countViolation(counter, policy, Violation{
+		Timestamp:   loggedAt,
+		Severity:    match.Severity,
+		Description: match.Description,
+		Pattern:     match.Pattern,
+		Sender:      match.Sender,
+		Username:    normalizeUsername(match.Username),
+	}))
+	counter.addSample(loggedAt, match.LogLine)
+
+	if m.cfg.Shadow.Enabled && len(m.cfg.Shadow.Patterns) == 0 {
+		m.evaluateShadow(key, match, stats.LastSuccess, now)
+	}
+
+	m.events.Publish(Event{
+		Type:      EventViolation,
+		IP:        formatKey(key),
+		Jail:      jail,
+		Pattern:   match.Pattern,
+		Reason:    match.Description,
+		Severity:  match.Severity,
+		Source:    SourceDetection,
+		Timestamp: now,
 	})
 
-	// Clean old violations outside time window
-	cutoff := now.Add(-m.cfg.Ban.TimeWindow)
-	validViolations := make([]Violation, 0)
-	totalSeverity := 0
-
-	for _, v := range stats.Violations {
-		if v.Timestamp.After(cutoff) {
-			validViolations = append(validViolations, v)
-			totalSeverity += v.Severity
+	// Check if IP should be banned. A failed login to a honeypot username
+	// bans at once for the maximum duration.
+	banned := false
+	if match.Username != "" && m.IsHoneypotUsername(match.Username) {
+		if counter.BanExpiry.Before(now) {
+			counter.BanCount++
+			m.applyBan(key, jail, "", policy, counter, policy.MaxBanTime,
+				fmt.Sprintf("failed login to honeypot username %s", normalizeUsername(match.Username)))
+			banned = true
 		}
+	} else if thresholdReached(policy, counter) && counter.BanExpiry.Before(now) {
+		m.banIP(key, jail, policy, counter)
+		banned = true
+	}
+	shard.mutex.Unlock()
+
+	// Escalations across addresses work on other shards, so they run once
+	// this one is released
+	if banned {
+		m.recordSubnetBan(key, now)
+	}
+	if match.Username != "" && m.cfg.Accounts.Enabled {
+		m.recordAccountFailure(key, match.Username, now)
+	}
+	m.evictIfFull(key, now)
+}
+
+// countViolation adds v to the counter: violations outside the policy's time
+// window are dropped, the buffer is kept within its capacity and the
+// severity total and decayed score are updated. Violations are dated by
+// their log timestamps, which may arrive out of order, so v is inserted in
+// timestamp order and the window ends at the latest violation. It returns
+// the number of violations discarded to make room.
+func countViolation(counter *JailStats, policy config.BanConfig, v Violation) uint64 {
+	latest := v.Timestamp
+	if last, ok := counter.Violations.Latest(); ok && last.Timestamp.After(latest) {
+		latest = last.Timestamp
+	}
+
+	// Clean old violations outside time window
+	cutoff := latest.Add(-policy.TimeWindow)
+	counter.Violations.DropBefore(cutoff)
+
+	// Once the buffer is full the oldest violations are overwritten. A
+	// violation logged before the window arrived too late to count.
+	capacity := violationCapacity(policy)
+	dropped := counter.Violations.Shrink(capacity)
+	if v.Timestamp.After(cutoff) {
+		dropped += counter.Violations.Insert(v, capacity)
+	}
+
+	if v.Timestamp.After(counter.CleanSince) {
+		counter.CleanSince = v.Timestamp
+	}
+	counter.TotalSeverity = counter.Violations.Severity()
+
+	// Decay the severity score and add this violation. A late violation
+	// has itself decayed since it happened.
+	if elapsed := v.Timestamp.Sub(counter.ScoreUpdated); elapsed >= 0 {
+		counter.Score = decayScore(counter.Score, elapsed, policy.ScoreHalfLife) + float64(v.Severity)
+		counter.ScoreUpdated = v.Timestamp
+	} else {
+		counter.Score += decayScore(float64(v.Severity), -elapsed, policy.ScoreHalfLife)
 	}
 
-	stats.Violations = validViolations
-	stats.TotalSeverity = totalSeverity
+	return uint64(dropped)
+}
 
-	// Check if IP should be banned
-	if len(stats.Violations) >= m.cfg.Ban.MaxAttempts && stats.BanExpiry.Before(now) {
-		m.banIP(ip, stats)
+// violationCapacity returns the number of violations kept per IP and jail,
+// or 0 for no limit. The buffer always holds enough violations to reach
+// the policy's MaxAttempts.
+func violationCapacity(policy config.BanConfig) int {
+	if policy.MaxViolationsPerIP <= 0 {
+		return 0
 	}
+	return max(policy.MaxViolationsPerIP, policy.MaxAttempts)
 }
 
-func (m *Manager) banIP(ip string, stats *IPStats) {
-	stats.BanCount++
+// jailPolicy returns the ban policy of the named jail, or the global policy
+// for an empty name. It reports false for jails that are not configured.
+func (m *Manager) jailPolicy(jail string) (config.BanConfig, bool) {
+	policy := m.banPolicy()
+	if jail == "" {
+		return policy, true
+	}
+	jailCfg, ok := m.findJail(jail)
+	if !ok {
+		return policy, false
+	}
+	return policy.WithJail(jailCfg), true
+}
+
+// thresholdReached reports whether counter warrants a ban under the policy's mode
+func thresholdReached(policy config.BanConfig, counter *JailStats) bool {
+	if policy.Mode == config.BanModeScore {
+		return counter.Score >= policy.ScoreThreshold
+	}
+	return counter.Violations.Len() >= policy.MaxAttempts
+}
+
+// decayScore applies exponential decay to score over elapsed time. A
+// non-positive half-life disables decay.
+func decayScore(score float64, elapsed, halfLife time.Duration) float64 {
+	if halfLife <= 0 || elapsed <= 0 || score == 0 {
+		return score
+	}
+	return score * math.Exp2(-float64(elapsed)/float64(halfLife))
+}
+
+func (m *Manager) banIP(key netip.Prefix, jail string, policy config.BanConfig, counter *JailStats) {
+	counter.BanCount++
 
 	// Calculate ban duration with escalation
-	banDuration := time.Duration(float64(m.cfg.Ban.InitialBanTime) *
-		float64(stats.BanCount) * m.cfg.Ban.EscalationFactor)
+	banDuration := banDuration(policy, counter.BanCount)
 
-	if banDuration > m.cfg.Ban.MaxBanTime {
-		banDuration = m.cfg.Ban.MaxBanTime
+	reason := fmt.Sprintf("%d violations within %v", counter.Violations.Len(), policy.TimeWindow)
+	if policy.Mode == config.BanModeScore {
+		reason = fmt.Sprintf("score %.1f reached threshold %.1f", counter.Score, policy.ScoreThreshold)
 	}
 
-	stats.BanExpiry = time.Now().Add(banDuration)
+	m.applyBan(key, jail, m.banScope(jail, counter.BanCount), policy, counter, banDuration, reason)
+}
+
+// applyBan bans key under the jail's counter for banDuration, limited to
+// scope, and records the detection that triggered it. Caller must hold the
+// key's shard lock and have counted the ban in the counter's BanCount.
+func (m *Manager) applyBan(key netip.Prefix, jail, scope string, policy config.BanConfig, counter *JailStats, banDuration time.Duration, reason string) {
+	score := counter.Score
+	counter.Score = 0 // Start scoring afresh once the ban is served
 
-	// Add to radix tree
-	m.tree.Insert(ip)
+	now := m.clock.Now()
+	counter.BanExpiry = now.Add(banDuration)
+	counter.Scope = scope
 
+	// Add to the radix tree of the ban's scope
+	stats := m.shardFor(key).stats[key]
+	m.publishBan(key, stats, counter.Scope)
+
+	ip := formatKey(key)
 	m.logger.Info("IP banned",
 		zap.String("ip", ip),
+		zap.String("jail", jail),
+		zap.String("scope", counter.Scope),
+		zap.String("reason", reason),
+		zap.Duration("duration", banDuration),
+		zap.Int("ban_count", counter.BanCount),
+		zap.Int("violations", counter.Violations.Len()),
+		zap.Float64("score", score),
+		zap.Time("expires", counter.BanExpiry))
+
+	// The window ends at the latest violation, which may be dated before now
+	var pattern string
+	windowEnd := now
+	if last, ok := counter.Violations.Latest(); ok {
+		pattern = last.Pattern
+		windowEnd = last.Timestamp
+	}
+	counter.Provenance = detectionProvenance(counter, reason, windowEnd.Add(-policy.TimeWindow), now)
+	if m.cfg.Shadow.Enabled {
+		m.mutex.Lock()
+		m.shadow.live.record(key, now, counter.BanExpiry)
+		m.mutex.Unlock()
+	}
+	m.events.Publish(Event{
+		Type:      EventBanned,
+		IP:        ip,
+		Jail:      jail,
+		Scope:     counter.Scope,
+		Pattern:   pattern,
+		Reason:    reason,
+		Duration:  banDuration,
+		Expires:   counter.BanExpiry,
+		Source:    SourceDetection,
+		Timestamp: now,
+	})
+
+	m.recordRecidive(key, stats, now)
+}
+
+// recordSubnetBan tracks an automatic ban against the enclosing prefix and
+// bans the whole prefix once enough distinct addresses inside it have been
+// banned within the subnet escalation window. It takes the locks itself,
+// so callers must not hold any.
+func (m *Manager) recordSubnetBan(key netip.Prefix, now time.Time) {
+	subnetCfg := m.cfg.Ban.SubnetEscalation
+	if !subnetCfg.Enabled {
+		return
+	}
+
+	prefix, ok := prefixOf(key, subnetCfg.IPv4PrefixLength, subnetCfg.IPv6PrefixLength)
+	if !ok || prefix == key {
+		return
+	}
+
+	m.mutex.Lock()
+	hits, exists := m.subnetHits[prefix]
+	if !exists {
+		hits = make(map[netip.Prefix]time.Time)
+		m.subnetHits[prefix] = hits
+	}
+	hits[key] = now
+
+	// Forget bans that fell out of the window
+	cutoff := now.Add(-subnetCfg.TimeWindow)
+	for hitKey, bannedAt := range hits {
+		if !bannedAt.After(cutoff) {
+			delete(hits, hitKey)
+		}
+	}
+	distinctIPs := len(hits)
+	m.mutex.Unlock()
+
+	if distinctIPs < subnetCfg.Threshold {
+		return
+	}
+
+	shard := m.shardFor(prefix)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	stats := m.trackStats(prefix, now)
+
+	if stats.BannedUntil().After(now) {
+		return
+	}
+
+	m.mutex.Lock()
+	delete(m.subnetHits, prefix)
+	m.mutex.Unlock()
+
+	stats.BanCount++
+	stats.LastSeen = now
+
+	banDuration := escalatedBanDuration(subnetCfg.InitialBanTime, subnetCfg.MaxBanTime,
+		subnetCfg.EscalationFactor, stats.BanCount)
+	stats.BanExpiry = now.Add(banDuration)
+
+	reason := fmt.Sprintf("%d addresses banned within %v", distinctIPs, subnetCfg.TimeWindow)
+	stats.Provenance = &Provenance{
+		Source:   SourceSubnetEscalation,
+		Reason:   reason,
+		BannedAt: now,
+	}
+
+	stats.Scope = ""
+	m.publishBan(prefix, stats, "")
+
+	m.logger.Info("Subnet banned",
+		zap.String("prefix", formatKey(prefix)),
 		zap.Duration("duration", banDuration),
 		zap.Int("ban_count", stats.BanCount),
-		zap.Int("violations", len(stats.Violations)),
+		zap.Int("distinct_ips", distinctIPs),
 		zap.Time("expires", stats.BanExpiry))
+
+	m.events.Publish(Event{
+		Type:      EventBanned,
+		IP:        formatKey(prefix),
+		Reason:    reason,
+		Duration:  banDuration,
+		Expires:   stats.BanExpiry,
+		Source:    SourceSubnetEscalation,
+		Timestamp: now,
+	})
 }
 
-func (m *Manager) IsBanned(ip string) bool {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+// aggregationKey returns the key under which violations from key are
+// counted: the enclosing prefix of the configured aggregation length. A
+// zero length, which validation rejects but configurations built without
+// defaults hold, counts per address like /32 and /128.
+func (m *Manager) aggregationKey(key netip.Prefix) netip.Prefix {
+	ipv4Bits := m.cfg.Ban.IPv4AggregationPrefix
+	if ipv4Bits <= 0 {
+		ipv4Bits = 32
+	}
+	ipv6Bits := m.cfg.Ban.IPv6AggregationPrefix
+	if ipv6Bits <= 0 {
+		ipv6Bits = 128
+	}
 
-	stats, exists := m.stats[ip]
-	if !exists {
-		return false
+	if prefix, ok := prefixOf(key, ipv4Bits, ipv6Bits); ok {
+		return prefix
 	}
+	return key
+}
 
-	if stats.BanExpiry.After(time.Now()) {
-		return m.tree.Search(ip)
+// escalatedBanDuration computes the linear ban duration for the given ban
+// count, capped at maxBanTime
+func escalatedBanDuration(initialBanTime, maxBanTime time.Duration, escalationFactor float64, banCount int) time.Duration {
+	banDuration := time.Duration(float64(initialBanTime) *
+		float64(banCount) * escalationFactor)
+
+	if banDuration > maxBanTime {
+		banDuration = maxBanTime
 	}
 
-	// Ban expired, remove from tree
-	m.tree.Delete(ip)
+	return banDuration
+}
+
+// IsBanned reports whether ip is covered by an active ban of any scope,
+// either on the address itself or on any prefix containing it. Whitelist
+// entries take precedence over everything else, then blacklist entries. It
+// reads the published tries without taking the manager's lock, so proxy
+// decisions are not delayed by violation ingestion. Expired entries are
+// left for cleanup. Invalid addresses are never banned.
+func (m *Manager) IsBanned(ip string) bool {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return m.isBanned(addrKey(addr), m.clock.Now())
+}
+
+// isBanned reports whether key is covered by an active ban of any scope
+func (m *Manager) isBanned(key netip.Prefix, now time.Time) bool {
+	if banned, decided := m.checkAccessLists(key, now); decided {
+		return banned
+	}
+	if m.tree.bannedAt(key, now) {
+		return true
+	}
+	for _, tree := range *m.scoped.Load() {
+		if tree.bannedAt(key, now) {
+			return true
+		}
+	}
 	return false
 }
 
+// StartCleanup lifts bans as they expire and prunes old records every
+// CleanupInterval, until ctx is cancelled
 func (m *Manager) StartCleanup(ctx context.Context) {
-	ticker := time.NewTicker(m.cfg.Ban.CleanupInterval)
+	ticker := m.clock.NewTicker(m.cfg.Ban.CleanupInterval)
 	defer ticker.Stop()
 
+	timer := m.clock.NewTimer(0)
+	defer timer.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			m.cleanup()
+		case <-timer.C():
+			m.expireDue(m.clock.Now(), SourceExpiry)
+		case <-m.expiryWake:
+		}
+
+		// Sleep until the earliest ban expiry, or until an earlier one is
+		// scheduled
+		if wait, ok := m.nextExpiryIn(); ok {
+			timer.Reset(wait)
+		} else {
+			timer.Stop()
 		}
 	}
 }
 
 func (m *Manager) cleanup() {
+	now := m.clock.Now()
+	cutoff := now.Add(-m.cfg.Ban.MaxMemoryTTL)
+
+	m.expireDue(now, SourceExpiry)
+
+	m.eachShard(func(shard *statsShard) {
+		for key, stats := range shard.stats {
+			bannedUntil := stats.BannedUntil()
+
+			if bannedUntil.Before(now) && !bannedUntil.IsZero() {
+				// Lift bans the expiry queue missed, so each is reported once
+				m.expireBans(key, now, SourceCleanup)
+			}
+			m.forgive(stats, now)
+
+			// Remove from memory if too old and not currently banned
+			if stats.LastSeen.Before(cutoff) && bannedUntil.Before(now) {
+				m.forgetStats(key)
+				m.deleteBans(key)
+				m.logger.Debug("Cleaned up old IP record", zap.String("ip", formatKey(key)))
+			}
+		}
+		m.pruneHistory(shard, now)
+	})
+
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	now := time.Now()
-	cutoff := now.Add(-m.cfg.Ban.MaxMemoryTTL)
-
-	for ip, stats := range m.stats {
-		// Remove from memory if too old and not currently banned
-		if stats.LastSeen.Before(cutoff) && stats.BanExpiry.Before(now) {
-			delete(m.stats, ip)
-			m.tree.Delete(ip)
-			m.logger.Debug("Cleaned up old IP record", zap.String("ip", ip))
-		} else if stats.BanExpiry.Before(now) {
-			// Just remove from ban tree if ban expired
-			m.tree.Delete(ip)
+	if m.cfg.Shadow.Enabled {
+		m.pruneShadow(now)
+	}
+	m.pruneAccounts(now)
+
+	// Forget subnet escalation candidates whose bans fell out of the window
+	subnetCutoff := now.Add(-m.cfg.Ban.SubnetEscalation.TimeWindow)
+	for prefix, hits := range m.subnetHits {
+		for key, bannedAt := range hits {
+			if !bannedAt.After(subnetCutoff) {
+				delete(hits, key)
+			}
+		}
+		if len(hits) == 0 {
+			delete(m.subnetHits, prefix)
 		}
 	}
 }
 
-// GetIPStats returns the statistics for a specific IP (for testing)
+// GetIPStats returns the statistics for a specific IP or CIDR prefix (for
+// testing)
 func (m *Manager) GetIPStats(ip string) *IPStats {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-	return m.stats[ip]
+	key, err := parseKey(ip)
+	if err != nil {
+		return nil
+	}
+
+	shard := m.shardFor(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	return shard.stats[key]
 }
 
 // GetStatsCount returns the number of IPs in the stats map (for testing)
 func (m *Manager) GetStatsCount() int {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-	return len(m.stats)
+	return int(m.tracked.Load())
 }
 
-// ManualBan manually bans an IP for a specific duration
+// ManualBan manually bans an IP or CIDR prefix for a specific duration
 func (m *Manager) ManualBan(ip string, duration time.Duration) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	return m.ManualBanWithOptions(ip, BanOptions{Duration: duration})
+}
 
-	// Add to radix tree
-	m.tree.Insert(ip)
+// BanOptions describes a manual ban
+type BanOptions struct {
+	Duration  time.Duration
+	Reason    string
+	CreatedBy string // User who requested the ban
 
-	// Update or create stats
-	now := time.Now()
-	stats, exists := m.stats[ip]
-	if !exists {
-		stats = &IPStats{
-			Violations: make([]Violation, 0),
-			FirstSeen:  now,
-			LastSeen:   now,
-		}
-		m.stats[ip] = stats
+	// Scope limits the ban to one service, named like the jail whose bans
+	// it checks. The ban applies to every service if empty.
+	Scope string
+}
+
+// ManualBanWithOptions manually bans an IP or CIDR prefix, recording the
+// reason and the user who requested it
+func (m *Manager) ManualBanWithOptions(ip string, opts BanOptions) error {
+	key, err := parseKey(ip)
+	if err != nil {
+		return err
 	}
+	ip = formatKey(key)
 
-	stats.BanExpiry = now.Add(duration)
-	stats.BanCount++
+	shard := m.shardFor(key)
+	shard.mutex.Lock()
+
+	// Update or create stats
+	now := m.clock.Now()
+	stats := m.trackStats(key, now)
+
+	counter := stats.jail(opts.Scope)
+	counter.BanExpiry = now.Add(opts.Duration)
+	counter.BanCount++
+	counter.Scope = opts.Scope
+	counter.Provenance = &Provenance{
+		Source:    SourceManual,
+		Reason:    opts.Reason,
+		CreatedBy: opts.CreatedBy,
+		BannedAt:  now,
+	}
 	stats.LastSeen = now
 
+	// Add to the radix tree of the ban's scope
+	m.publishBan(key, stats, opts.Scope)
+
 	m.logger.Info("Manual ban applied",
 		zap.String("ip", ip),
-		zap.Duration("duration", duration),
-		zap.Time("expires", stats.BanExpiry))
+		zap.String("scope", opts.Scope),
+		zap.Duration("duration", opts.Duration),
+		zap.String("reason", opts.Reason),
+		zap.String("created_by", opts.CreatedBy),
+		zap.Time("expires", counter.BanExpiry))
+
+	m.events.Publish(Event{
+		Type:      EventBanned,
+		IP:        ip,
+		Jail:      opts.Scope,
+		Scope:     opts.Scope,
+		Reason:    opts.Reason,
+		Duration:  opts.Duration,
+		Expires:   counter.BanExpiry,
+		Source:    SourceManual,
+		Timestamp: now,
+	})
+	shard.mutex.Unlock()
 
+	m.evictIfFull(key, now)
 	return nil
 }
 
-// ManualUnban manually unbans an IP
+// ManualUnban manually unbans an IP or CIDR prefix. Unbanning a single
+// address also lifts the ban on its aggregation prefix, if any.
 func (m *Manager) ManualUnban(ip string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	key, err := parseKey(ip)
+	if err != nil {
+		return err
+	}
+	ip = formatKey(key)
 
-	// Remove from radix tree
-	m.tree.Delete(ip)
+	keys := []netip.Prefix{key}
+	if aggregated := m.aggregationKey(key); aggregated != key && key.IsSingleIP() {
+		keys = append(keys, aggregated)
+	}
 
-	// Clear ban expiry in stats
-	if stats, exists := m.stats[ip]; exists {
-		stats.BanExpiry = time.Time{}
+	now := m.clock.Now()
+	for _, key := range keys {
+		shard := m.shardFor(key)
+		shard.mutex.Lock()
+
+		// Remove from radix tree
+		m.deleteBans(key)
+
+		// Clear ban expiry in stats
+		if stats, exists := shard.stats[key]; exists {
+			bannedUntil := stats.BannedUntil()
+			stats.clearBans(now)
+			m.syncLRU(key, stats)
+
+			if bannedUntil.After(now) {
+				m.events.Publish(Event{
+					Type:      EventUnbanned,
+					IP:        formatKey(key),
+					Expires:   bannedUntil,
+					Source:    SourceManual,
+					Timestamp: now,
+				})
+			}
+		}
+		shard.mutex.Unlock()
 	}
 
 	m.logger.Info("Manual unban applied", zap.String("ip", ip))
@@ -246,55 +844,57 @@ func (m *Manager) ManualUnban(ip string) error {
 
 // GetAllBannedIPs returns all currently banned IPs with their expiry times
 func (m *Manager) GetAllBannedIPs() map[string]time.Time {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-
 	result := make(map[string]time.Time)
-	now := time.Now()
+	now := m.clock.Now()
 
-	for ip, stats := range m.stats {
-		if !stats.BanExpiry.IsZero() && stats.BanExpiry.After(now) {
-			result[ip] = stats.BanExpiry
+	m.eachShardRead(func(shard *statsShard) {
+		for key, stats := range shard.stats {
+			if bannedUntil := stats.BannedUntil(); bannedUntil.After(now) {
+				result[formatKey(key)] = bannedUntil
+			}
 		}
-	}
+	})
 
 	return result
 }
 
 // PurgeAllBans removes all temporary bans from memory and radix tree
 func (m *Manager) PurgeAllBans() int {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
 	count := 0
-	for ip, stats := range m.stats {
-		if !stats.BanExpiry.IsZero() {
-			m.tree.Delete(ip)
-			stats.BanExpiry = time.Time{}
-			count++
+	now := m.clock.Now()
+	m.eachShard(func(shard *statsShard) {
+		for key, stats := range shard.stats {
+			if bannedUntil := stats.BannedUntil(); !bannedUntil.IsZero() {
+				m.deleteBans(key)
+				stats.clearBans(now)
+				m.syncLRU(key, stats)
+				count++
+
+				eventType := EventUnbanned
+				if !bannedUntil.After(now) {
+					eventType = EventExpired
+				}
+				m.events.Publish(Event{
+					Type:      eventType,
+					IP:        formatKey(key),
+					Expires:   bannedUntil,
+					Source:    SourcePurge,
+					Timestamp: now,
+				})
+			}
 		}
-	}
+	})
 
 	m.logger.Info("Purged all temporary bans", zap.Int("count", count))
 
 	return count
 }
 
-// PurgeExpiredBans removes only expired bans (called by cleanup)
+// PurgeExpiredBans lifts the bans that expired but were not lifted by the
+// expiry timer yet, and returns the number of addresses and prefixes whose
+// bans ended
 func (m *Manager) PurgeExpiredBans() int {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
-	count := 0
-	now := time.Now()
-
-	for ip, stats := range m.stats {
-		if !stats.BanExpiry.IsZero() && stats.BanExpiry.Before(now) {
-			m.tree.Delete(ip)
-			stats.BanExpiry = time.Time{}
-			count++
-		}
-	}
+	count := m.expireDue(m.clock.Now(), SourcePurge)
 
 	if count > 0 {
 		m.logger.Info("Purged expired bans", zap.Int("count", count))
@@ -305,22 +905,33 @@ func (m *Manager) PurgeExpiredBans() int {
 
 // GetRadixTreeStats returns statistics about the radix tree
 func (m *Manager) GetRadixTreeStats() map[string]interface{} {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-
-	bannedCount := 0
-	now := time.Now()
-
-	for _, stats := range m.stats {
-		if !stats.BanExpiry.IsZero() && stats.BanExpiry.After(now) {
-			bannedCount++
+	bannedCount, tracked := 0, 0
+	now := m.clock.Now()
+
+	m.eachShardRead(func(shard *statsShard) {
+		tracked += len(shard.stats)
+		for _, stats := range shard.stats {
+			if stats.BannedUntil().After(now) {
+				bannedCount++
+			}
 		}
+	})
+
+	scoped := *m.scoped.Load()
+	treeNodes := m.countRadixNodes(m.tree.root.Load())
+	for _, tree := range scoped {
+		treeNodes += m.countRadixNodes(tree.root.Load())
 	}
 
 	return map[string]interface{}{
-		"total_ips_tracked": len(m.stats),
-		"currently_banned":  bannedCount,
-		"tree_nodes":        m.countRadixNodes(m.tree.root),
+		"total_ips_tracked":     tracked,
+		"currently_banned":      bannedCount,
+		"tree_nodes":            treeNodes,
+		"ban_scopes":            len(scoped),
+		"max_tracked_ips":       m.cfg.Ban.MaxTrackedIPs,
+		"evicted_ips":           m.evictedIPs.Load(),
+		"max_violations_per_ip": m.cfg.Ban.MaxViolationsPerIP,
+		"dropped_violations":    m.droppedViolations.Load(),
 	}
 }
 
@@ -337,75 +948,3 @@ func (m *Manager) countRadixNodes(node *RadixNode) int {
 
 	return count
 }
-
-func (rt *RadixTree) Insert(ip string) {
-	bytes := ipToBytes(ip)
-	if bytes == nil {
-		return
-	}
-
-	node := rt.root
-	for _, b := range bytes {
-		for i := 7; i >= 0; i-- {
-			bit := (b >> i) & 1
-			if node.children[bit] == nil {
-				node.children[bit] = &RadixNode{}
-			}
-			node = node.children[bit]
-		}
-	}
-	node.isEnd = true
-	node.ip = ip
-	node.banned = true
-}
-
-func (rt *RadixTree) Search(ip string) bool {
-	bytes := ipToBytes(ip)
-	if bytes == nil {
-		return false
-	}
-
-	node := rt.root
-	for _, b := range bytes {
-		for i := 7; i >= 0; i-- {
-			bit := (b >> i) & 1
-			if node.children[bit] == nil {
-				return false
-			}
-			node = node.children[bit]
-		}
-	}
-	return node.isEnd && node.banned
-}
-
-func (rt *RadixTree) Delete(ip string) {
-	bytes := ipToBytes(ip)
-	if bytes == nil {
-		return
-	}
-
-	node := rt.root
-	for _, b := range bytes {
-		for i := 7; i >= 0; i-- {
-			bit := (b >> i) & 1
-			if node.children[bit] == nil {
-				return
-			}
-			node = node.children[bit]
-		}
-	}
-	if node.isEnd {
-		node.banned = false
-	}
-}
-
-func ipToBytes(ip string) []byte {
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return nil
-	}
-	if parsedIP.To4() != nil {
-		return parsedIP.To4()
-	}
-	return parsedIP.To16()
-}
@@ -0,0 +1,79 @@
+package ipban
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newBenchmarkManager(bannedIPs int) *Manager {
+	cfg := getTestConfig()
+	manager := NewManager(cfg, zap.NewNop())
+	for i := 0; i < bannedIPs; i++ {
+		manager.ManualBan(fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255), time.Hour)
+	}
+	return manager
+}
+
+func BenchmarkIsBanned(b *testing.B) {
+	manager := newBenchmarkManager(10000)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			manager.IsBanned(fmt.Sprintf("10.0.%d.%d", i>>8&255, i&255))
+			i++
+		}
+	})
+}
+
+// BenchmarkIsBannedUnderIngestion measures proxy decision latency while
+// violations from a syslog flood are recorded concurrently, and reports
+// the p50 and p99 latency of individual IsBanned calls.
+func BenchmarkIsBannedUnderIngestion(b *testing.B) {
+	for _, writers := range []int{0, 1, 4} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			manager := newBenchmarkManager(10000)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{}, writers)
+			for w := 0; w < writers; w++ {
+				go func(w int) {
+					defer func() { done <- struct{}{} }()
+					for i := 0; ctx.Err() == nil; i++ {
+						ip := fmt.Sprintf("172.%d.%d.%d", 16+w, i>>8&255, i&255)
+						manager.RecordViolation(ip, 1, "flood")
+					}
+				}(w)
+			}
+
+			ips := make([]string, 1024)
+			for i := range ips {
+				ips[i] = fmt.Sprintf("10.0.%d.%d", i>>8&255, i&255)
+			}
+			latencies := make([]time.Duration, b.N)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				manager.IsBanned(ips[i%len(ips)])
+				latencies[i] = time.Since(start)
+			}
+			b.StopTimer()
+
+			cancel()
+			for w := 0; w < writers; w++ {
+				<-done
+			}
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[len(latencies)/2].Nanoseconds()), "p50-ns")
+			b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+		})
+	}
+}
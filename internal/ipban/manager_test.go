@@ -2,7 +2,9 @@ package ipban
 
 import (
 	"context"
+	"fail2ban-haproxy/internal/clock"
 	"fail2ban-haproxy/internal/config"
+	"fmt"
 	"testing"
 	"time"
 
@@ -28,6 +30,18 @@ func getTestLogger() *zap.Logger {
 	return logger
 }
 
+// testStart is the time the fake clocks of tests start at
+var testStart = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// newFakeClockManager returns a manager on a fake clock, so tests move time
+// forward instead of sleeping
+func newFakeClockManager(cfg *config.Config) (*Manager, *clock.Fake) {
+	fake := clock.NewFake(testStart)
+	manager := NewManager(cfg, getTestLogger())
+	manager.SetClock(fake)
+	return manager, fake
+}
+
 func TestNewManager(t *testing.T) {
 	cfg := getTestConfig()
 	logger := getTestLogger()
@@ -46,8 +60,8 @@ func TestNewManager(t *testing.T) {
 	if manager.tree == nil {
 		t.Error("Expected radix tree to be initialized")
 	}
-	if manager.stats == nil {
-		t.Error("Expected stats map to be initialized")
+	if len(manager.shards) != statsShards {
+		t.Errorf("Expected %d stats shards, got %d", statsShards, len(manager.shards))
 	}
 }
 
@@ -68,17 +82,17 @@ func TestRecordViolation(t *testing.T) {
 	if stats == nil {
 		t.Fatal("Expected IP stats to be created")
 	}
-	if len(stats.Violations) != 1 {
-		t.Errorf("Expected 1 violation, got %d", len(stats.Violations))
+	if stats.Violations.Len() != 1 {
+		t.Errorf("Expected 1 violation, got %d", stats.Violations.Len())
 	}
 	if stats.TotalSeverity != severity {
 		t.Errorf("Expected total severity %d, got %d", severity, stats.TotalSeverity)
 	}
-	if stats.Violations[0].Severity != severity {
-		t.Errorf("Expected violation severity %d, got %d", severity, stats.Violations[0].Severity)
+	if stats.Violations.At(0).Severity != severity {
+		t.Errorf("Expected violation severity %d, got %d", severity, stats.Violations.At(0).Severity)
 	}
-	if stats.Violations[0].Description != description {
-		t.Errorf("Expected violation description '%s', got '%s'", description, stats.Violations[0].Description)
+	if stats.Violations.At(0).Description != description {
+		t.Errorf("Expected violation description '%s', got '%s'", description, stats.Violations.At(0).Description)
 	}
 }
 
@@ -152,8 +166,7 @@ func TestBanEscalation(t *testing.T) {
 
 func TestIsBannedExpiry(t *testing.T) {
 	cfg := getTestConfig()
-	logger := getTestLogger()
-	manager := NewManager(cfg, logger)
+	manager, fake := newFakeClockManager(cfg)
 
 	ip := "192.168.1.103"
 
@@ -167,9 +180,14 @@ func TestIsBannedExpiry(t *testing.T) {
 		t.Error("Expected IP to be banned")
 	}
 
-	// Simulate ban expiry
-	stats := manager.GetIPStats(ip)
-	stats.BanExpiry = time.Now().Add(-1 * time.Second)
+	// Still banned just before the ban ends
+	fake.Set(manager.GetIPStats(ip).BannedUntil().Add(-time.Second))
+	if !manager.IsBanned(ip) {
+		t.Error("Expected IP to stay banned until its ban ends")
+	}
+
+	// Let the ban expire
+	fake.Advance(time.Second)
 
 	// Should not be banned anymore
 	if manager.IsBanned(ip) {
@@ -179,9 +197,7 @@ func TestIsBannedExpiry(t *testing.T) {
 
 func TestTimeWindowCleanup(t *testing.T) {
 	cfg := getTestConfig()
-	cfg.Ban.TimeWindow = 1 * time.Second // Short window for testing
-	logger := getTestLogger()
-	manager := NewManager(cfg, logger)
+	manager, fake := newFakeClockManager(cfg)
 
 	ip := "192.168.1.104"
 
@@ -189,8 +205,8 @@ func TestTimeWindowCleanup(t *testing.T) {
 	manager.RecordViolation(ip, 1, "old violation")
 	manager.RecordViolation(ip, 1, "old violation")
 
-	// Wait for time window to pass
-	time.Sleep(2 * time.Second)
+	// Let the time window pass
+	fake.Advance(cfg.Ban.TimeWindow + time.Second)
 
 	// Record new violation - should clean old ones
 	manager.RecordViolation(ip, 1, "new violation")
@@ -198,19 +214,75 @@ func TestTimeWindowCleanup(t *testing.T) {
 	stats := manager.GetIPStats(ip)
 
 	// Should only have the latest violation
-	if len(stats.Violations) != 1 {
-		t.Errorf("Expected 1 violation after cleanup, got %d", len(stats.Violations))
+	if stats.Violations.Len() != 1 {
+		t.Errorf("Expected 1 violation after cleanup, got %d", stats.Violations.Len())
 	}
 	if stats.TotalSeverity != 1 {
 		t.Errorf("Expected total severity 1 after cleanup, got %d", stats.TotalSeverity)
 	}
 }
 
+func TestViolationsDatedByLogTimestamp(t *testing.T) {
+	cfg := getTestConfig()
+	manager, fake := newFakeClockManager(cfg)
+	ip := "192.168.1.107"
+	now := fake.Now()
+
+	record := func(at time.Time) {
+		manager.RecordMatch(ip, Match{Severity: 1, Description: "late violation", Timestamp: at})
+	}
+
+	// Delivered out of order, kept in timestamp order
+	record(now.Add(-2 * time.Minute))
+	record(now.Add(-8 * time.Minute))
+	stats := manager.GetIPStats(ip)
+	if stats.Violations.Len() != 2 || !stats.Violations.At(0).Timestamp.Equal(now.Add(-8*time.Minute)) {
+		t.Fatalf("Expected violations in timestamp order, got %+v", stats.Violations)
+	}
+
+	// Older than the window before the latest violation: too late to count
+	record(now.Add(-15 * time.Minute))
+	if stats.Violations.Len() != 2 {
+		t.Errorf("Expected a violation before the window to be ignored, got %d violations", stats.Violations.Len())
+	}
+	if manager.IsBanned(ip) {
+		t.Fatal("Expected no ban below the threshold")
+	}
+
+	// The third violation within the window bans from now on
+	record(now.Add(-5 * time.Minute))
+	if !manager.IsBanned(ip) {
+		t.Fatal("Expected late violations within the window to ban")
+	}
+	if expiry := stats.BannedUntil(); !expiry.After(now) {
+		t.Errorf("Expected the ban to start on receipt, expires %v", expiry)
+	}
+}
+
+func TestLateViolationScoreDecays(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.Mode = config.BanModeScore
+	cfg.Ban.ScoreThreshold = 100
+	cfg.Ban.ScoreHalfLife = time.Minute
+	manager, fake := newFakeClockManager(cfg)
+	ip := "192.168.1.108"
+	now := fake.Now()
+
+	manager.RecordMatch(ip, Match{Severity: 8, Timestamp: now})
+	manager.RecordMatch(ip, Match{Severity: 8, Timestamp: now.Add(-2 * time.Minute)})
+
+	stats := manager.GetIPStats(ip)
+	if stats.Score != 10 {
+		t.Errorf("Expected the late violation to count after two half-lives, got score %v", stats.Score)
+	}
+	if !stats.ScoreUpdated.Equal(now) {
+		t.Errorf("Expected the score to stay dated %v, got %v", now, stats.ScoreUpdated)
+	}
+}
+
 func TestCleanup(t *testing.T) {
 	cfg := getTestConfig()
-	cfg.Ban.MaxMemoryTTL = 1 * time.Second // Short TTL for testing
-	logger := getTestLogger()
-	manager := NewManager(cfg, logger)
+	manager, fake := newFakeClockManager(cfg)
 
 	ip := "192.168.1.105"
 
@@ -223,8 +295,8 @@ func TestCleanup(t *testing.T) {
 		t.Fatal("Expected IP to exist in stats")
 	}
 
-	// Wait for TTL to pass
-	time.Sleep(2 * time.Second)
+	// Let the TTL pass
+	fake.Advance(cfg.Ban.MaxMemoryTTL + time.Second)
 
 	// Run cleanup
 	manager.cleanup()
@@ -238,25 +310,33 @@ func TestCleanup(t *testing.T) {
 
 func TestStartCleanup(t *testing.T) {
 	cfg := getTestConfig()
-	cfg.Ban.CleanupInterval = 100 * time.Millisecond // Fast cleanup for testing
-	logger := getTestLogger()
-	manager := NewManager(cfg, logger)
+	manager, fake := newFakeClockManager(cfg)
+	manager.RecordViolation("192.168.1.106", 1, "test violation")
 
 	ctx, cancel := context.WithCancel(context.Background())
-
-	// Start cleanup in goroutine
-	go manager.StartCleanup(ctx)
-
-	// Let it run for a bit
-	time.Sleep(500 * time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		manager.StartCleanup(ctx)
+	}()
+
+	// Once the cleanup ticker is running, move past the TTL
+	fake.BlockUntil(1)
+	fake.Advance(cfg.Ban.MaxMemoryTTL + cfg.Ban.CleanupInterval)
+	for i := 0; manager.GetStatsCount() != 0; i++ {
+		if i == 100 {
+			t.Fatal("Expected the cleanup ticker to drop the expired record")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 
 	// Cancel and verify it stops
 	cancel()
-
-	// Give it time to stop
-	time.Sleep(200 * time.Millisecond)
-
-	// Test passes if no panic or deadlock occurs
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expected cleanup to stop when the context is cancelled")
+	}
 }
 
 func TestRadixTreeOperations(t *testing.T) {
@@ -304,26 +384,6 @@ func TestRadixTreeInvalidIP(t *testing.T) {
 	tree.Delete("invalid.ip") // Should not panic
 }
 
-func TestIPToBytes(t *testing.T) {
-	tests := []struct {
-		ip       string
-		expected int
-	}{
-		{"192.168.1.1", 4}, // IPv4
-		{"::1", 16},        // IPv6
-		{"invalid", 0},     // Invalid IP
-	}
-
-	for _, test := range tests {
-		bytes := ipToBytes(test.ip)
-		if test.expected == 0 && bytes != nil {
-			t.Errorf("Expected nil for invalid IP %s, got %v", test.ip, bytes)
-		} else if test.expected > 0 && len(bytes) != test.expected {
-			t.Errorf("Expected %d bytes for IP %s, got %d", test.expected, test.ip, len(bytes))
-		}
-	}
-}
-
 func TestConcurrentAccess(t *testing.T) {
 	cfg := getTestConfig()
 	logger := getTestLogger()
@@ -367,3 +427,678 @@ func TestConcurrentAccess(t *testing.T) {
 		t.Error("Expected IP stats to exist after concurrent access")
 	}
 }
+
+func TestRadixTreePrefixOperations(t *testing.T) {
+	tree := NewRadixTree()
+
+	tree.Insert("203.0.113.0/24")
+	tree.Insert("2001:db8::/48")
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"203.0.113.1", true},
+		{"203.0.113.255", true},
+		{"203.0.114.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8:0:ffff::1", true},
+		{"2001:db8:1::1", false},
+		{"::ffff:203.0.113.7", true},
+	}
+
+	for _, test := range tests {
+		if result := tree.Search(test.ip); result != test.expected {
+			t.Errorf("Search(%s) = %v, expected %v", test.ip, result, test.expected)
+		}
+	}
+
+	tree.Delete("203.0.113.0/24")
+	if tree.Search("203.0.113.1") {
+		t.Error("Expected prefix ban to be removed after deletion")
+	}
+	if !tree.Search("2001:db8::1") {
+		t.Error("Expected unrelated prefix to remain banned")
+	}
+}
+
+func TestRadixTreeFamiliesAreSeparate(t *testing.T) {
+	tree := NewRadixTree()
+
+	// 1.0.0.0/8 shares its leading bits with 100::/8 but must not match it
+	tree.Insert("1.0.0.0/8")
+	if tree.Search("100::1") {
+		t.Error("Expected IPv4 prefix to not match IPv6 address")
+	}
+	if !tree.Search("1.2.3.4") {
+		t.Error("Expected IPv4 prefix to match IPv4 address")
+	}
+}
+
+func TestRadixTreeLookupLongestPrefixFirst(t *testing.T) {
+	tree := NewRadixTree()
+
+	tree.Insert("10.0.0.0/8")
+	tree.Insert("10.1.0.0/16")
+	tree.Insert("10.1.2.3")
+
+	matches := tree.Lookup("10.1.2.3")
+	expected := []string{"10.1.2.3", "10.1.0.0/16", "10.0.0.0/8"}
+
+	if len(matches) != len(expected) {
+		t.Fatalf("Expected %d matches, got %d (%v)", len(expected), len(matches), matches)
+	}
+	for i := range expected {
+		if matches[i] != expected[i] {
+			t.Errorf("Expected match %d to be %s, got %s", i, expected[i], matches[i])
+		}
+	}
+}
+
+func TestManualBanCIDR(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	if err := manager.ManualBan("198.51.100.17/24", time.Hour); err != nil {
+		t.Fatalf("Expected CIDR ban to succeed, got %v", err)
+	}
+
+	if !manager.IsBanned("198.51.100.200") {
+		t.Error("Expected address inside banned prefix to be banned")
+	}
+	if manager.IsBanned("198.51.101.1") {
+		t.Error("Expected address outside banned prefix to not be banned")
+	}
+
+	banned := manager.GetAllBannedIPs()
+	if _, exists := banned["198.51.100.0/24"]; !exists {
+		t.Errorf("Expected normalized prefix in banned list, got %v", banned)
+	}
+
+	if err := manager.ManualUnban("198.51.100.0/24"); err != nil {
+		t.Fatalf("Expected CIDR unban to succeed, got %v", err)
+	}
+	if manager.IsBanned("198.51.100.200") {
+		t.Error("Expected address to be unbanned after prefix unban")
+	}
+
+	if err := manager.ManualBan("not-a-prefix/24", time.Hour); err == nil {
+		t.Error("Expected invalid CIDR to be rejected")
+	}
+}
+
+func TestIsBannedPrefersActiveBroaderPrefix(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	manager.ManualBan("192.0.2.0/24", time.Hour)
+	manager.ManualBan("192.0.2.10", time.Hour)
+
+	// Expire the more specific ban; the prefix ban must still apply
+	manager.GetIPStats("192.0.2.10").BanExpiry = time.Now().Add(-time.Second)
+
+	if !manager.IsBanned("192.0.2.10") {
+		t.Error("Expected address to remain banned by the enclosing prefix")
+	}
+}
+
+func getSubnetEscalationConfig() *config.Config {
+	cfg := getTestConfig()
+	cfg.Ban.MaxAttempts = 1
+	cfg.Ban.SubnetEscalation = config.SubnetEscalationConfig{
+		Enabled:          true,
+		Threshold:        3,
+		TimeWindow:       time.Hour,
+		IPv4PrefixLength: 24,
+		IPv6PrefixLength: 64,
+		InitialBanTime:   time.Hour,
+		MaxBanTime:       7 * 24 * time.Hour,
+		EscalationFactor: 2.0,
+	}
+	return cfg
+}
+
+func TestSubnetEscalation(t *testing.T) {
+	cfg := getSubnetEscalationConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	manager.RecordViolation("203.0.113.1", 1, "test violation")
+	manager.RecordViolation("203.0.113.2", 1, "test violation")
+
+	if manager.IsBanned("203.0.113.50") {
+		t.Fatal("Expected prefix to not be banned below threshold")
+	}
+
+	manager.RecordViolation("203.0.113.3", 1, "test violation")
+
+	if !manager.IsBanned("203.0.113.50") {
+		t.Error("Expected prefix to be banned once threshold is reached")
+	}
+	if manager.IsBanned("203.0.114.1") {
+		t.Error("Expected neighbouring prefix to not be banned")
+	}
+
+	stats := manager.GetIPStats("203.0.113.0/24")
+	if stats == nil {
+		t.Fatal("Expected stats for the escalated prefix")
+	}
+	if stats.BanCount != 1 {
+		t.Errorf("Expected prefix ban count 1, got %d", stats.BanCount)
+	}
+
+	// Subnet bans use their own escalation settings
+	expected := escalatedBanDuration(time.Hour, 7*24*time.Hour, 2.0, 1)
+	remaining := time.Until(stats.BanExpiry)
+	if remaining > expected || remaining < expected-time.Minute {
+		t.Errorf("Expected subnet ban of about %v, got %v", expected, remaining)
+	}
+}
+
+func TestSubnetEscalationIPv6(t *testing.T) {
+	cfg := getSubnetEscalationConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	manager.RecordViolation("2001:db8:1:2::a", 1, "test violation")
+	manager.RecordViolation("2001:db8:1:2::b", 1, "test violation")
+	manager.RecordViolation("2001:db8:1:2::c", 1, "test violation")
+
+	if !manager.IsBanned("2001:db8:1:2:ffff::1") {
+		t.Error("Expected /64 to be banned once threshold is reached")
+	}
+	if manager.IsBanned("2001:db8:1:3::1") {
+		t.Error("Expected neighbouring /64 to not be banned")
+	}
+}
+
+func TestSubnetEscalationDisabled(t *testing.T) {
+	cfg := getSubnetEscalationConfig()
+	cfg.Ban.SubnetEscalation.Enabled = false
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	for i := 1; i <= 5; i++ {
+		manager.RecordViolation(fmt.Sprintf("203.0.113.%d", i), 1, "test violation")
+	}
+
+	if manager.IsBanned("203.0.113.50") {
+		t.Error("Expected no prefix ban when subnet escalation is disabled")
+	}
+}
+
+func TestSubnetEscalationWindow(t *testing.T) {
+	cfg := getSubnetEscalationConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	manager.RecordViolation("203.0.113.1", 1, "test violation")
+	manager.RecordViolation("203.0.113.2", 1, "test violation")
+
+	// Age the recorded bans past the window
+	manager.mutex.Lock()
+	for ip := range manager.subnetHits[testKey("203.0.113.0/24")] {
+		manager.subnetHits[testKey("203.0.113.0/24")][ip] = time.Now().Add(-2 * time.Hour)
+	}
+	manager.mutex.Unlock()
+
+	manager.RecordViolation("203.0.113.3", 1, "test violation")
+
+	if manager.IsBanned("203.0.113.50") {
+		t.Error("Expected bans outside the window to not count towards escalation")
+	}
+}
+
+func TestEscalatedBanDuration(t *testing.T) {
+	tests := []struct {
+		banCount int
+		expected time.Duration
+	}{
+		{1, 10 * time.Minute},
+		{2, 20 * time.Minute},
+		{3, 30 * time.Minute},
+		{100, time.Hour},
+	}
+
+	for _, test := range tests {
+		result := escalatedBanDuration(5*time.Minute, time.Hour, 2.0, test.banCount)
+		if result != test.expected {
+			t.Errorf("Ban count %d: expected %v, got %v", test.banCount, test.expected, result)
+		}
+	}
+}
+
+func TestIPv6ViolationAggregation(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.IPv6AggregationPrefix = 64
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	// A fresh address for every attempt still reaches MaxAttempts
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordViolation(fmt.Sprintf("2001:db8:a:b::%x", i+1), 1, "test violation")
+	}
+
+	stats := manager.GetIPStats("2001:db8:a:b::/64")
+	if stats == nil {
+		t.Fatal("Expected violations to be aggregated under the /64")
+	}
+	if stats.Violations.Len() != cfg.Ban.MaxAttempts {
+		t.Errorf("Expected %d aggregated violations, got %d", cfg.Ban.MaxAttempts, stats.Violations.Len())
+	}
+	if !manager.IsBanned("2001:db8:a:b:1234::1") {
+		t.Error("Expected every address in the /64 to be banned")
+	}
+	if manager.IsBanned("2001:db8:a:c::1") {
+		t.Error("Expected addresses outside the /64 to not be banned")
+	}
+
+	// IPv4 keeps per-address counting with the default /32
+	manager.RecordViolation("192.0.2.1", 1, "test violation")
+	if manager.GetIPStats("192.0.2.1") == nil {
+		t.Error("Expected IPv4 violations to be tracked per address")
+	}
+}
+
+func TestIPv4ViolationAggregation(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.IPv4AggregationPrefix = 24
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordViolation(fmt.Sprintf("198.51.100.%d", i+1), 1, "test violation")
+	}
+
+	if !manager.IsBanned("198.51.100.200") {
+		t.Error("Expected /24 to be banned after aggregated violations")
+	}
+}
+
+func TestManualUnbanLiftsAggregatedBan(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.IPv6AggregationPrefix = 64
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordViolation(fmt.Sprintf("2001:db8:a:b::%x", i+1), 1, "test violation")
+	}
+
+	if err := manager.ManualUnban("2001:db8:a:b::1"); err != nil {
+		t.Fatalf("Expected unban to succeed, got %v", err)
+	}
+	if manager.IsBanned("2001:db8:a:b::1") {
+		t.Error("Expected unbanning an address to lift its aggregated ban")
+	}
+}
+
+func getScoreModeConfig() *config.Config {
+	cfg := getTestConfig()
+	cfg.Ban.Mode = config.BanModeScore
+	cfg.Ban.ScoreThreshold = 9
+	cfg.Ban.ScoreHalfLife = 10 * time.Minute
+	return cfg
+}
+
+func TestScoreModeWeightsSeverity(t *testing.T) {
+	cfg := getScoreModeConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	// Two severity-5 brute force attempts reach the threshold
+	manager.RecordViolation("192.168.2.1", 5, "password brute force")
+	if manager.IsBanned("192.168.2.1") {
+		t.Fatal("Expected IP to not be banned below score threshold")
+	}
+	manager.RecordViolation("192.168.2.1", 5, "password brute force")
+	if !manager.IsBanned("192.168.2.1") {
+		t.Error("Expected IP to be banned once score reaches threshold")
+	}
+
+	// Severity-2 unknown-user attempts need more than MaxAttempts
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordViolation("192.168.2.2", 2, "unknown user")
+	}
+	if manager.IsBanned("192.168.2.2") {
+		t.Error("Expected low-severity IP to not be banned after MaxAttempts in score mode")
+	}
+}
+
+func TestScoreDecay(t *testing.T) {
+	cfg := getScoreModeConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	ip := "192.168.2.3"
+	manager.RecordViolation(ip, 8, "test violation")
+
+	// Pretend the first violation happened one half-life ago
+	stats := manager.GetIPStats(ip)
+	stats.ScoreUpdated = stats.ScoreUpdated.Add(-cfg.Ban.ScoreHalfLife)
+
+	manager.RecordViolation(ip, 1, "test violation")
+
+	stats = manager.GetIPStats(ip)
+	if stats.Score < 4.99 || stats.Score > 5.01 {
+		t.Errorf("Expected decayed score of about 5, got %f", stats.Score)
+	}
+	if manager.IsBanned(ip) {
+		t.Error("Expected decayed score to stay below threshold")
+	}
+}
+
+func TestScoreResetAfterBan(t *testing.T) {
+	cfg := getScoreModeConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	ip := "192.168.2.4"
+	manager.RecordViolation(ip, 10, "test violation")
+
+	stats := manager.GetIPStats(ip)
+	if stats.BanCount != 1 {
+		t.Fatalf("Expected ban count 1, got %d", stats.BanCount)
+	}
+	if stats.Score != 0 {
+		t.Errorf("Expected score to reset after ban, got %f", stats.Score)
+	}
+}
+
+func TestDecayScore(t *testing.T) {
+	tests := []struct {
+		score    float64
+		elapsed  time.Duration
+		halfLife time.Duration
+		expected float64
+	}{
+		{8, 0, time.Minute, 8},
+		{8, time.Minute, time.Minute, 4},
+		{8, 3 * time.Minute, time.Minute, 1},
+		{8, time.Hour, 0, 8},
+	}
+
+	for _, test := range tests {
+		result := decayScore(test.score, test.elapsed, test.halfLife)
+		if result < test.expected-1e-9 || result > test.expected+1e-9 {
+			t.Errorf("decayScore(%v, %v, %v) = %v, expected %v",
+				test.score, test.elapsed, test.halfLife, result, test.expected)
+		}
+	}
+}
+
+func getJailConfig() *config.Config {
+	cfg := getTestConfig()
+	cfg.Jails = []config.JailConfig{
+		{
+			Name:           "postfix-sasl",
+			MaxAttempts:    2,
+			InitialBanTime: time.Hour,
+		},
+		{
+			Name:        "sogo",
+			MaxAttempts: 5,
+		},
+	}
+	return cfg
+}
+
+func TestJailsCountViolationsSeparately(t *testing.T) {
+	manager := NewManager(getJailConfig(), getTestLogger())
+	ip := "192.168.1.100"
+
+	// One violation in each policy stays below every threshold
+	manager.RecordViolation(ip, 1, "global")
+	manager.RecordMatch(ip, Match{Jail: "postfix-sasl", Severity: 1, Description: "postfix"})
+	manager.RecordMatch(ip, Match{Jail: "sogo", Severity: 1, Description: "sogo"})
+
+	if manager.IsBanned(ip) {
+		t.Fatal("Expected IP to not be banned, violations are counted per jail")
+	}
+
+	stats := manager.GetIPStats(ip)
+	if stats.Violations.Len() != 1 {
+		t.Errorf("Expected 1 global violation, got %d", stats.Violations.Len())
+	}
+	for _, jail := range []string{"postfix-sasl", "sogo"} {
+		if counter := stats.Jails[jail]; counter == nil || counter.Violations.Len() != 1 {
+			t.Errorf("Expected 1 violation in jail %s", jail)
+		}
+	}
+}
+
+func TestJailBanPolicy(t *testing.T) {
+	manager := NewManager(getJailConfig(), getTestLogger())
+	ip := "192.168.1.101"
+
+	manager.RecordMatch(ip, Match{Jail: "postfix-sasl", Severity: 1, Description: "postfix"})
+	manager.RecordMatch(ip, Match{Jail: "postfix-sasl", Severity: 1, Description: "postfix"})
+
+	if !manager.IsBanned(ip) {
+		t.Fatal("Expected IP to be banned after reaching the jail's max attempts")
+	}
+
+	stats := manager.GetIPStats(ip)
+	counter := stats.Jails["postfix-sasl"]
+	if counter.BanCount != 1 {
+		t.Errorf("Expected jail ban count 1, got %d", counter.BanCount)
+	}
+	if stats.BanCount != 0 || !stats.BanExpiry.IsZero() {
+		t.Error("Expected the global counters to be untouched by a jail ban")
+	}
+
+	// Jail's initial ban time with the inherited escalation factor
+	expectedDuration := 2 * time.Hour
+	actualDuration := time.Until(counter.BanExpiry)
+	if actualDuration < expectedDuration-time.Minute || actualDuration > expectedDuration+time.Minute {
+		t.Errorf("Expected ban duration ~%v, got %v", expectedDuration, actualDuration)
+	}
+
+	bannedIPs := manager.GetAllBannedIPs()
+	if !bannedIPs[ip].Equal(counter.BanExpiry) {
+		t.Errorf("Expected banned IP list to report the jail's expiry")
+	}
+
+	if err := manager.ManualUnban(ip); err != nil {
+		t.Fatalf("ManualUnban failed: %v", err)
+	}
+	if manager.IsBanned(ip) {
+		t.Error("Expected manual unban to lift the jail ban")
+	}
+}
+
+func TestUnknownJailUsesGlobalPolicy(t *testing.T) {
+	manager := NewManager(getJailConfig(), getTestLogger())
+	ip := "192.168.1.102"
+
+	for i := 0; i < 3; i++ {
+		manager.RecordMatch(ip, Match{Jail: "missing", Severity: 1, Description: "unknown jail"})
+	}
+
+	stats := manager.GetIPStats(ip)
+	if len(stats.Jails) != 0 {
+		t.Errorf("Expected no jail counters for an unknown jail, got %d", len(stats.Jails))
+	}
+	if stats.BanCount != 1 || !manager.IsBanned(ip) {
+		t.Error("Expected violations of an unknown jail to count against the global policy")
+	}
+}
+
+func TestRadixTreeBannedAtRespectsExpiry(t *testing.T) {
+	tree := NewRadixTree()
+	now := time.Now()
+
+	tree.InsertUntil("10.0.0.0/8", now.Add(time.Hour))
+	tree.InsertUntil("10.1.2.3", now.Add(-time.Minute))
+	tree.Insert("192.0.2.1")
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.1.2.3", true},  // Expired itself, but covered by the active /8
+		{"10.9.9.9", true},  // Covered by the /8
+		{"192.0.2.1", true}, // No expiry
+		{"192.0.2.2", false},
+	}
+	for _, test := range tests {
+		if result := tree.BannedAt(test.ip, now); result != test.expected {
+			t.Errorf("BannedAt(%s): expected %v, got %v", test.ip, test.expected, result)
+		}
+	}
+
+	if tree.BannedAt("10.1.2.3", now.Add(2*time.Hour)) {
+		t.Error("Expected no active ban once every covering prefix expired")
+	}
+}
+
+func TestRadixTreeIsPersistent(t *testing.T) {
+	tree := NewRadixTree()
+	tree.Insert("192.0.2.1")
+	before := tree.root.Load()
+
+	tree.Insert("192.0.2.2")
+	tree.Delete("192.0.2.1")
+
+	// Readers holding the old root still see the old ban set
+	old := &RadixTree{}
+	old.root.Store(before)
+	if !old.Search("192.0.2.1") || old.Search("192.0.2.2") {
+		t.Error("Expected the previously published trie to be unchanged")
+	}
+	if tree.Search("192.0.2.1") || !tree.Search("192.0.2.2") {
+		t.Error("Expected the current trie to reflect the changes")
+	}
+
+	// Deleting a key that is not banned publishes nothing new
+	current := tree.root.Load()
+	tree.Delete("198.51.100.1")
+	if tree.root.Load() != current {
+		t.Error("Expected no-op delete to keep the published root")
+	}
+}
+
+func TestIsBannedConcurrentWithIngestion(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ctx.Err() == nil; i++ {
+			manager.RecordViolation(fmt.Sprintf("10.0.%d.%d", i/256%256, i%256), 1, "flood")
+			if i%100 == 0 {
+				manager.cleanup()
+			}
+		}
+	}()
+
+	for i := 0; i < 10000; i++ {
+		manager.IsBanned(fmt.Sprintf("10.0.%d.%d", i/256%256, i%256))
+	}
+	cancel()
+	<-done
+}
+
+func TestMaxTrackedIPsEvictsLeastRecentlySeen(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxTrackedIPs = 3
+	manager := NewManager(cfg, getTestLogger())
+
+	manager.RecordViolation("192.0.2.1", 1, "first")
+	manager.RecordViolation("192.0.2.2", 1, "second")
+	manager.RecordViolation("192.0.2.3", 1, "third")
+
+	// Seeing .1 again makes .2 the least recently seen
+	manager.RecordViolation("192.0.2.1", 1, "first again")
+	manager.RecordViolation("192.0.2.4", 1, "fourth")
+
+	if manager.GetStatsCount() != 3 {
+		t.Errorf("Expected 3 tracked IPs, got %d", manager.GetStatsCount())
+	}
+	if manager.GetIPStats("192.0.2.2") != nil {
+		t.Error("Expected least recently seen IP to be evicted")
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.3", "192.0.2.4"} {
+		if manager.GetIPStats(ip) == nil {
+			t.Errorf("Expected %s to still be tracked", ip)
+		}
+	}
+
+	stats := manager.GetRadixTreeStats()
+	if stats["evicted_ips"] != uint64(1) {
+		t.Errorf("Expected 1 evicted IP, got %v", stats["evicted_ips"])
+	}
+	if stats["max_tracked_ips"] != 3 {
+		t.Errorf("Expected max_tracked_ips 3, got %v", stats["max_tracked_ips"])
+	}
+}
+
+func TestMaxTrackedIPsKeepsBannedEntries(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxTrackedIPs = 2
+	manager := NewManager(cfg, getTestLogger())
+
+	manager.ManualBan("192.0.2.1", time.Hour)
+	for i := 2; i <= 10; i++ {
+		manager.RecordViolation(fmt.Sprintf("192.0.2.%d", i), 1, "flood")
+	}
+
+	if !manager.IsBanned("192.0.2.1") || manager.GetIPStats("192.0.2.1") == nil {
+		t.Error("Expected banned IP to survive eviction")
+	}
+	if manager.GetIPStats("192.0.2.10") == nil {
+		t.Error("Expected most recent IP to be tracked")
+	}
+	if manager.GetStatsCount() != 2 {
+		t.Errorf("Expected 2 tracked IPs, got %d", manager.GetStatsCount())
+	}
+}
+
+func TestViolationBufferKeepsMostRecent(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxViolationsPerIP = 5
+	manager := NewManager(cfg, getTestLogger())
+
+	ip := "192.0.2.1"
+	for i := 0; i < 10; i++ {
+		manager.RecordViolation(ip, i, fmt.Sprintf("violation %d", i))
+	}
+
+	stats := manager.GetIPStats(ip)
+	if stats.Violations.Len() != 5 {
+		t.Fatalf("Expected 5 buffered violations, got %d", stats.Violations.Len())
+	}
+	for i, v := range stats.Violations.Slice() {
+		if expected := fmt.Sprintf("violation %d", i+5); v.Description != expected {
+			t.Errorf("Expected %q at position %d, got %q", expected, i, v.Description)
+		}
+	}
+	if stats.TotalSeverity != 5+6+7+8+9 {
+		t.Errorf("Expected total severity of buffered violations, got %d", stats.TotalSeverity)
+	}
+
+	if dropped := manager.GetRadixTreeStats()["dropped_violations"]; dropped != uint64(5) {
+		t.Errorf("Expected 5 dropped violations, got %v", dropped)
+	}
+}
+
+func TestViolationCapacity(t *testing.T) {
+	tests := []struct {
+		maxViolations, maxAttempts, expected int
+	}{
+		{0, 5, 0},   // Unlimited
+		{50, 5, 50}, // Configured size
+		{3, 5, 5},   // Never below MaxAttempts
+	}
+	for _, test := range tests {
+		policy := config.BanConfig{MaxViolationsPerIP: test.maxViolations, MaxAttempts: test.maxAttempts}
+		if result := violationCapacity(policy); result != test.expected {
+			t.Errorf("violationCapacity(%d, %d): expected %d, got %d",
+				test.maxViolations, test.maxAttempts, test.expected, result)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package ipban
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fail2ban-haproxy/internal/config"
+	"fail2ban-haproxy/internal/database"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// snapshotVersion is bumped whenever the snapshot format changes incompatibly
+const snapshotVersion = 1
+
+// Snapshot is a point-in-time copy of the manager's per-IP state
+type Snapshot struct {
+	Version int                    `json:"version"`
+	SavedAt time.Time              `json:"saved_at"`
+	Entries map[string]*IPStats    `json:"entries"`
+	History map[string]*BanHistory `json:"history,omitempty"`
+}
+
+// StateStore persists snapshots between restarts
+type StateStore interface {
+	Save(snapshot *Snapshot) error
+	// Load returns nil without error if no snapshot has been saved yet
+	Load() (*Snapshot, error)
+}
+
+// FileStateStore keeps the snapshot in a local JSON file
+type FileStateStore struct {
+	path string
+}
+
+// NewFileStateStore creates a state store backed by the file at path
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+// Save writes the snapshot atomically by renaming a temporary file
+func (fs *FileStateStore) Save(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), fs.path); err != nil {
+		return fmt.Errorf("failed to replace snapshot file: %w", err)
+	}
+
+	return nil
+}
+
+// Load reads the snapshot file
+func (fs *FileStateStore) Load() (*Snapshot, error) {
+	data, err := os.ReadFile(fs.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+
+	return &snapshot, nil
+}
+
+// DatabaseStateStore keeps the snapshot in the ban_state table
+type DatabaseStateStore struct {
+	db *database.DB
+}
+
+// NewDatabaseStateStore creates a state store backed by the database
+func NewDatabaseStateStore(db *database.DB) *DatabaseStateStore {
+	return &DatabaseStateStore{db: db}
+}
+
+// Save replaces the contents of the ban_state table with the snapshot
+func (ds *DatabaseStateStore) Save(snapshot *Snapshot) error {
+	entries := make([]database.BanStateEntry, 0, len(snapshot.Entries))
+	for ip, stats := range snapshot.Entries {
+		violations, err := json.Marshal(stats.Violations)
+		if err != nil {
+			return fmt.Errorf("failed to encode violations for %s: %w", ip, err)
+		}
+
+		var jails []byte
+		if len(stats.Jails) > 0 {
+			jails, err = json.Marshal(stats.Jails)
+			if err != nil {
+				return fmt.Errorf("failed to encode jail counters for %s: %w", ip, err)
+			}
+		}
+
+		var provenance []byte
+		if stats.Provenance != nil {
+			provenance, err = json.Marshal(stats.Provenance)
+			if err != nil {
+				return fmt.Errorf("failed to encode ban provenance for %s: %w", ip, err)
+			}
+		}
+
+		var recentBans []byte
+		if len(stats.RecentBans) > 0 {
+			recentBans, err = json.Marshal(stats.RecentBans)
+			if err != nil {
+				return fmt.Errorf("failed to encode recent bans for %s: %w", ip, err)
+			}
+		}
+
+		entries = append(entries, database.BanStateEntry{
+			IPAddress:  ip,
+			BanExpiry:  stats.BanExpiry,
+			BanCount:   stats.BanCount,
+			FirstSeen:  stats.FirstSeen,
+			LastSeen:   stats.LastSeen,
+			Violations: string(violations),
+			Jails:      string(jails),
+			Provenance: string(provenance),
+			RecentBans: string(recentBans),
+
+			CleanSince:   stats.CleanSince,
+			LastSuccess:  stats.LastSuccess,
+			Score:        stats.Score,
+			ScoreUpdated: stats.ScoreUpdated,
+		})
+	}
+
+	if err := ds.db.SaveBanState(entries); err != nil {
+		return err
+	}
+
+	history := make([]database.BanHistoryEntry, 0, len(snapshot.History))
+	for ip, entry := range snapshot.History {
+		var jails, recentBans []byte
+		var err error
+		if len(entry.Jails) > 0 {
+			jails, err = json.Marshal(entry.Jails)
+			if err != nil {
+				return fmt.Errorf("failed to encode jail ban counts for %s: %w", ip, err)
+			}
+		}
+		if len(entry.RecentBans) > 0 {
+			recentBans, err = json.Marshal(entry.RecentBans)
+			if err != nil {
+				return fmt.Errorf("failed to encode recent bans for %s: %w", ip, err)
+			}
+		}
+
+		history = append(history, database.BanHistoryEntry{
+			IPAddress:  ip,
+			BanCount:   entry.BanCount,
+			Jails:      string(jails),
+			LastSeen:   entry.LastSeen,
+			CleanSince: entry.CleanSince,
+			RecentBans: string(recentBans),
+		})
+	}
+
+	return ds.db.SaveBanHistory(history)
+}
+
+// Load reads the ban_state table back into a snapshot
+func (ds *DatabaseStateStore) Load() (*Snapshot, error) {
+	entries, err := ds.db.GetBanState()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Version: snapshotVersion,
+		Entries: make(map[string]*IPStats, len(entries)),
+	}
+
+	for _, entry := range entries {
+		stats := &IPStats{
+			JailStats: JailStats{
+				BanExpiry:    entry.BanExpiry,
+				BanCount:     entry.BanCount,
+				CleanSince:   entry.CleanSince,
+				Score:        entry.Score,
+				ScoreUpdated: entry.ScoreUpdated,
+			},
+			FirstSeen:   entry.FirstSeen,
+			LastSeen:    entry.LastSeen,
+			LastSuccess: entry.LastSuccess,
+		}
+
+		if entry.Violations != "" {
+			if err := json.Unmarshal([]byte(entry.Violations), &stats.Violations); err != nil {
+				return nil, fmt.Errorf("failed to decode violations for %s: %w", entry.IPAddress, err)
+			}
+		}
+
+		if entry.Jails != "" {
+			if err := json.Unmarshal([]byte(entry.Jails), &stats.Jails); err != nil {
+				return nil, fmt.Errorf("failed to decode jail counters for %s: %w", entry.IPAddress, err)
+			}
+		}
+
+		if entry.Provenance != "" {
+			if err := json.Unmarshal([]byte(entry.Provenance), &stats.Provenance); err != nil {
+				return nil, fmt.Errorf("failed to decode ban provenance for %s: %w", entry.IPAddress, err)
+			}
+		}
+
+		if entry.RecentBans != "" {
+			if err := json.Unmarshal([]byte(entry.RecentBans), &stats.RecentBans); err != nil {
+				return nil, fmt.Errorf("failed to decode recent bans for %s: %w", entry.IPAddress, err)
+			}
+		}
+
+		snapshot.Entries[entry.IPAddress] = stats
+	}
+
+	history, err := ds.db.GetBanHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.History = make(map[string]*BanHistory, len(history))
+	for _, entry := range history {
+		banHistory := &BanHistory{
+			BanCount:   entry.BanCount,
+			LastSeen:   entry.LastSeen,
+			CleanSince: entry.CleanSince,
+		}
+
+		if entry.Jails != "" {
+			if err := json.Unmarshal([]byte(entry.Jails), &banHistory.Jails); err != nil {
+				return nil, fmt.Errorf("failed to decode jail ban counts for %s: %w", entry.IPAddress, err)
+			}
+		}
+
+		if entry.RecentBans != "" {
+			if err := json.Unmarshal([]byte(entry.RecentBans), &banHistory.RecentBans); err != nil {
+				return nil, fmt.Errorf("failed to decode recent bans for %s: %w", entry.IPAddress, err)
+			}
+		}
+
+		snapshot.History[entry.IPAddress] = banHistory
+	}
+
+	return snapshot, nil
+}
+
+// SetStateStore configures where snapshots are saved and restored from
+func (m *Manager) SetStateStore(store StateStore) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.store = store
+}
+
+// Snapshot returns a deep copy of the current per-IP state. Shards are
+// copied one after another, so the snapshot is consistent per address but
+// not across addresses.
+func (m *Manager) Snapshot() *Snapshot {
+	snapshot := &Snapshot{
+		Version: snapshotVersion,
+		SavedAt: m.clock.Now(),
+		Entries: make(map[string]*IPStats, m.tracked.Load()),
+	}
+
+	m.eachShardRead(func(shard *statsShard) {
+		for key, stats := range shard.stats {
+			entry := *stats
+			entry.lruElement = nil
+			entry.samples = nil
+			entry.Violations = stats.Violations.Clone()
+			entry.RecentBans = slices.Clone(stats.RecentBans)
+			if stats.Jails != nil {
+				entry.Jails = make(map[string]*JailStats, len(stats.Jails))
+				for name, counter := range stats.Jails {
+					jailEntry := *counter
+					jailEntry.samples = nil
+					jailEntry.Violations = counter.Violations.Clone()
+					entry.Jails[name] = &jailEntry
+				}
+			}
+			snapshot.Entries[formatKey(key)] = &entry
+		}
+
+		for key, entry := range shard.history {
+			historyEntry := *entry
+			historyEntry.RecentBans = slices.Clone(entry.RecentBans)
+			if entry.Jails != nil {
+				historyEntry.Jails = make(map[string]int, len(entry.Jails))
+				for name, banCount := range entry.Jails {
+					historyEntry.Jails[name] = banCount
+				}
+			}
+			if snapshot.History == nil {
+				snapshot.History = make(map[string]*BanHistory)
+			}
+			snapshot.History[formatKey(key)] = &historyEntry
+		}
+	})
+
+	return snapshot
+}
+
+// SaveState writes a snapshot to the configured state store
+func (m *Manager) SaveState() error {
+	m.mutex.RLock()
+	store := m.store
+	m.mutex.RUnlock()
+
+	if store == nil {
+		return fmt.Errorf("no state store configured")
+	}
+
+	snapshot := m.Snapshot()
+	if err := store.Save(snapshot); err != nil {
+		return err
+	}
+
+	m.logger.Debug("Saved ban state snapshot", zap.Int("entries", len(snapshot.Entries)))
+	return nil
+}
+
+// RestoreState loads the last snapshot from the state store and merges it
+// into memory. Expired entries are pruned on load: violations outside the
+// time window are dropped, and records whose ban expired and that have not
+// been seen within MaxMemoryTTL are only kept in the ban history. Active
+// bans are re-inserted into the radix tree. It returns the number of
+// restored records.
+func (m *Manager) RestoreState() (int, error) {
+	m.mutex.RLock()
+	store := m.store
+	m.mutex.RUnlock()
+
+	if store == nil {
+		return 0, fmt.Errorf("no state store configured")
+	}
+
+	snapshot, err := store.Load()
+	if err != nil {
+		return 0, err
+	}
+	if snapshot == nil {
+		return 0, nil
+	}
+
+	now := m.clock.Now()
+	memoryCutoff := now.Add(-m.cfg.Ban.MaxMemoryTTL)
+	restored, banned := 0, 0
+
+	type restoredEntry struct {
+		key       netip.Prefix
+		stats     *IPStats
+		activeBan bool
+	}
+	var entries []restoredEntry
+
+	for ip, stats := range snapshot.Entries {
+		if stats == nil {
+			continue
+		}
+
+		key, err := parseKey(ip)
+		if err != nil {
+			m.logger.Warn("Skipping invalid entry in ban state snapshot", zap.String("ip", ip))
+			continue
+		}
+		activeBan := stats.BannedUntil().After(now)
+		if !activeBan && stats.LastSeen.Before(memoryCutoff) {
+			shard := m.shardFor(key)
+			shard.mutex.Lock()
+			if _, exists := shard.stats[key]; !exists {
+				m.rememberHistory(key, stats)
+			}
+			shard.mutex.Unlock()
+			continue
+		}
+
+		pruneJailStats(&stats.JailStats, m.banPolicy(), now)
+		for name, counter := range stats.Jails {
+			if counter == nil {
+				delete(stats.Jails, name)
+				continue
+			}
+			// Manual bans may be scoped to services that are not jails;
+			// other counters of unknown jails were removed from the
+			// configuration
+			policy, ok := m.jailPolicy(name)
+			if !ok && !counter.BanExpiry.After(now) && !counter.isManual() {
+				delete(stats.Jails, name)
+				continue
+			}
+			pruneJailStats(counter, policy, now)
+		}
+
+		if !stats.BannedUntil().After(now) {
+			activeBan = false
+		}
+		entries = append(entries, restoredEntry{key: key, stats: stats, activeBan: activeBan})
+	}
+
+	// Restored entries are older than anything seen since startup, so they
+	// go to the back of the LRU list, least recently seen last
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].stats.LastSeen.After(entries[j].stats.LastSeen)
+	})
+	for _, entry := range entries {
+		shard := m.shardFor(entry.key)
+		shard.mutex.Lock()
+
+		// Live state recorded since startup takes precedence, as does the
+		// first of several spellings of one address in older snapshots
+		if _, exists := shard.stats[entry.key]; !exists {
+			if entry.activeBan {
+				entry.stats.lruElement = nil
+			} else {
+				m.lruMutex.Lock()
+				entry.stats.lruElement = m.lru.PushBack(entry.key)
+				m.lruMutex.Unlock()
+			}
+			shard.stats[entry.key] = entry.stats
+			m.tracked.Add(1)
+			restored++
+
+			if entry.activeBan {
+				m.publishBans(entry.key, entry.stats, now)
+				banned++
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	m.evictIfFull(netip.Prefix{}, now)
+
+	// Remembered ban counts of addresses no longer tracked; live state and
+	// restored records take precedence
+	for ip, entry := range snapshot.History {
+		if entry == nil {
+			continue
+		}
+		key, err := parseKey(ip)
+		if err != nil {
+			continue
+		}
+		shard := m.shardFor(key)
+		shard.mutex.Lock()
+		_, tracked := shard.stats[key]
+		_, remembered := shard.history[key]
+		if !tracked && !remembered {
+			shard.history[key] = entry
+		}
+		shard.mutex.Unlock()
+	}
+
+	history := 0
+	m.eachShard(func(shard *statsShard) {
+		m.pruneHistory(shard, now)
+		history += len(shard.history)
+	})
+
+	m.logger.Info("Restored ban state snapshot",
+		zap.Int("restored", restored),
+		zap.Int("active_bans", banned),
+		zap.Int("skipped", len(snapshot.Entries)-restored),
+		zap.Int("history", history),
+		zap.Time("saved_at", snapshot.SavedAt))
+
+	return restored, nil
+}
+
+// isManual reports whether the counter's last ban was applied manually
+func (c *JailStats) isManual() bool {
+	return c.Provenance != nil && c.Provenance.Source == SourceManual
+}
+
+// pruneJailStats drops violations outside the policy's time window or
+// beyond its violation capacity, and clears an expired ban
+func pruneJailStats(counter *JailStats, policy config.BanConfig, now time.Time) {
+	counter.Violations.DropBefore(now.Add(-policy.TimeWindow))
+	counter.Violations.Shrink(violationCapacity(policy))
+	counter.TotalSeverity = counter.Violations.Severity()
+
+	if !counter.BanExpiry.After(now) {
+		counter.endBan(now)
+	}
+}
+
+// StartPersistence saves a snapshot every interval until ctx is cancelled,
+// then saves a final snapshot before returning
+func (m *Manager) StartPersistence(ctx context.Context, interval time.Duration) {
+	ticker := m.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := m.SaveState(); err != nil {
+				m.logger.Error("Failed to save final ban state snapshot", zap.Error(err))
+			}
+			return
+		case <-ticker.C():
+			if err := m.SaveState(); err != nil {
+				m.logger.Error("Failed to save ban state snapshot", zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package ipban
+
+import (
+	"context"
+	"fail2ban-haproxy/internal/config"
+	"fail2ban-haproxy/internal/database"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestFileStateStoreRoundTrip(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+
+	manager := NewManager(cfg, logger)
+	manager.SetStateStore(store)
+
+	bannedIP := "192.168.1.200"
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordViolation(bannedIP, 2, "test violation")
+	}
+	manager.RecordViolation("192.168.1.201", 1, "test violation")
+	manager.ManualBan("203.0.113.0/24", time.Hour)
+
+	if err := manager.SaveState(); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	// Simulate a restart
+	restarted := NewManager(cfg, logger)
+	restarted.SetStateStore(store)
+
+	restored, err := restarted.RestoreState()
+	if err != nil {
+		t.Fatalf("Failed to restore state: %v", err)
+	}
+	if restored != 3 {
+		t.Errorf("Expected 3 restored records, got %d", restored)
+	}
+
+	if !restarted.IsBanned(bannedIP) {
+		t.Error("Expected ban to survive restart")
+	}
+	if !restarted.IsBanned("203.0.113.9") {
+		t.Error("Expected prefix ban to survive restart")
+	}
+
+	stats := restarted.GetIPStats(bannedIP)
+	if stats.BanCount != 1 {
+		t.Errorf("Expected ban count 1 after restart, got %d", stats.BanCount)
+	}
+	if stats.Violations.Len() != cfg.Ban.MaxAttempts {
+		t.Errorf("Expected %d violations after restart, got %d", cfg.Ban.MaxAttempts, stats.Violations.Len())
+	}
+	if stats.TotalSeverity != 2*cfg.Ban.MaxAttempts {
+		t.Errorf("Expected total severity %d after restart, got %d", 2*cfg.Ban.MaxAttempts, stats.TotalSeverity)
+	}
+}
+
+func TestRestoreStatePrunesExpiredEntries(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+
+	now := time.Now()
+	snapshot := &Snapshot{
+		Version: snapshotVersion,
+		SavedAt: now,
+		Entries: map[string]*IPStats{
+			// Ban expired and not seen for longer than MaxMemoryTTL
+			"192.168.1.10": {
+				JailStats: JailStats{
+					BanExpiry: now.Add(-time.Hour),
+					BanCount:  4,
+				},
+				FirstSeen: now.Add(-100 * time.Hour),
+				LastSeen:  now.Add(-80 * time.Hour),
+			},
+			// Ban expired but recently seen: keep the escalation count
+			"192.168.1.11": {
+				JailStats: JailStats{
+					BanExpiry: now.Add(-time.Minute),
+					BanCount:  2,
+					Violations: violationBufferOf([]Violation{
+						{Timestamp: now.Add(-time.Hour), Severity: 1, Description: "old"},
+						{Timestamp: now.Add(-time.Minute), Severity: 3, Description: "recent"},
+					}),
+				},
+				FirstSeen: now.Add(-2 * time.Hour),
+				LastSeen:  now.Add(-time.Hour),
+			},
+			// Still banned
+			"192.168.1.12": {
+				JailStats: JailStats{
+					BanExpiry: now.Add(time.Hour),
+					BanCount:  1,
+				},
+				FirstSeen: now.Add(-time.Hour),
+				LastSeen:  now.Add(-time.Hour),
+			},
+		},
+	}
+	if err := store.Save(snapshot); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+
+	manager := NewManager(cfg, logger)
+	manager.SetStateStore(store)
+
+	restored, err := manager.RestoreState()
+	if err != nil {
+		t.Fatalf("Failed to restore state: %v", err)
+	}
+	if restored != 2 {
+		t.Errorf("Expected 2 restored records, got %d", restored)
+	}
+
+	if manager.GetIPStats("192.168.1.10") != nil {
+		t.Error("Expected stale record to be pruned")
+	}
+
+	stats := manager.GetIPStats("192.168.1.11")
+	if stats == nil {
+		t.Fatal("Expected recently seen record to be restored")
+	}
+	if stats.BanCount != 2 {
+		t.Errorf("Expected ban count 2, got %d", stats.BanCount)
+	}
+	if !stats.BanExpiry.IsZero() {
+		t.Error("Expected expired ban to be cleared on load")
+	}
+	if stats.Violations.Len() != 1 || stats.TotalSeverity != 3 {
+		t.Errorf("Expected only the violation inside the time window, got %d (severity %d)",
+			stats.Violations.Len(), stats.TotalSeverity)
+	}
+	if manager.IsBanned("192.168.1.11") {
+		t.Error("Expected expired ban to not be restored")
+	}
+
+	if !manager.IsBanned("192.168.1.12") {
+		t.Error("Expected active ban to be restored")
+	}
+}
+
+func TestRestoreStateWithoutSnapshot(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+	manager.SetStateStore(NewFileStateStore(filepath.Join(t.TempDir(), "missing.json")))
+
+	restored, err := manager.RestoreState()
+	if err != nil {
+		t.Fatalf("Expected missing snapshot to not be an error, got %v", err)
+	}
+	if restored != 0 {
+		t.Errorf("Expected 0 restored records, got %d", restored)
+	}
+}
+
+func TestSaveStateWithoutStore(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	manager := NewManager(cfg, logger)
+
+	if err := manager.SaveState(); err == nil {
+		t.Error("Expected error when no state store is configured")
+	}
+}
+
+func TestDatabaseStateStoreRoundTrip(t *testing.T) {
+	db, err := database.NewDB(database.DatabaseConfig{
+		Enabled: true,
+		Driver:  "sqlite3",
+		DSN:     filepath.Join(t.TempDir(), "state.db"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	cfg := getJailConfig()
+	cfg.Ban.Forgiveness.HistoryRetention = 30 * 24 * time.Hour
+	cfg.Recidive = config.RecidiveConfig{Enabled: true, MaxBans: 5, LookbackWindow: 7 * 24 * time.Hour}
+	logger := getTestLogger()
+	store := NewDatabaseStateStore(db)
+
+	manager := NewManager(cfg, logger)
+	manager.SetStateStore(store)
+
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordViolation("10.1.2.3", 1, "test violation")
+	}
+	manager.RecordMatch("10.1.2.4", Match{Jail: "sogo", Severity: 1, Description: "jail violation"})
+	rememberTestHistory(manager, "10.1.2.5", &BanHistory{
+		BanCount:   1,
+		Jails:      map[string]int{"sogo": 3},
+		LastSeen:   time.Now().Add(-100 * time.Hour),
+		CleanSince: time.Now(),
+		RecentBans: []time.Time{time.Now().Add(-time.Hour)},
+	})
+
+	// Scoring, forgiveness and trust state is stored to the second
+	scoreUpdated := time.Now().Add(-time.Minute).Truncate(time.Second)
+	cleanSince := time.Now().Add(-2 * time.Minute).Truncate(time.Second)
+	lastSuccess := time.Now().Add(-3 * time.Minute).Truncate(time.Second)
+	withShard(manager, "10.1.2.3", func(shard *statsShard) {
+		stats := shard.stats[testKey("10.1.2.3")]
+		stats.Score, stats.ScoreUpdated = 7.5, scoreUpdated
+		stats.CleanSince, stats.LastSuccess = cleanSince, lastSuccess
+	})
+
+	// Saving twice must replace rather than duplicate entries
+	for i := 0; i < 2; i++ {
+		if err := manager.SaveState(); err != nil {
+			t.Fatalf("Failed to save state: %v", err)
+		}
+	}
+
+	restarted := NewManager(cfg, logger)
+	restarted.SetStateStore(store)
+
+	restored, err := restarted.RestoreState()
+	if err != nil {
+		t.Fatalf("Failed to restore state: %v", err)
+	}
+	if restored != 2 {
+		t.Errorf("Expected 2 restored records, got %d", restored)
+	}
+	if !restarted.IsBanned("10.1.2.3") {
+		t.Error("Expected ban to survive restart")
+	}
+	if stats := restarted.GetIPStats("10.1.2.3"); stats.Violations.Len() != cfg.Ban.MaxAttempts {
+		t.Errorf("Expected %d violations after restart, got %d", cfg.Ban.MaxAttempts, stats.Violations.Len())
+	}
+	if stats := restarted.GetIPStats("10.1.2.4"); stats == nil || stats.Jails["sogo"] == nil ||
+		stats.Jails["sogo"].Violations.Len() != 1 {
+		t.Error("Expected jail counters to survive restart")
+	}
+	if stats := restarted.GetIPStats("10.1.2.3"); stats.Provenance == nil ||
+		stats.Provenance.Source != SourceDetection {
+		t.Errorf("Expected ban provenance to survive restart, got %+v", stats.Provenance)
+	}
+	if stats := restarted.GetIPStats("10.1.2.3"); len(stats.RecentBans) != 1 {
+		t.Errorf("Expected recent ban times to survive restart, got %v", stats.RecentBans)
+	}
+	if stats := restarted.GetIPStats("10.1.2.3"); stats.Score != 7.5 || !stats.ScoreUpdated.Equal(scoreUpdated) {
+		t.Errorf("Expected the score to survive restart, got %v as of %v", stats.Score, stats.ScoreUpdated)
+	}
+	if stats := restarted.GetIPStats("10.1.2.3"); !stats.CleanSince.Equal(cleanSince) || !stats.LastSuccess.Equal(lastSuccess) {
+		t.Errorf("Expected clean and last success times to survive restart, got %v and %v", stats.CleanSince, stats.LastSuccess)
+	}
+	if stats := restarted.GetIPStats("10.1.2.4"); !stats.LastSuccess.IsZero() || !stats.ScoreUpdated.IsZero() {
+		t.Errorf("Expected zero times to stay zero after restart, got %v and %v", stats.LastSuccess, stats.ScoreUpdated)
+	}
+	if history := restarted.GetBanHistory("10.1.2.5"); history == nil || history.BanCount != 1 ||
+		history.Jails["sogo"] != 3 || len(history.RecentBans) != 1 {
+		t.Errorf("Expected ban history to survive restart, got %+v", history)
+	}
+}
+
+func TestStartPersistenceSavesOnShutdown(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+
+	manager := NewManager(cfg, logger)
+	manager.SetStateStore(store)
+	manager.ManualBan("192.168.1.50", time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		manager.StartPersistence(ctx, time.Hour)
+		close(done)
+	}()
+
+	cancel()
+	<-done
+
+	snapshot, err := store.Load()
+	if err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	if snapshot == nil || snapshot.Entries["192.168.1.50"] == nil {
+		t.Error("Expected final snapshot to be saved on shutdown")
+	}
+}
@@ -0,0 +1,119 @@
+package ipban
+
+import (
+	"time"
+)
+
+// provenanceSampleSize is the number of triggering log lines kept per ban
+const provenanceSampleSize = 5
+
+// maxSampleLength caps the length of a log line kept as ban evidence
+const maxSampleLength = 512
+
+// Provenance records what triggered a ban
+type Provenance struct {
+	Source    string    `json:"source"` // Event source that applied the ban
+	Reason    string    `json:"reason,omitempty"`
+	Patterns  []string  `json:"patterns,omitempty"`   // Distinct patterns of the counted violations
+	LogLines  []string  `json:"log_lines,omitempty"`  // Sample of the triggering log lines, oldest first
+	Senders   []string  `json:"senders,omitempty"`    // Syslog senders that reported the violations
+	CreatedBy string    `json:"created_by,omitempty"` // API user for manual bans
+	BannedAt  time.Time `json:"banned_at"`
+}
+
+// BanRecord describes an active ban and what triggered it
+type BanRecord struct {
+	IP         string
+	Jail       string // Jail whose ban lasts longest; empty for the global policy
+	Scope      string // Jail the ban is limited to; empty if it applies to every service
+	ExpiresAt  time.Time
+	Provenance *Provenance // Nil for bans restored from state saved without provenance
+}
+
+// logSample is a log line that matched a pattern
+type logSample struct {
+	timestamp time.Time
+	line      string
+}
+
+// addSample keeps line as one of the most recent log lines of the counter
+func (c *JailStats) addSample(timestamp time.Time, line string) {
+	if line == "" {
+		return
+	}
+	if len(line) > maxSampleLength {
+		line = line[:maxSampleLength]
+	}
+	if len(c.samples) >= provenanceSampleSize {
+		n := copy(c.samples, c.samples[1:])
+		c.samples = c.samples[:n]
+	}
+	c.samples = append(c.samples, logSample{timestamp: timestamp, line: line})
+}
+
+// detectionProvenance describes a ban triggered by the counter's current
+// violations. Log lines older than cutoff are left out.
+func detectionProvenance(counter *JailStats, reason string, cutoff, now time.Time) *Provenance {
+	provenance := &Provenance{
+		Source:   SourceDetection,
+		Reason:   reason,
+		BannedAt: now,
+	}
+
+	seenPatterns := make(map[string]bool)
+	seenSenders := make(map[string]bool)
+	for i := 0; i < counter.Violations.Len(); i++ {
+		v := counter.Violations.At(i)
+		if v.Pattern != "" && !seenPatterns[v.Pattern] {
+			seenPatterns[v.Pattern] = true
+			provenance.Patterns = append(provenance.Patterns, v.Pattern)
+		}
+		if v.Sender != "" && !seenSenders[v.Sender] {
+			seenSenders[v.Sender] = true
+			provenance.Senders = append(provenance.Senders, v.Sender)
+		}
+	}
+
+	for _, sample := range counter.samples {
+		if sample.timestamp.After(cutoff) {
+			provenance.LogLines = append(provenance.LogLines, sample.line)
+		}
+	}
+
+	return provenance
+}
+
+// activeBan returns the counter of stats whose ban lasts longest, and the
+// name of its jail
+func (s *IPStats) activeBan() (string, *JailStats) {
+	jail, counter := "", &s.JailStats
+	for name, jailCounter := range s.Jails {
+		if jailCounter.BanExpiry.After(counter.BanExpiry) {
+			jail, counter = name, jailCounter
+		}
+	}
+	return jail, counter
+}
+
+// GetActiveBans returns every active ban together with its provenance
+func (m *Manager) GetActiveBans() []BanRecord {
+	now := m.clock.Now()
+	var records []BanRecord
+	m.eachShardRead(func(shard *statsShard) {
+		for key, stats := range shard.stats {
+			jail, counter := stats.activeBan()
+			if !counter.BanExpiry.After(now) {
+				continue
+			}
+			records = append(records, BanRecord{
+				IP:         formatKey(key),
+				Jail:       jail,
+				Scope:      counter.Scope,
+				ExpiresAt:  counter.BanExpiry,
+				Provenance: counter.Provenance,
+			})
+		}
+	})
+
+	return records
+}
@@ -0,0 +1,132 @@
+package ipban
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectionBanRecordsProvenance(t *testing.T) {
+	cfg := getTestConfig()
+	manager := NewManager(cfg, getTestLogger())
+
+	ip := "192.168.1.100"
+	matches := []Match{
+		{Pattern: "postfix-sasl", Severity: 1, LogLine: "sasl failure 1", Sender: "10.0.0.1"},
+		{Pattern: "dovecot-auth", Severity: 1, LogLine: "auth failure 2", Sender: "10.0.0.2"},
+		{Pattern: "postfix-sasl", Severity: 1, LogLine: "sasl failure 3", Sender: "10.0.0.1"},
+	}
+	for _, match := range matches {
+		manager.RecordMatch(ip, match)
+	}
+
+	bans := manager.GetActiveBans()
+	if len(bans) != 1 || bans[0].IP != ip {
+		t.Fatalf("Expected one active ban for %s, got %+v", ip, bans)
+	}
+
+	provenance := bans[0].Provenance
+	if provenance == nil {
+		t.Fatal("Expected ban provenance to be recorded")
+	}
+	if provenance.Source != SourceDetection || provenance.Reason == "" {
+		t.Errorf("Expected detection provenance with a reason, got %+v", provenance)
+	}
+	if strings.Join(provenance.Patterns, ",") != "postfix-sasl,dovecot-auth" {
+		t.Errorf("Expected distinct patterns in order, got %v", provenance.Patterns)
+	}
+	if strings.Join(provenance.Senders, ",") != "10.0.0.1,10.0.0.2" {
+		t.Errorf("Expected distinct senders in order, got %v", provenance.Senders)
+	}
+	if len(provenance.LogLines) != 3 || provenance.LogLines[2] != "sasl failure 3" {
+		t.Errorf("Expected the triggering log lines, got %v", provenance.LogLines)
+	}
+	if !bans[0].ExpiresAt.Equal(manager.GetIPStats(ip).BannedUntil()) {
+		t.Error("Expected the record to carry the ban expiry")
+	}
+}
+
+func TestProvenanceSamplesMostRecentLogLines(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxAttempts = 2 * provenanceSampleSize
+	manager := NewManager(cfg, getTestLogger())
+
+	ip := "192.168.1.100"
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordMatch(ip, Match{
+			Pattern:  "test",
+			Severity: 1,
+			LogLine:  fmt.Sprintf("line %d %s", i, strings.Repeat("x", maxSampleLength)),
+		})
+	}
+
+	provenance := manager.GetIPStats(ip).Provenance
+	if provenance == nil || len(provenance.LogLines) != provenanceSampleSize {
+		t.Fatalf("Expected %d sampled log lines, got %+v", provenanceSampleSize, provenance)
+	}
+	if !strings.HasPrefix(provenance.LogLines[0], fmt.Sprintf("line %d ", cfg.Ban.MaxAttempts-provenanceSampleSize)) {
+		t.Errorf("Expected the most recent log lines, got first %.10q", provenance.LogLines[0])
+	}
+	for _, line := range provenance.LogLines {
+		if len(line) > maxSampleLength {
+			t.Errorf("Expected log lines capped at %d bytes, got %d", maxSampleLength, len(line))
+		}
+	}
+}
+
+func TestJailBanProvenance(t *testing.T) {
+	manager := NewManager(getJailConfig(), getTestLogger())
+
+	ip := "192.168.1.100"
+	for i := 0; i < 2; i++ {
+		manager.RecordMatch(ip, Match{Pattern: "postfix-sasl", Jail: "postfix-sasl", Severity: 1})
+	}
+
+	bans := manager.GetActiveBans()
+	if len(bans) != 1 || bans[0].Jail != "postfix-sasl" {
+		t.Fatalf("Expected a postfix-sasl jail ban, got %+v", bans)
+	}
+	if bans[0].Provenance == nil || len(bans[0].Provenance.Patterns) != 1 {
+		t.Errorf("Expected provenance from the jail's violations, got %+v", bans[0].Provenance)
+	}
+}
+
+func TestManualBanRecordsProvenance(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	err := manager.ManualBanWithOptions("10.0.0.0/24", BanOptions{
+		Duration:  time.Hour,
+		Reason:    "abuse report",
+		CreatedBy: "oncall",
+	})
+	if err != nil {
+		t.Fatalf("ManualBanWithOptions failed: %v", err)
+	}
+
+	bans := manager.GetActiveBans()
+	if len(bans) != 1 {
+		t.Fatalf("Expected one active ban, got %d", len(bans))
+	}
+	provenance := bans[0].Provenance
+	if provenance == nil || provenance.Source != SourceManual ||
+		provenance.Reason != "abuse report" || provenance.CreatedBy != "oncall" {
+		t.Errorf("Expected manual provenance with reason and user, got %+v", provenance)
+	}
+}
+
+func TestGetActiveBansSkipsExpiredBans(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	manager.ManualBan("192.168.1.1", time.Hour)
+	manager.ManualBan("192.168.1.2", time.Hour)
+
+	withStats(manager, "192.168.1.2", func(stats *IPStats) {
+		stats.BanExpiry = time.Now().Add(-time.Second)
+	})
+
+	bans := manager.GetActiveBans()
+	if len(bans) != 1 || bans[0].IP != "192.168.1.1" {
+		t.Errorf("Expected only the active ban, got %+v", bans)
+	}
+}
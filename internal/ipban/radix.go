@@ -0,0 +1,287 @@
+package ipban
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// keyBits is the length of the key space. IPv4 addresses and prefixes are
+// stored as IPv4-mapped IPv6 keys (::ffff:a.b.c.d), so both families share
+// one trie.
+const keyBits = 8 * net.IPv6len
+
+// ipv4KeyBits is the length of the IPv4-mapped prefix ::ffff:0:0/96 that
+// every IPv4 key starts with
+const ipv4KeyBits = keyBits - 8*net.IPv4len
+
+// RadixTree is a path-compressed binary (Patricia) trie of banned addresses
+// and CIDR prefixes. Nodes are either bans or branches where two sub-tries
+// diverge, so the trie holds fewer than two nodes per ban however long the
+// keys are, and deleting a ban frees the nodes that only led to it.
+//
+// The trie is persistent: nodes are never modified once published. Insert
+// and Delete copy the path they change and swap in the new root atomically,
+// so Lookup, Search and BannedAt never block and may run concurrently with
+// writers. Writers must be serialized by the caller.
+type RadixTree struct {
+	root atomic.Pointer[RadixNode] // Nil for an empty trie
+}
+
+type RadixNode struct {
+	prefix   [net.IPv6len]byte // Key bits, zero past bits
+	bits     int               // Length of prefix, in bits
+	children [2]*RadixNode     // By the bit after prefix
+	banned   bool              // Whether the node is a ban or only a branch
+	expiry   time.Time         // Zero for bans without expiry
+}
+
+func NewRadixTree() *RadixTree {
+	return &RadixTree{}
+}
+
+// Insert bans an IP address or CIDR prefix without expiry. Plain addresses
+// are stored as full-length prefixes (/32 or /128).
+func (rt *RadixTree) Insert(key string) {
+	rt.InsertUntil(key, time.Time{})
+}
+
+// InsertUntil bans an IP address or CIDR prefix until expiry; the zero time
+// means no expiry. Inserting an existing key replaces its expiry.
+func (rt *RadixTree) InsertUntil(key string, expiry time.Time) {
+	if parsed, err := parseKey(key); err == nil {
+		rt.insert(parsed, expiry)
+	}
+}
+
+// clone returns a trie holding the same bans that can be changed without
+// affecting this one. Nodes are never modified once published, so the
+// copy shares them and takes constant time.
+func (rt *RadixTree) clone() *RadixTree {
+	c := &RadixTree{}
+	c.root.Store(rt.root.Load())
+	return c
+}
+
+// insert bans key until expiry
+func (rt *RadixTree) insert(key netip.Prefix, expiry time.Time) {
+	prefix, bits, _ := treeKey(key)
+	ban := &RadixNode{prefix: prefix, bits: bits, banned: true, expiry: expiry}
+	rt.root.Store(insertNode(rt.root.Load(), ban))
+}
+
+// insertNode returns a copy of the sub-trie n with ban added
+func insertNode(n, ban *RadixNode) *RadixNode {
+	if n == nil {
+		return ban
+	}
+
+	common := commonPrefixLen(n.prefix, ban.prefix, min(n.bits, ban.bits))
+	switch {
+	case common == n.bits && common == ban.bits:
+		// Same key: replace the ban, keeping the sub-trie below it
+		ban.children = n.children
+		return ban
+	case common == n.bits:
+		// The ban belongs below n
+		c := n.clone()
+		bit := keyBit(ban.prefix, n.bits)
+		c.children[bit] = insertNode(n.children[bit], ban)
+		return c
+	case common == ban.bits:
+		// The ban covers n
+		ban.children[keyBit(n.prefix, ban.bits)] = n
+		return ban
+	default:
+		// The keys diverge below both: branch where they part
+		branch := &RadixNode{prefix: maskKey(ban.prefix, common), bits: common}
+		branch.children[keyBit(ban.prefix, common)] = ban
+		branch.children[keyBit(n.prefix, common)] = n
+		return branch
+	}
+}
+
+// Search reports whether the address (or prefix) is covered by any banned prefix.
+func (rt *RadixTree) Search(ip string) bool {
+	return len(rt.Lookup(ip)) > 0
+}
+
+// Lookup returns the keys of all banned prefixes containing the given address,
+// most specific first, regardless of their expiry.
+func (rt *RadixTree) Lookup(ip string) []string {
+	key, err := parseKey(ip)
+	if err != nil {
+		return nil
+	}
+
+	var matches []string
+	rt.walk(key, func(node *RadixNode) bool {
+		matches = append(matches, formatKey(node.key()))
+		return false
+	})
+
+	// Reverse so the longest prefix comes first
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	return matches
+}
+
+// BannedAt reports whether the address is covered by a banned prefix that
+// has not expired at the given time
+func (rt *RadixTree) BannedAt(ip string, now time.Time) bool {
+	key, err := parseKey(ip)
+	return err == nil && rt.bannedAt(key, now)
+}
+
+// bannedAt reports whether key is covered by a banned prefix that has not
+// expired at the given time
+func (rt *RadixTree) bannedAt(key netip.Prefix, now time.Time) bool {
+	found := false
+	rt.walk(key, func(node *RadixNode) bool {
+		found = node.expiry.IsZero() || node.expiry.After(now)
+		return found
+	})
+	return found
+}
+
+// walk calls visit for every banned node on the path to the key, from the
+// broadest prefix down, until visit returns true. IPv6 prefixes that happen
+// to cover the IPv4-mapped range are skipped for IPv4 keys.
+func (rt *RadixTree) walk(target netip.Prefix, visit func(node *RadixNode) bool) {
+	key, bits, ipv4 := treeKey(target)
+
+	for node := rt.root.Load(); node != nil && node.bits <= bits; {
+		if commonPrefixLen(node.prefix, key, node.bits) < node.bits {
+			return
+		}
+		if node.banned && (!ipv4 || node.bits >= ipv4KeyBits) && visit(node) {
+			return
+		}
+		if node.bits == bits {
+			return
+		}
+		node = node.children[keyBit(key, node.bits)]
+	}
+}
+
+// Delete removes the ban on exactly this address or prefix. Broader or
+// narrower prefixes are left untouched.
+func (rt *RadixTree) Delete(key string) {
+	if parsed, err := parseKey(key); err == nil {
+		rt.delete(parsed)
+	}
+}
+
+// delete removes the ban on exactly key
+func (rt *RadixTree) delete(key netip.Prefix) {
+	prefix, bits, _ := treeKey(key)
+
+	// Leave the published trie alone unless the key is actually banned
+	if root, deleted := deleteNode(rt.root.Load(), prefix, bits); deleted {
+		rt.root.Store(root)
+	}
+}
+
+// deleteNode returns a copy of the sub-trie n without the ban on prefix,
+// and whether there was one. Branches left with a single child are merged
+// into it, so no node outlives the bans it leads to.
+func deleteNode(n *RadixNode, prefix [net.IPv6len]byte, bits int) (*RadixNode, bool) {
+	if n == nil || n.bits > bits || commonPrefixLen(n.prefix, prefix, n.bits) < n.bits {
+		return n, false
+	}
+
+	if n.bits == bits {
+		if !n.banned {
+			return n, false
+		}
+		branch := &RadixNode{prefix: n.prefix, bits: n.bits, children: n.children}
+		return branch.compact(), true
+	}
+
+	bit := keyBit(prefix, n.bits)
+	child, deleted := deleteNode(n.children[bit], prefix, bits)
+	if !deleted {
+		return n, false
+	}
+	c := n.clone()
+	c.children[bit] = child
+	return c.compact(), true
+}
+
+// compact returns the node, or what replaces it if it is a branch with
+// fewer than two children
+func (n *RadixNode) compact() *RadixNode {
+	if n.banned {
+		return n
+	}
+	switch {
+	case n.children[0] == nil:
+		return n.children[1]
+	case n.children[1] == nil:
+		return n.children[0]
+	default:
+		return n
+	}
+}
+
+// clone returns a shallow copy of the node
+func (n *RadixNode) clone() *RadixNode {
+	c := *n
+	return &c
+}
+
+// treeKey converts a key into the trie's 128-bit key space and returns its
+// length there, reporting whether it is IPv4
+func treeKey(key netip.Prefix) (prefix [net.IPv6len]byte, bits int, ipv4 bool) {
+	// As16 maps IPv4 addresses into ::ffff:0:0/96
+	prefix = key.Addr().As16()
+	if key.Addr().Is4() {
+		return prefix, ipv4KeyBits + key.Bits(), true
+	}
+	return prefix, key.Bits(), false
+}
+
+// key returns the key the node's ban was inserted with
+func (n *RadixNode) key() netip.Prefix {
+	if n.bits >= ipv4KeyBits && [12]byte(n.prefix[:12]) == [12]byte{10: 0xff, 11: 0xff} {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(n.prefix[12:])), n.bits-ipv4KeyBits)
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(n.prefix), n.bits)
+}
+
+// keyBit returns bit i of key, counting from the most significant bit
+func keyBit(key [net.IPv6len]byte, i int) int {
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+// maskKey clears the bits of key from bits on
+func maskKey(key [net.IPv6len]byte, bits int) [net.IPv6len]byte {
+	for i := range key {
+		switch {
+		case bits >= 8*(i+1):
+		case bits <= 8*i:
+			key[i] = 0
+		default:
+			key[i] &= 0xff << (8 - (bits - 8*i))
+		}
+	}
+	return key
+}
+
+// commonPrefixLen returns the number of leading bits a and b share, up to
+// limit
+func commonPrefixLen(a, b [net.IPv6len]byte, limit int) int {
+	for i := 0; i < net.IPv6len && 8*i < limit; i++ {
+		if diff := a[i] ^ b[i]; diff != 0 {
+			n := 8 * i
+			for diff&0x80 == 0 {
+				diff <<= 1
+				n++
+			}
+			return min(n, limit)
+		}
+	}
+	return limit
+}
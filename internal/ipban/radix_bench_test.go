@@ -0,0 +1,107 @@
+package ipban
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// benchmarkTreeSize is the number of bans in the benchmark trie
+const benchmarkTreeSize = 1_000_000
+
+var (
+	benchmarkKeysOnce sync.Once
+	benchmarkKeys     []string
+	benchmarkTree     *RadixTree
+)
+
+// randomKeys returns n distinct random addresses, every fourth one IPv6
+func randomKeys(n int, seed int64) []string {
+	rng := rand.New(rand.NewSource(seed))
+	seen := make(map[string]bool, n)
+	keys := make([]string, 0, n)
+	for len(keys) < n {
+		var key string
+		if len(keys)%4 == 3 {
+			key = fmt.Sprintf("2001:db8:%x:%x::%x", rng.Intn(1<<16), rng.Intn(1<<16), rng.Intn(1<<16))
+		} else {
+			key = fmt.Sprintf("%d.%d.%d.%d", 1+rng.Intn(223), rng.Intn(256), rng.Intn(256), rng.Intn(256))
+		}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// loadBenchmarkTree builds the 1M ban trie shared by the lookup benchmarks
+func loadBenchmarkTree() ([]string, *RadixTree) {
+	benchmarkKeysOnce.Do(func() {
+		benchmarkKeys = randomKeys(benchmarkTreeSize, 1)
+		benchmarkTree = NewRadixTree()
+		for _, key := range benchmarkKeys {
+			benchmarkTree.Insert(key)
+		}
+	})
+	return benchmarkKeys, benchmarkTree
+}
+
+// BenchmarkRadixTreeMemory inserts b.N distinct bans, up to 1M, into a
+// trie and reports its heap size and node count per ban. Run it with
+// -benchtime=1000000x to measure a trie of 1M bans.
+func BenchmarkRadixTreeMemory(b *testing.B) {
+	keys := randomKeys(min(b.N, benchmarkTreeSize), 2)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.ResetTimer()
+	tree := NewRadixTree()
+	for i := 0; i < b.N; i++ {
+		tree.Insert(keys[i%len(keys)])
+	}
+	b.StopTimer()
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(len(keys)), "bytes/ban")
+	b.ReportMetric(float64(countNodes(tree))/float64(len(keys)), "nodes/ban")
+	runtime.KeepAlive(tree)
+}
+
+// BenchmarkRadixTreeLookup measures BannedAt against a trie of 1M bans, for
+// banned addresses and for addresses that are not banned
+func BenchmarkRadixTreeLookup(b *testing.B) {
+	keys, tree := loadBenchmarkTree()
+	misses := randomKeys(1024, 3)
+	now := time.Now()
+
+	b.Run("hit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.BannedAt(keys[i%len(keys)], now)
+		}
+	})
+	b.Run("miss", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree.BannedAt(misses[i%len(misses)], now)
+		}
+	})
+}
+
+// BenchmarkRadixTreeChurn deletes and re-inserts bans in a trie of 1M
+// bans, as expiring and new bans do
+func BenchmarkRadixTreeChurn(b *testing.B) {
+	keys, tree := loadBenchmarkTree()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := keys[i%len(keys)]
+		tree.Delete(key)
+		tree.Insert(key)
+	}
+}
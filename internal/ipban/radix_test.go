@@ -0,0 +1,94 @@
+package ipban
+
+import (
+	"fmt"
+	"testing"
+)
+
+// countNodes returns the number of nodes in the published trie
+func countNodes(tree *RadixTree) int {
+	return new(Manager).countRadixNodes(tree.root.Load())
+}
+
+func TestRadixTreeCompressesPaths(t *testing.T) {
+	tree := NewRadixTree()
+
+	tree.Insert("10.0.0.1")
+	if nodes := countNodes(tree); nodes != 1 {
+		t.Errorf("Expected a single ban to take one node, got %d", nodes)
+	}
+
+	tree.Insert("10.0.0.2")
+	if nodes := countNodes(tree); nodes != 3 {
+		t.Errorf("Expected two bans and their branch, got %d nodes", nodes)
+	}
+
+	tree.Delete("10.0.0.1")
+	if nodes := countNodes(tree); nodes != 1 {
+		t.Errorf("Expected the branch to be merged away on delete, got %d nodes", nodes)
+	}
+	if !tree.Search("10.0.0.2") || tree.Search("10.0.0.1") {
+		t.Error("Expected only the remaining ban to be found")
+	}
+}
+
+func TestRadixTreeDeleteFreesNodes(t *testing.T) {
+	tree := NewRadixTree()
+
+	keys := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		keys[fmt.Sprintf("10.%d.%d.%d", i%7, i/7%256, i%256)] = true
+		keys[fmt.Sprintf("2001:db8:%x::%x", i%13, i)] = true
+		keys[fmt.Sprintf("172.%d.0.0/16", i%32)] = true
+	}
+	for key := range keys {
+		tree.Insert(key)
+	}
+
+	if nodes := countNodes(tree); nodes >= 2*len(keys) {
+		t.Errorf("Expected fewer than two nodes per ban, got %d nodes for %d bans", nodes, len(keys))
+	}
+
+	for key := range keys {
+		tree.Delete(key)
+	}
+	if tree.root.Load() != nil {
+		t.Errorf("Expected every node to be freed, %d left", countNodes(tree))
+	}
+}
+
+func TestRadixTreeDeleteKeepsCoveredBans(t *testing.T) {
+	tree := NewRadixTree()
+
+	tree.Insert("10.0.0.0/8")
+	tree.Insert("10.1.2.3")
+	tree.Delete("10.0.0.0/8")
+
+	if !tree.Search("10.1.2.3") {
+		t.Error("Expected the narrower ban to survive deleting the prefix")
+	}
+	if tree.Search("10.9.9.9") {
+		t.Error("Expected the deleted prefix to no longer match")
+	}
+	if nodes := countNodes(tree); nodes != 1 {
+		t.Errorf("Expected one node left, got %d", nodes)
+	}
+}
+
+func TestRadixTreeIPv6PrefixDoesNotCoverIPv4(t *testing.T) {
+	tree := NewRadixTree()
+
+	// ::/8 spans the IPv4-mapped range the trie stores IPv4 keys in
+	tree.Insert("::/8")
+	if tree.Search("1.2.3.4") {
+		t.Error("Expected IPv6 prefix to not match IPv4 address")
+	}
+	if !tree.Search("::1") {
+		t.Error("Expected IPv6 prefix to match IPv6 address")
+	}
+
+	tree.Insert("0.0.0.0/0")
+	if !tree.Search("1.2.3.4") || tree.Search("2001:db8::1") {
+		t.Error("Expected the IPv4 default route to cover IPv4 addresses only")
+	}
+}
@@ -0,0 +1,109 @@
+package ipban
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RecidiveReason is the blacklist reason of promoted repeat offenders
+const RecidiveReason = "auto-recidive"
+
+// BlacklistStore persists blacklist entries, such as the ConfigManager
+// writing to the database blacklist table
+type BlacklistStore interface {
+	// AddToBlacklist blacklists the address until expiresAt, or for good
+	// if expiresAt is zero
+	AddToBlacklist(ipAddress, reason, createdBy string, expiresAt time.Time) error
+}
+
+// SetBlacklistStore configures where repeat offenders promoted by the
+// recidive policy are blacklisted. Without a store they are only
+// blacklisted in memory.
+func (m *Manager) SetBlacklistStore(store BlacklistStore) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.blacklistStore = store
+}
+
+// pruneBanTimes drops the ban times before cutoff, reusing the slice
+func pruneBanTimes(banTimes []time.Time, cutoff time.Time) []time.Time {
+	kept := banTimes[:0]
+	for _, bannedAt := range banTimes {
+		if bannedAt.After(cutoff) {
+			kept = append(kept, bannedAt)
+		}
+	}
+	return kept
+}
+
+// recordRecidive records an automatic ban of key and promotes the address
+// to the blacklist once it was banned MaxBans times within the lookback
+// window. Caller must hold the key's shard lock.
+func (m *Manager) recordRecidive(key netip.Prefix, stats *IPStats, now time.Time) {
+	recidive := m.cfg.Recidive
+	if !recidive.Enabled {
+		return
+	}
+
+	stats.RecentBans = append(pruneBanTimes(stats.RecentBans, now.Add(-recidive.LookbackWindow)), now)
+	if len(stats.RecentBans) < recidive.MaxBans {
+		return
+	}
+
+	bans := len(stats.RecentBans)
+	stats.RecentBans = nil
+
+	var expiresAt time.Time
+	if recidive.BlacklistDuration > 0 {
+		expiresAt = now.Add(recidive.BlacklistDuration)
+	}
+
+	// Enforce at once by publishing a new blacklist with the address. It
+	// stays pending, and is merged into the lists of SetAccessListEntries,
+	// until the synchronized blacklist has it; the store makes it outlive
+	// restarts.
+	m.mutex.Lock()
+	lists := m.lists.Load()
+	if lists.blacklist.bannedAt(key, now) {
+		m.mutex.Unlock()
+		return
+	}
+	m.pendingBlacklist[key] = expiresAt
+	blacklist := lists.blacklist.clone()
+	blacklist.insert(key, expiresAt)
+	m.lists.Store(&accessLists{whitelist: lists.whitelist, blacklist: blacklist})
+	store := m.blacklistStore
+	m.mutex.Unlock()
+
+	ip := formatKey(key)
+	reason := fmt.Sprintf("%d bans within %v", bans, recidive.LookbackWindow)
+	m.logger.Warn("Repeat offender blacklisted",
+		zap.String("ip", ip),
+		zap.Int("bans", bans),
+		zap.Duration("lookback_window", recidive.LookbackWindow),
+		zap.Time("expires", expiresAt))
+
+	m.events.Publish(Event{
+		Type:      EventBlacklisted,
+		IP:        ip,
+		Reason:    reason,
+		Duration:  recidive.BlacklistDuration,
+		Expires:   expiresAt,
+		Source:    SourceRecidive,
+		Timestamp: now,
+	})
+
+	if store != nil {
+		// Database writes must not hold up violation ingestion
+		go func() {
+			if err := store.AddToBlacklist(ip, RecidiveReason, "system", expiresAt); err != nil {
+				m.logger.Error("Failed to add repeat offender to the blacklist",
+					zap.String("ip", ip),
+					zap.Error(err))
+			}
+		}()
+	}
+}
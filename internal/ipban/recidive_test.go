@@ -0,0 +1,201 @@
+package ipban
+
+import (
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+)
+
+// blacklistEntry is an entry written to fakeBlacklistStore
+type blacklistEntry struct {
+	ip, reason, createdBy string
+	expiresAt             time.Time
+}
+
+// fakeBlacklistStore forwards blacklist writes to a channel
+type fakeBlacklistStore chan blacklistEntry
+
+func (s fakeBlacklistStore) AddToBlacklist(ipAddress, reason, createdBy string, expiresAt time.Time) error {
+	s <- blacklistEntry{ip: ipAddress, reason: reason, createdBy: createdBy, expiresAt: expiresAt}
+	return nil
+}
+
+func getRecidiveConfig(blacklistDuration time.Duration) *config.Config {
+	cfg := getTestConfig()
+	cfg.Recidive = config.RecidiveConfig{
+		Enabled:           true,
+		MaxBans:           3,
+		LookbackWindow:    7 * 24 * time.Hour,
+		BlacklistDuration: blacklistDuration,
+	}
+	return cfg
+}
+
+func waitForBlacklistEntry(t *testing.T, store fakeBlacklistStore) blacklistEntry {
+	t.Helper()
+	select {
+	case entry := <-store:
+		return entry
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the blacklist store")
+		return blacklistEntry{}
+	}
+}
+
+func TestRecidivePublishesNewBlacklist(t *testing.T) {
+	manager := NewManager(getRecidiveConfig(0), getTestLogger())
+	manager.SetAccessLists(nil, []string{"10.0.0.0/8"})
+	published := manager.lists.Load()
+	ip := "192.168.1.92"
+
+	for i := 0; i < 3; i++ {
+		banAndAge(manager, ip, time.Minute)
+	}
+	if !manager.IsBlacklisted(ip) || !manager.IsBlacklisted("10.1.2.3") {
+		t.Fatal("Expected the repeat offender added to the existing blacklist")
+	}
+	if published.blacklist.bannedAt(testKey(ip), time.Now()) {
+		t.Error("Expected the blacklist readers already hold to be left unchanged")
+	}
+}
+
+func TestRecidivePromotesToBlacklist(t *testing.T) {
+	manager := NewManager(getRecidiveConfig(0), getTestLogger())
+	store := make(fakeBlacklistStore, 1)
+	manager.SetBlacklistStore(store)
+	subscriber, events := collectEvents(64)
+	manager.Subscribe(subscriber, 64)
+	ip := "192.168.1.90"
+
+	banAndAge(manager, ip, time.Minute)
+	banAndAge(manager, ip, time.Minute)
+	if manager.IsBlacklisted(ip) {
+		t.Fatal("Expected IP to not be blacklisted below max_bans")
+	}
+
+	banAndAge(manager, ip, time.Minute)
+	if !manager.IsBlacklisted(ip) || !manager.IsBanned(ip) {
+		t.Fatal("Expected IP to be blacklisted after max_bans bans")
+	}
+
+	entry := waitForBlacklistEntry(t, store)
+	if entry.ip != ip || entry.reason != RecidiveReason || entry.createdBy != "system" || !entry.expiresAt.IsZero() {
+		t.Errorf("Expected a permanent auto-recidive blacklist entry, got %+v", entry)
+	}
+
+	for {
+		event := waitForEvent(t, events)
+		if event.Type == EventBlacklisted {
+			if event.IP != ip || event.Source != SourceRecidive {
+				t.Errorf("Unexpected blacklist event: %+v", event)
+			}
+			break
+		}
+	}
+}
+
+func TestRecidiveBlacklistDuration(t *testing.T) {
+	manager := NewManager(getRecidiveConfig(time.Hour), getTestLogger())
+	store := make(fakeBlacklistStore, 1)
+	manager.SetBlacklistStore(store)
+	ip := "192.168.1.91"
+
+	for i := 0; i < 3; i++ {
+		banAndAge(manager, ip, time.Minute)
+	}
+
+	entry := waitForBlacklistEntry(t, store)
+	if until := time.Until(entry.expiresAt); until <= 0 || until > time.Hour {
+		t.Errorf("Expected the blacklist entry to expire within an hour, got %v", entry.expiresAt)
+	}
+
+	blacklist := manager.lists.Load().blacklist
+	if !blacklist.BannedAt(ip, time.Now()) {
+		t.Error("Expected IP to be blacklisted")
+	}
+	if blacklist.BannedAt(ip, time.Now().Add(2*time.Hour)) {
+		t.Error("Expected the blacklist entry to expire after blacklist_duration")
+	}
+}
+
+func TestRecidiveEntrySurvivesAccessListSync(t *testing.T) {
+	manager := NewManager(getRecidiveConfig(time.Hour), getTestLogger())
+	store := make(fakeBlacklistStore, 1)
+	manager.SetBlacklistStore(store)
+	ip := "192.168.1.95"
+
+	for i := 0; i < 3; i++ {
+		banAndAge(manager, ip, time.Minute)
+	}
+
+	// A synchronization that runs before the store has the entry
+	manager.SetAccessLists(nil, []string{"10.0.0.0/8"})
+	if !manager.IsBlacklisted(ip) {
+		t.Fatal("Expected the repeat offender to stay blacklisted until stored")
+	}
+	if manager.lists.Load().blacklist.BannedAt(ip, time.Now().Add(2*time.Hour)) {
+		t.Error("Expected the pending entry to keep its expiry")
+	}
+
+	entry := waitForBlacklistEntry(t, store)
+	manager.SetAccessListEntries(nil, []config.BlacklistEntry{{Address: entry.ip, ExpiresAt: entry.expiresAt}})
+	if !manager.IsBlacklisted(ip) {
+		t.Fatal("Expected the stored entry to be blacklisted")
+	}
+
+	// Once synchronized, removing the entry from the source lifts it
+	manager.SetAccessLists(nil, nil)
+	if manager.IsBlacklisted(ip) {
+		t.Error("Expected the entry removed from the source to be lifted")
+	}
+}
+
+func TestRecidiveIgnoresBansOutsideLookback(t *testing.T) {
+	manager := NewManager(getRecidiveConfig(0), getTestLogger())
+	ip := "192.168.1.92"
+
+	banAndAge(manager, ip, time.Minute)
+	banAndAge(manager, ip, time.Minute)
+
+	withStats(manager, ip, func(stats *IPStats) {
+		for i := range stats.RecentBans {
+			stats.RecentBans[i] = time.Now().Add(-8 * 24 * time.Hour)
+		}
+	})
+
+	banAndAge(manager, ip, time.Minute)
+	if manager.IsBlacklisted(ip) {
+		t.Error("Expected bans outside the lookback window to not count")
+	}
+}
+
+func TestRecidiveBansOutliveStats(t *testing.T) {
+	manager := NewManager(getRecidiveConfig(0), getTestLogger())
+	ip := "192.168.1.93"
+
+	banAndAge(manager, ip, time.Minute)
+	banAndAge(manager, ip, time.Minute)
+
+	// Forget the address as if it aged past max_memory_ttl
+	withShard(manager, ip, func(*statsShard) {
+		manager.forgetStats(testKey(ip))
+	})
+
+	banAndAge(manager, ip, time.Minute)
+	if !manager.IsBlacklisted(ip) {
+		t.Error("Expected ban times to survive in the ban history")
+	}
+}
+
+func TestRecidiveDisabled(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+	ip := "192.168.1.94"
+
+	for i := 0; i < 10; i++ {
+		banAndAge(manager, ip, time.Minute)
+	}
+	if manager.IsBlacklisted(ip) || len(manager.GetIPStats(ip).RecentBans) != 0 {
+		t.Error("Expected bans to not be tracked with recidive disabled")
+	}
+}
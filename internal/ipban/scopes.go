@@ -0,0 +1,135 @@
+package ipban
+
+import (
+	"maps"
+	"net/netip"
+	"time"
+)
+
+// scopeTrees maps a scope to the trie of bans limited to it
+type scopeTrees map[string]*RadixTree
+
+// banScope returns the scope of a ban from the named jail: the jail itself,
+// or the empty global scope for the global policy, for jails configured as
+// global and for repeat offenders past the jail's global_after ban count
+func (m *Manager) banScope(jail string, banCount int) string {
+	if jail == "" {
+		return ""
+	}
+	jailCfg, ok := m.findJail(jail)
+	if !ok || jailCfg.Global || (jailCfg.GlobalAfter > 0 && banCount >= jailCfg.GlobalAfter) {
+		return ""
+	}
+	return jail
+}
+
+// bannedUntilIn returns the latest ban expiry among the counters whose
+// current ban applies to scope
+func (s *IPStats) bannedUntilIn(scope string) time.Time {
+	var expiry time.Time
+	if s.Scope == scope {
+		expiry = s.BanExpiry
+	}
+	for _, counter := range s.Jails {
+		if counter.Scope == scope && counter.BanExpiry.After(expiry) {
+			expiry = counter.BanExpiry
+		}
+	}
+	return expiry
+}
+
+// scopeTree returns the ban trie of scope, creating it if needed. The empty
+// scope is the global trie. Caller must hold the manager's lock.
+func (m *Manager) scopeTree(scope string) *RadixTree {
+	if scope == "" {
+		return m.tree
+	}
+
+	trees := *m.scoped.Load()
+	if tree, exists := trees[scope]; exists {
+		return tree
+	}
+
+	// Publish a new map so lock-free readers never see it change
+	next := make(scopeTrees, len(trees)+1)
+	maps.Copy(next, trees)
+	next[scope] = NewRadixTree()
+	m.scoped.Store(&next)
+	return next[scope]
+}
+
+// publishBan inserts key into the trie of scope, expiring with the latest
+// ban of that scope, and queues its expiry. Caller must hold the key's
+// shard lock.
+func (m *Manager) publishBan(key netip.Prefix, stats *IPStats, scope string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.scopeTree(scope).insert(key, stats.bannedUntilIn(scope))
+	m.scheduleExpiry(key, stats)
+}
+
+// publishBans inserts every active ban of stats into the trie of its scope.
+// Caller must hold the key's shard lock.
+func (m *Manager) publishBans(key netip.Prefix, stats *IPStats, now time.Time) {
+	if stats.BanExpiry.After(now) {
+		m.publishBan(key, stats, stats.Scope)
+	}
+	for _, counter := range stats.Jails {
+		if counter.BanExpiry.After(now) {
+			m.publishBan(key, stats, counter.Scope)
+		}
+	}
+}
+
+// deleteBans removes key from the global trie, every scope trie and the
+// expiry queue. Caller must hold the key's shard lock.
+func (m *Manager) deleteBans(key netip.Prefix) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expiries.remove(key)
+	m.tree.delete(key)
+	for _, tree := range *m.scoped.Load() {
+		tree.delete(key)
+	}
+}
+
+// checkAccessLists decides key from the whitelist and blacklist. It reports
+// false for decided if neither list covers key.
+func (m *Manager) checkAccessLists(key netip.Prefix, now time.Time) (banned, decided bool) {
+	lists := m.lists.Load()
+	if lists.whitelist.bannedAt(key, now) {
+		return false, true
+	}
+	if lists.blacklist.bannedAt(key, now) {
+		return true, true
+	}
+	return false, false
+}
+
+// IsBannedIn reports whether ip is banned for the given scope: by the
+// access lists or a global ban, or by a ban limited to that scope. An empty
+// scope names no service, so only the access lists and global bans apply;
+// IsBanned matches bans of every scope.
+func (m *Manager) IsBannedIn(ip, scope string) bool {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return false
+	}
+	key, now := addrKey(addr), m.clock.Now()
+
+	if banned, decided := m.checkAccessLists(key, now); decided {
+		return banned
+	}
+	if m.tree.bannedAt(key, now) {
+		return true
+	}
+	if scope == "" {
+		return false
+	}
+	if tree, exists := (*m.scoped.Load())[scope]; exists {
+		return tree.bannedAt(key, now)
+	}
+	return false
+}
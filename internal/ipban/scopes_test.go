@@ -0,0 +1,166 @@
+package ipban
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+)
+
+func getScopeConfig() *config.Config {
+	cfg := getTestConfig()
+	cfg.Jails = []config.JailConfig{
+		{Name: "postfix-sasl", MaxAttempts: 2, GlobalAfter: 2},
+		{Name: "ssh", MaxAttempts: 2, Global: true},
+	}
+	return cfg
+}
+
+func TestJailBanIsScoped(t *testing.T) {
+	manager := NewManager(getScopeConfig(), getTestLogger())
+	ip := "192.168.1.10"
+
+	manager.RecordMatch(ip, Match{Jail: "postfix-sasl", Severity: 1})
+	manager.RecordMatch(ip, Match{Jail: "postfix-sasl", Severity: 1})
+
+	if !manager.IsBannedIn(ip, "postfix-sasl") {
+		t.Error("Expected IP to be banned in its jail's scope")
+	}
+	if manager.IsBannedIn(ip, "sogo") {
+		t.Error("Expected IP to not be banned in another scope")
+	}
+	if manager.IsBannedIn(ip, "") {
+		t.Error("Expected a check without a scope to ignore scoped bans")
+	}
+	if !manager.IsBanned(ip) {
+		t.Error("Expected IsBanned to match bans of every scope")
+	}
+
+	bans := manager.GetActiveBans()
+	if len(bans) != 1 || bans[0].Scope != "postfix-sasl" {
+		t.Errorf("Expected one ban scoped to postfix-sasl, got %+v", bans)
+	}
+}
+
+func TestGlobalBans(t *testing.T) {
+	manager := NewManager(getScopeConfig(), getTestLogger())
+
+	// Bans of the global policy and of global jails block every scope
+	for i := 0; i < 3; i++ {
+		manager.RecordViolation("192.168.1.20", 1, "global")
+	}
+	manager.RecordMatch("192.168.1.21", Match{Jail: "ssh", Severity: 1})
+	manager.RecordMatch("192.168.1.21", Match{Jail: "ssh", Severity: 1})
+
+	for _, ip := range []string{"192.168.1.20", "192.168.1.21"} {
+		if !manager.IsBannedIn(ip, "sogo") {
+			t.Errorf("Expected global ban of %s to apply to every scope", ip)
+		}
+		if !manager.IsBannedIn(ip, "") {
+			t.Errorf("Expected global ban of %s to apply without a scope", ip)
+		}
+	}
+}
+
+func TestRepeatOffenderBanBecomesGlobal(t *testing.T) {
+	manager := NewManager(getScopeConfig(), getTestLogger())
+	ip := "192.168.1.30"
+
+	manager.RecordMatch(ip, Match{Jail: "postfix-sasl", Severity: 1})
+	manager.RecordMatch(ip, Match{Jail: "postfix-sasl", Severity: 1})
+	if manager.IsBannedIn(ip, "sogo") {
+		t.Fatal("Expected first ban to be scoped")
+	}
+
+	// Let the first ban expire, then offend again
+	withStats(manager, ip, func(stats *IPStats) {
+		stats.Jails["postfix-sasl"].BanExpiry = time.Now().Add(-time.Second)
+	})
+	manager.RecordMatch(ip, Match{Jail: "postfix-sasl", Severity: 1})
+	manager.RecordMatch(ip, Match{Jail: "postfix-sasl", Severity: 1})
+
+	if !manager.IsBannedIn(ip, "sogo") {
+		t.Error("Expected ban to become global at global_after")
+	}
+}
+
+func TestScopedManualBan(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	if err := manager.ManualBanWithOptions("10.0.0.0/24", BanOptions{Duration: time.Hour, Scope: "smtp"}); err != nil {
+		t.Fatalf("ManualBanWithOptions failed: %v", err)
+	}
+
+	if !manager.IsBannedIn("10.0.0.5", "smtp") {
+		t.Error("Expected scoped manual ban to apply to its scope")
+	}
+	if manager.IsBannedIn("10.0.0.5", "webmail") {
+		t.Error("Expected scoped manual ban to not apply to other scopes")
+	}
+
+	if err := manager.ManualUnban("10.0.0.0/24"); err != nil {
+		t.Fatalf("ManualUnban failed: %v", err)
+	}
+	if manager.IsBannedIn("10.0.0.5", "smtp") {
+		t.Error("Expected unban to lift scoped ban")
+	}
+}
+
+func TestScopedBanSurvivesRestart(t *testing.T) {
+	cfg := getScopeConfig()
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+
+	manager := NewManager(cfg, getTestLogger())
+	manager.SetStateStore(store)
+	manager.RecordMatch("192.168.1.40", Match{Jail: "postfix-sasl", Severity: 1})
+	manager.RecordMatch("192.168.1.40", Match{Jail: "postfix-sasl", Severity: 1})
+	if err := manager.SaveState(); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	restarted := NewManager(cfg, getTestLogger())
+	restarted.SetStateStore(store)
+	if _, err := restarted.RestoreState(); err != nil {
+		t.Fatalf("Failed to restore state: %v", err)
+	}
+
+	if !restarted.IsBannedIn("192.168.1.40", "postfix-sasl") {
+		t.Error("Expected scoped ban to survive restart")
+	}
+	if restarted.IsBannedIn("192.168.1.40", "sogo") {
+		t.Error("Expected restored ban to keep its scope")
+	}
+}
+
+func TestScopedManualBanSurvivesRestart(t *testing.T) {
+	cfg := getScopeConfig()
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+
+	// webmail is a service scope, not a configured jail
+	manager := NewManager(cfg, getTestLogger())
+	manager.SetStateStore(store)
+	if err := manager.ManualBanWithOptions("192.168.1.41", BanOptions{Duration: time.Hour, Scope: "webmail", Reason: "abuse"}); err != nil {
+		t.Fatalf("Failed to ban: %v", err)
+	}
+	if err := manager.SaveState(); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	restarted := NewManager(cfg, getTestLogger())
+	restarted.SetStateStore(store)
+	if _, err := restarted.RestoreState(); err != nil {
+		t.Fatalf("Failed to restore state: %v", err)
+	}
+
+	if !restarted.IsBannedIn("192.168.1.41", "webmail") {
+		t.Error("Expected manual ban scoped to a service without a jail to survive restart")
+	}
+	if restarted.IsBannedIn("192.168.1.41", "sogo") {
+		t.Error("Expected restored manual ban to keep its scope")
+	}
+	bans := restarted.GetActiveBans()
+	if len(bans) != 1 || bans[0].Provenance == nil || bans[0].Provenance.Reason != "abuse" {
+		t.Errorf("Expected the manual ban and its provenance restored, got %+v", bans)
+	}
+}
@@ -0,0 +1,205 @@
+package ipban
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PolicyDecision summarizes the bans one policy applied, or would have
+// applied, to an address
+type PolicyDecision struct {
+	FirstBan time.Time `json:"first_ban"`
+	LastBan  time.Time `json:"last_ban"`
+	Expires  time.Time `json:"expires"` // Expiry of the last ban
+	Bans     int       `json:"bans"`
+}
+
+// ShadowDiffEntry compares the live and shadow decisions for one address
+type ShadowDiffEntry struct {
+	IP     string          `json:"ip"`
+	Live   *PolicyDecision `json:"live,omitempty"`
+	Shadow *PolicyDecision `json:"shadow,omitempty"`
+}
+
+// ShadowDiff compares the bans of the live policy with those the shadow
+// policy would have applied since Since
+type ShadowDiff struct {
+	Since      time.Time         `json:"since"`
+	Both       []ShadowDiffEntry `json:"both"`
+	LiveOnly   []ShadowDiffEntry `json:"live_only"`
+	ShadowOnly []ShadowDiffEntry `json:"shadow_only"`
+}
+
+// decisionLog records ban decisions by key
+type decisionLog map[netip.Prefix]*PolicyDecision
+
+func (d decisionLog) record(key netip.Prefix, bannedAt, expires time.Time) {
+	decision, exists := d[key]
+	if !exists {
+		decision = &PolicyDecision{FirstBan: bannedAt}
+		d[key] = decision
+	}
+	decision.LastBan = bannedAt
+	decision.Expires = expires
+	decision.Bans++
+}
+
+// shadowState holds the shadow policy's counters and the decisions of both
+// policies. It is guarded by the manager's lock.
+type shadowState struct {
+	since    time.Time
+	counters map[netip.Prefix]*JailStats
+	live     decisionLog
+	shadow   decisionLog
+}
+
+func newShadowState(since time.Time) *shadowState {
+	return &shadowState{
+		since:    since,
+		counters: make(map[netip.Prefix]*JailStats),
+		live:     make(decisionLog),
+		shadow:   make(decisionLog),
+	}
+}
+
+// RecordShadowMatch records a match of one of the shadow policy's own
+// patterns. It only affects the shadow policy and never bans anything.
+func (m *Manager) RecordShadowMatch(ip string, match Match) {
+	if !m.cfg.Shadow.Enabled {
+		return
+	}
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return
+	}
+	key := addrKey(addr)
+	if m.lists.Load().whitelist.bannedAt(key, time.Time{}) {
+		return
+	}
+	key = m.aggregationKey(key)
+
+	// The shadow policy extends the same trust to successful logins
+	var lastSuccess time.Time
+	shard := m.shardFor(key)
+	shard.mutex.RLock()
+	if stats, exists := shard.stats[key]; exists {
+		lastSuccess = stats.LastSuccess
+	}
+	shard.mutex.RUnlock()
+
+	m.evaluateShadow(key, match, lastSuccess, m.clock.Now())
+}
+
+// evaluateShadow counts the match under the shadow policy and records the
+// ban it would have applied. The shadow policy applies one ban
+// configuration to every match, regardless of jails. Like live violations,
+// the match is dated by its log timestamp and tolerated more after a
+// successful login at lastSuccess.
+func (m *Manager) evaluateShadow(key netip.Prefix, match Match, lastSuccess, now time.Time) {
+	loggedAt := match.loggedAt(now)
+	policy := m.withTolerance(m.banPolicy().WithShadow(m.cfg.Shadow.Ban), lastSuccess, loggedAt)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counter, exists := m.shadow.counters[key]
+	if !exists {
+		counter = &JailStats{}
+		m.shadow.counters[key] = counter
+	}
+
+	countViolation(counter, policy, Violation{
+		Timestamp: loggedAt,
+		Severity:  match.Severity,
+		Pattern:   match.Pattern,
+	})
+
+	if !thresholdReached(policy, counter) || !counter.BanExpiry.Before(now) {
+		return
+	}
+
+	counter.BanCount++
+	counter.Score = 0
+	banDuration := banDuration(policy, counter.BanCount)
+	counter.BanExpiry = now.Add(banDuration)
+	m.shadow.shadow.record(key, now, counter.BanExpiry)
+
+	m.logger.Info("Shadow policy would ban IP",
+		zap.String("ip", formatKey(key)),
+		zap.Duration("duration", banDuration),
+		zap.Int("ban_count", counter.BanCount),
+		zap.Int("violations", counter.Violations.Len()),
+		zap.Bool("live_banned", m.isBanned(key, now)))
+}
+
+// pruneShadow forgets shadow counters that hold neither recent violations
+// nor an active ban, and decisions older than the retention period. Caller
+// must hold the lock.
+func (m *Manager) pruneShadow(now time.Time) {
+	policy := m.banPolicy().WithShadow(m.cfg.Shadow.Ban)
+	cutoff := now.Add(-policy.TimeWindow)
+	for key, counter := range m.shadow.counters {
+		last, ok := counter.Violations.Latest()
+		if counter.BanExpiry.Before(now) && (!ok || !last.Timestamp.After(cutoff)) {
+			delete(m.shadow.counters, key)
+		}
+	}
+
+	retention := m.cfg.Shadow.Retention
+	if retention <= 0 {
+		return
+	}
+	decisionCutoff := now.Add(-retention)
+	for _, decisions := range []decisionLog{m.shadow.live, m.shadow.shadow} {
+		for key, decision := range decisions {
+			if decision.LastBan.Before(decisionCutoff) {
+				delete(decisions, key)
+			}
+		}
+	}
+	if m.shadow.since.Before(decisionCutoff) {
+		m.shadow.since = decisionCutoff
+	}
+}
+
+// GetShadowDiff compares the addresses banned by the live policy with
+// those the shadow policy would have banned. Manual and subnet bans are
+// not part of the comparison.
+func (m *Manager) GetShadowDiff() ShadowDiff {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	diff := ShadowDiff{
+		Since:      m.shadow.since,
+		Both:       []ShadowDiffEntry{},
+		LiveOnly:   []ShadowDiffEntry{},
+		ShadowOnly: []ShadowDiffEntry{},
+	}
+
+	for key, live := range m.shadow.live {
+		liveCopy := *live
+		entry := ShadowDiffEntry{IP: formatKey(key), Live: &liveCopy}
+		if shadow, exists := m.shadow.shadow[key]; exists {
+			shadowCopy := *shadow
+			entry.Shadow = &shadowCopy
+			diff.Both = append(diff.Both, entry)
+		} else {
+			diff.LiveOnly = append(diff.LiveOnly, entry)
+		}
+	}
+	for key, shadow := range m.shadow.shadow {
+		if _, exists := m.shadow.live[key]; !exists {
+			shadowCopy := *shadow
+			diff.ShadowOnly = append(diff.ShadowOnly, ShadowDiffEntry{IP: formatKey(key), Shadow: &shadowCopy})
+		}
+	}
+
+	for _, entries := range [][]ShadowDiffEntry{diff.Both, diff.LiveOnly, diff.ShadowOnly} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].IP < entries[j].IP })
+	}
+
+	return diff
+}
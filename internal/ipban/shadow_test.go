@@ -0,0 +1,181 @@
+package ipban
+
+import (
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+)
+
+func getShadowConfig() *config.Config {
+	cfg := getTestConfig()
+	cfg.Shadow = config.ShadowConfig{
+		Enabled:   true,
+		Ban:       config.BanConfig{MaxAttempts: 2},
+		Retention: time.Hour,
+	}
+	return cfg
+}
+
+func TestShadowPolicyDoesNotEnforce(t *testing.T) {
+	cfg := getShadowConfig()
+	manager := NewManager(cfg, getTestLogger())
+
+	ip := "192.168.1.100"
+	for i := 0; i < 2; i++ {
+		manager.RecordViolation(ip, 1, "test violation")
+	}
+
+	if manager.IsBanned(ip) {
+		t.Error("Expected shadow policy to not ban the IP")
+	}
+
+	diff := manager.GetShadowDiff()
+	if len(diff.ShadowOnly) != 1 || diff.ShadowOnly[0].IP != ip {
+		t.Fatalf("Expected %s as shadow-only ban, got %+v", ip, diff)
+	}
+	if decision := diff.ShadowOnly[0].Shadow; decision.Bans != 1 ||
+		decision.Expires.Sub(decision.FirstBan) != cfg.Ban.InitialBanTime*2 {
+		t.Errorf("Expected one shadow ban with the escalated duration, got %+v", decision)
+	}
+	if len(diff.Both) != 0 || len(diff.LiveOnly) != 0 {
+		t.Errorf("Expected no live bans, got %+v", diff)
+	}
+}
+
+func TestShadowDiff(t *testing.T) {
+	cfg := getShadowConfig()
+	cfg.Shadow.Ban.MaxAttempts = 4
+	manager := NewManager(cfg, getTestLogger())
+
+	// Banned by both policies
+	for i := 0; i < 4; i++ {
+		manager.RecordViolation("192.168.1.1", 1, "test violation")
+	}
+	// Banned only by the live policy
+	for i := 0; i < 3; i++ {
+		manager.RecordViolation("192.168.1.2", 1, "test violation")
+	}
+	// Banned by neither
+	manager.RecordViolation("192.168.1.3", 1, "test violation")
+
+	diff := manager.GetShadowDiff()
+	if len(diff.Both) != 1 || diff.Both[0].IP != "192.168.1.1" {
+		t.Errorf("Expected 192.168.1.1 banned by both policies, got %+v", diff.Both)
+	} else if diff.Both[0].Live == nil || diff.Both[0].Shadow == nil {
+		t.Error("Expected both decisions to be reported")
+	}
+	if len(diff.LiveOnly) != 1 || diff.LiveOnly[0].IP != "192.168.1.2" {
+		t.Errorf("Expected 192.168.1.2 banned only by the live policy, got %+v", diff.LiveOnly)
+	}
+	if len(diff.ShadowOnly) != 0 {
+		t.Errorf("Expected no shadow-only bans, got %+v", diff.ShadowOnly)
+	}
+}
+
+func TestShadowPatternsOnlyFeedShadow(t *testing.T) {
+	cfg := getShadowConfig()
+	cfg.Shadow.Patterns = []config.PatternConfig{{Name: "candidate", Regex: "x", IPGroup: 1}}
+	manager := NewManager(cfg, getTestLogger())
+
+	// With its own patterns the shadow policy ignores live matches
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordViolation("192.168.1.1", 1, "test violation")
+	}
+	for i := 0; i < 2; i++ {
+		manager.RecordShadowMatch("192.168.1.2", Match{Pattern: "candidate", Severity: 1})
+	}
+
+	diff := manager.GetShadowDiff()
+	if len(diff.LiveOnly) != 1 || diff.LiveOnly[0].IP != "192.168.1.1" {
+		t.Errorf("Expected live-only ban of 192.168.1.1, got %+v", diff.LiveOnly)
+	}
+	if len(diff.ShadowOnly) != 1 || diff.ShadowOnly[0].IP != "192.168.1.2" {
+		t.Errorf("Expected shadow-only ban of 192.168.1.2, got %+v", diff.ShadowOnly)
+	}
+	if manager.GetIPStats("192.168.1.2") != nil {
+		t.Error("Expected shadow matches to leave live state untouched")
+	}
+}
+
+func TestShadowMatchesDatedByLogTimestamp(t *testing.T) {
+	cfg := getShadowConfig()
+	cfg.Shadow.Patterns = []config.PatternConfig{{Name: "candidate", Regex: "x", IPGroup: 1}}
+	cfg.Ban.Success = config.SuccessConfig{TrustDuration: time.Hour, ToleranceFactor: 2.0}
+	manager, fake := newFakeClockManager(cfg)
+	now := fake.Now()
+
+	// Delivered together, but logged further apart than the time window
+	manager.RecordShadowMatch("192.168.1.2", Match{Severity: 1, Timestamp: now.Add(-30 * time.Minute)})
+	manager.RecordShadowMatch("192.168.1.2", Match{Severity: 1, Timestamp: now})
+
+	// Logged in a burst an hour ago
+	for i := 0; i < 2; i++ {
+		manager.RecordShadowMatch("192.168.1.3", Match{Severity: 1, Timestamp: now.Add(-time.Hour + time.Duration(i)*time.Second)})
+	}
+
+	// Trusted after a successful login, like live violations
+	manager.RecordSuccess("192.168.1.4", Match{Timestamp: now.Add(-time.Minute)})
+	for i := 0; i < 2; i++ {
+		manager.RecordShadowMatch("192.168.1.4", Match{Severity: 1, Timestamp: now})
+	}
+
+	diff := manager.GetShadowDiff()
+	if len(diff.ShadowOnly) != 1 || diff.ShadowOnly[0].IP != "192.168.1.3" {
+		t.Errorf("Expected only the burst to be banned by the shadow policy, got %+v", diff.ShadowOnly)
+	}
+}
+
+func TestShadowDisabled(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	for i := 0; i < 3; i++ {
+		manager.RecordViolation("192.168.1.1", 1, "test violation")
+	}
+	manager.RecordShadowMatch("192.168.1.2", Match{Severity: 1})
+
+	diff := manager.GetShadowDiff()
+	if len(diff.Both)+len(diff.LiveOnly)+len(diff.ShadowOnly) != 0 {
+		t.Errorf("Expected no decisions while shadow mode is disabled, got %+v", diff)
+	}
+}
+
+func TestCleanupPrunesShadowState(t *testing.T) {
+	cfg := getShadowConfig()
+	manager := NewManager(cfg, getTestLogger())
+
+	for i := 0; i < 3; i++ {
+		manager.RecordViolation("192.168.1.1", 1, "test violation")
+	}
+
+	// Age the decisions and shadow counters past retention and expiry
+	past := time.Now().Add(-2 * time.Hour)
+	manager.mutex.Lock()
+	for _, decisions := range []decisionLog{manager.shadow.live, manager.shadow.shadow} {
+		for _, decision := range decisions {
+			decision.LastBan = past
+		}
+	}
+	for _, counter := range manager.shadow.counters {
+		counter.BanExpiry = past
+		violations := counter.Violations.Slice()
+		for i := range violations {
+			violations[i].Timestamp = past
+		}
+		counter.Violations = violationBufferOf(violations)
+	}
+	manager.mutex.Unlock()
+
+	manager.cleanup()
+
+	diff := manager.GetShadowDiff()
+	if len(diff.Both)+len(diff.LiveOnly)+len(diff.ShadowOnly) != 0 {
+		t.Errorf("Expected decisions older than retention to be pruned, got %+v", diff)
+	}
+	if len(manager.shadow.counters) != 0 {
+		t.Errorf("Expected idle shadow counters to be pruned, got %d", len(manager.shadow.counters))
+	}
+	if time.Since(diff.Since) > cfg.Shadow.Retention+time.Minute {
+		t.Errorf("Expected comparison window to start within retention, got %v", diff.Since)
+	}
+}
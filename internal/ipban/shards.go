@@ -0,0 +1,171 @@
+package ipban
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// statsShards is the number of partitions of the per-address state. It is
+// a power of two so a key's shard is picked by masking its hash.
+const statsShards = 64
+
+// statsShard is one hash partition of the per-address state. Each shard
+// has its own lock, so violations from different addresses are recorded in
+// parallel and only contend when they hash to the same shard.
+type statsShard struct {
+	mutex   sync.RWMutex
+	stats   map[netip.Prefix]*IPStats
+	history map[netip.Prefix]*BanHistory // Ban counts of addresses dropped from memory
+}
+
+func newStatsShards(n int) []statsShard {
+	shards := make([]statsShard, n)
+	for i := range shards {
+		shards[i] = statsShard{
+			stats:   make(map[netip.Prefix]*IPStats),
+			history: make(map[netip.Prefix]*BanHistory),
+		}
+	}
+	return shards
+}
+
+// shardFor returns the shard holding the state of key
+func (m *Manager) shardFor(key netip.Prefix) *statsShard {
+	// FNV-1a over the address and prefix length
+	hash := uint64(14695981039346656037)
+	for _, b := range key.Addr().As16() {
+		hash ^= uint64(b)
+		hash *= 1099511628211
+	}
+	hash ^= uint64(key.Bits())
+	hash *= 1099511628211
+	return &m.shards[hash&uint64(len(m.shards)-1)]
+}
+
+// trackStats returns the stats for key, creating them if needed, and marks
+// the key as most recently seen. Caller must hold the key's shard lock and
+// call evictIfFull once it is released.
+func (m *Manager) trackStats(key netip.Prefix, now time.Time) *IPStats {
+	shard := m.shardFor(key)
+	if stats, exists := shard.stats[key]; exists {
+		m.lruMutex.Lock()
+		if stats.lruElement != nil {
+			m.lru.MoveToFront(stats.lruElement)
+		}
+		m.lruMutex.Unlock()
+		return stats
+	}
+
+	stats := newIPStats(now)
+	m.restoreHistory(key, stats)
+	m.lruMutex.Lock()
+	stats.lruElement = m.lru.PushFront(key)
+	m.lruMutex.Unlock()
+	shard.stats[key] = stats
+	m.tracked.Add(1)
+	return stats
+}
+
+// forgetStats removes key from the stats, remembering its ban counts in
+// the history. Caller must hold the key's shard lock.
+func (m *Manager) forgetStats(key netip.Prefix) {
+	shard := m.shardFor(key)
+	if stats, exists := shard.stats[key]; exists {
+		m.rememberHistory(key, stats)
+		m.lruMutex.Lock()
+		if stats.lruElement != nil {
+			m.lru.Remove(stats.lruElement)
+			stats.lruElement = nil
+		}
+		m.lruMutex.Unlock()
+		delete(shard.stats, key)
+		m.tracked.Add(-1)
+	}
+}
+
+// syncLRU takes key out of the LRU list while any of its bans is pending
+// and puts it back at the front once none is, so eviction never has to
+// skip banned entries. Caller must hold the key's shard lock.
+func (m *Manager) syncLRU(key netip.Prefix, stats *IPStats) {
+	banned := !stats.nextBanExpiry().IsZero()
+	m.lruMutex.Lock()
+	defer m.lruMutex.Unlock()
+
+	switch {
+	case banned && stats.lruElement != nil:
+		m.lru.Remove(stats.lruElement)
+		stats.lruElement = nil
+	case !banned && stats.lruElement == nil:
+		stats.lruElement = m.lru.PushFront(key)
+	}
+}
+
+// evictIfFull evicts the least recently seen unbanned entries while more
+// than MaxTrackedIPs are tracked. It never evicts keep, the entry the
+// caller just recorded, so an address is not forgotten on the violation
+// that tracked it. Banned entries are not in the LRU list, so every
+// eviction takes constant time however many of them there are. It takes
+// the locks itself, so callers must not hold any.
+func (m *Manager) evictIfFull(keep netip.Prefix, now time.Time) {
+	limit := int64(m.cfg.Ban.MaxTrackedIPs)
+	if limit <= 0 {
+		return
+	}
+
+	for m.tracked.Load() > limit {
+		m.lruMutex.Lock()
+		back := m.lru.Back()
+		m.lruMutex.Unlock()
+		if back == nil || back.Value.(netip.Prefix) == keep {
+			return
+		}
+		m.evictBack(back, limit)
+	}
+}
+
+// evictBack evicts the entry of the LRU element back, unless it was seen
+// again since it was picked or the limit is no longer exceeded
+func (m *Manager) evictBack(back *list.Element, limit int64) {
+	key := back.Value.(netip.Prefix)
+	shard := m.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	// Only holders of the shard lock move the element, so once it is still
+	// the back it stays the back until the entry is forgotten
+	stats, exists := shard.stats[key]
+	m.lruMutex.Lock()
+	current := exists && stats.lruElement == back && m.lru.Back() == back
+	m.lruMutex.Unlock()
+	if !current || m.tracked.Load() <= limit {
+		return
+	}
+
+	m.forgetStats(key)
+	m.evictedIPs.Add(1)
+	m.logger.Debug("Evicted least recently seen IP record", zap.String("ip", formatKey(key)))
+}
+
+// eachShard calls fn for every shard while holding its lock for writing
+func (m *Manager) eachShard(fn func(shard *statsShard)) {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mutex.Lock()
+		fn(shard)
+		shard.mutex.Unlock()
+	}
+}
+
+// eachShardRead calls fn for every shard while holding its lock for reading
+func (m *Manager) eachShardRead(fn func(shard *statsShard)) {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mutex.RLock()
+		fn(shard)
+		shard.mutex.RUnlock()
+	}
+}
@@ -0,0 +1,278 @@
+package ipban
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// withShard calls fn with the shard holding ip while holding its lock
+func withShard(manager *Manager, ip string, fn func(shard *statsShard)) {
+	shard := manager.shardFor(testKey(ip))
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	fn(shard)
+}
+
+// withStats calls fn with the stats of ip while holding its shard's lock
+func withStats(manager *Manager, ip string, fn func(stats *IPStats)) {
+	withShard(manager, ip, func(shard *statsShard) {
+		fn(shard.stats[testKey(ip)])
+	})
+}
+
+// rememberTestHistory sets the remembered ban counts of ip
+func rememberTestHistory(manager *Manager, ip string, entry *BanHistory) {
+	withShard(manager, ip, func(shard *statsShard) {
+		shard.history[testKey(ip)] = entry
+	})
+}
+
+func TestShardForSpreadsKeys(t *testing.T) {
+	manager := NewManager(getTestConfig(), getTestLogger())
+
+	used := make(map[*statsShard]bool)
+	for i := 0; i < 1000; i++ {
+		shard := manager.shardFor(testKey(fmt.Sprintf("10.0.%d.%d", i/256, i%256)))
+		if shard != manager.shardFor(testKey(fmt.Sprintf("10.0.%d.%d", i/256, i%256))) {
+			t.Fatal("Expected a key to always map to the same shard")
+		}
+		used[shard] = true
+	}
+	if len(used) < statsShards/2 {
+		t.Errorf("Expected addresses to spread across shards, got %d of %d", len(used), statsShards)
+	}
+}
+
+func TestEvictionIsLeastRecentlySeenAcrossShards(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxTrackedIPs = 10
+	manager := NewManager(cfg, getTestLogger())
+
+	for i := 0; i < 20; i++ {
+		manager.RecordViolation(fmt.Sprintf("192.0.2.%d", i), 1, "test violation")
+		if i == 10 {
+			// Seen again, so the oldest address is no longer 192.0.2.0
+			manager.RecordViolation("192.0.2.0", 1, "test violation")
+		}
+	}
+
+	if count := manager.GetStatsCount(); count != 10 {
+		t.Fatalf("Expected 10 tracked IPs, got %d", count)
+	}
+	if manager.GetIPStats("192.0.2.0") == nil {
+		t.Error("Expected the address seen again to survive eviction")
+	}
+	for i := 1; i <= 10; i++ {
+		if manager.GetIPStats(fmt.Sprintf("192.0.2.%d", i)) != nil {
+			t.Errorf("Expected 192.0.2.%d to be evicted", i)
+		}
+	}
+	for i := 11; i < 20; i++ {
+		if manager.GetIPStats(fmt.Sprintf("192.0.2.%d", i)) == nil {
+			t.Errorf("Expected 192.0.2.%d to be kept", i)
+		}
+	}
+}
+
+// lruLen returns the number of entries in the LRU list
+func lruLen(manager *Manager) int {
+	manager.lruMutex.Lock()
+	defer manager.lruMutex.Unlock()
+	return manager.lru.Len()
+}
+
+func TestEvictionSkipsBannedEntries(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxTrackedIPs = 3
+	manager := NewManager(cfg, getTestLogger())
+
+	for i := 1; i <= 3; i++ {
+		manager.ManualBan(fmt.Sprintf("192.0.2.%d", i), time.Hour)
+	}
+	if n := lruLen(manager); n != 0 {
+		t.Fatalf("Expected banned entries to stay out of the LRU list, got %d entries", n)
+	}
+
+	// With only banned entries to evict, the address just seen is kept
+	manager.RecordViolation("198.51.100.1", 1, "test violation")
+	if manager.GetIPStats("198.51.100.1") == nil {
+		t.Fatal("Expected the address just seen not to be evicted")
+	}
+
+	manager.RecordViolation("198.51.100.2", 1, "test violation")
+	if manager.GetIPStats("198.51.100.1") != nil {
+		t.Error("Expected the least recently seen unbanned address to be evicted")
+	}
+	if manager.GetIPStats("198.51.100.2") == nil {
+		t.Error("Expected the address just seen not to be evicted")
+	}
+	for i := 1; i <= 3; i++ {
+		if !manager.IsBanned(fmt.Sprintf("192.0.2.%d", i)) {
+			t.Errorf("Expected 192.0.2.%d to stay banned", i)
+		}
+	}
+	if evicted := manager.GetRadixTreeStats()["evicted_ips"]; evicted != uint64(1) {
+		t.Errorf("Expected 1 evicted IP, got %v", evicted)
+	}
+
+	// Unbanned, an entry is evictable again
+	manager.ManualUnban("192.0.2.1")
+	if n := lruLen(manager); n != 2 {
+		t.Errorf("Expected the unbanned entry back in the LRU list, got %d entries", n)
+	}
+	manager.RecordViolation("198.51.100.3", 1, "test violation")
+	for _, ip := range []string{"198.51.100.2", "192.0.2.1"} {
+		if manager.GetIPStats(ip) != nil {
+			t.Errorf("Expected %s to be evicted", ip)
+		}
+	}
+	if manager.GetIPStats("198.51.100.3") == nil || manager.GetStatsCount() != 3 {
+		t.Errorf("Expected the 2 banned and the most recent address to be kept, got %d", manager.GetStatsCount())
+	}
+}
+
+func TestBanExpiryReturnsEntryToLRU(t *testing.T) {
+	cfg := getTestConfig()
+	manager, fake := newFakeClockManager(cfg)
+
+	ip := "192.0.2.1"
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		manager.RecordViolation(ip, 1, "test violation")
+	}
+	if !manager.IsBanned(ip) || lruLen(manager) != 0 {
+		t.Fatalf("Expected %s banned and out of the LRU list", ip)
+	}
+
+	fake.Set(manager.GetIPStats(ip).BannedUntil().Add(time.Second))
+	manager.cleanup()
+	if manager.IsBanned(ip) || lruLen(manager) != 1 {
+		t.Errorf("Expected %s back in the LRU list once its ban expired", ip)
+	}
+}
+
+func TestConcurrentRecordingAcrossShards(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxAttempts = 5
+	manager := NewManager(cfg, getTestLogger())
+
+	const workers, ipsPerWorker = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < ipsPerWorker; i++ {
+				ip := fmt.Sprintf("10.%d.0.%d", w, i)
+				for n := 0; n < cfg.Ban.MaxAttempts; n++ {
+					manager.RecordViolation(ip, 1, "test violation")
+					manager.IsBanned(ip)
+				}
+			}
+		}(w)
+	}
+
+	// Readers and cleanup run alongside ingestion
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			manager.GetAllBannedIPs()
+			manager.GetRadixTreeStats()
+			manager.cleanup()
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	if count := manager.GetStatsCount(); count != workers*ipsPerWorker {
+		t.Errorf("Expected %d tracked IPs, got %d", workers*ipsPerWorker, count)
+	}
+	if banned := len(manager.GetAllBannedIPs()); banned != workers*ipsPerWorker {
+		t.Errorf("Expected %d banned IPs, got %d", workers*ipsPerWorker, banned)
+	}
+	stats := manager.GetRadixTreeStats()
+	if stats["total_ips_tracked"] != workers*ipsPerWorker || stats["currently_banned"] != workers*ipsPerWorker {
+		t.Errorf("Expected stats to count every address, got %v", stats)
+	}
+}
+
+// BenchmarkRecordViolationParallel measures violation ingestion from many
+// addresses at once, with every violation on a single lock and split
+// across the shards. Run it with -cpu 1,2,4,8 to see throughput scale with
+// cores.
+func BenchmarkRecordViolationParallel(b *testing.B) {
+	for _, shards := range []int{1, statsShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cfg := getTestConfig()
+			cfg.Ban.MaxAttempts = 1 << 30 // Measure tracking, not banning
+			manager := NewManager(cfg, zap.NewNop())
+			manager.shards = newStatsShards(shards)
+
+			var worker sync.Mutex
+			next := 0
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				worker.Lock()
+				w := next
+				next++
+				worker.Unlock()
+
+				// Enough addresses that each sees few violations
+				ips := make([]string, 1<<16)
+				for i := range ips {
+					ips[i] = fmt.Sprintf("10.%d.%d.%d", w%256, i>>8, i&255)
+				}
+				i := 0
+				for pb.Next() {
+					manager.RecordViolation(ips[i%len(ips)], 1, "test violation")
+					i++
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "violations/s")
+		})
+	}
+}
+
+// BenchmarkRecordViolationUnderCleanup measures ingestion while cleanup
+// scans the state in a loop, as during a large attack
+func BenchmarkRecordViolationUnderCleanup(b *testing.B) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxAttempts = 1 << 30
+	manager := NewManager(cfg, zap.NewNop())
+	for i := 0; i < 10000; i++ {
+		manager.RecordViolation(fmt.Sprintf("172.16.%d.%d", i/256, i%256), 1, "test violation")
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				manager.cleanup()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			manager.RecordViolation(fmt.Sprintf("10.0.%d.%d", i>>8&255, i&255), 1, "test violation")
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
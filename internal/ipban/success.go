@@ -0,0 +1,112 @@
+package ipban
+
+import (
+	"fail2ban-haproxy/internal/config"
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RecordSuccess records a successful login from ip. It forgives the most
+// recent violations of the match's jail, or of every jail if the match has
+// no configured jail, and lets the address tolerate more violations for
+// the configured trust duration. Only failed logins to the same account
+// are forgiven, so logging in to one valid account does not wipe the
+// failures against others. Active bans are not lifted. Logins from invalid
+// addresses are ignored.
+func (m *Manager) RecordSuccess(ip string, match Match) {
+	addr, err := parseAddr(ip)
+	if err != nil {
+		return
+	}
+	key := m.aggregationKey(addrKey(addr))
+	successCfg := m.cfg.Ban.Success
+	_, jailKnown := m.jailPolicy(match.Jail)
+
+	shard := m.shardFor(key)
+	shard.mutex.Lock()
+
+	now := m.clock.Now()
+	username := normalizeUsername(match.Username)
+	if _, exists := shard.stats[key]; !exists && !trustEnabled(successCfg) {
+		// Nothing to forgive and nothing to remember
+		shard.mutex.Unlock()
+		return
+	}
+	stats := m.trackStats(key, now)
+	stats.LastSeen = now
+	loggedAt := match.loggedAt(now)
+	if loggedAt.After(stats.LastSuccess) {
+		stats.LastSuccess = loggedAt
+	}
+
+	forgiven := 0
+	if match.Jail != "" && jailKnown {
+		if counter, exists := stats.Jails[match.Jail]; exists {
+			forgiven = forgiveViolations(counter, successCfg.ForgiveViolations, username, loggedAt)
+		}
+	} else {
+		forgiven = forgiveViolations(&stats.JailStats, successCfg.ForgiveViolations, username, loggedAt)
+		for _, counter := range stats.Jails {
+			forgiven += forgiveViolations(counter, successCfg.ForgiveViolations, username, loggedAt)
+		}
+	}
+	shard.mutex.Unlock()
+	m.evictIfFull(key, now)
+
+	m.logger.Debug("Successful login recorded",
+		zap.String("ip", ip),
+		zap.String("pattern", match.Pattern),
+		zap.String("jail", match.Jail),
+		zap.Int("forgiven_violations", forgiven))
+}
+
+// forgiveViolations removes the n most recent violations of the counter
+// for the normalized username and logged at or before the login, or all of
+// them if n is 0, and returns how many were removed. A login without a
+// username forgives only violations without one. Violations logged after
+// the login are not forgiven by it, even if they arrived first. The score
+// is reduced by their severity, which may forgive slightly more than they
+// still weighed after decay.
+func forgiveViolations(counter *JailStats, n int, username string, loggedAt time.Time) int {
+	if counter.Violations.Len() == 0 {
+		return 0
+	}
+
+	severity := counter.Violations.Severity()
+	removed := counter.Violations.DropNewest(n, func(v Violation) bool {
+		return v.Username == username && !v.Timestamp.After(loggedAt)
+	})
+	severity -= counter.Violations.Severity()
+	counter.TotalSeverity -= severity
+	if counter.Violations.Len() == 0 {
+		counter.Score = 0
+	} else {
+		counter.Score = max(0, counter.Score-float64(severity))
+	}
+	return removed
+}
+
+// trustEnabled reports whether successful logins raise the tolerance of
+// the address
+func trustEnabled(successCfg config.SuccessConfig) bool {
+	return successCfg.TrustDuration > 0 && successCfg.ToleranceFactor > 1
+}
+
+// withTolerance raises the policy's ban threshold for a failure logged at
+// loggedAt, if the address had a successful login within the trust
+// duration before it. Both are dated by their log timestamps.
+func (m *Manager) withTolerance(policy config.BanConfig, lastSuccess, loggedAt time.Time) config.BanConfig {
+	successCfg := m.cfg.Ban.Success
+	if !trustEnabled(successCfg) || lastSuccess.IsZero() {
+		return policy
+	}
+	if elapsed := loggedAt.Sub(lastSuccess); elapsed < 0 || elapsed > successCfg.TrustDuration {
+		return policy
+	}
+
+	policy.MaxAttempts = int(math.Ceil(float64(policy.MaxAttempts) * successCfg.ToleranceFactor))
+	policy.ScoreThreshold *= successCfg.ToleranceFactor
+	return policy
+}
@@ -0,0 +1,165 @@
+package ipban
+
+import (
+	"testing"
+	"time"
+
+	"fail2ban-haproxy/internal/config"
+)
+
+func getSuccessConfig(forgive int) *config.Config {
+	cfg := getTestConfig()
+	cfg.Ban.Success = config.SuccessConfig{
+		ForgiveViolations: forgive,
+		TrustDuration:     time.Hour,
+		ToleranceFactor:   2.0,
+	}
+	return cfg
+}
+
+func TestSuccessClearsViolations(t *testing.T) {
+	manager := NewManager(getSuccessConfig(0), getTestLogger())
+	ip := "192.168.1.50"
+
+	manager.RecordViolation(ip, 2, "first")
+	manager.RecordViolation(ip, 1, "second")
+	manager.RecordSuccess(ip, Match{Pattern: "dovecot-login"})
+
+	stats := manager.GetIPStats(ip)
+	if stats == nil || stats.Violations.Len() != 0 || stats.TotalSeverity != 0 {
+		t.Fatalf("Expected successful login to clear all violations, got %+v", stats)
+	}
+	if stats.LastSuccess.IsZero() {
+		t.Error("Expected successful login to be remembered")
+	}
+}
+
+func TestSuccessReducesViolations(t *testing.T) {
+	manager := NewManager(getSuccessConfig(1), getTestLogger())
+	ip := "192.168.1.51"
+
+	manager.RecordViolation(ip, 2, "first")
+	manager.RecordViolation(ip, 1, "second")
+	manager.RecordSuccess(ip, Match{Pattern: "dovecot-login"})
+
+	stats := manager.GetIPStats(ip)
+	if stats.Violations.Len() != 1 || stats.Violations.At(0).Description != "first" || stats.TotalSeverity != 2 {
+		t.Errorf("Expected only the most recent violation to be forgiven, got %+v", stats.Violations)
+	}
+}
+
+func TestSuccessDatedByLogTimestamp(t *testing.T) {
+	manager, fake := newFakeClockManager(getSuccessConfig(0))
+	now := fake.Now()
+	ip := "192.168.1.55"
+
+	// The login is logged between the failures but delivered after both
+	manager.RecordMatch(ip, Match{Severity: 1, Description: "before", Timestamp: now.Add(-10 * time.Minute)})
+	manager.RecordMatch(ip, Match{Severity: 1, Description: "after", Timestamp: now})
+	manager.RecordSuccess(ip, Match{Pattern: "dovecot-login", Timestamp: now.Add(-5 * time.Minute)})
+
+	stats := manager.GetIPStats(ip)
+	if stats.Violations.Len() != 1 || stats.Violations.At(0).Description != "after" {
+		t.Errorf("Expected only the failure logged before the login to be forgiven, got %+v", stats.Violations)
+	}
+	if want := now.Add(-5 * time.Minute); !stats.LastSuccess.Equal(want) {
+		t.Errorf("Expected the login dated %v, got %v", want, stats.LastSuccess)
+	}
+
+	// Trust runs from when the login was logged, not when it arrived
+	other := "192.168.1.56"
+	manager.RecordSuccess(other, Match{Pattern: "dovecot-login", Timestamp: now.Add(-2 * time.Hour)})
+	for i := 0; i < 3; i++ {
+		manager.RecordViolation(other, 1, "failure")
+	}
+	if !manager.IsBanned(other) {
+		t.Error("Expected a login logged before the trust duration to raise no tolerance")
+	}
+}
+
+func TestSuccessRaisesTolerance(t *testing.T) {
+	manager := NewManager(getSuccessConfig(1), getTestLogger())
+	ip := "192.168.1.52"
+
+	manager.RecordSuccess(ip, Match{Pattern: "dovecot-login"})
+	for i := 0; i < 5; i++ {
+		manager.RecordViolation(ip, 1, "failure")
+	}
+	if manager.IsBanned(ip) {
+		t.Fatal("Expected recently successful IP to tolerate twice the attempts")
+	}
+	manager.RecordViolation(ip, 1, "failure")
+	if !manager.IsBanned(ip) {
+		t.Fatal("Expected IP to be banned at the raised threshold")
+	}
+
+	// Trust ends with the trust duration
+	other := "192.168.1.53"
+	manager.RecordSuccess(other, Match{Pattern: "dovecot-login"})
+	withStats(manager, other, func(stats *IPStats) {
+		stats.LastSuccess = time.Now().Add(-2 * time.Hour)
+	})
+	for i := 0; i < 3; i++ {
+		manager.RecordViolation(other, 1, "failure")
+	}
+	if !manager.IsBanned(other) {
+		t.Error("Expected the usual threshold after the trust duration")
+	}
+}
+
+func TestSuccessForgivesOnlyItsJail(t *testing.T) {
+	cfg := getSuccessConfig(0)
+	cfg.Jails = []config.JailConfig{{Name: "dovecot"}, {Name: "postfix"}}
+	manager := NewManager(cfg, getTestLogger())
+	ip := "192.168.1.54"
+
+	manager.RecordMatch(ip, Match{Jail: "dovecot", Severity: 1})
+	manager.RecordMatch(ip, Match{Jail: "postfix", Severity: 1})
+	manager.RecordSuccess(ip, Match{Pattern: "dovecot-login", Jail: "dovecot"})
+
+	stats := manager.GetIPStats(ip)
+	if stats.Jails["dovecot"].Violations.Len() != 0 {
+		t.Error("Expected violations of the login's jail to be forgiven")
+	}
+	if stats.Jails["postfix"].Violations.Len() != 1 {
+		t.Error("Expected violations of other jails to be kept")
+	}
+}
+
+func TestSuccessForgivesOnlyItsAccount(t *testing.T) {
+	manager := NewManager(getSuccessConfig(0), getTestLogger())
+	ip := "192.168.1.56"
+
+	// An attacker owning one valid account logs in to it between attempts
+	// against other accounts
+	manager.RecordMatch(ip, Match{Severity: 1, Username: "alice"})
+	manager.RecordSuccess(ip, Match{Pattern: "dovecot-login", Username: "mallory"})
+	manager.RecordMatch(ip, Match{Severity: 1, Username: "bob"})
+	manager.RecordSuccess(ip, Match{Pattern: "dovecot-login", Username: "mallory"})
+
+	stats := manager.GetIPStats(ip)
+	if stats.Violations.Len() != 2 {
+		t.Fatalf("Expected failures against other accounts to be kept, got %+v", stats.Violations)
+	}
+
+	manager.RecordMatch(ip, Match{Severity: 1, Username: "Mallory"})
+	manager.RecordSuccess(ip, Match{Pattern: "dovecot-login", Username: "mallory"})
+	stats = manager.GetIPStats(ip)
+	if stats.Violations.Len() != 2 || stats.TotalSeverity != 2 {
+		t.Errorf("Expected only the failure against the logged in account to be forgiven, got %+v", stats.Violations)
+	}
+}
+
+func TestSuccessKeepsActiveBan(t *testing.T) {
+	manager := NewManager(getSuccessConfig(0), getTestLogger())
+	ip := "192.168.1.55"
+
+	for i := 0; i < 3; i++ {
+		manager.RecordViolation(ip, 1, "failure")
+	}
+	manager.RecordSuccess(ip, Match{Pattern: "dovecot-login"})
+
+	if !manager.IsBanned(ip) {
+		t.Error("Expected successful login to not lift an active ban")
+	}
+}
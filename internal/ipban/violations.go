@@ -0,0 +1,193 @@
+package ipban
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// ViolationBuffer holds violations in timestamp order in a ring buffer,
+// the oldest at the head. Recording a violation newer than the others and
+// dropping the oldest take constant time; only a violation that arrives
+// late moves the violations logged after it. The zero value is an empty
+// buffer. It marshals to JSON as an array, oldest first.
+type ViolationBuffer struct {
+	ring     []Violation
+	head     int // Index of the oldest violation in ring
+	size     int
+	severity int // Sum of the severities held
+}
+
+// violationBufferOf returns a buffer holding violations, which it takes
+// ownership of
+func violationBufferOf(violations []Violation) ViolationBuffer {
+	slices.SortStableFunc(violations, func(a, b Violation) int {
+		return a.Timestamp.Compare(b.Timestamp)
+	})
+	b := ViolationBuffer{ring: violations, size: len(violations)}
+	for _, v := range violations {
+		b.severity += v.Severity
+	}
+	return b
+}
+
+// Len returns the number of violations held
+func (b *ViolationBuffer) Len() int {
+	return b.size
+}
+
+// At returns the i-th oldest violation, starting from 0
+func (b *ViolationBuffer) At(i int) Violation {
+	return b.ring[b.index(i)]
+}
+
+// Latest returns the most recent violation, or false if there is none
+func (b *ViolationBuffer) Latest() (Violation, bool) {
+	if b.size == 0 {
+		return Violation{}, false
+	}
+	return b.At(b.size - 1), true
+}
+
+// Severity returns the sum of the severities of the violations held
+func (b *ViolationBuffer) Severity() int {
+	return b.severity
+}
+
+// Slice returns a copy of the violations, oldest first
+func (b *ViolationBuffer) Slice() []Violation {
+	violations := make([]Violation, b.size)
+	for i := range violations {
+		violations[i] = b.At(i)
+	}
+	return violations
+}
+
+// Clone returns a copy of the buffer that shares no memory with it
+func (b *ViolationBuffer) Clone() ViolationBuffer {
+	return violationBufferOf(b.Slice())
+}
+
+// Insert adds v in timestamp order, after any violation logged at the same
+// time. A buffer holding capacity violations, 0 meaning no limit, drops its
+// oldest to make room, which is v itself if it is older than all of them.
+// It returns the number of violations dropped.
+func (b *ViolationBuffer) Insert(v Violation, capacity int) int {
+	pos := b.size
+	for pos > 0 && b.At(pos-1).Timestamp.After(v.Timestamp) {
+		pos--
+	}
+
+	dropped := 0
+	if capacity > 0 && b.size >= capacity {
+		if pos == 0 {
+			return 1
+		}
+		b.dropOldest()
+		pos--
+		dropped++
+	}
+	b.grow(capacity)
+
+	// Move the violations logged after v one place towards the tail
+	for i := b.size; i > pos; i-- {
+		b.ring[b.index(i)] = b.ring[b.index(i-1)]
+	}
+	b.ring[b.index(pos)] = v
+	b.size++
+	b.severity += v.Severity
+	return dropped
+}
+
+// DropBefore drops the violations logged at or before cutoff and returns
+// how many it dropped
+func (b *ViolationBuffer) DropBefore(cutoff time.Time) int {
+	dropped := 0
+	for b.size > 0 && !b.At(0).Timestamp.After(cutoff) {
+		b.dropOldest()
+		dropped++
+	}
+	return dropped
+}
+
+// Shrink drops the oldest violations beyond capacity, 0 meaning no limit,
+// and returns how many it dropped
+func (b *ViolationBuffer) Shrink(capacity int) int {
+	dropped := 0
+	for capacity > 0 && b.size > capacity {
+		b.dropOldest()
+		dropped++
+	}
+	return dropped
+}
+
+// DropNewest drops the n most recent violations for which match reports
+// true, or all of them if n is not positive, and returns how many it
+// dropped
+func (b *ViolationBuffer) DropNewest(n int, match func(Violation) bool) int {
+	if b.size == 0 {
+		return 0
+	}
+
+	// Walk from the newest, moving the violations kept over those dropped
+	dropped, kept := 0, b.size
+	for i := b.size - 1; i >= 0; i-- {
+		v := b.At(i)
+		if (n <= 0 || dropped < n) && match(v) {
+			b.severity -= v.Severity
+			dropped++
+			continue
+		}
+		kept--
+		b.ring[b.index(kept)] = v
+	}
+	for i := 0; i < dropped; i++ {
+		b.ring[b.index(i)] = Violation{}
+	}
+	b.head = b.index(dropped)
+	b.size -= dropped
+	return dropped
+}
+
+// dropOldest drops the oldest violation of a non-empty buffer
+func (b *ViolationBuffer) dropOldest() {
+	b.severity -= b.ring[b.head].Severity
+	b.ring[b.head] = Violation{} // Release its strings
+	b.head = (b.head + 1) % len(b.ring)
+	b.size--
+}
+
+// grow makes room for one more violation, doubling the ring up to capacity
+// so addresses seen a few times do not hold a full buffer each
+func (b *ViolationBuffer) grow(capacity int) {
+	if b.size < len(b.ring) {
+		return
+	}
+	length := max(2*len(b.ring), 4)
+	if capacity > 0 {
+		length = min(length, capacity)
+	}
+	ring := make([]Violation, length)
+	for i := 0; i < b.size; i++ {
+		ring[i] = b.At(i)
+	}
+	b.ring, b.head = ring, 0
+}
+
+// index returns the position in ring of the i-th oldest violation
+func (b *ViolationBuffer) index(i int) int {
+	return (b.head + i) % len(b.ring)
+}
+
+func (b ViolationBuffer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.Slice())
+}
+
+func (b *ViolationBuffer) UnmarshalJSON(data []byte) error {
+	var violations []Violation
+	if err := json.Unmarshal(data, &violations); err != nil {
+		return err
+	}
+	*b = violationBufferOf(violations)
+	return nil
+}
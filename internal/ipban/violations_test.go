@@ -0,0 +1,131 @@
+package ipban
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// violationAt returns a violation logged at start plus minutes
+func violationAt(start time.Time, minutes, severity int) Violation {
+	return Violation{
+		Timestamp:   start.Add(time.Duration(minutes) * time.Minute),
+		Severity:    severity,
+		Description: fmt.Sprintf("minute %d", minutes),
+	}
+}
+
+// expectMinutes checks that b holds the violations of the given minutes,
+// oldest first
+func expectMinutes(t *testing.T, b *ViolationBuffer, start time.Time, minutes ...int) {
+	t.Helper()
+	if b.Len() != len(minutes) {
+		t.Fatalf("Expected %d violations, got %d", len(minutes), b.Len())
+	}
+	for i, m := range minutes {
+		if want := start.Add(time.Duration(m) * time.Minute); !b.At(i).Timestamp.Equal(want) {
+			t.Errorf("Expected violation %d at minute %d, got %v", i, m, b.At(i).Timestamp.Sub(start))
+		}
+	}
+}
+
+func TestViolationBufferOverwritesOldest(t *testing.T) {
+	var b ViolationBuffer
+	dropped := 0
+	for m := 0; m < 10; m++ {
+		dropped += b.Insert(violationAt(testStart, m, m), 4)
+	}
+
+	expectMinutes(t, &b, testStart, 6, 7, 8, 9)
+	if dropped != 6 {
+		t.Errorf("Expected 6 dropped violations, got %d", dropped)
+	}
+	if b.Severity() != 6+7+8+9 {
+		t.Errorf("Expected the severity of the buffered violations, got %d", b.Severity())
+	}
+	if last, ok := b.Latest(); !ok || last.Description != "minute 9" {
+		t.Errorf("Expected the latest violation at minute 9, got %+v", last)
+	}
+}
+
+func TestViolationBufferInsertsLateViolationsInOrder(t *testing.T) {
+	var b ViolationBuffer
+	for _, m := range []int{2, 4, 6, 8} {
+		b.Insert(violationAt(testStart, m, 1), 4)
+	}
+
+	// Wrap the ring around before inserting out of order
+	b.Insert(violationAt(testStart, 10, 1), 4)
+	b.Insert(violationAt(testStart, 7, 1), 4)
+	expectMinutes(t, &b, testStart, 6, 7, 8, 10)
+
+	// Older than everything in a full buffer: dropped at once
+	if dropped := b.Insert(violationAt(testStart, 1, 1), 4); dropped != 1 {
+		t.Errorf("Expected the late violation to be dropped, got %d dropped", dropped)
+	}
+	expectMinutes(t, &b, testStart, 6, 7, 8, 10)
+}
+
+func TestViolationBufferDrops(t *testing.T) {
+	var b ViolationBuffer
+	for m := 0; m < 6; m++ {
+		b.Insert(violationAt(testStart, m, 1), 0)
+	}
+
+	if dropped := b.DropBefore(testStart.Add(time.Minute)); dropped != 2 {
+		t.Errorf("Expected 2 violations dropped before the cutoff, got %d", dropped)
+	}
+	if dropped := b.Shrink(3); dropped != 1 {
+		t.Errorf("Expected 1 violation dropped beyond the capacity, got %d", dropped)
+	}
+	expectMinutes(t, &b, testStart, 3, 4, 5)
+
+	if removed := b.DropNewest(2, func(Violation) bool { return true }); removed != 2 {
+		t.Errorf("Expected 2 violations removed, got %d", removed)
+	}
+	expectMinutes(t, &b, testStart, 3)
+	if removed := b.DropNewest(0, func(Violation) bool { return true }); removed != 1 || b.Severity() != 0 {
+		t.Errorf("Expected every violation removed, got %d and severity %d", removed, b.Severity())
+	}
+}
+
+func TestViolationBufferJSON(t *testing.T) {
+	var b ViolationBuffer
+	data, err := json.Marshal(b)
+	if err != nil || string(data) != "[]" {
+		t.Fatalf("Expected an empty buffer to marshal to [], got %s (%v)", data, err)
+	}
+
+	for _, m := range []int{0, 1, 2, 3, 4} {
+		b.Insert(violationAt(testStart, m, 2), 3)
+	}
+	if data, err = json.Marshal(b); err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+
+	var restored ViolationBuffer
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	expectMinutes(t, &restored, testStart, 2, 3, 4)
+	if restored.Severity() != 6 {
+		t.Errorf("Expected severity 6 after unmarshalling, got %d", restored.Severity())
+	}
+}
+
+func TestViolationBufferRecordsWithoutAllocating(t *testing.T) {
+	var b ViolationBuffer
+	for m := 0; m < 100; m++ {
+		b.Insert(violationAt(testStart, m, 1), 100)
+	}
+
+	v := violationAt(testStart, 100, 1)
+	allocs := testing.AllocsPerRun(1000, func() {
+		v.Timestamp = v.Timestamp.Add(time.Minute)
+		b.Insert(v, 100)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected a full buffer to record in place, got %.1f allocations", allocs)
+	}
+}
@@ -76,10 +76,13 @@ func (s *Server) handleAuthRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if IP is banned
-	if s.banManager.IsBanned(clientIP) {
+	// Check if IP is banned, for the service named by the scope parameter
+	// if any
+	scope := r.URL.Query().Get("scope")
+	if s.banManager.IsBannedIn(clientIP, scope) {
 		s.logger.Debug("Blocking banned IP via nginx auth_request",
 			zap.String("ip", clientIP),
+			zap.String("scope", scope),
 			zap.String("method", r.Method),
 			zap.String("uri", r.RequestURI))
 
@@ -224,6 +224,99 @@ func TestHandleAuthRequestBanned(t *testing.T) {
 	}
 }
 
+func TestHandleAuthRequestAggregatedIPv6Ban(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.IPv6AggregationPrefix = 64
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	server := NewServer(cfg, logger, banManager)
+
+	// Each violation comes from a fresh address in the same /64
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		banManager.RecordViolation(fmt.Sprintf("2001:db8:1:2::%x", i+1), 1, "test violation")
+	}
+
+	tests := []struct {
+		remoteAddr   string
+		expectedCode int
+	}{
+		{"[2001:db8:1:2::beef]:54321", http.StatusForbidden},
+		{"[2001:db8:1:3::1]:54321", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/auth", nil)
+		req.RemoteAddr = test.remoteAddr
+
+		recorder := httptest.NewRecorder()
+		server.handleAuthRequest(recorder, req)
+
+		if recorder.Code != test.expectedCode {
+			t.Errorf("Expected status %d for %s, got %d", test.expectedCode, test.remoteAddr, recorder.Code)
+		}
+	}
+}
+
+func TestHandleAuthRequestAccessLists(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.Blacklist = []string{"203.0.113.0/24"}
+	cfg.Ban.Whitelist = []string{"203.0.113.10"}
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	server := NewServer(cfg, logger, banManager)
+
+	tests := []struct {
+		ip           string
+		expectedCode int
+	}{
+		{"203.0.113.77", http.StatusForbidden},
+		{"203.0.113.10", http.StatusOK},
+		{"198.51.100.1", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/auth", nil)
+		req.Header.Set("X-Original-IP", test.ip)
+
+		recorder := httptest.NewRecorder()
+		server.handleAuthRequest(recorder, req)
+
+		if recorder.Code != test.expectedCode {
+			t.Errorf("Expected status %d for %s, got %d", test.expectedCode, test.ip, recorder.Code)
+		}
+	}
+}
+
+func TestHandleAuthRequestScope(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	server := NewServer(cfg, logger, banManager)
+
+	banManager.ManualBanWithOptions("203.0.113.7", ipban.BanOptions{Duration: time.Hour, Scope: "smtp"})
+
+	tests := []struct {
+		target       string
+		expectedCode int
+	}{
+		{"/auth?scope=smtp", http.StatusForbidden},
+		{"/auth?scope=webmail", http.StatusOK},
+		{"/auth", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.target, nil)
+		req.Header.Set("X-Original-IP", "203.0.113.7")
+
+		recorder := httptest.NewRecorder()
+		server.handleAuthRequest(recorder, req)
+
+		if recorder.Code != test.expectedCode {
+			t.Errorf("Expected status %d for %s, got %d", test.expectedCode, test.target, recorder.Code)
+		}
+	}
+}
+
 func TestHandleAuthRequestBannedWithJSON(t *testing.T) {
 	cfg := getTestConfig()
 	cfg.Nginx.ReturnJSON = true
@@ -108,17 +108,27 @@ func (s *Server) processMessage(message string) string {
 	}
 }
 
+// handleHAProxyProcessing checks the src address against the bans. An
+// optional scope argument names the service, so that only global bans and
+// bans of that scope apply; without it only global bans apply.
 func (s *Server) handleHAProxyProcessing(parts []string) string {
+	var ip, scope string
 	for _, part := range parts {
-		if strings.HasPrefix(part, "src=") {
-			ip := strings.TrimPrefix(part, "src=")
-			if s.banManager.IsBanned(ip) {
-				s.logger.Debug("Blocking banned IP", zap.String("ip", ip))
-				return "banned=1"
-			}
-			return "banned=0"
+		switch {
+		case strings.HasPrefix(part, "src="):
+			ip = strings.TrimPrefix(part, "src=")
+		case strings.HasPrefix(part, "scope="):
+			scope = strings.TrimPrefix(part, "scope=")
 		}
 	}
+	if ip == "" {
+		return "banned=0"
+	}
+
+	if s.banManager.IsBannedIn(ip, scope) {
+		s.logger.Debug("Blocking banned IP", zap.String("ip", ip), zap.String("scope", scope))
+		return "banned=1"
+	}
 	return "banned=0"
 }
 
@@ -208,6 +208,53 @@ func TestHandleHAProxyProcessingWithBannedIP(t *testing.T) {
 	}
 }
 
+func TestHandleHAProxyProcessingWithAggregatedIPv6Ban(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.IPv6AggregationPrefix = 64
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	server := NewServer(cfg, logger, banManager)
+
+	// Each violation comes from a fresh address in the same /64
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		banManager.RecordViolation(fmt.Sprintf("2001:db8:1:2::%x", i+1), 1, "test violation")
+	}
+
+	result := server.handleHAProxyProcessing([]string{"src=2001:db8:1:2::beef"})
+	if result != "banned=1" {
+		t.Errorf("Expected banned=1 for address inside banned /64, got '%s'", result)
+	}
+
+	result = server.handleHAProxyProcessing([]string{"src=2001:db8:1:3::1"})
+	if result != "banned=0" {
+		t.Errorf("Expected banned=0 for address outside banned /64, got '%s'", result)
+	}
+}
+
+func TestHandleHAProxyProcessingWithScope(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	server := NewServer(cfg, logger, banManager)
+
+	banManager.ManualBanWithOptions("172.16.0.100", ipban.BanOptions{Duration: time.Hour, Scope: "smtp"})
+
+	tests := []struct {
+		parts    []string
+		expected string
+	}{
+		{[]string{"src=172.16.0.100", "scope=smtp"}, "banned=1"},
+		{[]string{"scope=webmail", "src=172.16.0.100"}, "banned=0"},
+		{[]string{"src=172.16.0.100"}, "banned=0"},
+	}
+
+	for _, test := range tests {
+		if result := server.handleHAProxyProcessing(test.parts); result != test.expected {
+			t.Errorf("Expected %s for %v, got '%s'", test.expected, test.parts, result)
+		}
+	}
+}
+
 func TestHandleNotify(t *testing.T) {
 	cfg := getTestConfig()
 	logger := getTestLogger()
@@ -2,12 +2,14 @@ package syslog
 
 import (
 	"context"
+	"fail2ban-haproxy/internal/clock"
 	"fail2ban-haproxy/internal/config"
 	"fail2ban-haproxy/internal/ipban"
 	"fmt"
 	"net"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -16,8 +18,18 @@ import (
 type Reader struct {
 	cfg        *config.Config
 	logger     *zap.Logger
+	clock      clock.Clock
 	banManager *ipban.Manager
+
+	// patternsMu guards patterns, which SetPatterns replaces
+	patternsMu sync.RWMutex
 	patterns   []*compiledPattern
+
+	// shadowPatterns are the shadow policy's own patterns, if any
+	shadowPatterns []*compiledPattern
+
+	// successPatterns match successful logins
+	successPatterns []*compiledPattern
 }
 
 type compiledPattern struct {
@@ -26,18 +38,72 @@ type compiledPattern struct {
 	ipGroup     int
 	severity    int
 	description string
+	jail        string
+
+	usernameGroup int // 0 if the pattern captures no account name
 }
 
 func NewReader(cfg *config.Config, logger *zap.Logger, banManager *ipban.Manager) *Reader {
 	reader := &Reader{
 		cfg:        cfg,
 		logger:     logger,
+		clock:      clock.Real(),
 		banManager: banManager,
-		patterns:   make([]*compiledPattern, 0, len(cfg.Syslog.Patterns)),
 	}
 
 	// Compile patterns
-	for _, pattern := range cfg.Syslog.Patterns {
+	reader.patterns = compilePatterns(cfg.Syslog.Patterns, logger)
+	if cfg.Shadow.Enabled {
+		reader.shadowPatterns = compilePatterns(cfg.Shadow.Patterns, logger)
+	}
+	reader.successPatterns = compilePatterns(cfg.Syslog.SuccessPatterns, logger)
+
+	return reader
+}
+
+// PatternSource provides the detection patterns, such as the ConfigManager
+// reading them and their ban profiles from the database
+type PatternSource interface {
+	GetPatterns() []config.PatternConfig
+}
+
+// SetPatterns compiles the detection patterns and replaces the current
+// ones. Messages already being matched finish with the previous patterns.
+func (r *Reader) SetPatterns(patterns []config.PatternConfig) {
+	compiled := compilePatterns(patterns, r.logger)
+
+	r.patternsMu.Lock()
+	r.patterns = compiled
+	r.patternsMu.Unlock()
+
+	r.logger.Info("Detection patterns updated", zap.Int("patterns", len(compiled)))
+}
+
+// SyncPatterns loads the detection patterns from source, and again every
+// time updates signals a change, until ctx is cancelled
+func (r *Reader) SyncPatterns(ctx context.Context, source PatternSource, updates <-chan struct{}) {
+	r.SetPatterns(source.GetPatterns())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-updates:
+			r.SetPatterns(source.GetPatterns())
+		}
+	}
+}
+
+// SetClock replaces the clock message timestamps are checked against, the
+// system clock by default. It must be called before the reader is started.
+func (r *Reader) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+// compilePatterns compiles the pattern regexes, skipping invalid ones
+func compilePatterns(patterns []config.PatternConfig, logger *zap.Logger) []*compiledPattern {
+	compiled := make([]*compiledPattern, 0, len(patterns))
+	for _, pattern := range patterns {
 		regex, err := regexp.Compile(pattern.Regex)
 		if err != nil {
 			logger.Error("Failed to compile regex pattern",
@@ -47,16 +113,18 @@ func NewReader(cfg *config.Config, logger *zap.Logger, banManager *ipban.Manager
 			continue
 		}
 
-		reader.patterns = append(reader.patterns, &compiledPattern{
+		compiled = append(compiled, &compiledPattern{
 			name:        pattern.Name,
 			regex:       regex,
 			ipGroup:     pattern.IPGroup,
 			severity:    pattern.Severity,
 			description: pattern.Description,
+			jail:        pattern.Jail,
+
+			usernameGroup: pattern.UsernameGroup,
 		})
 	}
-
-	return reader
+	return compiled
 }
 
 func (r *Reader) Start(ctx context.Context) error {
@@ -81,7 +149,7 @@ func (r *Reader) Start(ctx context.Context) error {
 			return nil
 		default:
 			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
-			n, _, err := conn.ReadFromUDP(buffer)
+			n, remote, err := conn.ReadFromUDP(buffer)
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
@@ -91,29 +159,107 @@ func (r *Reader) Start(ctx context.Context) error {
 			}
 
 			message := string(buffer[:n])
-			r.processMessage(message)
+			r.processMessage(message, remote.IP.String())
 		}
 	}
 }
 
-func (r *Reader) processMessage(message string) {
-	for _, pattern := range r.patterns {
+// processMessage matches message against the patterns and records a
+// violation for every match, or a successful login for every success
+// pattern match. sender is the address the message came from.
+func (r *Reader) processMessage(message, sender string) {
+	timestamp := r.messageTime(message)
+
+	r.patternsMu.RLock()
+	patterns := r.patterns
+	r.patternsMu.RUnlock()
+
+	for _, pattern := range patterns {
 		matches := pattern.regex.FindStringSubmatch(message)
 		if len(matches) > pattern.ipGroup {
-			ip := strings.TrimSpace(matches[pattern.ipGroup])
-			if r.isValidIP(ip) {
+			if ip, ok := r.normalizeIP(matches[pattern.ipGroup]); ok {
 				r.logger.Debug("Suspicious activity detected",
 					zap.String("pattern", pattern.name),
+					zap.String("jail", pattern.jail),
 					zap.String("ip", ip),
 					zap.Int("severity", pattern.severity),
 					zap.String("message", message))
 
-				r.banManager.RecordViolation(ip, pattern.severity, pattern.description)
+				var username string
+				if pattern.usernameGroup > 0 && len(matches) > pattern.usernameGroup {
+					username = strings.TrimSpace(matches[pattern.usernameGroup])
+				}
+
+				r.banManager.RecordMatch(ip, ipban.Match{
+					Pattern:     pattern.name,
+					Jail:        pattern.jail,
+					Severity:    pattern.severity,
+					Description: pattern.description,
+					LogLine:     message,
+					Sender:      sender,
+					Username:    username,
+					Timestamp:   timestamp,
+				})
+			}
+		}
+	}
+
+	for _, pattern := range r.shadowPatterns {
+		matches := pattern.regex.FindStringSubmatch(message)
+		if len(matches) > pattern.ipGroup {
+			if ip, ok := r.normalizeIP(matches[pattern.ipGroup]); ok {
+				r.banManager.RecordShadowMatch(ip, ipban.Match{
+					Pattern:     pattern.name,
+					Severity:    pattern.severity,
+					Description: pattern.description,
+					Timestamp:   timestamp,
+				})
 			}
 		}
 	}
+
+	for _, pattern := range r.successPatterns {
+		matches := pattern.regex.FindStringSubmatch(message)
+		if len(matches) > pattern.ipGroup {
+			if ip, ok := r.normalizeIP(matches[pattern.ipGroup]); ok {
+				var username string
+				if pattern.usernameGroup > 0 && len(matches) > pattern.usernameGroup {
+					username = strings.TrimSpace(matches[pattern.usernameGroup])
+				}
+
+				r.banManager.RecordSuccess(ip, ipban.Match{
+					Pattern:   pattern.name,
+					Jail:      pattern.jail,
+					Username:  username,
+					Timestamp: timestamp,
+				})
+			}
+		}
+	}
+}
+
+// messageTime returns when message says it was logged, or the zero time,
+// meaning on receipt, if it has no timestamp or one further ahead of the
+// clock than the configured skew tolerance
+func (r *Reader) messageTime(message string) time.Time {
+	now := r.clock.Now()
+	timestamp, ok := parseTimestamp(message, now, time.Local)
+	if !ok {
+		return time.Time{}
+	}
+	if timestamp.After(now.Add(r.cfg.Syslog.ClockSkewTolerance)) {
+		r.logger.Debug("Ignoring syslog timestamp ahead of the local clock",
+			zap.Time("timestamp", timestamp),
+			zap.Duration("clock_skew_tolerance", r.cfg.Syslog.ClockSkewTolerance))
+		return time.Time{}
+	}
+	return timestamp
 }
 
-func (r *Reader) isValidIP(ip string) bool {
-	return net.ParseIP(ip) != nil
+// normalizeIP returns the canonical form of a captured address. Log
+// formats write addresses zero-padded, in brackets or with a zone, so they
+// are parsed like the ban manager parses them.
+func (r *Reader) normalizeIP(ip string) (string, bool) {
+	normalized, err := ipban.NormalizeIP(ip)
+	return normalized, err == nil
 }
@@ -2,11 +2,16 @@ package syslog
 
 import (
 	"context"
+	"database/sql"
+	"fail2ban-haproxy/internal/clock"
 	"fail2ban-haproxy/internal/config"
+	"fail2ban-haproxy/internal/database"
 	"fail2ban-haproxy/internal/ipban"
 	"fmt"
 	"net"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -162,7 +167,7 @@ func TestProcessMessage(t *testing.T) {
 			banManager = ipban.NewManager(cfg, logger)
 			reader.banManager = banManager
 
-			reader.processMessage(test.message)
+			reader.processMessage(test.message, "")
 
 			if test.shouldMatch {
 				// Check if violation was recorded
@@ -172,8 +177,8 @@ func TestProcessMessage(t *testing.T) {
 					t.Errorf("Expected IP %s to have stats recorded", test.expectedIP)
 					return
 				}
-				if len(stats.Violations) != 1 {
-					t.Errorf("Expected 1 violation for IP %s, got %d", test.expectedIP, len(stats.Violations))
+				if stats.Violations.Len() != 1 {
+					t.Errorf("Expected 1 violation for IP %s, got %d", test.expectedIP, stats.Violations.Len())
 					return
 				}
 
@@ -188,7 +193,7 @@ func TestProcessMessage(t *testing.T) {
 					}
 				}
 
-				violation := stats.Violations[0]
+				violation := stats.Violations.At(0)
 				if violation.Severity != expectedSeverity {
 					t.Errorf("Expected severity %d, got %d", expectedSeverity, violation.Severity)
 				}
@@ -207,33 +212,245 @@ func TestProcessMessage(t *testing.T) {
 	}
 }
 
-func TestIsValidIP(t *testing.T) {
+func TestProcessMessageJail(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Syslog.Patterns[1].Jail = "postfix-sasl"
+	cfg.Jails = []config.JailConfig{{Name: "postfix-sasl", MaxAttempts: 1}}
+
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	reader := NewReader(cfg, logger, banManager)
+
+	reader.processMessage("Oct 15 10:30:16 mail postfix/smtpd: authentication failed: client=10.0.0.50", "192.0.2.10")
+
+	stats := banManager.GetIPStats("10.0.0.50")
+	if stats == nil {
+		t.Fatal("Expected IP to have stats recorded")
+	}
+	if stats.Violations.Len() != 0 {
+		t.Errorf("Expected no global violations, got %d", stats.Violations.Len())
+	}
+	if counter := stats.Jails["postfix-sasl"]; counter == nil || counter.Violations.Len() != 1 {
+		t.Error("Expected the violation to be counted in the pattern's jail")
+	}
+	if !banManager.IsBanned("10.0.0.50") {
+		t.Error("Expected IP to be banned under the jail's max attempts")
+	}
+}
+
+func TestProcessMessageRecordsProvenance(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Ban.MaxAttempts = 1
+
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	reader := NewReader(cfg, logger, banManager)
+
+	message := "Oct 15 10:30:16 mail postfix/smtpd: authentication failed: client=10.0.0.50"
+	reader.processMessage(message, "192.0.2.10")
+
+	bans := banManager.GetActiveBans()
+	if len(bans) != 1 || bans[0].Provenance == nil {
+		t.Fatalf("Expected one ban with provenance, got %+v", bans)
+	}
+	provenance := bans[0].Provenance
+	if len(provenance.LogLines) != 1 || provenance.LogLines[0] != message {
+		t.Errorf("Expected the syslog message as evidence, got %v", provenance.LogLines)
+	}
+	if len(provenance.Senders) != 1 || provenance.Senders[0] != "192.0.2.10" {
+		t.Errorf("Expected the syslog sender, got %v", provenance.Senders)
+	}
+	if len(provenance.Patterns) != 1 || provenance.Patterns[0] != cfg.Syslog.Patterns[1].Name {
+		t.Errorf("Expected the matching pattern, got %v", provenance.Patterns)
+	}
+}
+
+func TestProcessMessageUsesLogTimestamps(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Syslog.ClockSkewTolerance = time.Minute
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(now)
+
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	banManager.SetClock(fake)
+	reader := NewReader(cfg, logger, banManager)
+	reader.SetClock(fake)
+
+	message := func(at time.Time, ip string) string {
+		return fmt.Sprintf("<34>1 %s mail dovecot - - - auth failed rip=%s", at.Format(time.RFC3339), ip)
+	}
+
+	// A relay delivers an hour of failures at once: they are too far apart
+	// to reach the threshold within the time window
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		reader.processMessage(message(now.Add(time.Duration(i-3)*20*time.Minute), "10.0.0.60"), "192.0.2.10")
+	}
+	if banManager.IsBanned("10.0.0.60") {
+		t.Error("Expected failures spread over an hour not to ban")
+	}
+
+	// Replayed failures from an hour ago that did happen in a burst ban
+	for i := 0; i < cfg.Ban.MaxAttempts; i++ {
+		reader.processMessage(message(now.Add(-time.Hour+time.Duration(i)*time.Second), "10.0.0.61"), "192.0.2.10")
+	}
+	if !banManager.IsBanned("10.0.0.61") {
+		t.Error("Expected a burst of failures to ban whenever it is delivered")
+	}
+	stats := banManager.GetIPStats("10.0.0.61")
+	if want := now.Add(-time.Hour); !stats.Violations.At(0).Timestamp.Equal(want) {
+		t.Errorf("Expected the violation dated %v, got %v", want, stats.Violations.At(0).Timestamp)
+	}
+
+	// Timestamps within the tolerance are kept, later ones are dated on receipt
+	reader.processMessage(message(now.Add(30*time.Second), "10.0.0.62"), "192.0.2.10")
+	reader.processMessage(message(now.Add(time.Hour), "10.0.0.63"), "192.0.2.10")
+	if got := banManager.GetIPStats("10.0.0.62").Violations.At(0).Timestamp; !got.Equal(now.Add(30 * time.Second)) {
+		t.Errorf("Expected a timestamp within the tolerance to be kept, got %v", got)
+	}
+	if got := banManager.GetIPStats("10.0.0.63").Violations.At(0).Timestamp; !got.Equal(now) {
+		t.Errorf("Expected a timestamp beyond the tolerance to be rejected, got %v", got)
+	}
+}
+
+func TestProcessMessageDatesShadowAndSuccessByLog(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Syslog.SuccessPatterns = []config.PatternConfig{{
+		Name:    "dovecot-login",
+		Regex:   `dovecot: imap-login: Login: .*rip=([0-9.]+)`,
+		IPGroup: 1,
+	}}
+	cfg.Ban.Success = config.SuccessConfig{TrustDuration: 2 * time.Hour, ToleranceFactor: 2.0}
+	cfg.Shadow = config.ShadowConfig{
+		Enabled: true,
+		Ban:     config.BanConfig{MaxAttempts: 2},
+		Patterns: []config.PatternConfig{{
+			Name:     "sogo-login-failure",
+			Regex:    `SOGo.*Login failed.*from ([0-9.]+)`,
+			IPGroup:  1,
+			Severity: 1,
+		}},
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(now)
+
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	banManager.SetClock(fake)
+	reader := NewReader(cfg, logger, banManager)
+	reader.SetClock(fake)
+
+	stamp := func(at time.Time) string {
+		return at.Format(time.RFC3339)
+	}
+
+	reader.processMessage("<34>1 "+stamp(now.Add(-time.Hour))+" mail dovecot - - - dovecot: imap-login: Login: user=<alice>, rip=10.0.0.71", "")
+	stats := banManager.GetIPStats("10.0.0.71")
+	if stats == nil || !stats.LastSuccess.Equal(now.Add(-time.Hour)) {
+		t.Errorf("Expected the login dated by its log timestamp, got %+v", stats)
+	}
+
+	// Logged further apart than the time window, so the shadow policy
+	// would not ban either
+	reader.processMessage("<34>1 "+stamp(now.Add(-30*time.Minute))+" mail sogod - - - SOGo Login failed for user bob from 10.0.0.72", "")
+	reader.processMessage("<34>1 "+stamp(now)+" mail sogod - - - SOGo Login failed for user bob from 10.0.0.72", "")
+	if diff := banManager.GetShadowDiff(); len(diff.ShadowOnly) != 0 {
+		t.Errorf("Expected shadow matches dated by their log timestamps, got %+v", diff.ShadowOnly)
+	}
+}
+
+func TestProcessMessageShadowPatterns(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Shadow = config.ShadowConfig{
+		Enabled: true,
+		Ban:     config.BanConfig{MaxAttempts: 1},
+		Patterns: []config.PatternConfig{{
+			Name:     "sogo-login-failure",
+			Regex:    `SOGo.*Login failed.*from ([0-9.]+)`,
+			IPGroup:  1,
+			Severity: 1,
+		}},
+	}
+
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	reader := NewReader(cfg, logger, banManager)
+
+	reader.processMessage("Oct 15 10:30:17 mail sogod: SOGo Login failed for user bob from 10.0.0.60", "")
+
+	if banManager.GetIPStats("10.0.0.60") != nil {
+		t.Error("Expected shadow pattern matches to not be recorded as violations")
+	}
+	diff := banManager.GetShadowDiff()
+	if len(diff.ShadowOnly) != 1 || diff.ShadowOnly[0].IP != "10.0.0.60" {
+		t.Errorf("Expected shadow-only ban of 10.0.0.60, got %+v", diff)
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
 	cfg := getTestConfig()
 	logger := getTestLogger()
 	banManager := ipban.NewManager(cfg, logger)
 	reader := NewReader(cfg, logger, banManager)
 
 	tests := []struct {
-		ip    string
-		valid bool
+		ip       string
+		valid    bool
+		expected string
 	}{
-		{"192.168.1.1", true},
-		{"10.0.0.1", true},
-		{"172.16.0.1", true},
-		{"8.8.8.8", true},
-		{"::1", true},
-		{"2001:db8::1", true},
-		{"invalid.ip", false},
-		{"999.999.999.999", false},
-		{"192.168.1", false},
-		{"", false},
-		{"not.an.ip.address", false},
+		{"192.168.1.1", true, "192.168.1.1"},
+		{"10.0.0.1", true, "10.0.0.1"},
+		{"172.16.0.1", true, "172.16.0.1"},
+		{"8.8.8.8", true, "8.8.8.8"},
+		{"::1", true, "::1"},
+		{"2001:db8::1", true, "2001:db8::1"},
+		{"001.002.003.004", true, "1.2.3.4"},
+		{"[::1]", true, "::1"},
+		{"fe80::1%eth0", true, "fe80::1"},
+		{" ::ffff:10.0.0.1 ", true, "10.0.0.1"},
+		{"invalid.ip", false, ""},
+		{"999.999.999.999", false, ""},
+		{"192.168.1", false, ""},
+		{"", false, ""},
+		{"not.an.ip.address", false, ""},
 	}
 
 	for _, test := range tests {
-		result := reader.isValidIP(test.ip)
-		if result != test.valid {
-			t.Errorf("isValidIP(%s): expected %t, got %t", test.ip, test.valid, result)
+		result, ok := reader.normalizeIP(test.ip)
+		if ok != test.valid || result != test.expected {
+			t.Errorf("normalizeIP(%q): expected %q, %t, got %q, %t", test.ip, test.expected, test.valid, result, ok)
+		}
+	}
+}
+
+func TestProcessMessageNormalizesAddresses(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Syslog.Patterns = []config.PatternConfig{{
+		Name:     "dovecot-auth-failure",
+		Regex:    `auth failed.*rip=([^,\s]+)`,
+		IPGroup:  1,
+		Severity: 1,
+	}}
+
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	reader := NewReader(cfg, logger, banManager)
+
+	tests := []struct {
+		logged string
+		ip     string
+	}{
+		{"010.000.000.001", "10.0.0.1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 3; i++ {
+			reader.processMessage(fmt.Sprintf("dovecot: auth failed, rip=%s, lip=10.0.0.254", test.logged), "")
+		}
+		if !banManager.IsBanned(test.ip) {
+			t.Errorf("Expected failures logged from %s to ban %s", test.logged, test.ip)
 		}
 	}
 }
@@ -355,8 +572,8 @@ func TestIntegrationWithRealSocket(t *testing.T) {
 	if stats == nil {
 		t.Fatal("Expected stats for IP 192.168.1.200")
 	}
-	if len(stats.Violations) != 3 {
-		t.Errorf("Expected 3 violations, got %d", len(stats.Violations))
+	if stats.Violations.Len() != 3 {
+		t.Errorf("Expected 3 violations, got %d", stats.Violations.Len())
 	}
 }
 
@@ -408,3 +625,210 @@ func TestCompiledPatternMatching(t *testing.T) {
 		t.Errorf("Expected IP match '10.0.0.100', got '%s'", matches[1])
 	}
 }
+
+func TestProcessMessageCapturesUsername(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Syslog.Patterns = []config.PatternConfig{{
+		Name:          "dovecot-auth-failure",
+		Regex:         `dovecot: auth failed.*user=<([^>]+)>.*rip=([0-9.]+)`,
+		IPGroup:       2,
+		UsernameGroup: 1,
+		Severity:      1,
+	}}
+	cfg.Accounts = config.AccountConfig{
+		Enabled:      true,
+		MaxAttempts:  3,
+		TimeWindow:   time.Hour,
+		Action:       config.AccountActionMark,
+		MarkDuration: time.Hour,
+	}
+
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	reader := NewReader(cfg, logger, banManager)
+
+	// One failure from each address stays below the per-IP threshold
+	for i := 1; i <= 3; i++ {
+		reader.processMessage(fmt.Sprintf("dovecot: auth failed, user=<Alice@example.com>, rip=10.0.0.%d", i), "192.0.2.10")
+	}
+
+	if !banManager.IsAccountUnderAttack("alice@example.com") {
+		t.Error("Expected failures from different addresses to be counted against the account")
+	}
+}
+
+func TestProcessMessageSuccessPatterns(t *testing.T) {
+	cfg := getTestConfig()
+	cfg.Syslog.Patterns = []config.PatternConfig{{
+		Name:          "dovecot-auth-failure",
+		Regex:         `dovecot: auth failed.*user=<([^>]+)>.*rip=([0-9.]+)`,
+		IPGroup:       2,
+		UsernameGroup: 1,
+		Severity:      3,
+	}}
+	cfg.Syslog.SuccessPatterns = []config.PatternConfig{{
+		Name:          "dovecot-login",
+		Regex:         `dovecot: imap-login: Login: user=<([^>]+)>.*rip=([0-9.]+)`,
+		IPGroup:       2,
+		UsernameGroup: 1,
+	}}
+
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	reader := NewReader(cfg, logger, banManager)
+
+	reader.processMessage("dovecot: auth failed, user=<Alice@example.com>, rip=10.0.0.70", "")
+	reader.processMessage("dovecot: auth failed, user=<Alice@example.com>, rip=10.0.0.70", "")
+	reader.processMessage("dovecot: imap-login: Login: user=<alice@example.com>, method=PLAIN, rip=10.0.0.70, lip=10.0.0.1", "")
+
+	stats := banManager.GetIPStats("10.0.0.70")
+	if stats == nil || stats.Violations.Len() != 0 {
+		t.Errorf("Expected successful login to clear the violations, got %+v", stats)
+	}
+
+	reader.processMessage("dovecot: auth failed, user=<Alice@example.com>, rip=10.0.0.70", "")
+	if banManager.IsBanned("10.0.0.70") {
+		t.Error("Expected cleared violations to not count towards a ban")
+	}
+}
+
+// patternSource is a PatternSource whose patterns tests replace
+type patternSource struct {
+	mu       sync.Mutex
+	patterns []config.PatternConfig
+}
+
+func (s *patternSource) GetPatterns() []config.PatternConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.patterns
+}
+
+func (s *patternSource) set(patterns []config.PatternConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.patterns = patterns
+}
+
+// waitForPattern waits until the reader has compiled the named pattern
+func waitForPattern(t *testing.T, reader *Reader, name string) {
+	t.Helper()
+	for i := 0; ; i++ {
+		reader.patternsMu.RLock()
+		found := len(reader.patterns) > 0 && reader.patterns[0].name == name
+		reader.patternsMu.RUnlock()
+		if found {
+			return
+		}
+		if i == 100 {
+			t.Fatalf("Expected pattern %s to be loaded", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSyncPatternsRecompilesOnUpdate(t *testing.T) {
+	cfg := getTestConfig()
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	reader := NewReader(cfg, logger, banManager)
+
+	source := &patternSource{patterns: []config.PatternConfig{{
+		Name: "first", Regex: `first.*rip=([0-9.]+)`, IPGroup: 1, Severity: 1,
+	}}}
+	updates := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reader.SyncPatterns(ctx, source, updates)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitForPattern(t, reader, "first")
+
+	source.set([]config.PatternConfig{{
+		Name: "second", Regex: `second.*rip=([0-9.]+)`, IPGroup: 1, Severity: 1,
+	}})
+	updates <- struct{}{}
+	waitForPattern(t, reader, "second")
+
+	reader.processMessage("first failure, rip=10.0.0.80", "")
+	reader.processMessage("second failure, rip=10.0.0.81", "")
+	if banManager.GetIPStats("10.0.0.80") != nil {
+		t.Error("Expected the replaced pattern to no longer match")
+	}
+	if banManager.GetIPStats("10.0.0.81") == nil {
+		t.Error("Expected the updated pattern to match")
+	}
+}
+
+func TestDatabasePatternUsesItsBanProfile(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "config.db")
+	db, err := database.NewDB(database.DatabaseConfig{Driver: "sqlite3", DSN: dsn})
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	if err := db.InsertDefaultData(); err != nil {
+		t.Fatalf("Failed to insert default data: %v", err)
+	}
+	db.Close()
+
+	conn, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, statement := range []string{
+		`DELETE FROM patterns`,
+		`INSERT INTO ban_config (name, initial_ban_time_seconds, max_ban_time_seconds, escalation_factor,
+			max_attempts, time_window_seconds, cleanup_interval_seconds, max_memory_ttl_seconds)
+		VALUES ('postfix-sasl', 3600, 86400, 2.0, 1, 600, 60, 259200)`,
+		`INSERT INTO patterns (name, regex, ip_group, severity, description, ban_config_id)
+		VALUES ('postfix-sasl-failure', 'unknown\[([0-9.]+)\]: SASL LOGIN authentication failed', 1, 1, 'SASL failure',
+			(SELECT id FROM ban_config WHERE name = 'postfix-sasl'))`,
+	} {
+		if _, err := conn.Exec(statement); err != nil {
+			t.Fatalf("Failed to run %q: %v", statement, err)
+		}
+	}
+	conn.Close()
+
+	cfg := getTestConfig()
+	cfg.Database = config.DatabaseConfig{Enabled: true, Driver: "sqlite3", DSN: dsn}
+	// Per-address counting as by default, for the configuration to validate
+	cfg.Ban.IPv4AggregationPrefix = 32
+	cfg.Ban.IPv6AggregationPrefix = 128
+	cm, err := config.NewConfigManager(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create config manager: %v", err)
+	}
+	defer cm.Stop()
+
+	// The ban manager learns the profile's jail, the reader its pattern
+	logger := getTestLogger()
+	banManager := ipban.NewManager(cfg, logger)
+	banManager.SetJails(cm.GetJails())
+	reader := NewReader(cfg, logger, banManager)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reader.SyncPatterns(ctx, cm, cm.Subscribe())
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitForPattern(t, reader, "postfix-sasl-failure")
+
+	reader.processMessage("postfix/smtpd[123]: warning: unknown[10.0.0.90]: SASL LOGIN authentication failed", "")
+	if !banManager.IsBannedIn("10.0.0.90", "postfix-sasl") {
+		t.Error("Expected the pattern's ban profile to ban after its single attempt")
+	}
+	if banManager.IsBannedIn("10.0.0.90", "sogo") {
+		t.Error("Expected the ban to be scoped to the pattern's ban profile")
+	}
+}
@@ -0,0 +1,75 @@
+package syslog
+
+import (
+	"strings"
+	"time"
+)
+
+// parseTimestamp returns the time a syslog message was logged, from its
+// RFC 5424 timestamp, an RFC 3339 timestamp in place of the RFC 3164 one
+// (as relays such as rsyslog emit in high precision mode), or its RFC 3164
+// timestamp. RFC 3164 timestamps carry neither year nor zone: they are read
+// in loc, in the year that puts them closest to now. It reports false for
+// messages without a timestamp.
+func parseTimestamp(message string, now time.Time, loc *time.Location) (time.Time, bool) {
+	header, hasPriority := skipPriority(message)
+
+	// RFC 5424: "<PRI>VERSION TIMESTAMP ...", with "-" for no timestamp
+	if version, rest, ok := strings.Cut(header, " "); ok && hasPriority && isDigits(version) {
+		field, _, _ := strings.Cut(rest, " ")
+		timestamp, err := time.Parse(time.RFC3339Nano, field)
+		return timestamp, err == nil
+	}
+
+	if field, _, _ := strings.Cut(header, " "); len(field) > 0 && field[0] >= '0' && field[0] <= '9' {
+		timestamp, err := time.Parse(time.RFC3339Nano, field)
+		return timestamp, err == nil
+	}
+
+	// RFC 3164: "Mmm dd hh:mm:ss", the day padded with a space
+	if len(header) < len(time.Stamp) {
+		return time.Time{}, false
+	}
+	stamp, err := time.ParseInLocation(time.Stamp, header[:len(time.Stamp)], loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	now = now.In(loc)
+	timestamp := time.Date(now.Year(), stamp.Month(), stamp.Day(),
+		stamp.Hour(), stamp.Minute(), stamp.Second(), 0, loc)
+	switch {
+	case timestamp.After(now.AddDate(0, 1, 0)):
+		// Logged in December, received in January
+		timestamp = timestamp.AddDate(-1, 0, 0)
+	case timestamp.Before(now.AddDate(0, -11, 0)):
+		// Logged on New Year's Day by a sender whose clock is ahead
+		timestamp = timestamp.AddDate(1, 0, 0)
+	}
+	return timestamp, true
+}
+
+// skipPriority returns the message without its leading "<PRI>" field and
+// whether it had one
+func skipPriority(message string) (string, bool) {
+	if !strings.HasPrefix(message, "<") {
+		return message, false
+	}
+	end := strings.IndexByte(message, '>')
+	if end < 2 || end > 4 || !isDigits(message[1:end]) {
+		return message, false
+	}
+	return message[end+1:], true
+}
+
+// isDigits reports whether s is a non-empty string of decimal digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
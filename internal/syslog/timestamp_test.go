@@ -0,0 +1,90 @@
+package syslog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		message string
+		want    time.Time
+		ok      bool
+	}{
+		{
+			name:    "RFC 5424",
+			message: "<34>1 2024-03-01T11:58:30.250Z mail dovecot - - - auth failed rip=192.0.2.1",
+			want:    time.Date(2024, 3, 1, 11, 58, 30, 250e6, time.UTC),
+			ok:      true,
+		},
+		{
+			name:    "RFC 5424 with offset",
+			message: "<165>1 2024-03-01T13:58:30+02:00 mail postfix 123 - - authentication failed",
+			want:    time.Date(2024, 3, 1, 11, 58, 30, 0, time.UTC),
+			ok:      true,
+		},
+		{
+			name:    "RFC 5424 without timestamp",
+			message: "<34>1 - mail dovecot - - - auth failed rip=192.0.2.1",
+			ok:      false,
+		},
+		{
+			name:    "RFC 3339 in an RFC 3164 header",
+			message: "<34>2024-03-01T11:58:30.000001Z mail dovecot: auth failed",
+			want:    time.Date(2024, 3, 1, 11, 58, 30, 1000, time.UTC),
+			ok:      true,
+		},
+		{
+			name:    "RFC 3164",
+			message: "<34>Mar  1 11:58:30 mail dovecot: auth failed rip=192.0.2.1",
+			want:    time.Date(2024, 3, 1, 11, 58, 30, 0, time.UTC),
+			ok:      true,
+		},
+		{
+			name:    "RFC 3164 without priority",
+			message: "Feb 29 23:59:59 mail sshd[42]: Failed password from 192.0.2.1",
+			want:    time.Date(2024, 2, 29, 23, 59, 59, 0, time.UTC),
+			ok:      true,
+		},
+		{
+			name:    "RFC 3164 from last year",
+			message: "<34>Dec 31 23:59:59 mail dovecot: auth failed",
+			want:    time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC),
+			ok:      true,
+		},
+		{
+			name:    "no timestamp",
+			message: "auth failed rip=192.0.2.1",
+			ok:      false,
+		},
+		{
+			name:    "invalid RFC 3164 timestamp",
+			message: "<34>Mar 41 11:58:30 mail dovecot: auth failed",
+			ok:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseTimestamp(tt.message, now, time.UTC)
+			if ok != tt.ok {
+				t.Fatalf("Expected ok %v, got %v", tt.ok, ok)
+			}
+			if ok && !got.Equal(tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseTimestampAcrossNewYear(t *testing.T) {
+	// The sender's clock is a little ahead and already in the new year
+	now := time.Date(2023, 12, 31, 23, 59, 50, 0, time.UTC)
+	got, ok := parseTimestamp("<34>Jan  1 00:00:10 mail dovecot: auth failed", now, time.UTC)
+	if want := time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC); !ok || !got.Equal(want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
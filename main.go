@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"fail2ban-haproxy/internal/config"
+	"fail2ban-haproxy/internal/database"
 	"fail2ban-haproxy/internal/envoy"
 	"fail2ban-haproxy/internal/ipban"
 	"fail2ban-haproxy/internal/nginx"
 	"fail2ban-haproxy/internal/spoa"
 	"fail2ban-haproxy/internal/syslog"
+	"fmt"
 	"os"
 	"os/signal"
 	"sync"
@@ -31,6 +33,17 @@ func main() {
 		logger.Fatal("Failed to load configuration", zap.Error(err))
 	}
 
+	// The configuration manager merges the file configuration with the
+	// database, if enabled; the result must be valid to start
+	configManager, err := config.NewConfigManager(cfg)
+	if err != nil {
+		logger.Fatal("Failed to initialize configuration manager", zap.Error(err))
+	}
+	defer configManager.Stop()
+	if err := configManager.ValidateConfiguration(); err != nil {
+		logger.Fatal("Invalid configuration", zap.Error(err))
+	}
+
 	logger.Info("Starting fail2ban-haproxy service")
 
 	// Validate that at least one proxy protocol is enabled
@@ -54,6 +67,19 @@ func main() {
 	// Initialize IP ban manager
 	banManager := ipban.NewManager(cfg, logger)
 
+	// Restore ban state from the last snapshot
+	if cfg.Persistence.Enabled {
+		store, err := newStateStore(cfg)
+		if err != nil {
+			logger.Fatal("Failed to initialize ban state persistence", zap.Error(err))
+		}
+		banManager.SetStateStore(store)
+
+		if _, err := banManager.RestoreState(); err != nil {
+			logger.Error("Failed to restore ban state, starting empty", zap.Error(err))
+		}
+	}
+
 	// Initialize syslog reader
 	syslogReader := syslog.NewReader(cfg, logger, banManager)
 
@@ -131,6 +157,34 @@ func main() {
 		banManager.StartCleanup(ctx)
 	}()
 
+	// Keep the access lists, ban profiles and patterns in sync with the database
+	if cfg.Database.Enabled {
+		// Repeat offenders promoted by the recidive policy go to the database blacklist
+		banManager.SetBlacklistStore(configManager)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			banManager.SyncAccessLists(ctx, configManager, configManager.UpdateChan())
+		}()
+
+		patternUpdates := configManager.Subscribe()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			syslogReader.SyncPatterns(ctx, configManager, patternUpdates)
+		}()
+	}
+
+	// Start ban state persistence routine
+	if cfg.Persistence.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			banManager.StartPersistence(ctx, cfg.Persistence.Interval)
+		}()
+	}
+
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -153,3 +207,29 @@ func main() {
 		logger.Warn("Timeout waiting for services to stop")
 	}
 }
+
+// newStateStore creates the ban state store selected by the persistence backend
+func newStateStore(cfg *config.Config) (ipban.StateStore, error) {
+	switch cfg.Persistence.Backend {
+	case "file":
+		return ipban.NewFileStateStore(cfg.Persistence.Path), nil
+	case "database":
+		if !cfg.Database.Enabled {
+			return nil, fmt.Errorf("database persistence backend requires database.enabled")
+		}
+		db, err := database.NewDB(database.DatabaseConfig{
+			Enabled:         cfg.Database.Enabled,
+			Driver:          cfg.Database.Driver,
+			DSN:             cfg.Database.DSN,
+			RefreshInterval: cfg.Database.RefreshInterval,
+			MaxRetries:      cfg.Database.MaxRetries,
+			RetryDelay:      cfg.Database.RetryDelay,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ipban.NewDatabaseStateStore(db), nil
+	default:
+		return nil, fmt.Errorf("unknown persistence backend: %s", cfg.Persistence.Backend)
+	}
+}